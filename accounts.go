@@ -0,0 +1,57 @@
+package kmm
+
+import (
+	"strings"
+
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	_ rita.Evolver = &AccountList{}
+)
+
+// AccountBalance is an account and its current balance.
+type AccountBalance struct {
+	Account string
+	Balance decimal.Decimal
+}
+
+// AccountList lists the accounts having events, in the order they were first
+// seen, with their current balances. It is evolved over the events of all
+// accounts.
+type AccountList struct {
+	Accounts []*AccountBalance
+
+	index map[string]*AccountBalance
+}
+
+// NewAccountList returns an empty list, so no accounts is an empty list
+// rather than null once encoded.
+func NewAccountList() *AccountList {
+	return &AccountList{
+		Accounts: []*AccountBalance{},
+	}
+}
+
+func (l *AccountList) Evolve(event *rita.Event) error {
+	account := event.Subject[strings.LastIndexByte(event.Subject, '.')+1:]
+
+	b, ok := l.index[account]
+	if !ok {
+		if l.index == nil {
+			l.index = make(map[string]*AccountBalance)
+		}
+		b = &AccountBalance{Account: account}
+		l.index[account] = b
+		l.Accounts = append(l.Accounts, b)
+	}
+
+	funds := CurrentFunds{Amount: b.Balance}
+	if err := funds.Evolve(event); err != nil {
+		return err
+	}
+	b.Balance = funds.Amount
+
+	return nil
+}
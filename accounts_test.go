@@ -0,0 +1,31 @@
+package kmm
+
+import (
+	"testing"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestAccountList(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	l := NewAccountList()
+	is.Equal(len(l.Accounts), 0)
+
+	events := []*rita.Event{
+		{Subject: "kmm.events.accounts.bob", Data: &AccountOpened{Owner: "Bob"}},
+		{Subject: "kmm.events.accounts.alice", Data: &FundsDeposited{Amount: d("10")}},
+		{Subject: "kmm.events.accounts.bob", Data: &FundsDeposited{Amount: d("5")}},
+		{Subject: "kmm.events.accounts.alice", Data: &FundsWithdrawn{Amount: d("2.5")}},
+	}
+	for _, e := range events {
+		is.NoErr(l.Evolve(e))
+	}
+
+	is.Equal(len(l.Accounts), 2)
+	is.Equal(l.Accounts[0].Account, "bob")
+	is.True(l.Accounts[0].Balance.Equal(d("5")))
+	is.Equal(l.Accounts[1].Account, "alice")
+	is.True(l.Accounts[1].Balance.Equal(d("7.5")))
+}
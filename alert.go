@@ -0,0 +1,107 @@
+package kmm
+
+import (
+	"errors"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrInvalidAlertThreshold = errors.New("kmm: alert low balance must not be negative and budget percent must be between 0 and 100")
+)
+
+// Kinds of alerts.
+const (
+	AlertLowBalance            = "low-balance"
+	AlertBudgetNearlyExhausted = "budget-nearly-exhausted"
+)
+
+// SetAlertThreshold sets the thresholds withdrawals alert at: the balance
+// dropping below the low balance, or the funds withdrawn within the budget
+// period reaching the percent of the max amount. A zero threshold disables
+// the alert.
+type SetAlertThreshold struct {
+	LowBalance    decimal.Decimal
+	BudgetPercent int
+}
+
+func (c *SetAlertThreshold) Validate() error {
+	if c.LowBalance.IsNegative() || c.BudgetPercent < 0 || c.BudgetPercent > 100 {
+		return ErrInvalidAlertThreshold
+	}
+	return checkDecimalPlaces(c.LowBalance)
+}
+
+type AlertThresholdSet struct {
+	LowBalance    decimal.Decimal
+	BudgetPercent int
+	Time          time.Time
+}
+
+// Alert is raised by a withdrawal which crosses a threshold of the account.
+type Alert struct {
+	Kind string
+	// Balance is the balance after the withdrawal.
+	Balance    decimal.Decimal
+	LowBalance decimal.Decimal
+	// Budget is the state of the budget after the withdrawal, only set for
+	// budget alerts.
+	Budget        *BudgetState
+	BudgetPercent int
+	Time          time.Time
+}
+
+// EvolveAlerts evolves the account with the event and returns the alerts
+// raised if it is a withdrawal. An alert is raised once per crossing of the
+// threshold, not by later withdrawals until the balance is back at or above
+// the low balance, or the next budget period.
+func EvolveAlerts(a *Account, event *rita.Event) ([]*Alert, error) {
+	w, ok := event.Data.(*FundsWithdrawn)
+	if !ok || isForeign(w.Currency) {
+		return nil, a.Evolve(event)
+	}
+
+	balance := a.CurrentFunds
+	budget := NewBudgetState(a, w.Time)
+
+	if err := a.Evolve(event); err != nil {
+		return nil, err
+	}
+
+	var alerts []*Alert
+
+	if low := a.AlertLowBalance; low.IsPositive() && !balance.LessThan(low) && a.CurrentFunds.LessThan(low) {
+		alerts = append(alerts, &Alert{
+			Kind:       AlertLowBalance,
+			Balance:    a.CurrentFunds,
+			LowBalance: low,
+			Time:       w.Time,
+		})
+	}
+
+	if pct := a.AlertBudgetPercent; pct > 0 {
+		after := NewBudgetState(a, w.Time)
+		if !budgetReached(budget, pct) && budgetReached(after, pct) {
+			alerts = append(alerts, &Alert{
+				Kind:          AlertBudgetNearlyExhausted,
+				Balance:       a.CurrentFunds,
+				Budget:        after,
+				BudgetPercent: pct,
+				Time:          w.Time,
+			})
+		}
+	}
+
+	return alerts, nil
+}
+
+// budgetReached returns true if the funds withdrawn within the period are at
+// least the percent of the max amount.
+func budgetReached(s *BudgetState, pct int) bool {
+	if !s.MaxWithdrawAmount.IsPositive() {
+		return false
+	}
+	return s.FundsWithdrawn.Mul(decimal.NewFromInt(100)).GreaterThanOrEqual(s.MaxWithdrawAmount.Mul(decimal.NewFromInt(int64(pct))))
+}
@@ -0,0 +1,72 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestAlerts(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	is.Err((&SetAlertThreshold{LowBalance: d("-1")}).Validate(), ErrInvalidAlertThreshold)
+	is.Err((&SetAlertThreshold{BudgetPercent: 101}).Validate(), ErrInvalidAlertThreshold)
+
+	clock := testutil.NewClock(time.Minute)
+	a := &Account{clock: clock}
+
+	decide := func(cmd any) {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		is.NoErr(err)
+		for _, e := range events {
+			is.NoErr(a.Evolve(e))
+		}
+	}
+
+	decide(&DepositFunds{Amount: d("20")})
+	decide(&SetBudget{MaxAmount: d("10"), Period: Weekly})
+	decide(&SetAlertThreshold{LowBalance: d("8"), BudgetPercent: 90})
+	is.True(a.AlertLowBalance.Equal(d("8")))
+	is.Equal(a.AlertBudgetPercent, 90)
+
+	withdraw := func(amount string, tm time.Time) []string {
+		alerts, err := EvolveAlerts(a, &rita.Event{
+			Data: &FundsWithdrawn{Amount: d(amount), Time: tm},
+		})
+		is.NoErr(err)
+		var kinds []string
+		for _, a := range alerts {
+			kinds = append(kinds, a.Kind)
+		}
+		return kinds
+	}
+
+	now := clock.Now()
+	is.Equal(withdraw("5", now), []string(nil))
+	is.Equal(withdraw("4", now), []string{AlertBudgetNearlyExhausted})
+
+	// Not again within the period.
+	is.Equal(withdraw("1", now), []string(nil))
+
+	// Below the low balance once.
+	is.Equal(len(withdraw("3", now)), 1)
+	is.True(a.CurrentFunds.Equal(d("7")))
+	is.Equal(withdraw("1", now), []string(nil))
+
+	// Again after the balance is back above the low balance.
+	is.NoErr(a.Evolve(&rita.Event{Data: &FundsDeposited{Amount: d("10"), Time: now}}))
+	is.Equal(withdraw("9", now), []string{AlertLowBalance})
+
+	// Again in the next period. The first withdrawal of a period is
+	// decided as changing it.
+	next := a.NextPeriodStartTime.Add(time.Hour)
+	is.NoErr(a.Evolve(&rita.Event{Data: &FundsDeposited{Amount: d("20"), Time: next}}))
+	alerts, err := EvolveAlerts(a, &rita.Event{Data: &FundsWithdrawn{Amount: d("9"), Time: next, PeriodChanged: true}})
+	is.NoErr(err)
+	is.Equal(len(alerts), 1)
+	is.Equal(alerts[0].Kind, AlertBudgetNearlyExhausted)
+	is.True(alerts[0].Budget.FundsWithdrawn.Equal(d("9")))
+	is.Equal(alerts[0].BudgetPercent, 90)
+}
@@ -0,0 +1,100 @@
+package kmm
+
+import (
+	"errors"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrNoAllowance = errors.New("kmm: no allowance set")
+)
+
+// MaxAllowanceDeposits is the max number of missed allowances deposited at
+// once, e.g. after the server was down for a while.
+const MaxAllowanceDeposits = 100
+
+// AllowanceDescription is the description of allowance deposits.
+const AllowanceDescription = "allowance"
+
+// SetAllowance sets an allowance deposited at the start of each period,
+// beginning with the next period.
+type SetAllowance struct {
+	Amount decimal.Decimal
+	Period Period
+}
+
+func (c *SetAllowance) Validate() error {
+	if c.Amount.LessThanOrEqual(decimal.Zero) {
+		return ErrNonZeroAmount
+	}
+	if err := checkDecimalPlaces(c.Amount); err != nil {
+		return err
+	}
+	return c.Period.Validate()
+}
+
+type AllowanceSet struct {
+	Amount          decimal.Decimal
+	Period          Period
+	NextDepositTime time.Time
+	Time            time.Time
+}
+
+type RemoveAllowance struct{}
+
+type AllowanceRemoved struct {
+	Time time.Time
+}
+
+// DepositAllowance deposits the allowance for each period which has begun
+// since the last allowance deposit. It is expected to be sent periodically,
+// e.g. by a ticker, and results in no events if no allowance is due.
+type DepositAllowance struct{}
+
+func (a *Account) decideDepositAllowance() ([]*rita.Event, error) {
+	if a.AllowancePeriod == "" {
+		return nil, ErrNoAllowance
+	}
+
+	now := a.clock.Now()
+
+	var events []*rita.Event
+	t := a.NextAllowanceTime
+	for !now.Before(t) && len(events) < MaxAllowanceDeposits {
+		events = append(events, &rita.Event{
+			Data: &FundsDeposited{
+				Amount:        a.AllowanceAmount,
+				Description:   AllowanceDescription,
+				AllowanceTime: t,
+				Time:          now,
+			},
+		})
+		_, t = periodWindow(t, a.AllowancePeriod)
+	}
+
+	return events, nil
+}
+
+func (a *Account) evolveAllowance(event *rita.Event) {
+	switch e := event.Data.(type) {
+	case *AllowanceSet:
+		a.AllowanceAmount = e.Amount
+		a.AllowancePeriod = e.Period
+		a.NextAllowanceTime = e.NextDepositTime
+
+	case *AllowanceRemoved:
+		a.AllowanceAmount = decimal.Zero
+		a.AllowancePeriod = ""
+		a.NextAllowanceTime = time.Time{}
+
+	case *FundsDeposited:
+		// The next deposit is recomputed from the last one, so missed
+		// allowances are deposited after a restart.
+		if a.AllowancePeriod != "" {
+			_, a.NextAllowanceTime = periodWindow(e.AllowanceTime, a.AllowancePeriod)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+	"github.com/shopspring/decimal"
+)
+
+func TestAllowance(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	five := decimal.NewFromInt(5)
+
+	clock := testutil.NewClock(time.Second)
+	a := Account{clock: clock}
+
+	var history []*rita.Event
+
+	decide := func(cmd any) ([]*rita.Event, error) {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			is.NoErr(a.Evolve(e))
+		}
+		history = append(history, events...)
+		return events, err
+	}
+
+	_, err := decide(&DepositAllowance{})
+	is.Err(err, ErrNoAllowance)
+
+	is.Err((&SetAllowance{Amount: five, Period: "fortnightly"}).Validate(), ErrInvalidPeriod)
+	is.Err((&SetAllowance{Amount: d("5.001"), Period: Weekly}).Validate(), ErrTooManyDecimalPlaces)
+
+	// Deposits are limited, but allowances are not counted.
+	_, err = decide(&SetDepositLimit{MaxDeposits: 1, Period: Weekly})
+	is.NoErr(err)
+
+	// The first allowance is deposited at the start of the next week.
+	_, err = decide(&SetAllowance{Amount: five, Period: Weekly})
+	is.NoErr(err)
+	is.True(a.NextAllowanceTime.Equal(time.Date(2019, 9, 23, 0, 0, 0, 0, time.UTC)))
+
+	events, err := decide(&DepositAllowance{})
+	is.NoErr(err)
+	is.Equal(len(events), 0)
+
+	clock.Add(3 * 24 * time.Hour)
+	events, err = decide(&DepositAllowance{})
+	is.NoErr(err)
+	is.Equal(len(events), 1)
+	is.True(a.CurrentFunds.Equal(five))
+
+	events, err = decide(&DepositAllowance{})
+	is.NoErr(err)
+	is.Equal(len(events), 0)
+
+	_, err = decide(&DepositFunds{Amount: five})
+	is.NoErr(err)
+
+	// Missed allowances are deposited at once.
+	clock.Add(14 * 24 * time.Hour)
+	events, err = decide(&DepositAllowance{})
+	is.NoErr(err)
+	is.Equal(len(events), 2)
+	is.True(a.CurrentFunds.Equal(decimal.NewFromInt(20)))
+	is.True(a.NextAllowanceTime.Equal(time.Date(2019, 10, 14, 0, 0, 0, 0, time.UTC)))
+
+	// The next deposit is recomputed from the events, e.g. after a restart.
+	b := Account{clock: clock}
+	for _, e := range history {
+		is.NoErr(b.Evolve(e))
+	}
+	is.True(b.NextAllowanceTime.Equal(a.NextAllowanceTime))
+
+	_, err = decide(&RemoveAllowance{})
+	is.NoErr(err)
+	_, err = decide(&DepositAllowance{})
+	is.Err(err, ErrNoAllowance)
+	_, err = decide(&RemoveAllowance{})
+	is.Err(err, ErrNoAllowance)
+}
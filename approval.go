@@ -0,0 +1,206 @@
+package kmm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrApprovalRequired          = errors.New("kmm: withdrawal above the approval threshold must be requested")
+	ErrInvalidApprovalThreshold  = errors.New("kmm: approval threshold must not be negative")
+	ErrRequestIDRequired         = errors.New("kmm: request id is required")
+	ErrWithdrawalRequestExists   = errors.New("kmm: withdrawal request already exists")
+	ErrWithdrawalRequestNotFound = errors.New("kmm: withdrawal request not found")
+)
+
+// SetApprovalThreshold requires withdrawals of more than the amount to be
+// requested and approved. A zero amount removes the requirement.
+type SetApprovalThreshold struct {
+	Amount decimal.Decimal
+}
+
+func (c *SetApprovalThreshold) Validate() error {
+	if c.Amount.IsNegative() {
+		return ErrInvalidApprovalThreshold
+	}
+	return nil
+}
+
+type ApprovalThresholdSet struct {
+	Amount decimal.Decimal
+	Time   time.Time
+}
+
+// RequestWithdrawal requests a withdrawal which is pending until it is
+// approved or denied. The ID is chosen by the requester.
+type RequestWithdrawal struct {
+	ID          string
+	Amount      decimal.Decimal
+	Description string
+	Category    string
+}
+
+func (c *RequestWithdrawal) Validate() error {
+	if strings.TrimSpace(c.ID) == "" {
+		return ErrRequestIDRequired
+	}
+	if c.Amount.LessThanOrEqual(decimal.Zero) {
+		return ErrNonZeroAmount
+	}
+	return checkDecimalPlaces(c.Amount)
+}
+
+type WithdrawalRequested struct {
+	ID          string
+	Amount      decimal.Decimal
+	Description string
+	Category    string
+	Time        time.Time
+}
+
+// ApproveWithdrawal approves a pending request. The withdrawal is decided as
+// of the approval, so it is rejected if it is no longer allowed, e.g. the
+// funds are insufficient, and the request remains pending.
+type ApproveWithdrawal struct {
+	ID string
+}
+
+func (c *ApproveWithdrawal) Validate() error {
+	if strings.TrimSpace(c.ID) == "" {
+		return ErrRequestIDRequired
+	}
+	return nil
+}
+
+// WithdrawalApproved is followed by the events of the withdrawal.
+type WithdrawalApproved struct {
+	ID   string
+	Time time.Time
+}
+
+// DenyWithdrawal denies a pending request.
+type DenyWithdrawal struct {
+	ID string
+}
+
+func (c *DenyWithdrawal) Validate() error {
+	if strings.TrimSpace(c.ID) == "" {
+		return ErrRequestIDRequired
+	}
+	return nil
+}
+
+type WithdrawalDenied struct {
+	ID   string
+	Time time.Time
+}
+
+// WithdrawalRequest is a pending withdrawal request.
+type WithdrawalRequest struct {
+	Amount      decimal.Decimal
+	Description string
+	Category    string
+	Time        time.Time
+}
+
+// requiresApproval returns true if a withdrawal of the amount must be
+// requested.
+func (a *Account) requiresApproval(amount decimal.Decimal) bool {
+	return a.ApprovalThreshold.IsPositive() && amount.GreaterThan(a.ApprovalThreshold)
+}
+
+func (a *Account) decideRequestWithdrawal(c *RequestWithdrawal) ([]*rita.Event, error) {
+	if a.Frozen {
+		return nil, ErrAccountFrozen
+	}
+	if _, ok := a.PendingWithdrawals[c.ID]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrWithdrawalRequestExists, c.ID)
+	}
+	if err := a.checkAmountStep(c.Amount); err != nil {
+		return nil, err
+	}
+	if a.CurrentFunds.LessThan(c.Amount) {
+		return nil, insufficientFunds(a.CurrentFunds, c.Amount)
+	}
+	if err := a.checkMinimumBalance(c.Amount); err != nil {
+		return nil, err
+	}
+
+	return []*rita.Event{
+		{
+			Data: &WithdrawalRequested{
+				ID:          c.ID,
+				Amount:      c.Amount,
+				Description: c.Description,
+				Category:    c.Category,
+				Time:        a.clock.Now(),
+			},
+		},
+	}, nil
+}
+
+func (a *Account) decideApproveWithdrawal(c *ApproveWithdrawal) ([]*rita.Event, error) {
+	r, ok := a.PendingWithdrawals[c.ID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrWithdrawalRequestNotFound, c.ID)
+	}
+
+	approved := &rita.Event{
+		Data: &WithdrawalApproved{
+			ID:   c.ID,
+			Time: a.clock.Now(),
+		},
+	}
+
+	events, err := a.decideWithdrawal(&WithdrawFunds{
+		Amount:      r.Amount,
+		Description: r.Description,
+		Category:    r.Category,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]*rita.Event{approved}, events...), nil
+}
+
+func (a *Account) decideDenyWithdrawal(c *DenyWithdrawal) ([]*rita.Event, error) {
+	if _, ok := a.PendingWithdrawals[c.ID]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrWithdrawalRequestNotFound, c.ID)
+	}
+
+	return []*rita.Event{
+		{
+			Data: &WithdrawalDenied{
+				ID:   c.ID,
+				Time: a.clock.Now(),
+			},
+		},
+	}, nil
+}
+
+func (a *Account) evolveWithdrawalRequest(event *rita.Event) {
+	switch e := event.Data.(type) {
+	case *WithdrawalRequested:
+		if a.PendingWithdrawals == nil {
+			a.PendingWithdrawals = make(map[string]*WithdrawalRequest)
+		}
+		a.PendingWithdrawals[e.ID] = &WithdrawalRequest{
+			Amount:      e.Amount,
+			Description: e.Description,
+			Category:    e.Category,
+			Time:        e.Time,
+		}
+
+	case *WithdrawalApproved:
+		delete(a.PendingWithdrawals, e.ID)
+
+	case *WithdrawalDenied:
+		delete(a.PendingWithdrawals, e.ID)
+	}
+}
@@ -0,0 +1,80 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestWithdrawalApproval(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Second)
+	a := Account{clock: clock}
+
+	decide := func(cmd any) ([]*rita.Event, error) {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			is.NoErr(a.Evolve(e))
+		}
+		return events, err
+	}
+
+	_, err := decide(&DepositFunds{Amount: d("100")})
+	is.NoErr(err)
+	_, err = decide(&SetApprovalThreshold{Amount: d("20")})
+	is.NoErr(err)
+
+	// Up to the threshold is withdrawn directly.
+	_, err = decide(&WithdrawFunds{Amount: d("20")})
+	is.NoErr(err)
+	_, err = decide(&WithdrawFunds{Amount: d("25")})
+	is.Err(err, ErrApprovalRequired)
+	is.Equal(NewWithdrawalExplanation(&a, &WithdrawFunds{Amount: d("25")}).Rule, RuleApprovalRequired)
+
+	is.Err((&RequestWithdrawal{Amount: d("25")}).Validate(), ErrRequestIDRequired)
+
+	_, err = decide(&RequestWithdrawal{ID: "r1", Amount: d("25"), Description: "skateboard"})
+	is.NoErr(err)
+	_, err = decide(&RequestWithdrawal{ID: "r1", Amount: d("25")})
+	is.Err(err, ErrWithdrawalRequestExists)
+	_, err = decide(&RequestWithdrawal{ID: "r2", Amount: d("30")})
+	is.NoErr(err)
+
+	// Nothing is withdrawn while pending.
+	is.Equal(len(a.PendingWithdrawals), 2)
+	is.True(a.CurrentFunds.Equal(d("80")))
+
+	events, err := decide(&ApproveWithdrawal{ID: "r1"})
+	is.NoErr(err)
+	is.Equal(len(events), 2)
+	_, ok := events[0].Data.(*WithdrawalApproved)
+	is.True(ok)
+	w, ok := events[1].Data.(*FundsWithdrawn)
+	is.True(ok)
+	is.Equal(w.Description, "skateboard")
+	is.True(a.CurrentFunds.Equal(d("55")))
+
+	_, err = decide(&ApproveWithdrawal{ID: "r1"})
+	is.Err(err, ErrWithdrawalRequestNotFound)
+
+	_, err = decide(&DenyWithdrawal{ID: "r2"})
+	is.NoErr(err)
+	_, err = decide(&ApproveWithdrawal{ID: "r2"})
+	is.Err(err, ErrWithdrawalRequestNotFound)
+
+	is.Equal(len(a.PendingWithdrawals), 0)
+	is.True(a.CurrentFunds.Equal(d("55")))
+
+	// An approval is rejected if the withdrawal is no longer allowed, and
+	// the request remains pending.
+	_, err = decide(&RequestWithdrawal{ID: "r3", Amount: d("50")})
+	is.NoErr(err)
+	_, err = decide(&WithdrawFunds{Amount: d("10")})
+	is.NoErr(err)
+	_, err = decide(&ApproveWithdrawal{ID: "r3"})
+	is.Err(err, ErrInsufficientFunds)
+	is.Equal(len(a.PendingWithdrawals), 1)
+}
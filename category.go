@@ -0,0 +1,118 @@
+package kmm
+
+import (
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	_ rita.Evolver = &CategoryPeriods{}
+)
+
+// CategoryBudget is a budget limiting the withdrawals of one category, e.g.
+// snacks. It applies in addition to the budget of the account, if any.
+type CategoryBudget struct {
+	MaxWithdrawAmount       decimal.Decimal
+	PeriodMaxWithdrawAmount decimal.Decimal
+	Period                  Period
+	TimeZone                string
+	PeriodStartTime         time.Time
+	NextPeriodStartTime     time.Time
+	FundsWithdrawnInPeriod  decimal.Decimal
+	MaxPerTransaction       decimal.Decimal
+}
+
+// checkCategoryBudget returns whether the period of the category budget
+// changed as of now and an error if the withdrawal would exceed it.
+func (a *Account) checkCategoryBudget(c *WithdrawFunds, now time.Time) (bool, error) {
+	b, ok := a.CategoryBudgets[c.Category]
+	if c.Category == "" || !ok {
+		return false, nil
+	}
+
+	if err := checkPerTransaction(c.Category, b.MaxPerTransaction, c.Amount); err != nil {
+		return false, err
+	}
+
+	changed := !now.Before(b.NextPeriodStartTime)
+
+	withdrawn := b.FundsWithdrawnInPeriod
+	limit := b.PeriodMaxWithdrawAmount
+	if changed {
+		withdrawn = decimal.Zero
+		limit = b.MaxWithdrawAmount
+	}
+
+	if withdrawn.Add(c.Amount).GreaterThan(limit) {
+		return changed, budgetExceeded(c.Category, limit.Sub(withdrawn), c.Amount)
+	}
+	return changed, nil
+}
+
+func (a *Account) evolveCategoryBudget(event *rita.Event) {
+	switch e := event.Data.(type) {
+	case *BudgetSet:
+		if a.CategoryBudgets == nil {
+			a.CategoryBudgets = make(map[string]*CategoryBudget)
+		}
+		a.CategoryBudgets[e.Category] = &CategoryBudget{
+			MaxWithdrawAmount:       e.MaxWithdrawAmount,
+			PeriodMaxWithdrawAmount: e.periodMaxAmount(),
+			Period:                  e.Period,
+			TimeZone:                e.TimeZone,
+			PeriodStartTime:         e.PeriodStartTime,
+			NextPeriodStartTime:     e.NextPeriodStartTime,
+			MaxPerTransaction:       e.MaxPerTransaction,
+		}
+
+	case *BudgetRemoved:
+		delete(a.CategoryBudgets, e.Category)
+
+	case *FundsWithdrawn:
+		b, ok := a.CategoryBudgets[e.Category]
+		if !ok || e.Time.Before(b.PeriodStartTime) {
+			return
+		}
+		if e.CategoryPeriodChanged {
+			b.FundsWithdrawnInPeriod = e.Amount
+			b.PeriodMaxWithdrawAmount = b.MaxWithdrawAmount
+			b.PeriodStartTime, b.NextPeriodStartTime = budgetWindow(e.Time, b.Period, b.TimeZone)
+		} else {
+			b.FundsWithdrawnInPeriod = b.FundsWithdrawnInPeriod.Add(e.Amount)
+		}
+	}
+}
+
+// CategoryPeriods is the state of the current period of each category
+// budget, keyed by category.
+type CategoryPeriods struct {
+	Categories map[string]*BudgetPeriod
+}
+
+func (c *CategoryPeriods) Evolve(event *rita.Event) error {
+	switch e := event.Data.(type) {
+	case *BudgetSet:
+		if e.Category == "" {
+			break
+		}
+		if c.Categories == nil {
+			c.Categories = make(map[string]*BudgetPeriod)
+		}
+		c.Categories[e.Category] = &BudgetPeriod{Category: e.Category}
+
+	case *BudgetRemoved:
+		if e.Category != "" {
+			delete(c.Categories, e.Category)
+			return nil
+		}
+	}
+
+	for _, p := range c.Categories {
+		if err := p.Evolve(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestCategoryBudget(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Second)
+	a := Account{clock: clock}
+
+	var (
+		p  BudgetPeriod
+		cp CategoryPeriods
+	)
+
+	decide := func(cmd any) error {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			is.NoErr(a.Evolve(e))
+			is.NoErr(p.Evolve(e))
+			is.NoErr(cp.Evolve(e))
+		}
+		return err
+	}
+
+	is.NoErr(decide(&DepositFunds{Amount: d("100")}))
+
+	is.NoErr(decide(&SetBudget{MaxAmount: d("20"), Period: Weekly}))
+	is.NoErr(decide(&SetBudget{MaxAmount: d("5"), Period: Daily, Category: "snacks"}))
+	is.NoErr(decide(&SetBudget{MaxAmount: d("10"), Period: Weekly, Category: "games"}))
+
+	// The category budgets do not replace the budget of the account.
+	is.True(a.MaxWithdrawAmount.Equal(d("20")))
+	is.Equal(a.PolicyPeriod, Weekly)
+	is.Equal(len(a.CategoryBudgets), 2)
+
+	is.NoErr(decide(&WithdrawFunds{Amount: d("4"), Category: "snacks"}))
+	err := decide(&WithdrawFunds{Amount: d("2"), Category: "snacks"})
+	is.Err(err, ErrExceedWithinPeriod)
+	is.Equal(err.Error(), "kmm: withdrawal would exceed max amount allowed in current period: snacks: remaining 1.00, requested 2.00")
+
+	// Other categories are unaffected.
+	is.NoErr(decide(&WithdrawFunds{Amount: d("8"), Category: "games"}))
+	is.NoErr(decide(&WithdrawFunds{Amount: d("2"), Category: "books"}))
+
+	is.True(a.CategoryBudgets["snacks"].FundsWithdrawnInPeriod.Equal(d("4")))
+	is.True(a.CategoryBudgets["games"].FundsWithdrawnInPeriod.Equal(d("8")))
+
+	// All withdrawals count against the budget of the account.
+	is.True(a.FundsWithdrawnInPeriod.Equal(d("14")))
+	is.Equal(p.WithdrawalsInPeriod, 3)
+	is.Err(decide(&WithdrawFunds{Amount: d("7")}), ErrExceedWithinPeriod)
+
+	// The next day starts a new snacks period, but not a games period.
+	clock.Add(24 * time.Hour)
+
+	is.NoErr(decide(&WithdrawFunds{Amount: d("5"), Category: "snacks"}))
+	is.Err(decide(&WithdrawFunds{Amount: d("3"), Category: "games"}), ErrExceedWithinPeriod)
+
+	snacks := cp.Categories["snacks"]
+	is.Equal(snacks.WithdrawalsInPeriod, 1)
+	is.True(snacks.FundsWithdrawnInPeriod.Equal(d("5")))
+	is.Equal(snacks.PeriodStartTime, time.Date(2019, time.September, 21, 0, 0, 0, 0, time.UTC))
+
+	games := cp.Categories["games"]
+	is.Equal(games.WithdrawalsInPeriod, 1)
+	is.True(games.FundsWithdrawnInPeriod.Equal(d("8")))
+	is.True(games.PolicyMaxWithdrawAmount.Equal(d("10")))
+
+	// Removing a category budget leaves the others.
+	is.Err(decide(&RemoveBudget{Category: "books"}), ErrNoBudget)
+	is.NoErr(decide(&RemoveBudget{Category: "games"}))
+	is.NoErr(decide(&WithdrawFunds{Amount: d("1"), Category: "games"}))
+
+	is.Equal(len(a.CategoryBudgets), 1)
+	is.Equal(len(cp.Categories), 1)
+	is.Equal(a.PolicyPeriod, Weekly)
+}
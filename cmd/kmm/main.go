@@ -1,47 +1,189 @@
 package main
 
 import (
+	"bufio"
+	"container/list"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	// Embed the time zone database so budget time zones resolve on hosts
+	// without one installed.
+	_ "time/tzdata"
 
 	"github.com/bruth/kmm"
+	"github.com/bruth/kmm/money"
 	"github.com/bruth/rita"
+	"github.com/bruth/rita/codec"
 	"github.com/bruth/rita/testutil"
 	"github.com/bruth/rita/types"
 	"github.com/nats-io/jsm.go/natscontext"
+	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 	"github.com/nats-io/nuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/shopspring/decimal"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
 	defaultRequestTimeout = 5 * time.Second
 
+	// requestTimeout is the timeout of service requests, set by the
+	// --timeout flag.
+	requestTimeout = defaultRequestTimeout
+
+	// signer signs service requests if connected with user credentials.
+	signer *requestSigner
+
 	// Initialize the type registry with the application/domain types.
 	tr, _ = types.NewRegistry(kmm.Types)
 
+	// The same types encoded with msgpack for clients requesting it.
+	trMsgPack, _ = types.NewRegistry(kmm.Types, types.Codec(codec.MsgPack.Name()))
+
+	// The same types encoded as JSON with snake case field names.
+	trSnake = newCodecRegistry(kmm.SnakeCaseJSON)
+
+	// Registries by codec name a client can request responses be encoded
+	// with using the Accept header. JSON is the default.
+	responseRegistries = map[string]*types.Registry{
+		codec.JSON.Name():        tr,
+		codec.MsgPack.Name():     trMsgPack,
+		kmm.SnakeCaseJSON.Name(): trSnake,
+	}
+
+	// Registries by codec name a client can encode requests with, indicated
+	// by the Content-Type header. JSON is the default. Events are always
+	// stored using the default registry.
+	requestRegistries = map[string]*types.Registry{
+		codec.JSON.Name():        tr,
+		kmm.SnakeCaseJSON.Name(): trSnake,
+	}
+
 	app = &cli.App{
 		Name:  "kmm",
 		Usage: "Kids money manager.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "profile",
+				Value:   "",
+				Usage:   "Named profile of connection settings in the config file.",
+				EnvVars: []string{"KMM_PROFILE"},
+			},
+			&cli.StringFlag{
+				Name:    "config",
+				Value:   defaultConfigPath(),
+				Usage:   "Path to the config file containing profiles.",
+				EnvVars: []string{"KMM_CONFIG"},
+			},
+			&cli.StringFlag{
+				Name:    "output",
+				Value:   "text",
+				Usage:   "Output format of queries and acknowledgements, text or json.",
+				EnvVars: []string{"KMM_OUTPUT"},
+			},
+			&cli.DurationFlag{
+				Name:    "timeout",
+				Value:   defaultRequestTimeout,
+				Usage:   "Timeout of requests to the server, e.g. 30s.",
+				EnvVars: []string{"KMM_TIMEOUT"},
+			},
+		},
+		Before: func(c *cli.Context) error {
+			switch c.String("output") {
+			case "text", "json":
+			default:
+				return fmt.Errorf("invalid output %q: expected text or json", c.String("output"))
+			}
+
+			t := c.Duration("timeout")
+			if t <= 0 {
+				return fmt.Errorf("invalid timeout %s: must be positive", t)
+			}
+			requestTimeout = t
+			return nil
+		},
 		Commands: []*cli.Command{
 			serve,
+			openAccount,
+			closeAccount,
+			freezeAccount,
+			unfreezeAccount,
 			deposit,
 			withdraw,
+			withdrawRequest,
+			approveWithdrawal,
+			denyWithdrawal,
+			reverse,
+			setApprovalThreshold,
+			setAlertThreshold,
 			setBudget,
+			adjustBudget,
 			removeBudget,
+			setRoundUp,
+			removeRoundUp,
+			setDepositLimit,
+			setAllowance,
+			removeAllowance,
+			setMinBalance,
+			removeMinBalance,
+			setAmountStep,
 			currentBalance,
+			balanceSeries,
 			lastBudgetPeriod,
+			budgetState,
+			carryover,
+			stats,
+			report,
+			netflow,
 			ledger,
+			tail,
+			alerts,
+			backup,
+			restore,
+			replay,
+			setNote,
+			setReflection,
+			setPinCmd,
+			removePinCmd,
+			info,
+			descriptions,
+			familyCmd,
+			settingsCmd,
+			explain,
+			admin,
+			interest,
+			setInterest,
+			nextPeriod,
+			periods,
+			search,
+			accountsCmd,
+			goalCmd,
+			goals,
+			audit,
+			rebuild,
 		},
 	}
 
@@ -58,6 +200,12 @@ var (
 			Usage:   "NATS credentials file.",
 			EnvVars: []string{"NATS_CREDS"},
 		},
+		&cli.StringFlag{
+			Name:    "nats.inbox-prefix",
+			Value:   "",
+			Usage:   "NATS inbox prefix for reply subjects.",
+			EnvVars: []string{"NATS_INBOX_PREFIX"},
+		},
 		&cli.StringFlag{
 			Name:    "nats.context",
 			Value:   natscontext.SelectedContext(),
@@ -66,6 +214,65 @@ var (
 		},
 	}
 
+	// Flags for commands which change the state of an account.
+	commandFlags = append([]cli.Flag{
+		&cli.BoolFlag{
+			Name:    "quiet",
+			Aliases: []string{"q"},
+			Value:   false,
+			Usage:   "Do not print a confirmation on success.",
+		},
+		&cli.BoolFlag{
+			Name:  "no-pin",
+			Value: false,
+			Usage: "Skip the local PIN check of the account, e.g. for scripts.",
+		},
+	}, natsFlags...)
+
+	// Flags for commands which print amounts.
+	currencyFlags = append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "currency",
+			Value: money.DefaultCurrency,
+			Usage: "ISO 4217 currency amounts are printed in.",
+		},
+		&cli.StringFlag{
+			Name:  "locale",
+			Value: "",
+			Usage: "Locale amounts are printed in, e.g. en-US. Defaults to the system locale.",
+		},
+	}, natsFlags...)
+
+	// Flags for commands which deposit or withdraw funds.
+	fundsFlags = append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "currency",
+			Value: "",
+			Usage: "ISO 4217 currency of the amount, e.g. EUR. Defaults to the default currency.",
+		},
+		&cli.BoolFlag{
+			Name:  "stdin",
+			Value: false,
+			Usage: "Read newline-delimited <amount>,<description> pairs from stdin.",
+		},
+		&cli.BoolFlag{
+			Name:  "fail-fast",
+			Value: false,
+			Usage: "Stop reading from stdin on the first failure.",
+		},
+		&cli.StringFlag{
+			Name:  "idempotency-key",
+			Usage: "Key identifying the request, so retrying it with the same key applies it only once.",
+		},
+	}, commandFlags...)
+
+	// Flag of commands which can be decided without committing them.
+	dryRunFlag = &cli.BoolFlag{
+		Name:  "dry-run",
+		Value: false,
+		Usage: "Report whether the command would be accepted and the resulting state without committing it.",
+	}
+
 	serve = &cli.Command{
 		Name:  "serve",
 		Usage: "Run the server.",
@@ -79,31 +286,121 @@ var (
 			&cli.StringFlag{
 				Name:    "http.addr",
 				Value:   "127.0.0.1:8080",
-				Usage:   "HTTP bind address.",
+				Usage:   "HTTP bind address. Metrics are served on /metrics.",
 				EnvVars: []string{"HTTP_ADDR"},
 			},
+			&cli.IntFlag{
+				Name:    "periods.max-closed",
+				Value:   100,
+				Usage:   "Max number of closed budget periods retained in period history. Older periods are rolled up. Zero retains all.",
+				EnvVars: []string{"PERIODS_MAX_CLOSED"},
+			},
+			&cli.DurationFlag{
+				Name:    "periods.rollover-interval",
+				Value:   time.Minute,
+				Usage:   "Interval at which budget periods which have ended are rolled over. Zero disables it, so period changes are only detected on withdrawal.",
+				EnvVars: []string{"PERIODS_ROLLOVER_INTERVAL"},
+			},
+			&cli.DurationFlag{
+				Name:    "allowances.interval",
+				Value:   time.Minute,
+				Usage:   "Interval at which due allowances are deposited. Zero disables allowance deposits.",
+				EnvVars: []string{"ALLOWANCES_INTERVAL"},
+			},
+			&cli.DurationFlag{
+				Name:    "interest.interval",
+				Value:   time.Minute,
+				Usage:   "Interval at which due interest is accrued. Zero disables interest accrual.",
+				EnvVars: []string{"INTEREST_INTERVAL"},
+			},
+			&cli.IntFlag{
+				Name:    "snapshots.interval",
+				Value:   100,
+				Usage:   "Number of events appended to an account after which a snapshot of its state is stored, so commands only replay the events after it. Zero disables snapshots.",
+				EnvVars: []string{"SNAPSHOTS_INTERVAL"},
+			},
+			&cli.BoolFlag{
+				Name:    "projections.cache",
+				Value:   true,
+				Usage:   "Cache the balance and budget period of each account, so queries only evolve the events after the cached state.",
+				EnvVars: []string{"PROJECTIONS_CACHE"},
+			},
+			&cli.DurationFlag{
+				Name:    "idempotency.ttl",
+				Value:   24 * time.Hour,
+				Usage:   "Duration the idempotency key of a command is retained. A retry with the same key within it is not applied again.",
+				EnvVars: []string{"IDEMPOTENCY_TTL"},
+			},
+			&cli.BoolFlag{
+				Name:    "services.legacy-errors",
+				Value:   false,
+				Usage:   "Reply to failed service requests with the error text only, for clients which predate structured errors.",
+				EnvVars: []string{"SERVICES_LEGACY_ERRORS"},
+			},
+			&cli.BoolFlag{
+				Name:    "alerts.enabled",
+				Value:   true,
+				Usage:   "Publish alerts of withdrawals crossing the alert thresholds of accounts.",
+				EnvVars: []string{"ALERTS_ENABLED"},
+			},
+			&cli.StringFlag{
+				Name:    "auth.policy",
+				Value:   "",
+				Usage:   "Source of the accounts each user may operate on, file:<path> of a JSON object of accounts by user or kv:<bucket>. Requests to account, family, search and account list services must be signed by an allowed user if set, and the HTTP account API is disabled.",
+				EnvVars: []string{"AUTH_POLICY"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "auth.issuer",
+				Usage:   "Public key of an account or signing key trusted to issue the JWTs of users signing requests.",
+				EnvVars: []string{"AUTH_ISSUERS"},
+			},
+			&cli.IntFlag{
+				Name:    "commands.max-attempts",
+				Value:   10,
+				Usage:   "Max number of times a command is decided if the account is changed concurrently.",
+				EnvVars: []string{"COMMANDS_MAX_ATTEMPTS"},
+			},
+			&cli.IntFlag{
+				Name:    "family.max-members",
+				Value:   kmm.DefaultMaxFamilyMembers,
+				Usage:   "Max number of accounts in a family.",
+				EnvVars: []string{"FAMILY_MAX_MEMBERS"},
+			},
+			&cli.DurationFlag{
+				Name:    "shutdown.timeout",
+				Value:   10 * time.Second,
+				Usage:   "Max duration to wait on shutdown for in-flight requests to finish and NATS to drain.",
+				EnvVars: []string{"SHUTDOWN_TIMEOUT"},
+			},
+			&cli.BoolFlag{
+				Name:    "selftest",
+				Value:   false,
+				Usage:   "Deposit and withdraw on a throwaway account before serving and fail if the round-trip does not work.",
+				EnvVars: []string{"SELFTEST"},
+			},
 		}, natsFlags...),
 		Action: func(c *cli.Context) error {
 			return runServer(c)
 		},
 	}
 
-	deposit = &cli.Command{
-		Name:      "deposit",
-		Usage:     "Deposit money into an account.",
-		Flags:     natsFlags,
-		ArgsUsage: "<account> <amount> [<description>]",
+	openAccount = &cli.Command{
+		Name:      "open",
+		Usage:     "Opens a new account. An account must be opened before funds can be deposited.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account> <owner>",
 		Action: func(c *cli.Context) error {
-			n := c.NArg()
-			if n < 2 {
-				return fmt.Errorf("account and amount are required")
-			} else if n > 3 {
-				return fmt.Errorf("at most three arguments are supported")
+			if c.NArg() != 2 {
+				return fmt.Errorf("account and owner are required")
 			}
 
 			account := c.Args().Get(0)
-			amount := c.Args().Get(1)
-			description := c.Args().Get(2)
+			cmd := &kmm.OpenAccount{
+				Owner: c.Args().Get(1),
+			}
+			if err := cmd.Validate(); err != nil {
+				return err
+			}
 
 			nc, err := connectNats(c)
 			if err != nil {
@@ -111,39 +408,34 @@ var (
 			}
 			defer nc.Drain() //nolint
 
-			subject := fmt.Sprintf("kmm.services.%s.deposit-funds", account)
-			data, _ := json.Marshal(map[string]string{
-				"Amount":      amount,
-				"Description": description,
-			})
+			subject := fmt.Sprintf("kmm.services.%s.open-account", account)
+			data, _ := json.Marshal(cmd)
 
-			rep, err := nc.Request(subject, data, defaultRequestTimeout)
+			rep, err := request(nc, subject, data)
 			if err != nil {
 				return err
 			}
-			if len(rep.Data) > 0 {
-				fmt.Println(string(rep.Data))
-			}
+			confirm := fmt.Sprintf("ok: opened %s for %s", account, cmd.Owner)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
 			return nil
 		},
 	}
 
-	withdraw = &cli.Command{
-		Name:      "withdraw",
-		Usage:     "Withdraw money from an account.",
-		Flags:     natsFlags,
-		ArgsUsage: "<account> <amount> [<description>]",
+	closeAccount = &cli.Command{
+		Name:      "close",
+		Usage:     "Closes an account. A closed account rejects all further commands.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account>",
 		Action: func(c *cli.Context) error {
-			n := c.NArg()
-			if n < 2 {
-				return fmt.Errorf("account and amount are required")
-			} else if n > 3 {
-				return fmt.Errorf("at most three arguments are supported")
+			if c.NArg() != 1 {
+				return fmt.Errorf("account required")
 			}
 
 			account := c.Args().Get(0)
-			amount := c.Args().Get(1)
-			description := c.Args().Get(2)
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
 
 			nc, err := connectNats(c)
 			if err != nil {
@@ -151,37 +443,32 @@ var (
 			}
 			defer nc.Drain() //nolint
 
-			subject := fmt.Sprintf("kmm.services.%s.withdraw-funds", account)
-			data, _ := json.Marshal(map[string]string{
-				"Amount":      amount,
-				"Description": description,
-			})
-
-			rep, err := nc.Request(subject, data, defaultRequestTimeout)
+			subject := fmt.Sprintf("kmm.services.%s.close-account", account)
+			rep, err := request(nc, subject, []byte{})
 			if err != nil {
 				return err
 			}
-			if len(rep.Data) > 0 {
-				fmt.Println(string(rep.Data))
-			}
+			confirm := fmt.Sprintf("ok: closed %s", account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
 			return nil
 		},
 	}
 
-	setBudget = &cli.Command{
-		Name:      "set-budget",
-		Usage:     "Set a budget on an account.",
-		Flags:     natsFlags,
-		ArgsUsage: "<account> <amount> <period>",
+	freezeAccount = &cli.Command{
+		Name:      "freeze",
+		Usage:     "Freezes an account. A frozen account rejects withdrawals until unfrozen, but accepts deposits.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account>",
 		Action: func(c *cli.Context) error {
-			n := c.NArg()
-			if n != 3 {
-				return fmt.Errorf("account, amount, and period are required")
+			if c.NArg() != 1 {
+				return fmt.Errorf("account required")
 			}
 
 			account := c.Args().Get(0)
-			amount := c.Args().Get(1)
-			period := c.Args().Get(2)
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
 
 			nc, err := connectNats(c)
 			if err != nil {
@@ -189,66 +476,95 @@ var (
 			}
 			defer nc.Drain() //nolint
 
-			subject := fmt.Sprintf("kmm.services.%s.set-budget", account)
-			data, _ := json.Marshal(map[string]string{
-				"MaxAmount": amount,
-				"Period":    period,
-			})
-
-			rep, err := nc.Request(subject, data, defaultRequestTimeout)
+			subject := fmt.Sprintf("kmm.services.%s.freeze-account", account)
+			rep, err := request(nc, subject, []byte{})
 			if err != nil {
 				return err
 			}
-			if len(rep.Data) > 0 {
-				fmt.Println(string(rep.Data))
-			}
+			confirm := fmt.Sprintf("ok: froze %s", account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
 			return nil
 		},
 	}
 
-	removeBudget = &cli.Command{
-		Name:      "remove-budget",
-		Usage:     "Removes a budget from an account.",
-		Flags:     natsFlags,
+	unfreezeAccount = &cli.Command{
+		Name:      "unfreeze",
+		Usage:     "Unfreezes a frozen account.",
+		Flags:     commandFlags,
 		ArgsUsage: "<account>",
 		Action: func(c *cli.Context) error {
-			n := c.NArg()
-			if n != 1 {
+			if c.NArg() != 1 {
 				return fmt.Errorf("account required")
 			}
 
 			account := c.Args().Get(0)
 
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
 			nc, err := connectNats(c)
 			if err != nil {
 				return err
 			}
 			defer nc.Drain() //nolint
 
-			subject := fmt.Sprintf("kmm.services.%s.remove-budget", account)
-			rep, err := nc.Request(subject, []byte{}, defaultRequestTimeout)
+			subject := fmt.Sprintf("kmm.services.%s.unfreeze-account", account)
+			rep, err := request(nc, subject, []byte{})
 			if err != nil {
 				return err
 			}
-			if len(rep.Data) > 0 {
-				fmt.Println(string(rep.Data))
-			}
+			confirm := fmt.Sprintf("ok: unfroze %s", account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
 			return nil
 		},
 	}
 
-	currentBalance = &cli.Command{
-		Name:      "balance",
-		Usage:     "Gets the current balance for an account.",
-		Flags:     natsFlags,
-		ArgsUsage: "<account>",
+	deposit = &cli.Command{
+		Name:  "deposit",
+		Usage: "Deposit money into an account.",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "goal",
+				Value: "",
+				Usage: "Name of the savings goal the deposit contributes to.",
+			},
+			dryRunFlag,
+		}, fundsFlags...),
+		ArgsUsage: "<account> <amount> [<description>]",
 		Action: func(c *cli.Context) error {
 			n := c.NArg()
-			if n != 1 {
-				return fmt.Errorf("account required")
+			if c.Bool("stdin") {
+				if n != 1 {
+					return fmt.Errorf("only the account is supported when reading from stdin")
+				}
+				if c.String("idempotency-key") != "" {
+					return fmt.Errorf("idempotency key cannot be combined with stdin")
+				}
+				if c.Bool("dry-run") {
+					return fmt.Errorf("dry run cannot be combined with stdin")
+				}
+			} else if n < 2 {
+				return fmt.Errorf("account and amount are required")
+			} else if n > 3 {
+				return fmt.Errorf("at most three arguments are supported")
 			}
 
 			account := c.Args().Get(0)
+			amount := c.Args().Get(1)
+			description := c.Args().Get(2)
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			if !c.Bool("stdin") {
+				v, err := money.Parse(amount)
+				if err != nil {
+					return err
+				}
+				amount = v.String()
+			}
 
 			nc, err := connectNats(c)
 			if err != nil {
@@ -256,33 +572,95 @@ var (
 			}
 			defer nc.Drain() //nolint
 
-			subject := fmt.Sprintf("kmm.services.%s.balance", account)
-			rep, err := nc.Request(subject, []byte{}, defaultRequestTimeout)
-			if err != nil {
-				return err
+			subject := fmt.Sprintf("kmm.services.%s.deposit-funds", account)
+
+			if c.Bool("stdin") {
+				return applyLines(os.Stdin, os.Stdout, c.Bool("fail-fast"), func(amount, description string) error {
+					v, _ := money.Parse(amount)
+					return requestCommand(nc, subject, map[string]string{
+						"Amount":      v.String(),
+						"Description": description,
+						"GoalName":    c.String("goal"),
+						"Currency":    strings.ToUpper(c.String("currency")),
+					})
+				})
+			}
+
+			data, _ := json.Marshal(map[string]string{
+				"Amount":      amount,
+				"Description": description,
+				"GoalName":    c.String("goal"),
+				"Currency":    strings.ToUpper(c.String("currency")),
+			})
+
+			if c.Bool("dry-run") {
+				return dryRun(c, nc, account, "deposit-funds", data)
 			}
-			v, err := tr.UnmarshalType(rep.Data, "current-funds")
+
+			rep, err := requestMsg(nc, commandMsg(subject, data, c.String("idempotency-key")))
 			if err != nil {
 				return err
 			}
-			funds, _ := v.(*kmm.CurrentFunds)
-			fmt.Println(funds.Amount)
+			if jsonOutput(c) {
+				return printReplyJSON(os.Stdout, rep, map[string]string{
+					"Account":     account,
+					"Amount":      amount,
+					"Description": description,
+					"GoalName":    c.String("goal"),
+					"Currency":    strings.ToUpper(c.String("currency")),
+				})
+			}
+			confirm := fmt.Sprintf("ok: deposited %s into %s", amount, account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
 			return nil
 		},
 	}
 
-	ledger = &cli.Command{
-		Name:      "ledger",
-		Usage:     "Subscribes to the account ledger.",
-		Flags:     natsFlags,
-		ArgsUsage: "<account>",
+	withdraw = &cli.Command{
+		Name:  "withdraw",
+		Usage: "Withdraw money from an account.",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "category",
+				Value: "",
+				Usage: "Category of the withdrawal, counted against the budget of the category.",
+			},
+			dryRunFlag,
+		}, fundsFlags...),
+		ArgsUsage: "<account> <amount> [<description>]",
 		Action: func(c *cli.Context) error {
 			n := c.NArg()
-			if n != 1 {
-				return fmt.Errorf("account required")
+			if c.Bool("stdin") {
+				if n != 1 {
+					return fmt.Errorf("only the account is supported when reading from stdin")
+				}
+				if c.String("idempotency-key") != "" {
+					return fmt.Errorf("idempotency key cannot be combined with stdin")
+				}
+				if c.Bool("dry-run") {
+					return fmt.Errorf("dry run cannot be combined with stdin")
+				}
+			} else if n < 2 {
+				return fmt.Errorf("account and amount are required")
+			} else if n > 3 {
+				return fmt.Errorf("at most three arguments are supported")
 			}
 
 			account := c.Args().Get(0)
+			amount := c.Args().Get(1)
+			description := c.Args().Get(2)
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			if !c.Bool("stdin") {
+				v, err := money.Parse(amount)
+				if err != nil {
+					return err
+				}
+				amount = v.String()
+			}
 
 			nc, err := connectNats(c)
 			if err != nil {
@@ -290,195 +668,6377 @@ var (
 			}
 			defer nc.Drain() //nolint
 
-			rt, _ := rita.New(nc, rita.TypeRegistry(tr))
-
-			streamID := nuid.Next()
-			streamSubject := fmt.Sprintf("kmm.streams.%s", streamID)
+			subject := fmt.Sprintf("kmm.services.%s.withdraw-funds", account)
 
-			sub, err := nc.Subscribe(streamSubject, func(msg *nats.Msg) {
-				event, err := rt.UnpackEvent(msg)
-				if err != nil {
-					log.Print(err)
-					return
-				}
+			if c.Bool("stdin") {
+				return applyLines(os.Stdin, os.Stdout, c.Bool("fail-fast"), func(amount, description string) error {
+					v, _ := money.Parse(amount)
+					return requestCommand(nc, subject, map[string]string{
+						"Amount":      v.String(),
+						"Description": description,
+						"Category":    c.String("category"),
+						"Currency":    strings.ToUpper(c.String("currency")),
+					})
+				})
+			}
 
-				switch e := event.Data.(type) {
-				case *kmm.FundsDeposited:
-					if e.Description == "" {
-						fmt.Printf("+%s | %s\n", e.Amount, e.Time.Format(time.ANSIC))
-					} else {
-						fmt.Printf("+%s | %s | %s\n", e.Amount, e.Time.Format(time.ANSIC), e.Description)
-					}
-				case *kmm.FundsWithdrawn:
-					if e.Description == "" {
-						fmt.Printf("-%s | %s\n", e.Amount, e.Time.Format(time.ANSIC))
-					} else {
-						fmt.Printf("-%s | %s | %s\n", e.Amount, e.Time.Format(time.ANSIC), e.Description)
-					}
-				}
+			data, _ := json.Marshal(map[string]string{
+				"Amount":      amount,
+				"Description": description,
+				"Category":    c.String("category"),
+				"Currency":    strings.ToUpper(c.String("currency")),
 			})
-			if err != nil {
-				return fmt.Errorf("ledger-subscribe: %w", err)
+
+			if c.Bool("dry-run") {
+				return dryRun(c, nc, account, "withdraw-funds", data)
 			}
-			defer sub.Unsubscribe() //nolint
 
-			subject := fmt.Sprintf("kmm.services.%s.ledger", account)
-			_, err = nc.Request(subject, []byte(fmt.Sprintf(`{"id": "%s"}`, streamID)), defaultRequestTimeout)
+			rep, err := requestMsg(nc, commandMsg(subject, data, c.String("idempotency-key")))
 			if err != nil {
-				return fmt.Errorf("ledger-request: %w", err)
+				return err
 			}
-
-			sigch := make(chan os.Signal, 1)
-			signal.Notify(sigch, os.Interrupt)
-			<-sigch
-
+			if jsonOutput(c) {
+				return printReplyJSON(os.Stdout, rep, map[string]string{
+					"Account":     account,
+					"Amount":      amount,
+					"Description": description,
+					"Category":    c.String("category"),
+					"Currency":    strings.ToUpper(c.String("currency")),
+				})
+			}
+			confirm := fmt.Sprintf("ok: withdrew %s from %s", amount, account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
 			return nil
 		},
 	}
 
-	lastBudgetPeriod = &cli.Command{
-		Name:      "last-budget-period",
-		Usage:     "Gets the summary for the last active budget period.",
-		Flags:     natsFlags,
-		ArgsUsage: "<account>",
+	setApprovalThreshold = &cli.Command{
+		Name:      "set-approval-threshold",
+		Usage:     "Require withdrawals of more than the amount to be requested and approved. A zero amount removes the requirement.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account> <amount>",
 		Action: func(c *cli.Context) error {
-			n := c.NArg()
-			if n != 1 {
-				return fmt.Errorf("account required")
+			if c.NArg() != 2 {
+				return fmt.Errorf("account and amount are required")
 			}
 
 			account := c.Args().Get(0)
-
-			nc, err := connectNats(c)
+			amount, err := money.Parse(c.Args().Get(1))
 			if err != nil {
 				return err
 			}
-			defer nc.Drain() //nolint
 
-			subject := fmt.Sprintf("kmm.services.%s.last-budget-period", account)
-			rep, err := nc.Request(subject, []byte{}, defaultRequestTimeout)
-			if err != nil {
+			if err := requirePin(c, account); err != nil {
 				return err
 			}
-			v, err := tr.UnmarshalType(rep.Data, "budget-period")
-			if err != nil {
+
+			cmd := &kmm.SetApprovalThreshold{
+				Amount: amount,
+			}
+			if err := cmd.Validate(); err != nil {
 				return err
 			}
-			s, _ := v.(*kmm.BudgetPeriod)
 
-			if s.PolicyMaxWithdrawAmount.IsZero() {
-				fmt.Println("no budget set")
-				return nil
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
 			}
+			defer nc.Drain() //nolint
 
-			fmt.Printf(`period start: %s
-period end: %s
-withdrawals: %d
-total withdrawn: %s
-`, s.PeriodStartTime.Format(time.ANSIC), s.NextPeriodStartTime.Format(time.ANSIC), s.WithdrawalsInPeriod, s.FundsWithdrawnInPeriod)
+			subject := fmt.Sprintf("kmm.services.%s.set-approval-threshold", account)
+			data, _ := json.Marshal(cmd)
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: set approval threshold of %s on %s", money.Format(amount, ""), account)
+			if amount.IsZero() {
+				confirm = fmt.Sprintf("ok: removed approval threshold from %s", account)
+			}
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
 			return nil
 		},
 	}
-)
-
-func connectNats(c *cli.Context) (*nats.Conn, error) {
-	natsUrl := c.String("nats.url")
-	natsCreds := c.String("nats.creds")
-	natsContext := c.String("nats.context")
 
-	// Setup NATS connection depending on the values available.
-	if natsCreds == "" && os.Getenv("NATS_CREDS_B64") != "" {
-		// Hack to get the get the creds file content as a Fly.io secret..
+	setAlertThreshold = &cli.Command{
+		Name:  "set-alert-threshold",
+		Usage: "Alert when a withdrawal drops the balance below an amount or uses a percent of the budget period. A zero threshold disables the alert.",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "low-balance",
+				Value: "0",
+				Usage: "Alert when the balance drops below the amount.",
+			},
+			&cli.IntFlag{
+				Name:  "budget-percent",
+				Value: 0,
+				Usage: "Alert when the percent of the max amount of the budget period is withdrawn, e.g. 90.",
+			},
+		}, commandFlags...),
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+			lowBalance, err := money.Parse(c.String("low-balance"))
+			if err != nil {
+				return fmt.Errorf("low balance: %w", err)
+			}
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			cmd := &kmm.SetAlertThreshold{
+				LowBalance:    lowBalance,
+				BudgetPercent: c.Int("budget-percent"),
+			}
+			if err := cmd.Validate(); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.set-alert-threshold", account)
+			data, _ := json.Marshal(cmd)
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: set alert thresholds of %s balance and %d%% of budget on %s", money.Format(lowBalance, ""), cmd.BudgetPercent, account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	withdrawRequest = &cli.Command{
+		Name:  "withdraw-request",
+		Usage: "Request a withdrawal which is pending until approved or denied.",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "id",
+				Value: "",
+				Usage: "ID of the request. One is generated by default.",
+			},
+			&cli.StringFlag{
+				Name:  "category",
+				Value: "",
+				Usage: "Category of the withdrawal, counted against the budget of the category.",
+			},
+		}, natsFlags...),
+		ArgsUsage: "<account> <amount> [<description>]",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n < 2 {
+				return fmt.Errorf("account and amount are required")
+			} else if n > 3 {
+				return fmt.Errorf("at most three arguments are supported")
+			}
+
+			account := c.Args().Get(0)
+			amount, err := money.Parse(c.Args().Get(1))
+			if err != nil {
+				return err
+			}
+
+			cmd := &kmm.RequestWithdrawal{
+				ID:          c.String("id"),
+				Amount:      amount,
+				Description: c.Args().Get(2),
+				Category:    c.String("category"),
+			}
+			if cmd.ID == "" {
+				cmd.ID = nuid.Next()
+			}
+			if err := cmd.Validate(); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.request-withdrawal", account)
+			data, _ := json.Marshal(cmd)
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			if jsonOutput(c) {
+				return printReplyJSON(os.Stdout, rep, cmd)
+			}
+			confirm := fmt.Sprintf("ok: requested withdrawal of %s from %s, request %s", amount, account, cmd.ID)
+			printReply(os.Stdout, rep, false, confirm)
+			return nil
+		},
+	}
+
+	approveWithdrawal = &cli.Command{
+		Name:      "approve",
+		Usage:     "Approve a pending withdrawal request, which withdraws the funds.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account> <request-id>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 2 {
+				return fmt.Errorf("account and request id are required")
+			}
+
+			account := c.Args().Get(0)
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			cmd := &kmm.ApproveWithdrawal{
+				ID: c.Args().Get(1),
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.approve-withdrawal", account)
+			data, _ := json.Marshal(cmd)
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: approved request %s of %s", cmd.ID, account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	denyWithdrawal = &cli.Command{
+		Name:      "deny",
+		Usage:     "Deny a pending withdrawal request.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account> <request-id>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 2 {
+				return fmt.Errorf("account and request id are required")
+			}
+
+			account := c.Args().Get(0)
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			cmd := &kmm.DenyWithdrawal{
+				ID: c.Args().Get(1),
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.deny-withdrawal", account)
+			data, _ := json.Marshal(cmd)
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: denied request %s of %s", cmd.ID, account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	reverse = &cli.Command{
+		Name:      "reverse",
+		Usage:     "Reverse a deposit or withdrawal with a compensating transaction.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account> <transaction-id>",
+		Description: `The transaction ID is the ID of the deposit or withdrawal event, which
+is shown by ledger --ids. Only recent transactions can be reversed.`,
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 2 {
+				return fmt.Errorf("account and transaction id are required")
+			}
+
+			account := c.Args().Get(0)
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			cmd := &kmm.ReverseTransaction{
+				TransactionID: c.Args().Get(1),
+			}
+			if err := cmd.Validate(); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.reverse-transaction", account)
+			data, _ := json.Marshal(cmd)
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: reversed %s on %s", cmd.TransactionID, account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	setBudget = &cli.Command{
+		Name:  "set-budget",
+		Usage: "Set a budget on an account.",
+		Flags: append([]cli.Flag{
+			&cli.BoolFlag{
+				Name:  "pro-rate",
+				Value: false,
+				Usage: "Reduce the max amount of the current period by the fraction already passed.",
+			},
+			&cli.StringFlag{
+				Name:  "tz",
+				Value: "",
+				Usage: "IANA time zone the period boundaries are computed in, e.g. America/New_York. Defaults to the time zone of the server.",
+			},
+			&cli.StringFlag{
+				Name:  "category",
+				Value: "",
+				Usage: "Set the budget of withdrawals of the category rather than the account.",
+			},
+			&cli.StringFlag{
+				Name:  "max-per-transaction",
+				Value: "",
+				Usage: "Max amount of a single withdrawal, independent of the period.",
+			},
+			&cli.BoolFlag{
+				Name:  "rollover",
+				Value: false,
+				Usage: "Add the unspent funds of each period to the next period.",
+			},
+			&cli.StringFlag{
+				Name:  "rollover-cap",
+				Value: "",
+				Usage: "Max amount rolled over to the next period. Defaults to no cap.",
+			},
+			dryRunFlag,
+		}, commandFlags...),
+		ArgsUsage: "<account> <amount> <period>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 3 {
+				return fmt.Errorf("account, amount, and period are required")
+			}
+
+			account := c.Args().Get(0)
+			amount, err := money.Parse(c.Args().Get(1))
+			if err != nil {
+				return err
+			}
+			period := c.Args().Get(2)
+
+			maxPerTransaction := decimal.Zero
+			if v := c.String("max-per-transaction"); v != "" {
+				if maxPerTransaction, err = money.Parse(v); err != nil {
+					return fmt.Errorf("max per transaction: %w", err)
+				}
+			}
+
+			rolloverCap := decimal.Zero
+			if v := c.String("rollover-cap"); v != "" {
+				if rolloverCap, err = money.Parse(v); err != nil {
+					return fmt.Errorf("rollover cap: %w", err)
+				}
+			}
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.set-budget", account)
+			data, _ := json.Marshal(map[string]any{
+				"MaxAmount":         amount.String(),
+				"Period":            period,
+				"ProRate":           c.Bool("pro-rate"),
+				"TimeZone":          c.String("tz"),
+				"Category":          c.String("category"),
+				"MaxPerTransaction": maxPerTransaction.String(),
+				"Rollover":          c.Bool("rollover"),
+				"RolloverCap":       rolloverCap.String(),
+			})
+
+			if c.Bool("dry-run") {
+				return dryRun(c, nc, account, "set-budget", data)
+			}
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: set %s budget of %s on %s", period, amount, account)
+			if category := c.String("category"); category != "" {
+				confirm = fmt.Sprintf("ok: set %s %s budget of %s on %s", period, category, amount, account)
+			}
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	adjustBudget = &cli.Command{
+		Name:      "adjust-budget",
+		Usage:     "Adjusts the max amount of the budget on an account without resetting the current period.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account> <amount>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 2 {
+				return fmt.Errorf("account and amount are required")
+			}
+
+			account := c.Args().Get(0)
+			amount, err := money.Parse(c.Args().Get(1))
+			if err != nil {
+				return err
+			}
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.adjust-budget", account)
+			data, _ := json.Marshal(map[string]string{
+				"MaxAmount": amount.String(),
+			})
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: adjusted budget to %s on %s", amount, account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	removeBudget = &cli.Command{
+		Name:  "remove-budget",
+		Usage: "Removes a budget from an account.",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "category",
+				Value: "",
+				Usage: "Remove the budget of the category rather than the account.",
+			},
+		}, commandFlags...),
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.remove-budget", account)
+			data, _ := json.Marshal(&kmm.RemoveBudget{
+				Category: c.String("category"),
+			})
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: removed budget from %s", account)
+			if category := c.String("category"); category != "" {
+				confirm = fmt.Sprintf("ok: removed %s budget from %s", category, account)
+			}
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	setRoundUp = &cli.Command{
+		Name:  "set-round-up",
+		Usage: "Rounds up withdrawals and moves the difference to another account.",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "increment",
+				Value: kmm.DefaultRoundUpIncrement.String(),
+				Usage: "Increment withdrawals are rounded up to.",
+			},
+		}, commandFlags...),
+		ArgsUsage: "<account> <round-up-account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 2 {
+				return fmt.Errorf("account and round-up account are required")
+			}
+
+			account := c.Args().Get(0)
+			target := c.Args().Get(1)
+			increment := c.String("increment")
+			if increment != "" {
+				v, err := money.Parse(increment)
+				if err != nil {
+					return err
+				}
+				increment = v.String()
+			}
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.set-round-up", account)
+			data, _ := json.Marshal(map[string]string{
+				"Account":   target,
+				"Increment": increment,
+			})
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: set round-up to %s on %s into %s", increment, account, target)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	removeRoundUp = &cli.Command{
+		Name:      "remove-round-up",
+		Usage:     "Removes round-ups from an account.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.remove-round-up", account)
+			rep, err := request(nc, subject, []byte{})
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: removed round-up from %s", account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	setAllowance = &cli.Command{
+		Name:      "set-allowance",
+		Usage:     "Set an allowance deposited at the start of each period, beginning with the next period.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account> <amount> <period>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 3 {
+				return fmt.Errorf("account, amount, and period are required")
+			}
+
+			account := c.Args().Get(0)
+			amount, err := money.Parse(c.Args().Get(1))
+			if err != nil {
+				return err
+			}
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			cmd := &kmm.SetAllowance{
+				Amount: amount,
+				Period: kmm.Period(c.Args().Get(2)),
+			}
+			if err := cmd.Validate(); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.set-allowance", account)
+			data, _ := json.Marshal(cmd)
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: set %s allowance of %s on %s", cmd.Period, money.Format(amount, ""), account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	removeAllowance = &cli.Command{
+		Name:      "remove-allowance",
+		Usage:     "Removes the allowance from an account.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.remove-allowance", account)
+			rep, err := request(nc, subject, []byte{})
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: removed allowance from %s", account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	setMinBalance = &cli.Command{
+		Name:      "set-min-balance",
+		Usage:     "Set a minimum balance withdrawals cannot drop the balance below.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account> <amount>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 2 {
+				return fmt.Errorf("account and amount are required")
+			}
+
+			account := c.Args().Get(0)
+			amount, err := money.Parse(c.Args().Get(1))
+			if err != nil {
+				return err
+			}
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			cmd := &kmm.SetMinimumBalance{
+				Amount: amount,
+			}
+			if err := cmd.Validate(); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.set-minimum-balance", account)
+			data, _ := json.Marshal(cmd)
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: set minimum balance of %s on %s", money.Format(amount, ""), account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	removeMinBalance = &cli.Command{
+		Name:      "remove-min-balance",
+		Usage:     "Removes the minimum balance from an account.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.remove-minimum-balance", account)
+			rep, err := request(nc, subject, []byte{})
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: removed minimum balance from %s", account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	setDepositLimit = &cli.Command{
+		Name:      "set-deposit-limit",
+		Usage:     "Limit the number of deposits within each period. A max of zero removes the limit.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account> <max> [<period>]",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n < 2 || n > 3 {
+				return fmt.Errorf("account and max are required")
+			}
+
+			account := c.Args().Get(0)
+			maxDeposits, err := strconv.Atoi(c.Args().Get(1))
+			if err != nil {
+				return fmt.Errorf("invalid max: %w", err)
+			}
+			period := c.Args().Get(2)
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			cmd := &kmm.SetDepositLimit{
+				MaxDeposits: maxDeposits,
+				Period:      kmm.Period(period),
+			}
+			if err := cmd.Validate(); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.set-deposit-limit", account)
+			data, _ := json.Marshal(cmd)
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: set %s deposit limit of %d on %s", period, maxDeposits, account)
+			if maxDeposits == 0 {
+				confirm = fmt.Sprintf("ok: removed deposit limit from %s", account)
+			}
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	setAmountStep = &cli.Command{
+		Name:      "set-amount-step",
+		Usage:     "Require deposit and withdrawal amounts to be multiples of the step, e.g. 0.25. A step of zero removes the restriction.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account> <step>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 2 {
+				return fmt.Errorf("account and step are required")
+			}
+
+			account := c.Args().Get(0)
+			step, err := money.Parse(c.Args().Get(1))
+			if err != nil {
+				return err
+			}
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			cmd := &kmm.SetAmountStep{
+				Step: step,
+			}
+			if err := cmd.Validate(); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.set-amount-step", account)
+			data, _ := json.Marshal(cmd)
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: set amount step of %s on %s", money.Format(step, ""), account)
+			if step.IsZero() {
+				confirm = fmt.Sprintf("ok: removed amount step from %s", account)
+			}
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	currentBalance = &cli.Command{
+		Name:  "balance",
+		Usage: "Gets the current balance for an account.",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "as-of",
+				Value: "",
+				Usage: "Get the balance as of a time instead, RFC3339, e.g. 2019-05-03T17:00:00-04:00.",
+			},
+			&cli.BoolFlag{
+				Name:  "watch",
+				Usage: "Print the balance again whenever it changes, until interrupted.",
+			},
+		}, currencyFlags...),
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+			watch := c.Bool("watch")
+
+			f, err := amountFormatter(c)
+			if err != nil {
+				return err
+			}
+
+			subject := fmt.Sprintf("kmm.services.%s.balance", account)
+			data := []byte{}
+
+			if s := c.String("as-of"); s != "" {
+				if watch {
+					return fmt.Errorf("--watch cannot be combined with --as-of")
+				}
+
+				t, err := time.Parse(time.RFC3339, s)
+				if err != nil {
+					return fmt.Errorf("invalid as-of time: %w", err)
+				}
+
+				subject = fmt.Sprintf("kmm.services.%s.balance-as-of", account)
+				data, err = tr.Marshal(&kmm.GetBalanceAsOf{Time: t})
+				if err != nil {
+					return err
+				}
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			getBalance := func() (*kmm.CurrentFunds, error) {
+				rep, err := request(nc, subject, data)
+				if err != nil {
+					return nil, err
+				}
+				v, err := unmarshalReply(rep, "current-funds")
+				if err != nil {
+					return nil, err
+				}
+				funds, _ := v.(*kmm.CurrentFunds)
+				return funds, nil
+			}
+
+			if !watch {
+				funds, err := getBalance()
+				if err != nil {
+					return err
+				}
+				if jsonOutput(c) {
+					return printJSON(os.Stdout, funds)
+				}
+				for _, line := range formatBalances(funds, f.Format) {
+					fmt.Println(line)
+				}
+				return nil
+			}
+
+			// Events of the account from the time of subscribing signal
+			// the balance to be fetched again, since besides deposits and
+			// withdrawals, e.g. accrued interest, round-ups and merged
+			// transactions change it too. Signals are coalesced while a
+			// balance is being fetched.
+			changed := make(chan struct{}, 1)
+			rt, _ := rita.New(nc, rita.TypeRegistry(tr))
+			sub, _, err := subscribeLedger(nc, rt, account, ledgerQuery{Since: time.Now()}, func(e *ledgerEvent) {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			})
+			if err != nil {
+				return err
+			}
+			defer sub.Unsubscribe() //nolint
+
+			// The balance is updated in place on a terminal.
+			inPlace := !jsonOutput(c) && isTerminal(os.Stdout)
+
+			var last string
+			update := func() error {
+				funds, err := getBalance()
+				if err != nil {
+					return err
+				}
+
+				var line string
+				if jsonOutput(c) {
+					b, err := json.Marshal(funds)
+					if err != nil {
+						return err
+					}
+					line = string(b)
+				} else {
+					line = strings.Join(formatBalances(funds, f.Format), "  ")
+				}
+				if line != last {
+					printBalanceUpdate(os.Stdout, line, inPlace)
+					last = line
+				}
+				return nil
+			}
+
+			if err := update(); err != nil {
+				return err
+			}
+
+			sigch := make(chan os.Signal, 1)
+			signal.Notify(sigch, os.Interrupt)
+
+			for {
+				select {
+				case <-sigch:
+					if inPlace {
+						fmt.Println()
+					}
+					return nil
+				case <-changed:
+					if err := update(); err != nil {
+						return err
+					}
+				}
+			}
+		},
+	}
+
+	balanceSeries = &cli.Command{
+		Name:  "balance-series",
+		Usage: "Prints the balance at the end of each interval as JSON.",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "from",
+				Value: "",
+				Usage: "Start date of the range, YYYY-MM-DD. Defaults to a week prior to the end.",
+			},
+			&cli.StringFlag{
+				Name:  "to",
+				Value: "",
+				Usage: "End date of the range, YYYY-MM-DD. Defaults to today.",
+			},
+			&cli.StringFlag{
+				Name:  "interval",
+				Value: string(kmm.Daily),
+				Usage: "Interval of each point.",
+			},
+		}, natsFlags...),
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			to := time.Now()
+			if s := c.String("to"); s != "" {
+				t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+				if err != nil {
+					return fmt.Errorf("invalid to date: %w", err)
+				}
+				to = t
+			}
+
+			from := to.AddDate(0, 0, -7)
+			if s := c.String("from"); s != "" {
+				t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+				if err != nil {
+					return fmt.Errorf("invalid from date: %w", err)
+				}
+				from = t
+			}
+
+			q := &kmm.GetBalanceSeries{
+				From:     from,
+				To:       to,
+				Interval: kmm.Period(c.String("interval")),
+			}
+			if err := q.Validate(); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.balance-series", account)
+			data, err := tr.Marshal(q)
+			if err != nil {
+				return err
+			}
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			v, err := unmarshalReply(rep, "balance-series")
+			if err != nil {
+				return err
+			}
+			series, _ := v.(*kmm.BalanceSeries)
+
+			b, err := json.MarshalIndent(series.Points, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+			return nil
+		},
+	}
+
+	ledger = &cli.Command{
+		Name:  "ledger",
+		Usage: "Subscribes to the account ledger.",
+		Flags: append([]cli.Flag{
+			&cli.IntFlag{
+				Name:  "limit",
+				Value: 0,
+				Usage: "Replay only the last N transactions before live ones. All are replayed by default.",
+			},
+			&cli.IntFlag{
+				Name:  "page-size",
+				Value: 0,
+				Usage: "Print at most N transactions of the history, then exit.",
+			},
+			&cli.Uint64Flag{
+				Name:  "start-seq",
+				Value: 0,
+				Usage: "Replay events from a sequence, e.g. the next page after --page-size.",
+			},
+			&cli.StringFlag{
+				Name:  "since",
+				Usage: "Replay only events since a time, RFC3339 or relative, e.g. 7d or 12h.",
+			},
+			&cli.StringFlag{
+				Name:  "until",
+				Usage: "Stop at the first event after a time, RFC3339 or relative, e.g. 1d.",
+			},
+			&cli.BoolFlag{
+				Name:  "ids",
+				Usage: "Prefix each transaction with its ID, e.g. to reverse it.",
+			},
+		}, currencyFlags...),
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			f, err := amountFormatter(c)
+			if err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			rt, _ := rita.New(nc, rita.TypeRegistry(tr))
+
+			q := ledgerQuery{
+				Last:          c.Int("limit"),
+				StartSequence: c.Uint64("start-seq"),
+			}
+			if q.Last < 0 {
+				return fmt.Errorf("limit must not be negative")
+			}
+			pageSize := c.Int("page-size")
+			if pageSize < 0 {
+				return fmt.Errorf("page size must not be negative")
+			}
+
+			now := time.Now()
+
+			var until time.Time
+			if s := c.String("since"); s != "" {
+				if q.Since, err = parseLedgerTime(s, now); err != nil {
+					return err
+				}
+			}
+			if s := c.String("until"); s != "" {
+				if until, err = parseLedgerTime(s, now); err != nil {
+					return err
+				}
+				// Nothing can be in an empty range.
+				if until.Before(q.Since) {
+					return nil
+				}
+			}
+
+			// Closed once an event after until is delivered, the history
+			// up to a past until is printed or the page is printed.
+			done := make(chan struct{})
+			var once sync.Once
+			stop := func() {
+				once.Do(func() { close(done) })
+			}
+
+			// Number of transactions printed, counted against the page size.
+			var printed int
+
+			sub, ok, err := subscribeLedger(nc, rt, account, q, func(e *ledgerEvent) {
+				if !until.IsZero() && e.Event.Time.After(until) {
+					stop()
+					return
+				}
+				if pageSize > 0 && printed == pageSize {
+					// The next page starts at the first event not printed.
+					fmt.Fprintf(os.Stderr, "more: --start-seq %d\n", e.Event.Sequence)
+					stop()
+					return
+				}
+				if _, ok := formatLedgerEvent(e.Event); ok {
+					printed++
+				}
+				if jsonOutput(c) {
+					if _, ok := formatLedgerEvent(e.Event); ok {
+						b, _ := json.Marshal(e)
+						fmt.Println(string(b))
+					}
+				} else if line, ok := formatLedgerLine(e.Event, e.Balance, f.Format); ok {
+					if _, ok := e.Event.Data.(*kmm.SpendReflection); c.Bool("ids") && !ok {
+						line = fmt.Sprintf("%s | %s", e.Event.ID, line)
+					}
+					fmt.Println(line)
+				}
+				if e.Last && (pageSize > 0 || !until.IsZero() && until.Before(now)) {
+					stop()
+				}
+			})
+			if err != nil {
+				return err
+			}
+			defer sub.Unsubscribe() //nolint
+
+			if !ok && (pageSize > 0 || !until.IsZero() && until.Before(now)) {
+				stop()
+			}
+
+			sigch := make(chan os.Signal, 1)
+			signal.Notify(sigch, os.Interrupt)
+
+			select {
+			case <-sigch:
+			case <-done:
+			}
+
+			return nil
+		},
+	}
+
+	carryover = &cli.Command{
+		Name:      "carryover",
+		Usage:     "Reports the unspent budget of past budget periods.",
+		Flags:     natsFlags,
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.carryover", account)
+			rep, err := request(nc, subject, []byte{})
+			if err != nil {
+				return err
+			}
+			v, err := unmarshalReply(rep, "carryover-report")
+			if err != nil {
+				return err
+			}
+			r, _ := v.(*kmm.CarryoverReport)
+
+			if len(r.Periods) == 0 && r.PriorPeriods.Periods == 0 {
+				fmt.Println("no past budget periods")
+				return nil
+			}
+
+			if r.PriorPeriods.Periods > 0 {
+				fmt.Printf("%d prior periods | spent %s of %s | unspent %s\n", r.PriorPeriods.Periods, r.PriorPeriods.FundsWithdrawn, r.PriorPeriods.MaxWithdrawAmount, r.PriorPeriods.Unspent)
+			}
+			for _, p := range r.Periods {
+				fmt.Printf("%s | spent %s of %s | unspent %s\n", p.PeriodStartTime.Format(time.ANSIC), p.FundsWithdrawn, p.MaxWithdrawAmount, p.Unspent)
+			}
+			fmt.Printf("total unspent: %s\n", r.TotalUnspent)
+			return nil
+		},
+	}
+
+	stats = &cli.Command{
+		Name:      "stats",
+		Usage:     "Prints statistics of the transactions of an account.",
+		Flags:     natsFlags,
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.stats", account)
+			rep, err := request(nc, subject, []byte{})
+			if err != nil {
+				return err
+			}
+			v, err := unmarshalReply(rep, "transaction-stats")
+			if err != nil {
+				return err
+			}
+			s, _ := v.(*kmm.TransactionStats)
+
+			if s.Count == 0 {
+				fmt.Println("no transactions")
+				return nil
+			}
+
+			fmt.Printf("transactions: %d\n", s.Count)
+			fmt.Printf("largest deposit: %s\n", s.LargestDeposit)
+			fmt.Printf("largest withdrawal: %s\n", s.LargestWithdrawal)
+			fmt.Printf("smallest transaction: %s\n", s.SmallestTransaction)
+			fmt.Printf("average transaction: %s\n", s.AverageAmount)
+			return nil
+		},
+	}
+
+	report = &cli.Command{
+		Name:  "report",
+		Usage: "Prints the spending of an account by category within the current period.",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "period",
+				Value: string(kmm.Monthly),
+				Usage: "Period to report the spending of.",
+			},
+		}, natsFlags...),
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			q := &kmm.GetSpendingReport{
+				Period: kmm.Period(c.String("period")),
+			}
+			if err := q.Validate(); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.spending-report", account)
+			data, err := tr.Marshal(q)
+			if err != nil {
+				return err
+			}
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			v, err := unmarshalReply(rep, "category-spending")
+			if err != nil {
+				return err
+			}
+			s, _ := v.(*kmm.CategorySpending)
+
+			if len(s.Categories) == 0 {
+				fmt.Printf("no spending since %s\n", s.PeriodStartTime.Format(time.ANSIC))
+				return nil
+			}
+
+			printSpendingReport(os.Stdout, s)
+			return nil
+		},
+	}
+
+	netflow = &cli.Command{
+		Name:  "netflow",
+		Usage: "Prints the total deposited, withdrawn and the net change of an account within the current period.",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "period",
+				Value: string(kmm.Monthly),
+				Usage: "Period to report the net flow of.",
+			},
+		}, natsFlags...),
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			q := &kmm.GetNetFlow{
+				Period: kmm.Period(c.String("period")),
+			}
+			if err := q.Validate(); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.net-flow", account)
+			data, err := tr.Marshal(q)
+			if err != nil {
+				return err
+			}
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			v, err := unmarshalReply(rep, "net-flow")
+			if err != nil {
+				return err
+			}
+			f, _ := v.(*kmm.NetFlow)
+
+			if jsonOutput(c) {
+				return printJSON(os.Stdout, f)
+			}
+			printNetFlow(os.Stdout, f)
+			return nil
+		},
+	}
+
+	tail = &cli.Command{
+		Name:  "tail",
+		Usage: "Subscribes to the ledgers of multiple accounts.",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "family",
+				Value: "",
+				Usage: "Include all accounts in the family.",
+			},
+		}, natsFlags...),
+		ArgsUsage: "[<account>...]",
+		Action: func(c *cli.Context) error {
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			accounts := c.Args().Slice()
+			if family := c.String("family"); family != "" {
+				members, err := queryFamilyMembers(nc, family)
+				if err != nil {
+					return err
+				}
+				accounts = append(accounts, members...)
+			}
+			if len(accounts) == 0 {
+				return fmt.Errorf("at least one account or a family is required")
+			}
+
+			rt, _ := rita.New(nc, rita.TypeRegistry(tr))
+
+			// Callbacks for each subscription are called concurrently.
+			var mu sync.Mutex
+
+			for _, account := range accounts {
+				account := account
+				sub, _, err := subscribeLedger(nc, rt, account, ledgerQuery{}, func(e *ledgerEvent) {
+					if line, ok := formatTailEvent(account, e.Event); ok {
+						mu.Lock()
+						fmt.Println(line)
+						mu.Unlock()
+					}
+				})
+				if err != nil {
+					return err
+				}
+				defer sub.Unsubscribe() //nolint
+			}
+
+			sigch := make(chan os.Signal, 1)
+			signal.Notify(sigch, os.Interrupt)
+			<-sigch
+
+			return nil
+		},
+	}
+
+	alerts = &cli.Command{
+		Name:      "alerts",
+		Usage:     "Subscribes to the alerts of an account.",
+		Flags:     natsFlags,
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			sub, err := nc.Subscribe(fmt.Sprintf("kmm.alerts.accounts.%s", account), func(msg *nats.Msg) {
+				v, err := tr.UnmarshalType(msg.Data, "alert")
+				if err != nil {
+					log.Print(err)
+					return
+				}
+				a, _ := v.(*kmm.Alert)
+				if jsonOutput(c) {
+					b, _ := json.Marshal(a)
+					fmt.Println(string(b))
+				} else {
+					fmt.Println(formatAlert(a))
+				}
+			})
+			if err != nil {
+				return err
+			}
+			defer sub.Unsubscribe() //nolint
+
+			sigch := make(chan os.Signal, 1)
+			signal.Notify(sigch, os.Interrupt)
+			<-sigch
+
+			return nil
+		},
+	}
+
+	lastBudgetPeriod = &cli.Command{
+		Name:  "last-budget-period",
+		Usage: "Gets the summary for the last active budget period.",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "category",
+				Value: "",
+				Usage: "Get the period of the budget of the category rather than the account.",
+			},
+		}, currencyFlags...),
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+			category := c.String("category")
+
+			f, err := amountFormatter(c)
+			if err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			var s *kmm.BudgetPeriod
+
+			if category == "" {
+				subject := fmt.Sprintf("kmm.services.%s.last-budget-period", account)
+				rep, err := request(nc, subject, []byte{})
+				if err != nil {
+					return err
+				}
+				v, err := unmarshalReply(rep, "budget-period")
+				if err != nil {
+					return err
+				}
+				s, _ = v.(*kmm.BudgetPeriod)
+			} else {
+				subject := fmt.Sprintf("kmm.services.%s.category-periods", account)
+				rep, err := request(nc, subject, []byte{})
+				if err != nil {
+					return err
+				}
+				v, err := unmarshalReply(rep, "category-periods")
+				if err != nil {
+					return err
+				}
+				s = v.(*kmm.CategoryPeriods).Categories[category]
+			}
+
+			if s != nil && s.PolicyMaxWithdrawAmount.IsZero() {
+				s = nil
+			}
+			if jsonOutput(c) {
+				return printJSON(os.Stdout, s)
+			}
+			if s == nil {
+				fmt.Println("no budget set")
+				return nil
+			}
+
+			fmt.Printf(`period start: %s
+period end: %s
+withdrawals: %d
+total withdrawn: %s
+`, s.PeriodStartTime.Format(time.ANSIC), s.NextPeriodStartTime.Format(time.ANSIC), s.WithdrawalsInPeriod, f.Format(s.FundsWithdrawnInPeriod))
+			return nil
+		},
+	}
+
+	budgetState = &cli.Command{
+		Name:      "budget",
+		Usage:     "Gets the state of the budget in the current period.",
+		Flags:     natsFlags,
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.budget-state", account)
+			rep, err := request(nc, subject, []byte{})
+			if err != nil {
+				return err
+			}
+			v, err := unmarshalReply(rep, "budget-state")
+			if err != nil {
+				return err
+			}
+			s, _ := v.(*kmm.BudgetState)
+
+			if s.Period == "" {
+				fmt.Println("no budget set")
+				return nil
+			}
+
+			fmt.Printf(`period: %s
+max amount: %s
+withdrawn: %s
+remaining: %s
+resets: %s
+`, s.Period, s.MaxWithdrawAmount, s.FundsWithdrawn, s.Remaining, s.NextPeriodStartTime.Format(time.ANSIC))
+			if s.RolledOverAmount.GreaterThan(decimal.Zero) {
+				fmt.Printf("rolled over: %s\n", s.RolledOverAmount)
+			}
+			return nil
+		},
+	}
+
+	settingsCmd = &cli.Command{
+		Name:      "settings",
+		Usage:     "Prints the settings of an account.",
+		Flags:     natsFlags,
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.settings", account)
+			rep, err := request(nc, subject, []byte{})
+			if err != nil {
+				return err
+			}
+			v, err := unmarshalReply(rep, "account-settings")
+			if err != nil {
+				return err
+			}
+
+			b, err := json.MarshalIndent(v, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+			return nil
+		},
+	}
+
+	explain = &cli.Command{
+		Name:  "explain",
+		Usage: "Explains whether a command would be accepted without applying it.",
+		Subcommands: []*cli.Command{
+			explainWithdraw,
+		},
+	}
+
+	explainWithdraw = &cli.Command{
+		Name:      "withdraw",
+		Usage:     "Explains whether a withdrawal would be accepted and why.",
+		Flags:     natsFlags,
+		ArgsUsage: "<account> <amount>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 2 {
+				return fmt.Errorf("account and amount are required")
+			}
+
+			account := c.Args().Get(0)
+			amount, err := money.Parse(c.Args().Get(1))
+			if err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.explain-withdraw", account)
+			data, _ := json.Marshal(map[string]string{
+				"Amount": amount.String(),
+			})
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			v, err := unmarshalReply(rep, "withdrawal-explanation")
+			if err != nil {
+				return err
+			}
+			e, _ := v.(*kmm.WithdrawalExplanation)
+
+			printWithdrawalExplanation(os.Stdout, e)
+			return nil
+		},
+	}
+
+	admin = &cli.Command{
+		Name:  "admin",
+		Usage: "Administrative operations on accounts.",
+		Subcommands: []*cli.Command{
+			adminMerge,
+		},
+	}
+
+	adminMerge = &cli.Command{
+		Name:  "merge",
+		Usage: "Merge the transactions of the source account into the target and archive the source.",
+		Flags: append([]cli.Flag{
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Value: false,
+				Usage: "Report the changes without making them.",
+			},
+		}, commandFlags...),
+		ArgsUsage: "<source> <target>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 2 {
+				return fmt.Errorf("source and target accounts are required")
+			}
+
+			source := c.Args().Get(0)
+			target := c.Args().Get(1)
+			if source == target {
+				return kmm.ErrMergeSameAccount
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.merge", source)
+			data, _ := json.Marshal(&mergeRequest{
+				Account: target,
+				DryRun:  c.Bool("dry-run"),
+			})
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+
+			if c.Bool("dry-run") {
+				v, err := unmarshalReply(rep, "merge-plan")
+				if err != nil {
+					return err
+				}
+				p, _ := v.(*kmm.MergePlan)
+				fmt.Printf(`archive %s after sequence %d, balance %s
+append %d transactions to %s after sequence %d
+%s balance: %s -> %s
+`, p.Source, p.SourceSequence, p.SourceBalance, p.Transactions, p.Target, p.TargetSequence, p.Target, p.TargetBalance, p.ResultingBalance)
+				return nil
+			}
+
+			confirm := fmt.Sprintf("ok: merged %s into %s", source, target)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	familyCmd = &cli.Command{
+		Name:  "family",
+		Usage: "Manage the accounts in a family.",
+		Subcommands: []*cli.Command{
+			familyAdd,
+			familyRemove,
+			familyMembers,
+			familySetBudget,
+		},
+	}
+
+	familySetBudget = &cli.Command{
+		Name:      "set-budget",
+		Usage:     "Set the same budget on every account in a family.",
+		Flags:     natsFlags,
+		ArgsUsage: "<family> <amount> <period>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 3 {
+				return fmt.Errorf("family, amount, and period are required")
+			}
+
+			family := c.Args().Get(0)
+			amount, err := money.Parse(c.Args().Get(1))
+			if err != nil {
+				return err
+			}
+			period := c.Args().Get(2)
+
+			if err := kmm.Period(period).Validate(); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			members, err := queryFamilyMembers(nc, family)
+			if err != nil {
+				return err
+			}
+
+			return applyMembers(members, os.Stdout, func(account string) error {
+				subject := fmt.Sprintf("kmm.services.%s.set-budget", account)
+				return requestCommand(nc, subject, map[string]string{
+					"MaxAmount": amount.String(),
+					"Period":    period,
+				})
+			})
+		},
+	}
+
+	familyAdd = &cli.Command{
+		Name:  "add",
+		Usage: "Add an account to a family.",
+		Flags: append([]cli.Flag{
+			&cli.BoolFlag{
+				Name:  "move",
+				Value: false,
+				Usage: "Move the account if it is a member of another family.",
+			},
+		}, commandFlags...),
+		ArgsUsage: "<family> <account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 2 {
+				return fmt.Errorf("family and account are required")
+			}
+
+			family := c.Args().Get(0)
+			account := c.Args().Get(1)
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.families.%s.add-family-member", family)
+			data, _ := json.Marshal(map[string]any{
+				"Account": account,
+				"Move":    c.Bool("move"),
+			})
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: added %s to %s", account, family)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	familyRemove = &cli.Command{
+		Name:      "remove",
+		Usage:     "Remove an account from a family.",
+		Flags:     commandFlags,
+		ArgsUsage: "<family> <account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 2 {
+				return fmt.Errorf("family and account are required")
+			}
+
+			family := c.Args().Get(0)
+			account := c.Args().Get(1)
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.families.%s.remove-family-member", family)
+			data, _ := json.Marshal(map[string]string{
+				"Account": account,
+			})
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: removed %s from %s", account, family)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	familyMembers = &cli.Command{
+		Name:      "members",
+		Usage:     "Lists the accounts in a family.",
+		Flags:     natsFlags,
+		ArgsUsage: "<family>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("family required")
+			}
+
+			family := c.Args().Get(0)
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			members, err := queryFamilyMembers(nc, family)
+			if err != nil {
+				return err
+			}
+			for _, m := range members {
+				fmt.Println(m)
+			}
+			return nil
+		},
+	}
+
+	search = &cli.Command{
+		Name:  "search",
+		Usage: "Searches withdrawals across accounts by description.",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "family",
+				Value: "",
+				Usage: "Only search the accounts in the family.",
+			},
+			&cli.IntFlag{
+				Name:  "offset",
+				Value: 0,
+				Usage: "Number of matches to skip.",
+			},
+			&cli.IntFlag{
+				Name:  "limit",
+				Value: kmm.DefaultSearchLimit,
+				Usage: "Max number of matches to return.",
+			},
+		}, natsFlags...),
+		ArgsUsage: "<text>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("search text required")
+			}
+
+			q := &kmm.SearchTransactions{
+				Text:   c.Args().Get(0),
+				Offset: c.Int("offset"),
+				Limit:  c.Int("limit"),
+			}
+			if err := q.Validate(); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := "kmm.search"
+			if family := c.String("family"); family != "" {
+				subject = fmt.Sprintf("kmm.families.%s.search", family)
+			}
+
+			data, err := tr.Marshal(q)
+			if err != nil {
+				return err
+			}
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			v, err := unmarshalReply(rep, "transaction-search")
+			if err != nil {
+				return err
+			}
+			s, _ := v.(*kmm.TransactionSearch)
+
+			for _, m := range s.Matches {
+				fmt.Printf("%s | -%s | %s | %s\n", m.Account, m.Amount, m.Time.Format(time.ANSIC), m.Description)
+			}
+			fmt.Printf("%d matches, total %s\n", s.Count, s.Total)
+			if s.Truncated {
+				fmt.Println("search truncated, not all transactions were scanned")
+			}
+			return nil
+		},
+	}
+
+	goalCmd = &cli.Command{
+		Name:  "goal",
+		Usage: "Manage the savings goals of an account.",
+		Subcommands: []*cli.Command{
+			goalCreate,
+		},
+	}
+
+	goalCreate = &cli.Command{
+		Name:      "create",
+		Usage:     "Create a savings goal deposits can contribute to.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account> <name> <target>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 3 {
+				return fmt.Errorf("account, name, and target are required")
+			}
+
+			account := c.Args().Get(0)
+			target, err := money.Parse(c.Args().Get(2))
+			if err != nil {
+				return err
+			}
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			cmd := &kmm.CreateSavingsGoal{
+				Name:         c.Args().Get(1),
+				TargetAmount: target,
+			}
+			if err := cmd.Validate(); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.create-savings-goal", account)
+			data, _ := json.Marshal(cmd)
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: created goal %s of %s on %s", cmd.Name, money.Format(target, ""), account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	goals = &cli.Command{
+		Name:      "goals",
+		Usage:     "Lists the progress of the savings goals of an account.",
+		Flags:     natsFlags,
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.goals", account)
+			rep, err := request(nc, subject, []byte{})
+			if err != nil {
+				return err
+			}
+			v, err := unmarshalReply(rep, "savings-goal-progress")
+			if err != nil {
+				return err
+			}
+			p, _ := v.(*kmm.SavingsGoalProgress)
+
+			if jsonOutput(c) {
+				return printJSON(os.Stdout, p.Goals)
+			}
+			if len(p.Goals) == 0 {
+				fmt.Println("no goals")
+				return nil
+			}
+			for _, g := range p.Goals {
+				line := fmt.Sprintf("%s | %s of %s | %s%%", g.Name, g.Contributed, g.TargetAmount, g.Percent())
+				if g.Reached {
+					line += " | reached"
+				}
+				fmt.Println(line)
+			}
+			return nil
+		},
+	}
+
+	rebuild = &cli.Command{
+		Name:  "rebuild",
+		Usage: fmt.Sprintf("Rebuilds a projection of an account from its first event and prints it as JSON. Projections: %s.", strings.Join(kmm.ProjectionNames(), ", ")),
+		Flags: append([]cli.Flag{
+			&cli.BoolFlag{
+				Name:  "store",
+				Value: false,
+				Usage: "Store the rebuilt projection in the projections bucket.",
+			},
+		}, natsFlags...),
+		ArgsUsage: "<account> <projection>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 2 {
+				return fmt.Errorf("account and projection are required")
+			}
+
+			account := c.Args().Get(0)
+			projection := c.Args().Get(1)
+
+			// Fail early rather than on the server.
+			if _, err := kmm.NewProjection(projection); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.rebuild", account)
+			data, _ := json.Marshal(&rebuildRequest{
+				Projection: projection,
+				Store:      c.Bool("store"),
+			})
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			v, err := unmarshalReply(rep, projection)
+			if err != nil {
+				return err
+			}
+			return printJSON(os.Stdout, v)
+		},
+	}
+
+	audit = &cli.Command{
+		Name:      "audit",
+		Usage:     "Lists the commands attempted against an account, including rejected ones.",
+		Flags:     natsFlags,
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.audit", account)
+			rep, err := request(nc, subject, []byte{})
+			if err != nil {
+				return err
+			}
+			if err := replyError(rep); err != nil {
+				return err
+			}
+
+			var records []*auditRecord
+			if err := json.Unmarshal(rep.Data, &records); err != nil {
+				return errors.New(string(rep.Data))
+			}
+
+			if jsonOutput(c) {
+				return printJSON(os.Stdout, records)
+			}
+			if len(records) == 0 {
+				fmt.Println("no commands")
+				return nil
+			}
+			for _, r := range records {
+				fmt.Println(formatAuditRecord(r))
+			}
+			return nil
+		},
+	}
+
+	accountsCmd = &cli.Command{
+		Name:  "accounts",
+		Usage: "Lists all accounts and their balances.",
+		Flags: natsFlags,
+		Action: func(c *cli.Context) error {
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			rep, err := request(nc, "kmm.accounts", []byte{})
+			if err != nil {
+				return err
+			}
+			v, err := unmarshalReply(rep, "account-list")
+			if err != nil {
+				return err
+			}
+			l, _ := v.(*kmm.AccountList)
+
+			if jsonOutput(c) {
+				return printJSON(os.Stdout, l.Accounts)
+			}
+			for _, a := range l.Accounts {
+				fmt.Printf("%s | %s\n", a.Account, a.Balance)
+			}
+			return nil
+		},
+	}
+
+	interest = &cli.Command{
+		Name:  "interest",
+		Usage: "Projects the balance of an account given an annual interest rate.",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "period",
+				Value: string(kmm.Monthly),
+				Usage: "Period interest is compounded.",
+			},
+			&cli.IntFlag{
+				Name:  "periods",
+				Value: 12,
+				Usage: "Number of periods to project.",
+			},
+		}, natsFlags...),
+		ArgsUsage: "<account> <rate>",
+		Description: `The rate is an annual percentage, e.g. 5% or 0.05. Values without
+a percent sign that are less than one are fractions, otherwise they are
+treated as a percentage, so 5 is 5%.`,
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 2 {
+				return fmt.Errorf("account and rate are required")
+			}
+
+			account := c.Args().Get(0)
+			rate, err := money.ParsePercent(c.Args().Get(1))
+			if err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.interest-projection", account)
+			data, _ := json.Marshal(map[string]any{
+				"Rate":    rate.String(),
+				"Period":  c.String("period"),
+				"Periods": c.Int("periods"),
+			})
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			v, err := unmarshalReply(rep, "interest-projection")
+			if err != nil {
+				return err
+			}
+			p, _ := v.(*kmm.InterestProjection)
+
+			fmt.Printf("balance: %s\n", p.Balance)
+			for _, x := range p.Points {
+				fmt.Printf("%s | +%s | %s\n", x.Time.Format(time.ANSIC), x.Interest, x.Balance)
+			}
+			return nil
+		},
+	}
+
+	setInterest = &cli.Command{
+		Name:      "set-interest",
+		Usage:     "Accrue interest on the balance at an annual rate, compounded each period. A rate of zero stops accruing interest.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account> <rate> <period>",
+		Description: `The rate is an annual percentage, e.g. 5% or 0.05. Values without
+a percent sign that are less than one are fractions, otherwise they are
+treated as a percentage, so 5 is 5%.`,
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 3 {
+				return fmt.Errorf("account, rate, and period are required")
+			}
+
+			account := c.Args().Get(0)
+			rate, err := money.ParsePercent(c.Args().Get(1))
+			if err != nil {
+				return err
+			}
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			cmd := &kmm.SetInterestRate{
+				Rate:   rate,
+				Period: kmm.Period(c.Args().Get(2)),
+			}
+			if err := cmd.Validate(); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.set-interest-rate", account)
+			data, _ := json.Marshal(cmd)
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: set interest of %s%% accrued %s on %s", rate.Mul(decimal.NewFromInt(100)), cmd.Period, account)
+			if rate.IsZero() {
+				confirm = fmt.Sprintf("ok: stopped interest on %s", account)
+			}
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	backup = &cli.Command{
+		Name:      "backup",
+		Usage:     "Writes all events of an account to stdout.",
+		Flags:     natsFlags,
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.events", account)
+			rep, err := request(nc, subject, []byte{})
+			if err != nil {
+				return err
+			}
+
+			// Ensure the reply is a backup and not an error.
+			if err := replyError(rep); err != nil {
+				return err
+			}
+			if _, err := decodeBackup(rep.Data); err != nil {
+				return errors.New(string(rep.Data))
+			}
+
+			fmt.Println(string(rep.Data))
+			return nil
+		},
+	}
+
+	replay = &cli.Command{
+		Name:  "replay",
+		Usage: "Replays the events of all accounts.",
+		Flags: append([]cli.Flag{
+			&cli.BoolFlag{
+				Name:  "validate",
+				Value: false,
+				Usage: "Verify the account aggregate and projections agree for each account.",
+			},
+		}, natsFlags...),
+		ArgsUsage: "[<account>...]",
+		Action: func(c *cli.Context) error {
+			if !c.Bool("validate") {
+				return fmt.Errorf("--validate is required")
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			accounts := c.Args().Slice()
+			if len(accounts) == 0 {
+				accounts, err = listAccounts(c.Context, nc)
+				if err != nil {
+					return err
+				}
+			}
+
+			rt, _ := rita.New(nc, rita.TypeRegistry(tr))
+			es := rt.EventStore("kmm")
+
+			// One account at a time to bound memory.
+			var r kmm.ReplayReport
+			for _, account := range accounts {
+				events, _, err := es.Load(c.Context, fmt.Sprintf("kmm.events.accounts.%s", account))
+				if err != nil {
+					return fmt.Errorf("%s: %w", account, err)
+				}
+				r.Add(kmm.VerifyAccount(account, events))
+			}
+
+			for _, v := range r.Failed {
+				for _, d := range v.Divergences {
+					fmt.Printf("%s: seq %d: %s\n", v.Account, d.Sequence, d.Reason)
+				}
+			}
+
+			fmt.Printf("%d accounts, %d events, %d diverged\n", r.Accounts, r.Events, len(r.Failed))
+			if len(r.Failed) > 0 {
+				return fmt.Errorf("%d account(s) diverged", len(r.Failed))
+			}
+			return nil
+		},
+	}
+
+	restore = &cli.Command{
+		Name:  "restore",
+		Usage: "Restores the events of an account from a backup read from stdin.",
+		Flags: append([]cli.Flag{
+			&cli.BoolFlag{
+				Name:  "force",
+				Value: false,
+				Usage: "Replace the events of the account if it already has events.",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Value: false,
+				Usage: "Report the changes without making them.",
+			},
+		}, commandFlags...),
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			b, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+
+			// Validate the backup prior to sending.
+			events, err := decodeBackup(b)
+			if err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.restore", account)
+			data, _ := json.Marshal(&restoreRequest{
+				Force:  c.Bool("force"),
+				DryRun: c.Bool("dry-run"),
+				Events: b,
+			})
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+
+			if c.Bool("dry-run") {
+				if err := replyError(rep); err != nil {
+					return err
+				}
+				var p restorePlan
+				if err := json.Unmarshal(rep.Data, &p); err != nil {
+					return errors.New(string(rep.Data))
+				}
+				if p.Replaced > 0 {
+					fmt.Printf("replace %d events of %s up to sequence %d with %d events, balance of restored events %s\n", p.Replaced, account, p.Sequence, p.Events, p.Balance)
+				} else {
+					fmt.Printf("append %d events to %s, balance of restored events %s\n", p.Events, account, p.Balance)
+				}
+				return nil
+			}
+			confirm := fmt.Sprintf("ok: restored %d events to %s", len(events), account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	setNote = &cli.Command{
+		Name:      "set-note",
+		Usage:     "Set a note on an account. An empty note clears it.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account> <note>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 2 {
+				return fmt.Errorf("account and note are required")
+			}
+
+			account := c.Args().Get(0)
+			note := c.Args().Get(1)
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.set-account-note", account)
+			data, _ := json.Marshal(map[string]string{
+				"Note": note,
+			})
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: set note on %s", account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	setPinCmd = &cli.Command{
+		Name:      "set-pin",
+		Usage:     "Sets or changes the local PIN required to change an account from this computer.",
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+			path := c.String("config")
+
+			in, done, err := openPinInput()
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			return updatePins(path, func(cfg *config) error {
+				return setPin(cfg, account, in, os.Stderr)
+			})
+		},
+	}
+
+	removePinCmd = &cli.Command{
+		Name:      "remove-pin",
+		Usage:     "Removes the local PIN of an account.",
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+			path := c.String("config")
+
+			in, done, err := openPinInput()
+			if err != nil {
+				return err
+			}
+			defer done()
+
+			return updatePins(path, func(cfg *config) error {
+				return removePin(cfg, account, in, os.Stderr)
+			})
+		},
+	}
+
+	setReflection = &cli.Command{
+		Name:      "set-reflection",
+		Usage:     "Enable or disable spend reflections after each withdrawal.",
+		Flags:     commandFlags,
+		ArgsUsage: "<account> <on|off>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 2 {
+				return fmt.Errorf("account and on or off are required")
+			}
+
+			account := c.Args().Get(0)
+
+			if err := requirePin(c, account); err != nil {
+				return err
+			}
+
+			var enabled bool
+			switch c.Args().Get(1) {
+			case "on":
+				enabled = true
+			case "off":
+			default:
+				return fmt.Errorf("expected on or off")
+			}
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.set-spend-reflection", account)
+			data, _ := json.Marshal(map[string]bool{
+				"Enabled": enabled,
+			})
+
+			rep, err := request(nc, subject, data)
+			if err != nil {
+				return err
+			}
+			confirm := fmt.Sprintf("ok: turned %s spend reflections on %s", c.Args().Get(1), account)
+			printReply(os.Stdout, rep, c.Bool("quiet"), confirm)
+			return nil
+		},
+	}
+
+	info = &cli.Command{
+		Name:      "info",
+		Usage:     "Gets the note and balance of an account.",
+		Flags:     natsFlags,
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.info", account)
+			rep, err := request(nc, subject, []byte{})
+			if err != nil {
+				return err
+			}
+			v, err := unmarshalReply(rep, "account-info")
+			if err != nil {
+				return err
+			}
+			i, _ := v.(*kmm.AccountInfo)
+
+			fmt.Printf(`account: %s
+owner: %s
+note: %s
+balance: %s
+`, account, i.Owner, i.Note, i.Balance)
+			return nil
+		},
+	}
+
+	nextPeriod = &cli.Command{
+		Name:      "next-period",
+		Usage:     "Shows when the current period started and when the next one starts.",
+		ArgsUsage: "<period>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("period required")
+			}
+
+			p := kmm.Period(c.Args().Get(0))
+			if err := p.Validate(); err != nil {
+				return err
+			}
+
+			printPeriodWindow(os.Stdout, p, time.Now())
+			return nil
+		},
+	}
+
+	periods = &cli.Command{
+		Name:  "periods",
+		Usage: "Lists the supported periods and their boundaries at the current time.",
+		Action: func(c *cli.Context) error {
+			printPeriods(os.Stdout, time.Now())
+			return nil
+		},
+	}
+
+	descriptions = &cli.Command{
+		Name:      "descriptions",
+		Usage:     "Lists the recently used descriptions for an account.",
+		Flags:     natsFlags,
+		ArgsUsage: "<account>",
+		Action: func(c *cli.Context) error {
+			n := c.NArg()
+			if n != 1 {
+				return fmt.Errorf("account required")
+			}
+
+			account := c.Args().Get(0)
+
+			nc, err := connectNats(c)
+			if err != nil {
+				return err
+			}
+			defer nc.Drain() //nolint
+
+			subject := fmt.Sprintf("kmm.services.%s.descriptions", account)
+			rep, err := request(nc, subject, []byte{})
+			if err != nil {
+				return err
+			}
+			v, err := unmarshalReply(rep, "recent-descriptions")
+			if err != nil {
+				return err
+			}
+			d, _ := v.(*kmm.RecentDescriptions)
+			for _, desc := range d.Descriptions {
+				fmt.Println(desc)
+			}
+			return nil
+		},
+	}
+)
+
+// natsOptions are the settings used to connect to NATS.
+type natsOptions struct {
+	URL         string `json:"nats_url"`
+	Creds       string `json:"nats_creds"`
+	Context     string `json:"nats_context"`
+	InboxPrefix string `json:"nats_inbox_prefix"`
+
+	// Whether the context was explicitly set rather than auto-selected.
+	contextSet bool
+}
+
+// config is the contents of the config file. Each profile is a named set
+// of connection settings, e.g. for dev and prod deployments. Pins are the
+// hashed local PINs by account.
+type config struct {
+	Profiles map[string]*natsOptions `json:"profiles,omitempty"`
+	Pins     map[string]string       `json:"pins,omitempty"`
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "kmm", "config.json")
+}
+
+// readConfig reads the config file.
+func readConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	var cfg config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// writeConfig writes the config file, creating the directory if needed. The
+// file is only readable by the user since it contains the PIN hashes.
+func writeConfig(path string, cfg *config) error {
+	b, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
+
+// updatePins reads the config, or starts with an empty one if it does not
+// exist, applies fn, and writes it back.
+func updatePins(path string, fn func(cfg *config) error) error {
+	cfg, err := readConfig(path)
+	if errors.Is(err, os.ErrNotExist) {
+		cfg, err = &config{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := fn(cfg); err != nil {
+		return err
+	}
+	return writeConfig(path, cfg)
+}
+
+// loadProfile reads the config file and returns the named profile.
+func loadProfile(path, name string) (*natsOptions, error) {
+	cfg, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %q not found in %s", name, path)
+	}
+	return p, nil
+}
+
+var errWrongPin = errors.New("wrong PIN")
+
+// hashPin returns the bcrypt hash of the PIN, which includes its salt.
+func hashPin(pin string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost)
+	return string(b), err
+}
+
+// pinMatches returns true if the PIN matches the hash.
+func pinMatches(hash, pin string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pin)) == nil
+}
+
+// openPinInput opens the terminal to prompt for a PIN on rather than
+// stdin, which may be the input of the command, e.g. of deposit --stdin.
+// No terminal is opened if the PIN is set in KMM_PIN. The function closes
+// the terminal.
+func openPinInput() (*bufio.Reader, func(), error) {
+	if os.Getenv("KMM_PIN") != "" {
+		return bufio.NewReader(strings.NewReader("")), func() {}, nil
+	}
+
+	name := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		name = "CONIN$"
+	}
+	tty, err := os.Open(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no terminal to read the PIN from, set KMM_PIN instead: %w", err)
+	}
+	return bufio.NewReader(tty), func() { tty.Close() }, nil
+}
+
+// readPin returns the PIN from the KMM_PIN environment variable, otherwise
+// it prompts for it. The PIN is echoed while typed.
+func readPin(in *bufio.Reader, out io.Writer, prompt string) (string, error) {
+	if pin := os.Getenv("KMM_PIN"); pin != "" {
+		return pin, nil
+	}
+
+	fmt.Fprint(out, prompt)
+	line, err := in.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", fmt.Errorf("read PIN: %w", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// checkPin checks the PIN of the account if one is set in the config.
+func checkPin(cfg *config, account string, in *bufio.Reader, out io.Writer) error {
+	hash, ok := cfg.Pins[account]
+	if !ok {
+		return nil
+	}
+
+	pin, err := readPin(in, out, fmt.Sprintf("PIN for %s: ", account))
+	if err != nil {
+		return err
+	}
+	if !pinMatches(hash, pin) {
+		return errWrongPin
+	}
+	return nil
+}
+
+// requirePin checks the local PIN of the account before a command changing
+// it is sent, unless --no-pin is set. This only guards the CLI on a shared
+// computer and is not enforced by the server.
+func requirePin(c *cli.Context, account string) error {
+	if c.Bool("no-pin") {
+		return nil
+	}
+
+	cfg, err := readConfig(c.String("config"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := cfg.Pins[account]; !ok {
+		return nil
+	}
+
+	in, done, err := openPinInput()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return checkPin(cfg, account, in, os.Stderr)
+}
+
+// setPin sets the PIN of the account after checking the current one, if
+// any. The new PIN is entered twice unless read from KMM_PIN.
+func setPin(cfg *config, account string, in *bufio.Reader, out io.Writer) error {
+	if err := checkPin(cfg, account, in, out); err != nil {
+		return err
+	}
+
+	pin, err := readPin(in, out, "new PIN: ")
+	if err != nil {
+		return err
+	}
+	if len(pin) < 4 || len(pin) > 12 || strings.Trim(pin, "0123456789") != "" {
+		return fmt.Errorf("PIN must be 4 to 12 digits")
+	}
+	if os.Getenv("KMM_PIN") == "" {
+		again, err := readPin(in, out, "repeat new PIN: ")
+		if err != nil {
+			return err
+		}
+		if again != pin {
+			return fmt.Errorf("PINs do not match")
+		}
+	}
+
+	hash, err := hashPin(pin)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Pins == nil {
+		cfg.Pins = make(map[string]string)
+	}
+	cfg.Pins[account] = hash
+	return nil
+}
+
+// removePin removes the PIN of the account after checking it.
+func removePin(cfg *config, account string, in *bufio.Reader, out io.Writer) error {
+	if _, ok := cfg.Pins[account]; !ok {
+		return fmt.Errorf("no PIN is set for %s", account)
+	}
+	if err := checkPin(cfg, account, in, out); err != nil {
+		return err
+	}
+	delete(cfg.Pins, account)
+	return nil
+}
+
+// resolveNatsOptions returns the connection settings from the flags. If a
+// profile is selected, its settings are used for any flag not explicitly
+// set.
+func resolveNatsOptions(c *cli.Context) (*natsOptions, error) {
+	o := &natsOptions{
+		URL:         c.String("nats.url"),
+		Creds:       c.String("nats.creds"),
+		Context:     c.String("nats.context"),
+		InboxPrefix: c.String("nats.inbox-prefix"),
+		contextSet:  c.IsSet("nats.context"),
+	}
+
+	name := c.String("profile")
+	if name == "" {
+		return o, nil
+	}
+
+	p, err := loadProfile(c.String("config"), name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.IsSet("nats.url") {
+		o.URL = p.URL
+	}
+	if !c.IsSet("nats.creds") {
+		o.Creds = p.Creds
+	}
+	if !c.IsSet("nats.context") {
+		o.Context = p.Context
+		o.contextSet = p.Context != ""
+	}
+	if !c.IsSet("nats.inbox-prefix") {
+		o.InboxPrefix = p.InboxPrefix
+	}
+	return o, nil
+}
+
+// selectContext returns the NATS context to connect with, or an empty string
+// to connect with the URL. An explicitly set context must exist. The
+// auto-selected context is only used if it exists and no URL is set.
+func selectContext(o *natsOptions, isKnown func(string) bool, known func() []string) (string, error) {
+	if o.Context == "" {
+		return "", nil
+	}
+
+	if o.contextSet {
+		if !isKnown(o.Context) {
+			names := known()
+			if len(names) == 0 {
+				return "", fmt.Errorf("unknown NATS context %q, no contexts are available", o.Context)
+			}
+			return "", fmt.Errorf("unknown NATS context %q, available: %s", o.Context, strings.Join(names, ", "))
+		}
+		return o.Context, nil
+	}
+
+	if o.URL != "" || !isKnown(o.Context) {
+		return "", nil
+	}
+	return o.Context, nil
+}
+
+func connectNats(c *cli.Context) (*nats.Conn, error) {
+	o, err := resolveNatsOptions(c)
+	if err != nil {
+		return nil, err
+	}
+
+	natsContext, err := selectContext(o, natscontext.IsKnown, natscontext.KnownContexts)
+	if err != nil {
+		return nil, err
+	}
+
+	natsUrl := o.URL
+	natsCreds := o.Creds
+	natsInboxPrefix := o.InboxPrefix
+
+	// Setup NATS connection depending on the values available.
+	if natsCreds == "" && os.Getenv("NATS_CREDS_B64") != "" {
+		// Hack to get the get the creds file content as a Fly.io secret..
+		natsCreds, err = decodeUserCredsToFile(os.Getenv("NATS_CREDS_B64"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var copts []nats.Option
+	if natsCreds != "" {
+		copts = append(copts, nats.UserCredentials(natsCreds))
+
+		// Credentials without a user JWT, e.g. of a plain nkey, cannot
+		// sign requests.
+		if s, err := newRequestSigner(natsCreds); err == nil {
+			signer = s
+		}
+	}
+	if natsInboxPrefix != "" {
+		copts = append(copts, nats.CustomInboxPrefix(natsInboxPrefix))
+	}
+
+	if natsContext != "" {
+		return natscontext.Connect(natsContext, copts...)
+	}
+
+	return nats.Connect(natsUrl, copts...)
+}
+
+// printReply prints the reply to a command request. Commands that succeed
+// reply with no data, so the confirmation is printed unless quiet is set.
+// printSpendingReport prints the spending by category as a table, largest
+// total first.
+func printSpendingReport(w io.Writer, s *kmm.CategorySpending) {
+	categories := make([]string, 0, len(s.Categories))
+	for c := range s.Categories {
+		categories = append(categories, c)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		a, b := s.Categories[categories[i]], s.Categories[categories[j]]
+		if !a.Total.Equal(b.Total) {
+			return a.Total.GreaterThan(b.Total)
+		}
+		return categories[i] < categories[j]
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "CATEGORY\tTOTAL\tCOUNT\n")
+	for _, c := range categories {
+		t := s.Categories[c]
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", c, t.Total.StringFixed(money.Places), t.Count)
+	}
+	tw.Flush()
+}
+
+// alertBucketName is the KV bucket recording the alerts published, so each
+// alert is published once by one of the servers.
+const alertBucketName = "kmm-alerts"
+
+// alertBucket returns the alert bucket, creating it if needed. The alerts
+// are recorded for an hour, well beyond how long servers lag behind each
+// other.
+func alertBucket(js nats.JetStreamContext) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(alertBucketName)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		return js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  alertBucketName,
+			History: 1,
+			TTL:     time.Hour,
+		})
+	}
+	return kv, err
+}
+
+// maxAlertAccounts is the max number of accounts whose state is kept to
+// raise alerts. The state of others is loaded from the events as needed.
+const maxAlertAccounts = 1024
+
+// alertState is the state of an account as evolved by alerts.
+type alertState struct {
+	account string
+	a       *kmm.Account
+}
+
+// alertStates is the state of the most recently used accounts.
+type alertStates struct {
+	limit int
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newAlertStates(limit int) *alertStates {
+	return &alertStates{
+		limit: limit,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the state of the account, or nil if not kept.
+func (s *alertStates) get(account string) *kmm.Account {
+	e, ok := s.items[account]
+	if !ok {
+		return nil
+	}
+	s.order.MoveToFront(e)
+	return e.Value.(*alertState).a
+}
+
+// put keeps the state of the account, dropping the least recently used
+// state if there are too many.
+func (s *alertStates) put(account string, a *kmm.Account) {
+	s.items[account] = s.order.PushFront(&alertState{account: account, a: a})
+	if s.order.Len() > s.limit {
+		e := s.order.Back()
+		s.order.Remove(e)
+		delete(s.items, e.Value.(*alertState).account)
+	}
+}
+
+// subscribeAlerts calls the function with the alerts raised by the
+// withdrawals appended after subscribing. The state of an account is loaded
+// from the events before the first of its events delivered and kept for
+// the most recently used accounts. If kv is set, an alert is only passed to
+// the function if it is not yet recorded in kv, so of the servers
+// subscribed, only one passes each alert on.
+func subscribeAlerts(js nats.JetStreamContext, es *rita.EventStore, rt *rita.Rita, kv nats.KeyValue, fn func(account string, a *kmm.Alert)) (*nats.Subscription, error) {
+	// Only accessed by the callback, which is not called concurrently.
+	states := newAlertStates(maxAlertAccounts)
+
+	return js.Subscribe("kmm.events.accounts.*", func(msg *nats.Msg) {
+		event, err := rt.UnpackEvent(msg)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		account := strings.TrimPrefix(msg.Subject, "kmm.events.accounts.")
+		a := states.get(account)
+		if a == nil {
+			a, err = loadAlertState(es, msg.Subject, event.Sequence)
+			if err != nil {
+				log.Printf("alerts of %s: %s", account, err)
+				return
+			}
+			states.put(account, a)
+		}
+
+		raised, err := kmm.EvolveAlerts(a, event)
+		if err != nil {
+			log.Printf("alerts of %s: %s", account, err)
+			return
+		}
+		for _, r := range raised {
+			if kv != nil {
+				// The first server to record the alert publishes it.
+				if _, err := kv.Create(fmt.Sprintf("%s.%d.%s", account, event.Sequence, r.Kind), nil); err != nil {
+					continue
+				}
+			}
+			fn(account, r)
+		}
+	}, nats.OrderedConsumer(), nats.DeliverNew())
+}
+
+// loadAlertState returns the state of the account evolved over the events
+// of the subject before the sequence.
+func loadAlertState(es *rita.EventStore, subject string, seq uint64) (*kmm.Account, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	events, _, err := es.Load(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	a := kmm.NewAccount()
+	for _, e := range events {
+		if e.Sequence >= seq {
+			break
+		}
+		if err := a.Evolve(e); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// formatAlert formats an alert as a line.
+func formatAlert(a *kmm.Alert) string {
+	switch a.Kind {
+	case kmm.AlertLowBalance:
+		return fmt.Sprintf("%s | low balance | %s is below %s", a.Time.Format(time.ANSIC), a.Balance.StringFixed(money.Places), a.LowBalance.StringFixed(money.Places))
+	case kmm.AlertBudgetNearlyExhausted:
+		b := a.Budget
+		return fmt.Sprintf("%s | budget nearly exhausted | %s of %s withdrawn in %s period, at least %d%%", a.Time.Format(time.ANSIC), b.FundsWithdrawn.StringFixed(money.Places), b.MaxWithdrawAmount.StringFixed(money.Places), b.Period, a.BudgetPercent)
+	}
+	return fmt.Sprintf("%s | %s", a.Time.Format(time.ANSIC), a.Kind)
+}
+
+// printNetFlow prints the totals of the net flow of the period.
+func printNetFlow(w io.Writer, f *kmm.NetFlow) {
+	fmt.Fprintf(w, "since %s\n", f.PeriodStartTime.Format(time.ANSIC))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "deposited\t%s\n", f.Deposited.StringFixed(money.Places))
+	fmt.Fprintf(tw, "withdrawn\t%s\n", f.Withdrawn.StringFixed(money.Places))
+	fmt.Fprintf(tw, "net\t%s\n", f.Net.StringFixed(money.Places))
+	tw.Flush()
+}
+
+func printReply(w io.Writer, rep *nats.Msg, quiet bool, confirm string) {
+	var serr *serviceError
+	if errors.As(replyError(rep), &serr) {
+		fmt.Fprintf(w, "%s (%s)\n", serr.Message, serr.Code)
+		return
+	}
+	// Servers with legacy errors reply with the error text.
+	if len(rep.Data) > 0 {
+		fmt.Fprintln(w, string(rep.Data))
+		return
+	}
+	if !quiet {
+		fmt.Fprintln(w, confirm)
+	}
+}
+
+// jsonOutput returns true if output is selected to be JSON.
+func jsonOutput(c *cli.Context) bool {
+	return c.String("output") == "json"
+}
+
+// amountFormatter returns the formatter of the currency and locale flags.
+// An unsupported system locale falls back to the default locale.
+func amountFormatter(c *cli.Context) (*money.Formatter, error) {
+	if locale := c.String("locale"); locale != "" {
+		return money.NewFormatter(c.String("currency"), locale)
+	}
+	f, err := money.NewFormatter(c.String("currency"), money.SystemLocale())
+	if errors.Is(err, money.ErrInvalidLocale) {
+		return money.NewFormatter(c.String("currency"), money.DefaultLocale)
+	}
+	return f, err
+}
+
+// printJSON prints the value as indented JSON.
+func printJSON(w io.Writer, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, string(b))
+	return nil
+}
+
+// printReplyJSON prints the reply to a command as JSON. The reply is the
+// error the command failed with and its code, otherwise the value
+// confirming the command is printed.
+func printReplyJSON(w io.Writer, rep *nats.Msg, confirm any) error {
+	var serr *serviceError
+	if errors.As(replyError(rep), &serr) {
+		return printJSON(w, map[string]string{"Error": serr.Message, "Code": serr.Code})
+	}
+	if len(rep.Data) > 0 {
+		return printJSON(w, map[string]string{"Error": string(rep.Data)})
+	}
+	return printJSON(w, confirm)
+}
+
+// request sends a request to a service. If no server is subscribed to the
+// subject, this fails fast with a clear error rather than timing out.
+func request(nc *nats.Conn, subject string, data []byte) (*nats.Msg, error) {
+	return requestMsg(nc, &nats.Msg{Subject: subject, Data: data})
+}
+
+// requestMsg is like request, but sends the message, e.g. with headers.
+func requestMsg(nc *nats.Conn, msg *nats.Msg) (*nats.Msg, error) {
+	if signer != nil {
+		if err := signer.sign(msg, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	rep, err := nc.RequestMsg(msg, requestTimeout)
+	if errors.Is(err, nats.ErrNoResponders) {
+		return nil, noRespondersError(msg.Subject)
+	}
+	return rep, err
+}
+
+// commandMsg returns the message of a command request with the idempotency
+// key, if any.
+func commandMsg(subject string, data []byte, key string) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	if key != "" {
+		msg.Header.Set(idempotencyKeyHdr, key)
+	}
+	return msg
+}
+
+// noRespondersError returns the error for a request to a subject no server
+// is subscribed to, naming the account or family the request was for.
+func noRespondersError(subject string) error {
+	toks := strings.Split(subject, ".")
+	if len(toks) == 4 && toks[0] == "kmm" {
+		switch toks[1] {
+		case "services":
+			return fmt.Errorf("kmm server not reachable for account %s", toks[2])
+		case "families":
+			return fmt.Errorf("kmm server not reachable for family %s", toks[2])
+		}
+	}
+	return fmt.Errorf("kmm server not reachable: no server handling %s", subject)
+}
+
+// unmarshalReply decodes the reply to a query of the given type. The error
+// of a failed query is returned, including the error text replied by
+// servers with legacy errors.
+func unmarshalReply(rep *nats.Msg, typ string) (any, error) {
+	if err := replyError(rep); err != nil {
+		return nil, err
+	}
+	if string(rep.Data) == kmm.ErrAccountNotFound.Error() {
+		return nil, kmm.ErrAccountNotFound
+	}
+	v, err := tr.UnmarshalType(rep.Data, typ)
+	if err != nil {
+		return nil, errors.New(string(rep.Data))
+	}
+	return v, nil
+}
+
+// dryRun requests the outcome of the command of the operation without
+// committing it and prints it.
+func dryRun(c *cli.Context, nc *nats.Conn, account, operation string, data []byte) error {
+	b, _ := json.Marshal(&dryRunRequest{
+		Operation: operation,
+		Command:   data,
+	})
+
+	rep, err := request(nc, fmt.Sprintf("kmm.services.%s.dry-run", account), b)
+	if err != nil {
+		return err
+	}
+	v, err := unmarshalReply(rep, "dry-run")
+	if err != nil {
+		return err
+	}
+	d, _ := v.(*kmm.DryRun)
+
+	if jsonOutput(c) {
+		return printJSON(os.Stdout, d)
+	}
+	printDryRun(os.Stdout, d)
+	return nil
+}
+
+// printDryRun prints the events of a dry run and the resulting state.
+func printDryRun(w io.Writer, d *kmm.DryRun) {
+	fmt.Fprintln(w, "dry run: nothing committed")
+
+	names := make([]string, len(d.Events))
+	for i, e := range d.Events {
+		names[i] = e.Type
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(w, "events: none")
+	} else {
+		fmt.Fprintf(w, "events: %s\n", strings.Join(names, ", "))
+	}
+
+	funds := &kmm.CurrentFunds{Amount: d.Balance, Balances: d.Balances}
+	fmt.Fprintf(w, "balance: %s\n", strings.Join(formatBalances(funds, decimal.Decimal.String), ", "))
+
+	if b := d.Budget; b != nil {
+		fmt.Fprintf(w, "budget: %s of %s withdrawn in %s period | %s remaining\n", b.FundsWithdrawn, b.MaxWithdrawAmount, b.Period, b.Remaining)
+	}
+}
+
+// backupEvent is the representation of an event in an account backup. The
+// ID is retained so references to the event, e.g. of reversals, can be
+// resolved on restore.
+type backupEvent struct {
+	ID   string          `json:"id,omitempty"`
+	Type string          `json:"type"`
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+type restoreRequest struct {
+	Force  bool            `json:"force"`
+	DryRun bool            `json:"dry_run"`
+	Events json.RawMessage `json:"events"`
+}
+
+// restorePlan describes the changes a restore would make. Replaced is the
+// number of existing events up to the sequence which are replaced.
+type restorePlan struct {
+	Events   int             `json:"events"`
+	Replaced int             `json:"replaced"`
+	Sequence uint64          `json:"sequence"`
+	Balance  decimal.Decimal `json:"balance"`
+}
+
+// newRestorePlan returns the plan for replacing the existing events up to
+// the sequence with the events. The balance is of the restored events.
+func newRestorePlan(events []*rita.Event, replaced int, seq uint64) *restorePlan {
+	var f kmm.CurrentFunds
+	for _, e := range events {
+		_ = f.Evolve(e)
+	}
+	return &restorePlan{
+		Events:   len(events),
+		Replaced: replaced,
+		Sequence: seq,
+		Balance:  f.Amount,
+	}
+}
+
+type mergeRequest struct {
+	Account string
+	DryRun  bool
+}
+
+type rebuildRequest struct {
+	Projection string
+	Store      bool
+}
+
+// dryRunRequest is a command of the operation to decide without committing
+// it. The command is encoded as it would be sent to the operation.
+type dryRunRequest struct {
+	Operation string
+	Command   json.RawMessage
+}
+
+// projectionBucketName is the KV bucket caching projections of each
+// account, so queries only evolve the events after the cached state.
+const projectionBucketName = "kmm-projections"
+
+// projectionBucket returns the projections bucket, creating it if needed.
+func projectionBucket(js nats.JetStreamContext) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(projectionBucketName)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		return js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  projectionBucketName,
+			History: 1,
+		})
+	}
+	return kv, err
+}
+
+// cachedProjection is the state of a projection of an account as of the
+// event sequence.
+type cachedProjection struct {
+	Sequence uint64
+	State    json.RawMessage
+}
+
+// projectionKey returns the bucket key of the projection of the account.
+func projectionKey(account, name string) string {
+	return fmt.Sprintf("%s.%s", account, name)
+}
+
+// decodeProjection decodes the cached state of the named projection and
+// returns it with the sequence it reflects.
+func decodeProjection(data []byte, name string) (rita.Evolver, uint64, error) {
+	var c cachedProjection
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, 0, err
+	}
+
+	p, err := kmm.NewProjection(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := tr.Unmarshal(c.State, p); err != nil {
+		return nil, 0, err
+	}
+	return p, c.Sequence, nil
+}
+
+// storeProjection stores the state of the projection of the account as of
+// the event sequence.
+func storeProjection(kv nats.KeyValue, account, name string, seq uint64, p rita.Evolver) error {
+	state, err := tr.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&cachedProjection{Sequence: seq, State: state})
+	if err != nil {
+		return err
+	}
+
+	_, err = kv.Put(projectionKey(account, name), data)
+	return err
+}
+
+// loadProjection returns the state of the named projection of the account
+// read through the cache. The cached state is evolved over the events after
+// its sequence, if any, and stored again. A cached state which cannot be
+// read or is ahead of the events, e.g. since the stream was recreated, is
+// invalidated and the state is evolved over all events. If kv is nil, the
+// cache is disabled.
+func loadProjection(ctx context.Context, nc *nats.Conn, es *rita.EventStore, kv nats.KeyValue, account, name string) (rita.Evolver, error) {
+	subject := fmt.Sprintf("kmm.events.accounts.%s", account)
+
+	last, err := lastSequence(ctx, nc, "kmm", subject)
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		if kv != nil {
+			_ = kv.Delete(projectionKey(account, name))
+		}
+		return nil, kmm.ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		p   rita.Evolver
+		seq uint64
+	)
+
+	if kv != nil {
+		entry, err := kv.Get(projectionKey(account, name))
+		if err == nil {
+			p, seq, err = decodeProjection(entry.Value(), name)
+		}
+		if err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+			log.Printf("projection %s of %s: %s", name, account, err)
+		}
+		if err != nil || seq > last {
+			p, seq = nil, 0
+		}
+	}
+
+	if p == nil {
+		if p, err = kmm.NewProjection(name); err != nil {
+			return nil, err
+		}
+	}
+
+	// The cached state is current.
+	if seq > 0 && seq == last {
+		return p, nil
+	}
+
+	var opts []rita.LoadOption
+	if seq > 0 {
+		opts = append(opts, rita.AfterSequence(seq))
+	}
+
+	events, _, err := es.Load(ctx, subject, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		if err := p.Evolve(e); err != nil {
+			return nil, err
+		}
+		seq = e.Sequence
+	}
+
+	// The state is already evolved, so a failure to cache it is only
+	// logged.
+	if kv != nil && len(events) > 0 {
+		if err := storeProjection(kv, account, name, seq, p); err != nil {
+			log.Printf("projection %s of %s: %s", name, account, err)
+		}
+	}
+
+	return p, nil
+}
+
+// encodeBackup encodes the events as a JSON array of typed events.
+func encodeBackup(events []*rita.Event) ([]byte, error) {
+	bes := make([]*backupEvent, len(events))
+	for i, e := range events {
+		data, err := tr.Marshal(e.Data)
+		if err != nil {
+			return nil, err
+		}
+		bes[i] = &backupEvent{
+			ID:   e.ID,
+			Type: e.Type,
+			Time: e.Time,
+			Data: data,
+		}
+	}
+	return json.Marshal(bes)
+}
+
+// decodeBackup decodes the events of a backup, retaining the event IDs and
+// times.
+func decodeBackup(b []byte) ([]*rita.Event, error) {
+	var bes []*backupEvent
+	if err := json.Unmarshal(b, &bes); err != nil {
+		return nil, fmt.Errorf("invalid backup: %w", err)
+	}
+
+	events := make([]*rita.Event, len(bes))
+	for i, be := range bes {
+		v, err := tr.UnmarshalType(be.Data, be.Type)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backup: event %d: %w", i, err)
+		}
+		events[i] = &rita.Event{
+			ID:   be.ID,
+			Type: be.Type,
+			Time: be.Time,
+			Data: v,
+		}
+	}
+	return events, nil
+}
+
+// renewEventIDs assigns new IDs to the events of a backup, so they are not
+// taken as duplicates of the original events when restored, and updates the
+// references of reversals to them.
+func renewEventIDs(events []*rita.Event) {
+	ids := make(map[string]string, len(events))
+	for _, e := range events {
+		id := nuid.Next()
+		if e.ID != "" {
+			ids[e.ID] = id
+		}
+		e.ID = id
+	}
+
+	for _, e := range events {
+		switch d := e.Data.(type) {
+		case *kmm.FundsDeposited:
+			if id, ok := ids[d.ReversalOf]; ok {
+				d.ReversalOf = id
+			}
+		case *kmm.FundsWithdrawn:
+			if id, ok := ids[d.ReversalOf]; ok {
+				d.ReversalOf = id
+			}
+		}
+	}
+}
+
+// auditStreamName is the stream recording the commands attempted against
+// each account, including rejected ones which produce no events.
+const auditStreamName = "kmm-audit"
+
+// Outcomes of an attempted command.
+const (
+	auditAccepted = "accepted"
+	auditRejected = "rejected"
+)
+
+// auditRecord is the record of a command attempted against an account.
+type auditRecord struct {
+	Time      time.Time       `json:"time"`
+	Operation string          `json:"operation"`
+	Command   json.RawMessage `json:"command,omitempty"`
+	Outcome   string          `json:"outcome"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// newAuditRecord returns the record of the command with the data, which
+// failed with the error, if any. The data is only retained if it is JSON.
+func newAuditRecord(t time.Time, operation string, data []byte, err error) *auditRecord {
+	r := &auditRecord{
+		Time:      t,
+		Operation: operation,
+		Outcome:   auditAccepted,
+	}
+	if len(data) > 0 && json.Valid(data) {
+		r.Command = data
+	}
+	if err != nil {
+		r.Outcome = auditRejected
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// formatAuditRecord formats a line of the audit log.
+func formatAuditRecord(r *auditRecord) string {
+	line := fmt.Sprintf("%s | %s | %s", r.Time.Format(time.ANSIC), r.Operation, r.Outcome)
+	if r.Error != "" {
+		line += ": " + r.Error
+	}
+	return line
+}
+
+// auditStream returns the audit stream, creating it if needed.
+func auditStream(js nats.JetStreamContext) error {
+	_, err := js.StreamInfo(auditStreamName)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     auditStreamName,
+			Subjects: []string{"kmm.audit.accounts.*"},
+			MaxBytes: 64 * 1000 * 1000, // 64MiB
+		})
+	}
+	return err
+}
+
+// loadAudit returns the audit records of the account in the order the
+// commands were attempted.
+func loadAudit(ctx context.Context, nc *nats.Conn, account string) ([]*auditRecord, error) {
+	subject := fmt.Sprintf("kmm.audit.accounts.%s", account)
+
+	records := []*auditRecord{}
+
+	last, err := lastSequence(ctx, nc, auditStreamName, subject)
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := js.SubscribeSync(subject, nats.OrderedConsumer(), nats.DeliverAll())
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe() //nolint
+
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var r auditRecord
+		if err := json.Unmarshal(msg.Data, &r); err != nil {
+			return nil, err
+		}
+		records = append(records, &r)
+
+		md, err := msg.Metadata()
+		if err != nil {
+			return nil, err
+		}
+		if md.Sequence.Stream >= last {
+			return records, nil
+		}
+	}
+}
+
+// listAccounts returns the accounts having events in the order they were
+// first seen. Only the headers of the events are fetched.
+func listAccounts(ctx context.Context, nc *nats.Conn) ([]string, error) {
+	const subject = "kmm.events.accounts.*"
+
+	last, err := lastSequence(ctx, nc, "kmm", subject)
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := js.SubscribeSync(subject, nats.OrderedConsumer(), nats.DeliverAll(), nats.HeadersOnly())
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe() //nolint
+
+	var (
+		accounts []string
+		seen     = make(map[string]bool)
+	)
+
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		account := msg.Subject[strings.LastIndexByte(msg.Subject, '.')+1:]
+		if !seen[account] {
+			seen[account] = true
+			accounts = append(accounts, account)
+		}
+
+		md, err := msg.Metadata()
+		if err != nil {
+			return nil, err
+		}
+		if md.Sequence.Stream >= last {
+			return accounts, nil
+		}
+	}
+}
+
+// lastSequence returns the stream sequence of the last message on the
+// subject, which may contain wildcards, or nats.ErrMsgNotFound if there is
+// none. The message is requested from the JetStream API directly since the
+// client has no call for it.
+func lastSequence(ctx context.Context, nc *nats.Conn, stream, subject string) (uint64, error) {
+	req, _ := json.Marshal(struct {
+		LastBySubject string `json:"last_by_subj"`
+	}{subject})
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	rep, err := nc.RequestWithContext(ctx, fmt.Sprintf("$JS.API.STREAM.MSG.GET.%s", stream), req)
+	if err != nil {
+		return 0, err
+	}
+
+	var resp struct {
+		Message *struct {
+			Sequence uint64 `json:"seq"`
+		} `json:"message"`
+		Error *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rep.Data, &resp); err != nil {
+		return 0, err
+	}
+
+	switch {
+	case resp.Error != nil && resp.Error.Code == 404:
+		return 0, nats.ErrMsgNotFound
+	case resp.Error != nil:
+		return 0, fmt.Errorf("get last message of %s: %s", subject, resp.Error.Description)
+	case resp.Message == nil:
+		return 0, nats.ErrMsgNotFound
+	}
+	return resp.Message.Sequence, nil
+}
+
+// purgeSubject purges the messages on the subject of the stream up to and
+// including the sequence. Like lastSequence, the JetStream API is requested
+// directly since the client cannot purge a subject.
+func purgeSubject(ctx context.Context, nc *nats.Conn, stream, subject string, seq uint64) error {
+	req, _ := json.Marshal(struct {
+		Subject  string `json:"filter"`
+		Sequence uint64 `json:"seq"`
+	}{subject, seq + 1})
+
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	rep, err := nc.RequestWithContext(ctx, fmt.Sprintf("$JS.API.STREAM.PURGE.%s", stream), req)
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Error *struct {
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rep.Data, &resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("purge %s: %s", subject, resp.Error.Description)
+	}
+	return nil
+}
+
+// requestCommand sends a command request and returns the error reply, if any.
+func requestCommand(nc *nats.Conn, subject string, cmd any) error {
+	data, _ := json.Marshal(cmd)
+
+	rep, err := request(nc, subject, data)
+	if err != nil {
+		return err
+	}
+	if err := replyError(rep); err != nil {
+		return err
+	}
+	if len(rep.Data) > 0 {
+		return errors.New(string(rep.Data))
+	}
+	return nil
+}
+
+// applyMembers calls fn for each account in a family. The result for each
+// account is reported followed by a summary. A failure does not stop the
+// remaining accounts from being applied.
+func applyMembers(members []string, w io.Writer, fn func(account string) error) error {
+	var (
+		ok     int
+		failed int
+	)
+
+	for _, m := range members {
+		if err := fn(m); err != nil {
+			failed++
+			fmt.Fprintf(w, "%s: error: %s\n", m, err)
+			continue
+		}
+
+		ok++
+		fmt.Fprintf(w, "%s: ok\n", m)
+	}
+
+	fmt.Fprintf(w, "%d succeeded, %d failed\n", ok, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d account(s) failed", failed)
+	}
+	return nil
+}
+
+// applyLines reads newline-delimited <amount>,<description> pairs and calls
+// fn for each one. The result of each line is reported followed by a summary.
+// Malformed lines and failures do not stop the run unless failFast is true.
+func applyLines(r io.Reader, w io.Writer, failFast bool, fn func(amount, description string) error) error {
+	var (
+		line   int
+		ok     int
+		failed int
+	)
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line++
+
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+
+		amount, description, _ := strings.Cut(text, ",")
+		amount = strings.TrimSpace(amount)
+		description = strings.TrimSpace(description)
+
+		var err error
+		if _, err = money.Parse(amount); err != nil {
+			err = fmt.Errorf("invalid amount %q", amount)
+		} else {
+			err = fn(amount, description)
+		}
+
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "line %d: error: %s\n", line, err)
+			if failFast {
+				break
+			}
+			continue
+		}
+
+		ok++
+		fmt.Fprintf(w, "line %d: ok\n", line)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%d succeeded, %d failed\n", ok, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d line(s) failed", failed)
+	}
+	return nil
+}
+
+// newCodecRegistry registers the codec with rita and returns a registry of
+// the types using it.
+func newCodecRegistry(c codec.Codec) *types.Registry {
+	codec.Codecs[c.Name()] = c
+	r, _ := types.NewRegistry(kmm.Types, types.Codec(c.Name()))
+	return r
+}
+
+// requestRegistry returns the registry for the codec indicated by the
+// Content-Type header of the message, defaulting to JSON.
+func requestRegistry(msg *nats.Msg) *types.Registry {
+	return contentTypeRegistry(msg.Header.Get("Content-Type"))
+}
+
+// contentTypeRegistry returns the registry for the codec name, defaulting to
+// JSON, e.g. for application/json.
+func contentTypeRegistry(name string) *types.Registry {
+	if r, ok := requestRegistries[name]; ok {
+		return r
+	}
+	return tr
+}
+
+// responseRegistry returns the registry for the codec requested in the
+// Accept header of the message, defaulting to JSON.
+func responseRegistry(msg *nats.Msg) *types.Registry {
+	if r, ok := responseRegistries[msg.Header.Get("Accept")]; ok {
+		return r
+	}
+	return tr
+}
+
+// printWithdrawalExplanation prints the state a withdrawal was decided
+// against followed by the result.
+func printWithdrawalExplanation(w io.Writer, e *kmm.WithdrawalExplanation) {
+	fmt.Fprintf(w, "amount: %s\nbalance: %s\n", e.Amount, e.Balance)
+	if e.Budget != nil {
+		fmt.Fprintf(w, "budget: %s\nmax amount: %s\nwithdrawn: %s\nremaining: %s\n", e.Budget.Period, e.Budget.MaxWithdrawAmount, e.Budget.FundsWithdrawn, e.Budget.Remaining)
+	} else {
+		fmt.Fprintln(w, "budget: none")
+	}
+	if e.Allowed() {
+		fmt.Fprintln(w, "result: allowed")
+	} else {
+		fmt.Fprintf(w, "result: rejected by %s: %s\n", e.Rule, e.Reason)
+	}
+}
+
+// printPeriods prints each supported period with its description and the
+// window containing now.
+func printPeriods(w io.Writer, now time.Time) {
+	for i, p := range kmm.Periods {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s: %s\n", p, p.Description())
+		printPeriodWindow(w, p, now)
+	}
+}
+
+// printPeriodWindow prints the start of the period containing now and the
+// start of the next period.
+func printPeriodWindow(w io.Writer, p kmm.Period, now time.Time) {
+	st, nst := p.Window(now)
+	fmt.Fprintf(w, `period start: %s
+next period start: %s
+`, st.Format(time.ANSIC), nst.Format(time.ANSIC))
+}
+
+// queryFamilyMembers returns the accounts in the family.
+func queryFamilyMembers(nc *nats.Conn, family string) ([]string, error) {
+	subject := fmt.Sprintf("kmm.families.%s.members", family)
+	rep, err := request(nc, subject, []byte{})
+	if err != nil {
+		return nil, err
+	}
+	if err := replyError(rep); err != nil {
+		return nil, err
+	}
+	v, err := tr.UnmarshalType(rep.Data, "family")
+	if err != nil {
+		return nil, err
+	}
+	f, _ := v.(*kmm.Family)
+	return f.Members, nil
+}
+
+// ledgerQuery selects the history a ledger subscription starts with.
+type ledgerQuery struct {
+	// Last is the number of last transactions of the history to deliver.
+	// Zero delivers the full history.
+	Last int
+	// Since is the time of the first event of the history to deliver. The
+	// last transactions are the last since the time.
+	Since time.Time
+	// StartSequence is the sequence of the first event to deliver, e.g.
+	// to page through the history. The first event since the time and the
+	// last transactions are at or after it.
+	StartSequence uint64
+}
+
+// encodeLedgerQuery encodes the request for a ledger delivered to the
+// stream ID. Last is encoded as limit for compatibility.
+func encodeLedgerQuery(id string, q ledgerQuery) []byte {
+	req := map[string]string{
+		"id":    id,
+		"limit": strconv.Itoa(q.Last),
+	}
+	if !q.Since.IsZero() {
+		req["since"] = q.Since.Format(time.RFC3339Nano)
+	}
+	if q.StartSequence > 0 {
+		req["start"] = strconv.FormatUint(q.StartSequence, 10)
+	}
+	data, _ := json.Marshal(req)
+	return data
+}
+
+// decodeLedgerQuery decodes a ledger request into the stream ID and query.
+func decodeLedgerQuery(data []byte) (string, ledgerQuery) {
+	var m map[string]string
+	_ = json.Unmarshal(data, &m)
+
+	var q ledgerQuery
+	q.Last, _ = strconv.Atoi(m["limit"])
+	q.Since, _ = time.Parse(time.RFC3339Nano, m["since"])
+	q.StartSequence, _ = strconv.ParseUint(m["start"], 10, 64)
+	return m["id"], q
+}
+
+// ledgerEvent is an event delivered to a ledger subscription.
+type ledgerEvent struct {
+	Event *rita.Event
+	// Balance is the balance after the event.
+	Balance decimal.Decimal
+	// Last is true for the last event of the history at the time of
+	// subscribing.
+	Last bool `json:"-"`
+}
+
+// subscribeLedger subscribes to the ledger of the account. The server
+// creates a consumer delivering the history selected by the query followed
+// by new events. False is returned if the selected history is empty.
+func subscribeLedger(nc *nats.Conn, rt *rita.Rita, account string, q ledgerQuery, fn func(e *ledgerEvent)) (*nats.Subscription, bool, error) {
+	streamID := nuid.Next()
+	streamSubject := fmt.Sprintf("kmm.streams.%s", streamID)
+
+	// Events may be delivered before the reply with the starting balance,
+	// so they are held until it is known.
+	var (
+		balance decimal.Decimal
+		last    uint64
+	)
+	ready := make(chan struct{})
+
+	sub, err := nc.Subscribe(streamSubject, func(msg *nats.Msg) {
+		event, err := rt.UnpackEvent(msg)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		<-ready
+		balance = ledgerBalance(balance, event)
+		fn(&ledgerEvent{
+			Event:   event,
+			Balance: balance,
+			Last:    event.Sequence == last,
+		})
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("ledger-subscribe: %w", err)
+	}
+
+	subject := fmt.Sprintf("kmm.services.%s.ledger", account)
+	rep, err := request(nc, subject, encodeLedgerQuery(streamID, q))
+	if err != nil {
+		sub.Unsubscribe() //nolint
+		return nil, false, fmt.Errorf("ledger-request: %w", err)
+	}
+	if err := replyError(rep); err != nil {
+		sub.Unsubscribe() //nolint
+		return nil, false, err
+	}
+
+	// The balance before the first delivered event and the sequence of the
+	// last event of the history. Older servers do not reply with them, in
+	// which case the balance starts from zero.
+	var m map[string]string
+	_ = json.Unmarshal(rep.Data, &m)
+	if b, err := decimal.NewFromString(m["balance"]); err == nil {
+		balance = b
+	}
+	last, _ = strconv.ParseUint(m["last"], 10, 64)
+	close(ready)
+
+	return sub, last > 0, nil
+}
+
+// formatBalances returns the balance of the funds formatted by the function,
+// followed by the balances in other currencies, by currency.
+func formatBalances(funds *kmm.CurrentFunds, format func(decimal.Decimal) string) []string {
+	lines := []string{format(funds.Amount)}
+
+	currencies := make([]string, 0, len(funds.Balances))
+	for cur := range funds.Balances {
+		currencies = append(currencies, cur)
+	}
+	sort.Strings(currencies)
+	for _, cur := range currencies {
+		lines = append(lines, money.Format(funds.Balances[cur], cur))
+	}
+	return lines
+}
+
+// printBalanceUpdate prints the line of a watched balance. In place, the
+// line replaces the previous one rather than following it.
+func printBalanceUpdate(w io.Writer, line string, inPlace bool) {
+	if inPlace {
+		fmt.Fprintf(w, "\r\033[K%s", line)
+		return
+	}
+	fmt.Fprintln(w, line)
+}
+
+// isTerminal returns true if the file is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// parseLedgerTime parses an RFC3339 time or a duration before now, e.g. 7d
+// or 12h.
+func parseLedgerTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	} else if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: expected RFC3339 or relative, e.g. 7d", s)
+}
+
+// ledgerBalance returns the balance after the event is applied to it.
+func ledgerBalance(balance decimal.Decimal, event *rita.Event) decimal.Decimal {
+	funds := kmm.CurrentFunds{Amount: balance}
+	_ = funds.Evolve(event)
+	return funds.Amount
+}
+
+// ledgerStartSequence returns the sequence of the first of the last limit
+// transactions, or zero if there are fewer than limit transactions.
+func ledgerStartSequence(events []*rita.Event, limit int) uint64 {
+	n := 0
+	for i := len(events) - 1; i >= 0; i-- {
+		if _, ok := formatLedgerEvent(events[i]); !ok {
+			continue
+		}
+		n++
+		if n == limit {
+			return events[i].Sequence
+		}
+	}
+	return 0
+}
+
+// formatLedgerEvent formats a line of the ledger. False is returned if the
+// event is not a transaction.
+func formatLedgerEvent(event *rita.Event) (string, bool) {
+	return formatLedgerAmounts(event, decimal.Decimal.String)
+}
+
+// formatLedgerAmounts is formatLedgerEvent with amounts formatted by the
+// function, e.g. in a currency.
+func formatLedgerAmounts(event *rita.Event, format func(decimal.Decimal) string) (string, bool) {
+	var (
+		sign        string
+		amount      decimal.Decimal
+		t           time.Time
+		description string
+		currency    string
+	)
+
+	switch e := event.Data.(type) {
+	case *kmm.FundsDeposited:
+		sign, amount, t, description, currency = "+", e.Amount, e.Time, e.Description, e.Currency
+		if e.ReversalOf != "" {
+			description = fmt.Sprintf("reversal of %s", e.ReversalOf)
+		}
+	case *kmm.FundsWithdrawn:
+		sign, amount, t, description, currency = "-", e.Amount, e.Time, e.Description, e.Currency
+		if e.ReversalOf != "" {
+			description = fmt.Sprintf("reversal of %s", e.ReversalOf)
+		}
+	case *kmm.RoundUpWithdrawn:
+		sign, amount, t, description = "-", e.Amount, e.Time, fmt.Sprintf("round-up to %s", e.Account)
+	case *kmm.TransactionMerged:
+		sign, amount, t, description, currency = "+", e.Amount, e.Time, fmt.Sprintf("merged from %s", e.Account), e.Currency
+		if e.Amount.IsNegative() {
+			sign, amount = "-", e.Amount.Neg()
+		}
+		if e.Description != "" {
+			description = fmt.Sprintf("%s (merged from %s)", e.Description, e.Account)
+		}
+	case *kmm.InterestAccrued:
+		if e.Amount.IsZero() {
+			return "", false
+		}
+		sign, amount, t, description = "+", e.Amount, e.Time, "interest"
+	case *kmm.SpendReflection:
+		if e.Period == "" {
+			return fmt.Sprintf("you have %s left", format(e.Balance)), true
+		}
+		return fmt.Sprintf("you have %s left and %s of budget until %s", format(e.Balance), format(e.RemainingBudget), e.NextPeriodStartTime.Format("Mon Jan _2")), true
+	default:
+		return "", false
+	}
+
+	// Amounts in other currencies are always formatted in their currency.
+	formatted := format(amount)
+	if currency != "" && currency != kmm.DefaultCurrency {
+		formatted = money.Format(amount, currency)
+	}
+
+	if description == "" {
+		return fmt.Sprintf("%s%s | %s", sign, formatted, t.Format(time.ANSIC)), true
+	}
+	return fmt.Sprintf("%s%s | %s | %s", sign, formatted, t.Format(time.ANSIC), description), true
+}
+
+// ledgerDescriptionWidth is the width the description column of a ledger
+// line is padded to.
+const ledgerDescriptionWidth = 24
+
+// formatLedgerLine formats a ledger line followed by the balance after the
+// transaction with amounts formatted by the function. The description
+// column is padded so the balances line up.
+func formatLedgerLine(event *rita.Event, balance decimal.Decimal, format func(decimal.Decimal) string) (string, bool) {
+	line, ok := formatLedgerAmounts(event, format)
+	if !ok {
+		return "", false
+	}
+	if _, ok := event.Data.(*kmm.SpendReflection); ok {
+		return line, true
+	}
+
+	cols := strings.SplitN(line, " | ", 3)
+	if len(cols) < 3 {
+		cols = append(cols, "")
+	}
+	return fmt.Sprintf("%s | %s | %-*s | %s", cols[0], cols[1], ledgerDescriptionWidth, cols[2], format(balance)), true
+}
+
+// formatTailEvent formats a ledger line labeled with the account.
+func formatTailEvent(account string, event *rita.Event) (string, bool) {
+	line, ok := formatLedgerEvent(event)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%s | %s", account, line), true
+}
+
+func main() {
+	if err := app.Run(os.Args); err != nil {
+		log.SetFlags(0)
+		var serr *serviceError
+		if errors.As(err, &serr) {
+			log.Printf("%s (%s)", serr.Message, serr.Code)
+		} else {
+			log.Print(err)
+		}
+		os.Exit(1)
+	}
+}
+
+func decodeUserCredsToFile(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(b)
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// selfTest deposits and withdraws on a throwaway account, verifies the
+// balance, and deletes the events. The account events are under the
+// kmm.events.selftest subject so they are never mistaken for a real account.
+func selfTest(ctx context.Context, js nats.JetStreamContext, es *rita.EventStore) error {
+	subject := fmt.Sprintf("kmm.events.selftest.%s", nuid.Next())
+	one := decimal.NewFromInt(1)
+
+	decide := func(cmd any) error {
+		a := kmm.NewAccount()
+		seq, err := es.Evolve(ctx, subject, a)
+		if err != nil {
+			return err
+		}
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		if err != nil {
+			return err
+		}
+		_, err = es.Append(ctx, subject, events, rita.ExpectSequence(seq))
+		return err
+	}
+
+	if err := decide(&kmm.DepositFunds{Amount: one}); err != nil {
+		return fmt.Errorf("selftest: deposit: %w", err)
+	}
+	if err := decide(&kmm.WithdrawFunds{Amount: one}); err != nil {
+		return fmt.Errorf("selftest: withdraw: %w", err)
+	}
+
+	events, _, err := es.Load(ctx, subject)
+	if err != nil {
+		return fmt.Errorf("selftest: load: %w", err)
+	}
+
+	var f kmm.CurrentFunds
+	for _, e := range events {
+		_ = f.Evolve(e)
+	}
+	if len(events) != 2 || !f.Amount.IsZero() {
+		return fmt.Errorf("selftest: expected 2 events and a zero balance, got %d events and %s", len(events), f.Amount)
+	}
+
+	for _, e := range events {
+		if err := js.DeleteMsg("kmm", e.Sequence); err != nil {
+			return fmt.Errorf("selftest: delete: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// settingsBucketName is the KV bucket storing the settings of each account.
+const settingsBucketName = "kmm-settings"
+
+// settingsBucket returns the settings bucket, creating it if needed.
+func settingsBucket(js nats.JetStreamContext) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(settingsBucketName)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		return js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  settingsBucketName,
+			History: 1,
+		})
+	}
+	return kv, err
+}
+
+// rebuildSettings folds the settings from the account events and stores
+// them, unless settings of a later sequence are already stored by a
+// concurrent change. The stored settings are returned.
+func rebuildSettings(ctx context.Context, es *rita.EventStore, kv nats.KeyValue, account string) (*kmm.AccountSettings, error) {
+	var s kmm.AccountSettings
+	seq, err := es.Evolve(ctx, fmt.Sprintf("kmm.events.accounts.%s", account), &s)
+	if err != nil {
+		return nil, err
+	}
+	if seq == 0 {
+		return nil, kmm.ErrAccountNotFound
+	}
+
+	data, err := tr.Marshal(&s)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retry if the entry is changed concurrently.
+	for i := 0; i < 3; i++ {
+		entry, err := kv.Get(account)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			if _, err = kv.Create(account, data); err == nil {
+				return &s, nil
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := tr.UnmarshalType(entry.Value(), "account-settings")
+		if err == nil && v.(*kmm.AccountSettings).Sequence >= s.Sequence {
+			return v.(*kmm.AccountSettings), nil
+		}
+
+		if _, err = kv.Update(account, data, entry.Revision()); err == nil {
+			return &s, nil
+		}
+	}
+
+	return nil, fmt.Errorf("settings of %s changed concurrently", account)
+}
+
+// snapshotBucketName is the KV bucket storing a snapshot of the state of
+// each account.
+const snapshotBucketName = "kmm-snapshots"
+
+// snapshotBucket returns the snapshot bucket, creating it if needed.
+func snapshotBucket(js nats.JetStreamContext) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(snapshotBucketName)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		return js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  snapshotBucketName,
+			History: 1,
+		})
+	}
+	return kv, err
+}
+
+// accountSnapshot is the state of an account as of the event sequence.
+// The version is the kmm.AccountVersion of the state.
+type accountSnapshot struct {
+	Version  int
+	Sequence uint64
+	Account  *kmm.Account
+}
+
+var errSnapshotVersion = errors.New("snapshot is of another account version")
+
+// newAccountSnapshot returns the snapshot of a new account.
+func newAccountSnapshot() *accountSnapshot {
+	return &accountSnapshot{
+		Version: kmm.AccountVersion,
+		Account: kmm.NewAccount(),
+	}
+}
+
+// decodeSnapshot decodes a snapshot into an initialized account, so its
+// unexported state, e.g. the clock, is set. A snapshot of another version
+// of the account state cannot be decoded.
+func decodeSnapshot(data []byte) (*accountSnapshot, error) {
+	s := &accountSnapshot{Account: kmm.NewAccount()}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Version != kmm.AccountVersion {
+		return nil, fmt.Errorf("%w: %d", errSnapshotVersion, s.Version)
+	}
+	return s, nil
+}
+
+func storeSnapshot(kv nats.KeyValue, account string, s *accountSnapshot) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = kv.Put(account, data)
+	return err
+}
+
+// loadAccount returns the state of the account from the latest snapshot, if
+// any, evolved over the events after it, along with the number of those
+// events. A snapshot which cannot be read or is of another version is
+// ignored and the state is evolved over all events. If kv is nil, snapshots
+// are disabled.
+func loadAccount(ctx context.Context, es *rita.EventStore, kv nats.KeyValue, account string) (*accountSnapshot, int, error) {
+	s := newAccountSnapshot()
+
+	if kv != nil {
+		entry, err := kv.Get(account)
+		if err == nil {
+			s, err = decodeSnapshot(entry.Value())
+			if err != nil {
+				s = newAccountSnapshot()
+			}
+		}
+		if err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+			log.Printf("snapshot of %s: %s", account, err)
+		}
+	}
+
+	var opts []rita.LoadOption
+	if s.Sequence > 0 {
+		opts = append(opts, rita.AfterSequence(s.Sequence))
+	}
+
+	events, _, err := es.Load(ctx, fmt.Sprintf("kmm.events.accounts.%s", account), opts...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, e := range events {
+		if err := s.Account.Evolve(e); err != nil {
+			return nil, 0, err
+		}
+		s.Sequence = e.Sequence
+	}
+
+	return s, len(events), nil
+}
+
+// idempotencyKeyHdr is the header of a command request with the key which
+// identifies it, so a retry of the request is applied only once.
+const idempotencyKeyHdr = "Idempotency-Key"
+
+// idempotencyBucketName is the KV bucket recording the idempotency keys of
+// the commands handled per account.
+const idempotencyBucketName = "kmm-idempotency"
+
+// idempotencyLease is the duration a pending idempotency key is held. A
+// key still pending after it was left by a server which stopped before
+// the command was applied, so it is taken over by a retry.
+const idempotencyLease = time.Minute
+
+var (
+	errIdempotencyKeyInProgress = errors.New("kmm: a command with the idempotency key is in progress")
+	errIdempotencyKeyReused     = errors.New("kmm: idempotency key was used for another command")
+)
+
+// idempotencyBucket returns the idempotency bucket, creating it if needed.
+// Keys expire after the TTL.
+func idempotencyBucket(js nats.JetStreamContext, ttl time.Duration) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(idempotencyBucketName)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		return js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  idempotencyBucketName,
+			History: 1,
+			TTL:     ttl,
+		})
+	}
+	return kv, err
+}
+
+// idempotencyRecord is the record of a command with an idempotency key. It
+// is pending until the command is applied. Hash is the hash of the command
+// payload, so the key cannot be reused for another payload.
+type idempotencyRecord struct {
+	Operation string
+	Hash      string
+	Reserved  time.Time
+	Done      bool
+}
+
+// idempotencyHash returns the hash of the payload of a command.
+func idempotencyHash(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// idempotencyBucketKey returns the bucket key of the idempotency key of the
+// account. The key is hashed since it is chosen by the client and may
+// contain characters not allowed in bucket keys.
+func idempotencyBucketKey(account, key string) string {
+	h := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s.%s", account, hex.EncodeToString(h[:]))
+}
+
+// reserveIdempotencyKey records the idempotency key of the command as
+// pending. It returns true if the command was already applied. A key
+// pending for longer than the lease is taken over.
+func reserveIdempotencyKey(kv nats.KeyValue, account, key, operation string, data []byte) (bool, error) {
+	k := idempotencyBucketKey(account, key)
+	hash := idempotencyHash(data)
+
+	b, _ := json.Marshal(&idempotencyRecord{
+		Operation: operation,
+		Hash:      hash,
+		Reserved:  time.Now(),
+	})
+	_, cerr := kv.Create(k, b)
+	if cerr == nil {
+		return false, nil
+	}
+
+	// Depending on the client version, the error of an existing key is
+	// not ErrKeyExists, so the key is read to tell.
+	e, err := kv.Get(k)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return false, cerr
+	} else if err != nil {
+		return false, err
+	}
+
+	var rec idempotencyRecord
+	if err := json.Unmarshal(e.Value(), &rec); err != nil {
+		return false, err
+	}
+	if rec.Operation != operation || rec.Hash != hash {
+		return false, &requestError{errIdempotencyKeyReused}
+	}
+	if rec.Done {
+		return true, nil
+	}
+	if time.Since(rec.Reserved) < idempotencyLease {
+		return false, errIdempotencyKeyInProgress
+	}
+
+	// The update fails if another retry took over the key first.
+	if _, err := kv.Update(k, b, e.Revision()); err != nil {
+		return false, errIdempotencyKeyInProgress
+	}
+	return false, nil
+}
+
+// completeIdempotencyKey records the command with the idempotency key as
+// applied.
+func completeIdempotencyKey(kv nats.KeyValue, account, key, operation string, data []byte) error {
+	b, _ := json.Marshal(&idempotencyRecord{
+		Operation: operation,
+		Hash:      idempotencyHash(data),
+		Done:      true,
+	})
+	_, err := kv.Put(idempotencyBucketKey(account, key), b)
+	return err
+}
+
+// releaseIdempotencyKey removes the pending idempotency key of a command
+// which failed, so it can be retried.
+func releaseIdempotencyKey(kv nats.KeyValue, account, key string) error {
+	return kv.Delete(idempotencyBucketKey(account, key))
+}
+
+var errUnknownOperation = errors.New("unknown service operation")
+
+// Headers of a request signed by the user of the NATS credentials of the
+// client. The signature is of the subject, the time, the nonce and the
+// data, so it cannot be used for another account or operation, after the
+// max age, or a second time.
+const (
+	authJWTHdr   = "Kmm-Auth-Jwt"
+	authTimeHdr  = "Kmm-Auth-Time"
+	authNonceHdr = "Kmm-Auth-Nonce"
+	authSigHdr   = "Kmm-Auth-Sig"
+)
+
+// authMaxAge is the max difference between the time a request was signed
+// and the time it is authorized, in either direction.
+const authMaxAge = 5 * time.Minute
+
+// authNonceBucketName is the KV bucket recording the nonces of the
+// authorized requests. A nonce is kept as long as its request could be
+// authorized.
+const authNonceBucketName = "kmm-auth-nonces"
+
+var errPermissionDenied = errors.New("kmm: permission denied")
+
+// authPayload returns the payload of the signature of a request.
+func authPayload(msg *nats.Msg, t, nonce string) []byte {
+	b := make([]byte, 0, len(msg.Subject)+len(t)+len(nonce)+len(msg.Data)+3)
+	b = append(b, msg.Subject...)
+	b = append(b, '\n')
+	b = append(b, t...)
+	b = append(b, '\n')
+	b = append(b, nonce...)
+	b = append(b, '\n')
+	return append(b, msg.Data...)
+}
+
+// authNonceBucket returns the nonce bucket, creating it if needed.
+func authNonceBucket(js nats.JetStreamContext) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(authNonceBucketName)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		return js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  authNonceBucketName,
+			History: 1,
+			TTL:     2 * authMaxAge,
+		})
+	}
+	return kv, err
+}
+
+// authNonceKey returns the bucket key of the nonce. The nonce is hashed
+// since it is chosen by the client and may contain characters not allowed
+// in bucket keys.
+func authNonceKey(nonce string) string {
+	h := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(h[:])
+}
+
+// requestSigner signs requests with the user JWT and key of NATS
+// credentials.
+type requestSigner struct {
+	jwt string
+	kp  nkeys.KeyPair
+}
+
+// newRequestSigner returns a signer of the user of the creds file.
+func newRequestSigner(creds string) (*requestSigner, error) {
+	b, err := os.ReadFile(creds)
+	if err != nil {
+		return nil, err
+	}
+	token, err := jwt.ParseDecoratedJWT(b)
+	if err != nil {
+		return nil, err
+	}
+	kp, err := jwt.ParseDecoratedUserNKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return &requestSigner{jwt: token, kp: kp}, nil
+}
+
+// sign sets the headers of the request signed at time t with a new nonce.
+func (s *requestSigner) sign(msg *nats.Msg, t time.Time) error {
+	ts := t.UTC().Format(time.RFC3339Nano)
+	nonce := nuid.Next()
+	sig, err := s.kp.Sign(authPayload(msg, ts, nonce))
+	if err != nil {
+		return err
+	}
+
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	msg.Header.Set(authJWTHdr, s.jwt)
+	msg.Header.Set(authTimeHdr, ts)
+	msg.Header.Set(authNonceHdr, nonce)
+	msg.Header.Set(authSigHdr, base64.RawURLEncoding.EncodeToString(sig))
+	return nil
+}
+
+// authPolicy decides which accounts a user may operate on.
+type authPolicy interface {
+	Allowed(user, account string) (bool, error)
+}
+
+// staticPolicy is the accounts each user may operate on, by user. The
+// account * allows all accounts.
+type staticPolicy map[string][]string
+
+func (p staticPolicy) Allowed(user, account string) (bool, error) {
+	return allowsAccount(p[user], account), nil
+}
+
+// kvPolicy is a policy stored in a KV bucket, with the JSON array of the
+// accounts each user may operate on keyed by user. Changes apply to the
+// next request.
+type kvPolicy struct {
+	kv nats.KeyValue
+}
+
+func (p *kvPolicy) Allowed(user, account string) (bool, error) {
+	entry, err := p.kv.Get(user)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var accounts []string
+	if err := json.Unmarshal(entry.Value(), &accounts); err != nil {
+		return false, fmt.Errorf("auth policy of %s: %w", user, err)
+	}
+	return allowsAccount(accounts, account), nil
+}
+
+// allowsAccount returns true if the accounts include the account or *.
+func allowsAccount(accounts []string, account string) bool {
+	for _, a := range accounts {
+		if a == account || a == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// newAuthPolicy returns the policy of the source, either file:<path> of a
+// JSON object of the accounts by user, or kv:<bucket>. The bucket is
+// created if needed.
+func newAuthPolicy(js nats.JetStreamContext, source string) (authPolicy, error) {
+	scheme, arg, _ := strings.Cut(source, ":")
+	if arg == "" {
+		return nil, fmt.Errorf("invalid auth policy %q: expected file:<path> or kv:<bucket>", source)
+	}
+
+	switch scheme {
+	case "file":
+		b, err := os.ReadFile(arg)
+		if err != nil {
+			return nil, err
+		}
+		var p staticPolicy
+		if err := json.Unmarshal(b, &p); err != nil {
+			return nil, fmt.Errorf("auth policy %s: %w", arg, err)
+		}
+		return p, nil
+
+	case "kv":
+		kv, err := js.KeyValue(arg)
+		if errors.Is(err, nats.ErrBucketNotFound) {
+			kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+				Bucket:  arg,
+				History: 1,
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &kvPolicy{kv: kv}, nil
+	}
+
+	return nil, fmt.Errorf("invalid auth policy %q: expected file:<path> or kv:<bucket>", source)
+}
+
+// nonceStore records the nonces of authorized requests, e.g. a
+// nats.KeyValue. Create fails if the nonce is already recorded.
+type nonceStore interface {
+	Create(key string, value []byte) (uint64, error)
+}
+
+// authorizer authorizes requests by the user who signed them against the
+// policy. Users must be issued by one of the trusted issuers, and each
+// signed request is authorized once.
+type authorizer struct {
+	issuers map[string]bool
+	policy  authPolicy
+	nonces  nonceStore
+	now     func() time.Time
+}
+
+func newAuthorizer(issuers []string, policy authPolicy, nonces nonceStore) *authorizer {
+	a := &authorizer{
+		issuers: make(map[string]bool, len(issuers)),
+		policy:  policy,
+		nonces:  nonces,
+		now:     time.Now,
+	}
+	for _, i := range issuers {
+		a.issuers[i] = true
+	}
+	return a
+}
+
+// user returns the name of the user who signed the request, or the public
+// key of the user if the JWT has no name.
+func (a *authorizer) user(msg *nats.Msg) (string, error) {
+	token := msg.Header.Get(authJWTHdr)
+	if token == "" {
+		return "", errors.New("request is not signed")
+	}
+
+	// The JWT is verified to be signed by its issuer.
+	claims, err := jwt.DecodeUserClaims(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid user JWT: %w", err)
+	}
+	vr := jwt.CreateValidationResults()
+	claims.Validate(vr)
+	if vr.IsBlocking(true) {
+		return "", errors.New("user JWT is expired or not yet valid")
+	}
+	if !a.issuers[claims.Issuer] {
+		return "", fmt.Errorf("user JWT issuer %s is not trusted", claims.Issuer)
+	}
+
+	ts := msg.Header.Get(authTimeHdr)
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature time: %w", err)
+	}
+	if d := a.now().Sub(t); d > authMaxAge || d < -authMaxAge {
+		return "", errors.New("signature is expired")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(msg.Header.Get(authSigHdr))
+	if err != nil {
+		return "", fmt.Errorf("invalid signature: %w", err)
+	}
+	nonce := msg.Header.Get(authNonceHdr)
+	if nonce == "" {
+		return "", errors.New("signature has no nonce")
+	}
+	kp, err := nkeys.FromPublicKey(claims.Subject)
+	if err != nil {
+		return "", err
+	}
+	if err := kp.Verify(authPayload(msg, ts, nonce), sig); err != nil {
+		return "", errors.New("invalid signature")
+	}
+
+	// Only the first of identical requests, e.g. replayed by a
+	// subscriber, is authorized.
+	if _, err := a.nonces.Create(authNonceKey(nonce), nil); err != nil {
+		return "", fmt.Errorf("nonce was already used: %w", err)
+	}
+
+	if claims.Name != "" {
+		return claims.Name, nil
+	}
+	return claims.Subject, nil
+}
+
+// authorize returns an error if the request is not signed by a user allowed
+// to operate on all the accounts.
+func (a *authorizer) authorize(msg *nats.Msg, accounts ...string) error {
+	user, err := a.user(msg)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errPermissionDenied, err)
+	}
+
+	for _, account := range accounts {
+		ok, err := a.policy.Allowed(user, account)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: %s may not operate on account %s", errPermissionDenied, user, account)
+		}
+	}
+	return nil
+}
+
+// allowedAccounts returns the accounts of those given the user who signed
+// the request may operate on, or nil if the user may operate on all
+// accounts.
+func (a *authorizer) allowedAccounts(msg *nats.Msg, accounts []string) ([]string, error) {
+	user, err := a.user(msg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errPermissionDenied, err)
+	}
+
+	if ok, err := a.policy.Allowed(user, "*"); err != nil || ok {
+		return nil, err
+	}
+
+	allowed := []string{}
+	for _, account := range accounts {
+		ok, err := a.policy.Allowed(user, account)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			allowed = append(allowed, account)
+		}
+	}
+	return allowed, nil
+}
+
+// commandHandler applies a decoded command to an account and returns the
+// appended events.
+type commandHandler func(ctx context.Context, account string, cmd any) ([]*rita.Event, error)
+
+// commandRegistry maps the operation of each account command to its
+// handler, so a command is added by registering it once. The command is
+// decoded as the type registered under the name of the operation.
+type commandRegistry map[string]commandHandler
+
+// register registers the handler of the operation. It panics if the
+// operation is already registered.
+func (r commandRegistry) register(operation string, h commandHandler) {
+	if _, ok := r[operation]; ok {
+		panic(fmt.Sprintf("command %s already registered", operation))
+	}
+	r[operation] = h
+}
+
+// has returns true if the operation is a registered command.
+func (r commandRegistry) has(operation string) bool {
+	_, ok := r[operation]
+	return ok
+}
+
+// decode decodes the command of the operation using the type registry and
+// validates it. The command is returned with the handler of the operation.
+func (r commandRegistry) decode(reg *types.Registry, data []byte, operation string) (any, commandHandler, error) {
+	h, ok := r[operation]
+	if !ok {
+		return nil, nil, &requestError{fmt.Errorf("unknown command: %s", operation)}
+	}
+
+	// Unmarshal the command based on the type.
+	cmd, err := reg.UnmarshalType(data, operation)
+	if err != nil {
+		if errors.Is(err, types.ErrTypeNotRegistered) {
+			return nil, nil, &requestError{fmt.Errorf("unknown command: %s", operation)}
+		}
+		return nil, nil, &requestError{err}
+	}
+
+	if v, ok := cmd.(interface{ Validate() error }); ok {
+		if err := v.Validate(); err != nil {
+			return nil, nil, &requestError{err}
+		}
+	}
+
+	return cmd, h, nil
+}
+
+// requestError is an error of the request rather than of handling it, e.g.
+// a command which cannot be decoded or is invalid.
+type requestError struct {
+	err error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// httpStatus returns the HTTP status code of a service error.
+func httpStatus(err error) int {
+	var rerr *requestError
+	switch {
+	case errors.As(err, &rerr):
+		return http.StatusBadRequest
+	case errors.Is(err, rita.ErrSequenceConflict), errors.Is(err, errIdempotencyKeyInProgress):
+		return http.StatusConflict
+	case errors.Is(err, kmm.ErrAccountNotFound), errors.Is(err, kmm.ErrAccountNotOpen):
+		return http.StatusNotFound
+	case errorType(err) != "other":
+		// The command was rejected by the account, e.g. insufficient
+		// funds.
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// Headers of the reply to a failed service request, following the NATS
+// service convention. The body is the JSON encoded serviceError.
+const (
+	serviceErrorHdr     = "Nats-Service-Error"
+	serviceErrorCodeHdr = "Nats-Service-Error-Code"
+)
+
+// errorCodes are the stable codes of the errors service requests fail
+// with, so clients need not match the error text.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{kmm.ErrAccountNotFound, "account_not_found"},
+	{kmm.ErrAccountNotOpen, "account_not_open"},
+	{kmm.ErrAccountClosed, "account_closed"},
+	{kmm.ErrAccountArchived, "account_archived"},
+	{kmm.ErrAccountFrozen, "account_frozen"},
+	{kmm.ErrInsufficientFunds, "insufficient_funds"},
+	{kmm.ErrBelowMinimumBalance, "below_minimum_balance"},
+	{kmm.ErrExceedWithinPeriod, "exceed_within_period"},
+	{kmm.ErrExceedsPerTransactionLimit, "exceeds_per_transaction_limit"},
+	{kmm.ErrDepositFrequencyExceeded, "deposit_frequency_exceeded"},
+	{kmm.ErrApprovalRequired, "approval_required"},
+	{kmm.ErrNoCurrencyBalance, "no_currency_balance"},
+	{kmm.ErrNonZeroAmount, "invalid_amount"},
+	{kmm.ErrTooManyDecimalPlaces, "invalid_amount"},
+	{kmm.ErrInvalidDenomination, "invalid_amount"},
+	{kmm.ErrNoBudget, "no_budget"},
+	{kmm.ErrTransactionNotFound, "transaction_not_found"},
+	{kmm.ErrAlreadyReversed, "already_reversed"},
+	{kmm.ErrGoalNotFound, "goal_not_found"},
+	{kmm.ErrWithdrawalRequestNotFound, "withdrawal_request_not_found"},
+	{errPermissionDenied, "permission_denied"},
+}
+
+// serviceError is the error a service request failed with.
+type serviceError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *serviceError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the error of the code, if known, so it can be matched with
+// errors.Is.
+func (e *serviceError) Unwrap() error {
+	for _, c := range errorCodes {
+		if c.code == e.Code {
+			return c.err
+		}
+	}
+	return nil
+}
+
+// serviceErrorCode returns the code of a service error. Errors without a
+// code of their own are classified, e.g. as rejected by the account.
+func serviceErrorCode(err error) string {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+
+	var rerr *requestError
+	switch {
+	case errors.As(err, &rerr):
+		return "bad_request"
+	case errors.Is(err, rita.ErrSequenceConflict), errors.Is(err, errIdempotencyKeyInProgress):
+		return "conflict"
+	case errorType(err) != "other":
+		return "rejected"
+	}
+	return "internal"
+}
+
+// serviceErrorMsg returns the reply to a service request which failed with
+// the error.
+func serviceErrorMsg(err error) *nats.Msg {
+	e := &serviceError{
+		Code:    serviceErrorCode(err),
+		Message: err.Error(),
+	}
+
+	msg := nats.NewMsg("")
+	msg.Header.Set(serviceErrorHdr, e.Message)
+	msg.Header.Set(serviceErrorCodeHdr, e.Code)
+	msg.Data, _ = json.Marshal(e)
+	return msg
+}
+
+// replyError returns the error of a reply to a service request, or nil if
+// the reply does not have the service error header.
+func replyError(rep *nats.Msg) error {
+	if rep.Header.Get(serviceErrorHdr) == "" {
+		return nil
+	}
+	e := &serviceError{
+		Code:    rep.Header.Get(serviceErrorCodeHdr),
+		Message: rep.Header.Get(serviceErrorHdr),
+	}
+	_ = json.Unmarshal(rep.Data, e)
+	return e
+}
+
+// accountResources are the resources of the HTTP API of an account and the
+// service operation each maps to.
+var accountResources = map[string]struct {
+	method    string
+	operation string
+}{
+	"deposit":  {http.MethodPost, "deposit-funds"},
+	"withdraw": {http.MethodPost, "withdraw-funds"},
+	"balance":  {http.MethodGet, "balance"},
+	"budget":   {http.MethodGet, "last-budget-period"},
+}
+
+// writeHTTPError writes the error as a JSON body with the status code.
+func writeHTTPError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()}) //nolint
+}
+
+var (
+	commandsHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kmm_commands_total",
+		Help: "Number of service requests handled by operation.",
+	}, []string{"operation"})
+
+	commandErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kmm_command_errors_total",
+		Help: "Number of service requests which failed by operation and error.",
+	}, []string{"operation", "error"})
+
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kmm_command_duration_seconds",
+		Help:    "Latency of handling service requests by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	// Servers may be run more than once in-process, e.g. by tests.
+	registerMetrics sync.Once
+)
+
+// errorType returns the label of the error, which is the message of the
+// innermost error without the kmm prefix, e.g. insufficient funds. Other
+// errors are labeled as such to bound the number of labels.
+func errorType(err error) string {
+	if errors.Is(err, rita.ErrSequenceConflict) {
+		return "sequence conflict"
+	}
+	for u := errors.Unwrap(err); u != nil; u = errors.Unwrap(err) {
+		err = u
+	}
+	if msg := err.Error(); strings.HasPrefix(msg, "kmm: ") {
+		return strings.TrimPrefix(msg, "kmm: ")
+	}
+	return "other"
+}
+
+// instrument wraps a service handler to record the metrics of the operation,
+// which is the last token of the subject.
+func instrument(handle func(msg *nats.Msg) error) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		start := time.Now()
+		err := handle(msg)
+
+		operation := msg.Subject[strings.LastIndexByte(msg.Subject, '.')+1:]
+		if errors.Is(err, errUnknownOperation) {
+			operation = "unknown"
+		}
+
+		commandsHandled.WithLabelValues(operation).Inc()
+		commandDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+		if err != nil {
+			commandErrors.WithLabelValues(operation, errorType(err)).Inc()
+		}
+	}
+}
+
+// drainNats drains the connection and waits until it is closed or the
+// context is done.
+func drainNats(ctx context.Context, nc *nats.Conn) error {
+	closed := make(chan struct{})
+	nc.SetClosedHandler(func(*nats.Conn) {
+		close(closed)
+	})
+
+	if err := nc.Drain(); err != nil {
+		return err
+	}
+
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func runServer(c *cli.Context) error {
+	natsEmbed := c.Bool("nats.embed")
+	httpAddr := c.String("http.addr")
+	maxFamilyMembers := c.Int("family.max-members")
+	maxClosedPeriods := c.Int("periods.max-closed")
+	rolloverInterval := c.Duration("periods.rollover-interval")
+	allowanceInterval := c.Duration("allowances.interval")
+	interestInterval := c.Duration("interest.interval")
+	snapshotInterval := c.Int("snapshots.interval")
+	maxAttempts := c.Int("commands.max-attempts")
+	idempotencyTTL := c.Duration("idempotency.ttl")
+	shutdownTimeout := c.Duration("shutdown.timeout")
+	legacyErrors := c.Bool("services.legacy-errors")
+	projectionCache := c.Bool("projections.cache")
+	alertsEnabled := c.Bool("alerts.enabled")
+	authPolicySource := c.String("auth.policy")
+	authIssuers := c.StringSlice("auth.issuer")
+
+	if authPolicySource != "" && len(authIssuers) == 0 {
+		return fmt.Errorf("auth.issuer is required with auth.policy")
+	}
+
+	// Shut down gracefully on SIGINT or SIGTERM, or when the context is
+	// done so the server can be run in-process, e.g. by tests.
+	ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var (
+		nc  *nats.Conn
+		err error
+	)
+
+	if natsEmbed {
+		ns := testutil.NewNatsServer(4837)
+		defer ns.Shutdown()
+		nc, err = nats.Connect(ns.ClientURL())
+	} else {
+		nc, err = connectNats(c)
+	}
+	if err != nil {
+		return err
+	}
+	defer nc.Drain() //nolint
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+
+	// Initialize a new Rita instance.
+	rt, err := rita.New(nc, rita.TypeRegistry(tr))
+	if err != nil {
+		return err
+	}
+
+	// Create an event store. (this is idempotent)
+	es := rt.EventStore("kmm")
+	if natsEmbed {
+		_ = es.Delete()
+	}
+	err = es.Create(&nats.StreamConfig{
+		Subjects: []string{"kmm.events.>"},
+		MaxBytes: 512 * 1000 * 1000, // 512MiB
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("selftest") {
+		if err := selfTest(ctx, js, es); err != nil {
+			return err
+		}
+		log.Print("self-test passed")
+	}
+
+	settings, err := settingsBucket(js)
+	if err != nil {
+		return err
+	}
+
+	// Snapshots and stored projections are of the deleted stream, and the
+	// commands of the idempotency keys and the audit are deleted with it.
+	if natsEmbed {
+		_ = js.DeleteKeyValue(snapshotBucketName)
+		_ = js.DeleteKeyValue(idempotencyBucketName)
+		_ = js.DeleteKeyValue(projectionBucketName)
+		_ = js.DeleteStream(auditStreamName)
+	}
+
+	if err := auditStream(js); err != nil {
+		return err
+	}
+
+	var snapshots nats.KeyValue
+	if snapshotInterval > 0 {
+		snapshots, err = snapshotBucket(js)
+		if err != nil {
+			return err
+		}
+	}
+
+	idempotency, err := idempotencyBucket(js, idempotencyTTL)
+	if err != nil {
+		return err
+	}
+
+	var projections nats.KeyValue
+	if projectionCache {
+		projections, err = projectionBucket(js)
+		if err != nil {
+			return err
+		}
+	}
+
+	var auth *authorizer
+	if authPolicySource != "" {
+		policy, err := newAuthPolicy(js, authPolicySource)
+		if err != nil {
+			return err
+		}
+		nonces, err := authNonceBucket(js)
+		if err != nil {
+			return err
+		}
+		auth = newAuthorizer(authIssuers, policy, nonces)
+	}
+
+	// syncSettings stores the account settings if any of the appended events
+	// changed them. The events are the source of truth, so a failure is only
+	// logged and the settings are rebuilt on the next read or change.
+	syncSettings := func(ctx context.Context, account string, events []*rita.Event) {
+		for _, e := range events {
+			if kmm.IsSettingsEvent(e) {
+				if _, err := rebuildSettings(ctx, es, settings, account); err != nil {
+					log.Printf("settings of %s: %s", account, err)
+				}
+				return
+			}
+		}
+	}
+
+	// appendDecision decides the command against the account and appends the
+	// resulting events.
+	appendDecision := func(ctx context.Context, account string, cmd any) ([]*rita.Event, error) {
+		subject := fmt.Sprintf("kmm.events.accounts.%s", account)
+
+		// Initialize the aggregate from the latest snapshot and evolve the
+		// state.
+		s, n, err := loadAccount(ctx, es, snapshots, account)
+		if err != nil {
+			return nil, err
+		}
+		a, seq := s.Account, s.Sequence
+
+		// Only an open account accepts commands, other than opening it.
+		if _, ok := cmd.(*kmm.OpenAccount); !ok && !a.Opened {
+			return nil, fmt.Errorf("%w: %s", kmm.ErrAccountNotOpen, account)
+		}
+
+		// Decide if accepted and the resulting events.
+		// TODO: extract out additional headers as command fields, e.g. rita-command-id
+		events, err := a.Decide(&rita.Command{
+			Data: cmd,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(events) == 0 {
+			return nil, nil
+		}
+
+		// Append new events.
+		seq, err = es.Append(ctx, subject, events, rita.ExpectSequence(seq))
+		if err != nil {
+			return nil, err
+		}
+
+		syncSettings(ctx, account, events)
+
+		// Store a snapshot once enough events are appended since the last
+		// one. The events are the source of truth, so a failure is only
+		// logged.
+		if snapshots != nil && n+len(events) >= snapshotInterval {
+			for _, e := range events {
+				if err = a.Evolve(e); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				s.Sequence = seq
+				err = storeSnapshot(snapshots, account, s)
+			}
+			if err != nil {
+				log.Printf("snapshot of %s: %s", account, err)
+			}
+		}
+
+		return events, nil
+	}
+
+	// decideAccount decides the command and appends the events. If another
+	// event is appended to the account concurrently, the command is decided
+	// again against the latest state.
+	decideAccount := func(ctx context.Context, account string, cmd any) ([]*rita.Event, error) {
+		for i := 1; ; i++ {
+			events, err := appendDecision(ctx, account, cmd)
+			if !errors.Is(err, rita.ErrSequenceConflict) {
+				return events, err
+			}
+			if i >= maxAttempts {
+				return nil, fmt.Errorf("account %s changed concurrently, gave up after %d attempts: %w", account, i, err)
+			}
+		}
+	}
+
+	// Account commands handled by the services. All of them are decided
+	// against the account, except that a round-up must target another
+	// account which is open.
+	commands := commandRegistry{}
+	for _, op := range []string{"open-account", "close-account", "deposit-funds", "withdraw-funds", "set-budget", "adjust-budget", "roll-over-period", "remove-budget", "remove-round-up", "set-deposit-limit", "set-amount-step", "set-spend-reflection", "set-account-note", "create-savings-goal", "set-approval-threshold", "set-alert-threshold", "request-withdrawal", "approve-withdrawal", "deny-withdrawal", "set-allowance", "remove-allowance", "set-interest-rate", "reverse-transaction", "set-minimum-balance", "remove-minimum-balance", "freeze-account", "unfreeze-account"} {
+		commands.register(op, decideAccount)
+	}
+	commands.register("set-round-up", func(ctx context.Context, account string, cmd any) ([]*rita.Event, error) {
+		c, _ := cmd.(*kmm.SetRoundUp)
+		if c.Account == account {
+			return nil, &requestError{kmm.ErrRoundUpSameAccount}
+		}
+
+		s, _, err := loadAccount(ctx, es, snapshots, c.Account)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !s.Account.Opened:
+			return nil, fmt.Errorf("%w: %s", kmm.ErrAccountNotOpen, c.Account)
+		case s.Account.Archived:
+			return nil, fmt.Errorf("%w: %s", kmm.ErrAccountArchived, c.Account)
+		case s.Account.Closed:
+			return nil, fmt.Errorf("%w: %s", kmm.ErrAccountClosed, c.Account)
+		}
+		return decideAccount(ctx, account, cmd)
+	})
+
+	// transferRoundUp deposits the round-up into the round-up account. A
+	// deposit which fails for other reasons than being rejected, e.g. a
+	// timeout, is retried. Once it cannot be deposited, the round-up is
+	// refunded to the account, so it is never lost.
+	transferRoundUp := func(ctx context.Context, account string, event *rita.Event) {
+		r := event.Data.(*kmm.RoundUpWithdrawn)
+
 		var err error
-		natsCreds, err = decodeUserCredsToFile(os.Getenv("NATS_CREDS_B64"))
+		for i := 0; i < maxAttempts; i++ {
+			_, err = decideAccount(ctx, r.Account, &kmm.DepositFunds{
+				Amount:      r.Amount,
+				Description: fmt.Sprintf("round-up from %s", account),
+			})
+			if err == nil {
+				return
+			}
+			if errorType(err) != "other" {
+				break
+			}
+		}
+		log.Printf("round-up deposit from %s to %s: %s", account, r.Account, err)
+
+		_, err = decideAccount(ctx, account, &kmm.RefundRoundUp{
+			RoundUpID: event.ID,
+			Amount:    r.Amount,
+		})
+		if err != nil {
+			log.Printf("round-up refund of %s: %s", account, err)
+		}
+	}
+
+	// applyCommand decodes the command using the registry and applies it
+	// with the handler of the operation. It does not depend on the
+	// transport, so it is shared by the NATS services and the HTTP API.
+	// The command is applied once per idempotency key of the account, if
+	// any.
+	applyCommand := func(ctx context.Context, r *types.Registry, data []byte, account, operation, key string) (any, error) {
+		cmd, handle, err := commands.decode(r, data, operation)
+		if err != nil {
+			return nil, err
+		}
+
+		if key != "" {
+			done, err := reserveIdempotencyKey(idempotency, account, key, operation, data)
+			if err != nil {
+				return nil, err
+			}
+			if done {
+				return nil, nil
+			}
+		}
+
+		events, err := handle(ctx, account, cmd)
+		if err != nil {
+			if key != "" {
+				if err := releaseIdempotencyKey(idempotency, account, key); err != nil {
+					log.Printf("release idempotency key of %s: %s", account, err)
+				}
+			}
+			return nil, err
+		}
+
+		// The command is applied, so a failure to record it is only
+		// logged. A retry after the lease of the pending key applies it
+		// again.
+		if key != "" {
+			if err := completeIdempotencyKey(idempotency, account, key, operation, data); err != nil {
+				log.Printf("complete idempotency key of %s: %s", account, err)
+			}
+		}
+
+		// Transfer round-ups into the round-up account. The withdrawal has
+		// already been accepted, so it does not fail the command.
+		for _, e := range events {
+			if _, ok := e.Data.(*kmm.RoundUpWithdrawn); ok {
+				transferRoundUp(ctx, account, e)
+			}
+		}
+
+		return nil, nil
+	}
+
+	// handleCommand applies the command and records the attempt in the
+	// audit. The outcome is already decided, so a failure to record it is
+	// only logged.
+	handleCommand := func(ctx context.Context, r *types.Registry, data []byte, account, operation, key string) (any, error) {
+		result, err := applyCommand(ctx, r, data, account, operation, key)
+
+		b, _ := json.Marshal(newAuditRecord(time.Now(), operation, data, err))
+		if _, perr := js.Publish(fmt.Sprintf("kmm.audit.accounts.%s", account), b); perr != nil {
+			log.Printf("audit of %s: %s", account, perr)
+		}
+
+		return result, err
+	}
+
+	handleAuditQuery := func(ctx context.Context, account string) (any, error) {
+		records, err := loadAudit(ctx, nc, account)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(records)
+	}
+
+	// evolveAccount evolves the model over the account events. Queries do
+	// not implicitly create an account, so an account with no events is not
+	// found.
+	evolveAccount := func(ctx context.Context, account string, model rita.Evolver) error {
+		subject := fmt.Sprintf("kmm.events.accounts.%s", account)
+		seq, err := es.Evolve(ctx, subject, model)
+		if err != nil {
+			return err
+		}
+		if seq == 0 {
+			return kmm.ErrAccountNotFound
+		}
+		return nil
+	}
+
+	// handleRebuild evolves the projection from the first event of the
+	// account and stores it, if requested.
+	handleRebuild := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		var r rebuildRequest
+		if err := json.Unmarshal(msg.Data, &r); err != nil {
+			return nil, &requestError{err}
+		}
+
+		p, err := kmm.NewProjection(r.Projection)
+		if err != nil {
+			return nil, &requestError{err}
+		}
+		seq, err := es.Evolve(ctx, fmt.Sprintf("kmm.events.accounts.%s", account), p)
+		if err != nil {
+			return nil, err
+		}
+		if seq == 0 {
+			return nil, kmm.ErrAccountNotFound
+		}
+
+		// Replace the cached state, if any.
+		if r.Store {
+			kv := projections
+			if kv == nil {
+				if kv, err = projectionBucket(js); err != nil {
+					return nil, err
+				}
+			}
+			if err := storeProjection(kv, account, r.Projection, seq, p); err != nil {
+				return nil, err
+			}
+		}
+		return p, nil
+	}
+
+	// handleDryRun decides the command against the account like
+	// appendDecision, but returns the events and the resulting state rather
+	// than appending them.
+	handleDryRun := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		var r dryRunRequest
+		if err := json.Unmarshal(msg.Data, &r); err != nil {
+			return nil, &requestError{err}
+		}
+
+		cmd, _, err := commands.decode(requestRegistry(msg), r.Command, r.Operation)
+		if err != nil {
+			return nil, err
+		}
+
+		s, _, err := loadAccount(ctx, es, snapshots, account)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := cmd.(*kmm.OpenAccount); !ok && !s.Account.Opened {
+			return nil, fmt.Errorf("%w: %s", kmm.ErrAccountNotOpen, account)
+		}
+
+		d, err := kmm.NewDryRun(s.Account, cmd)
+		if err != nil {
+			return nil, err
+		}
+
+		// Name the events, since their data is not decoded by type.
+		for _, e := range d.Events {
+			e.Type, _ = tr.Lookup(e.Data)
+		}
+		return d, nil
+	}
+
+	handleEventsQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		subject := fmt.Sprintf("kmm.events.accounts.%s", account)
+		events, seq, err := es.Load(ctx, subject)
+		if err != nil {
+			return nil, err
+		}
+		if seq == 0 {
+			return nil, kmm.ErrAccountNotFound
+		}
+
+		return encodeBackup(events)
+	}
+
+	handleRestore := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		var r restoreRequest
+		if err := json.Unmarshal(msg.Data, &r); err != nil {
+			return nil, err
+		}
+
+		events, err := decodeBackup(r.Events)
+		if err != nil {
+			return nil, err
+		}
+
+		subject := fmt.Sprintf("kmm.events.accounts.%s", account)
+		existing, seq, err := es.Load(ctx, subject)
+		if err != nil {
+			return nil, err
+		}
+
+		if seq > 0 && !r.Force {
+			return nil, fmt.Errorf("account %s already has events", account)
+		}
+
+		// Report the changes prior to making them.
+		if r.DryRun {
+			return json.Marshal(newRestorePlan(events, len(existing), seq))
+		}
+
+		// The existing events are replaced rather than appended to, which
+		// would add up the state of both. The snapshot and projections of
+		// them are removed with them.
+		if seq > 0 {
+			if err := purgeSubject(ctx, nc, "kmm", subject, seq); err != nil {
+				return nil, err
+			}
+			if snapshots != nil {
+				_ = snapshots.Delete(account)
+			}
+			if projections != nil {
+				for _, name := range kmm.ProjectionNames() {
+					_ = projections.Delete(projectionKey(account, name))
+				}
+			}
+		}
+
+		// The original event times are retained so the restored
+		// events are backdated. An event appended since the purge
+		// fails the append.
+		renewEventIDs(events)
+		_, err = es.Append(ctx, subject, events, rita.ExpectSequence(0))
+		if err != nil {
+			return nil, err
+		}
+
+		if seq > 0 {
+			if _, err := rebuildSettings(ctx, es, settings, account); err != nil {
+				log.Printf("settings of %s: %s", account, err)
+			}
+		} else {
+			syncSettings(ctx, account, events)
+		}
+
+		return nil, nil
+	}
+
+	// handleMerge merges the transactions of the account into the target
+	// account and archives it. The account is archived first so no further
+	// transactions can occur while the transactions are appended to the
+	// target. Appending to the target is retried if another event is
+	// appended concurrently, since the merged events do not depend on the
+	// state of the target.
+	handleMerge := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		var r mergeRequest
+		if err := json.Unmarshal(msg.Data, &r); err != nil {
+			return nil, err
+		}
+
+		target := r.Account
+		if target == "" {
+			return nil, kmm.ErrAccountRequired
+		}
+		if target == account {
+			return nil, kmm.ErrMergeSameAccount
+		}
+
+		subject := fmt.Sprintf("kmm.events.accounts.%s", account)
+		targetSubject := fmt.Sprintf("kmm.events.accounts.%s", target)
+
+		events, seq, err := es.Load(ctx, subject)
+		if err != nil {
+			return nil, err
+		}
+		if seq == 0 {
+			return nil, kmm.ErrAccountNotFound
+		}
+
+		a := kmm.NewAccount()
+		for _, e := range events {
+			if err := a.Evolve(e); err != nil {
+				return nil, err
+			}
+		}
+		if a.Archived {
+			return nil, fmt.Errorf("%w: %s", kmm.ErrAccountArchived, account)
+		}
+
+		t := kmm.NewAccount()
+		tseq, err := es.Evolve(ctx, targetSubject, t)
+		if err != nil {
+			return nil, err
+		}
+		if tseq == 0 {
+			return nil, fmt.Errorf("%w: %s", kmm.ErrAccountNotFound, target)
+		}
+		if t.Archived {
+			return nil, fmt.Errorf("%w: %s", kmm.ErrAccountArchived, target)
+		}
+		if t.Closed {
+			return nil, fmt.Errorf("%w: %s", kmm.ErrAccountClosed, target)
+		}
+
+		// Report the changes prior to making them.
+		if r.DryRun {
+			p := kmm.NewMergePlan(account, target, events, t)
+			p.SourceSequence = seq
+			p.TargetSequence = tseq
+			return p, nil
+		}
+
+		// Check the source can be archived before merging into the target.
+		if _, err := a.Decide(&rita.Command{
+			Data: &kmm.ArchiveAccount{MergedInto: target},
+		}); err != nil {
+			return nil, err
+		}
+
+		// The transactions are appended to the target before the source is
+		// archived, so a failure leaves the source as is rather than
+		// archived with its funds lost. Transactions appended to the source
+		// in the meantime are merged before archiving again.
+		for {
+			merged := kmm.MergeTransactions(account, events)
+			for len(merged) > 0 {
+				_, err = es.Append(ctx, targetSubject, merged, rita.ExpectSequence(tseq))
+				if err == nil {
+					break
+				}
+				if !errors.Is(err, rita.ErrSequenceConflict) {
+					return nil, err
+				}
+
+				tseq, err = es.Evolve(ctx, targetSubject, kmm.NewAccount())
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			archived, err := a.Decide(&rita.Command{
+				Data: &kmm.ArchiveAccount{MergedInto: target},
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			_, err = es.Append(ctx, subject, archived, rita.ExpectSequence(seq))
+			if err == nil {
+				syncSettings(ctx, account, archived)
+				return nil, nil
+			}
+			if !errors.Is(err, rita.ErrSequenceConflict) {
+				return nil, err
+			}
+
+			var last uint64
+			events, last, err = es.Load(ctx, subject, rita.AfterSequence(seq))
+			if err != nil {
+				return nil, err
+			}
+			if last > 0 {
+				seq = last
+			}
+			for _, e := range events {
+				if err := a.Evolve(e); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	handleCurrentFundsQuery := func(ctx context.Context, account string) (any, error) {
+		return loadProjection(ctx, nc, es, projections, account, "current-funds")
+	}
+
+	handleBudgetSummaryQuery := func(ctx context.Context, account string) (any, error) {
+		return loadProjection(ctx, nc, es, projections, account, "budget-period")
+	}
+
+	handleCategoryPeriodsQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		var s kmm.CategoryPeriods
+
+		if err := evolveAccount(ctx, account, &s); err != nil {
+			return nil, err
+		}
+
+		return &s, nil
+	}
+
+	handleGoalsQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		var p kmm.SavingsGoalProgress
+
+		if err := evolveAccount(ctx, account, &p); err != nil {
+			return nil, err
+		}
+
+		return &p, nil
+	}
+
+	handleBudgetStateQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		a := kmm.NewAccount()
+		if err := evolveAccount(ctx, account, a); err != nil {
+			return nil, err
+		}
+
+		return kmm.NewBudgetState(a, time.Now()), nil
+	}
+
+	handleExplainWithdrawQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		v, err := requestRegistry(msg).UnmarshalType(msg.Data, "withdraw-funds")
 		if err != nil {
 			return nil, err
 		}
+
+		a := kmm.NewAccount()
+		if err := evolveAccount(ctx, account, a); err != nil {
+			return nil, err
+		}
+
+		return kmm.NewWithdrawalExplanation(a, v.(*kmm.WithdrawFunds)), nil
 	}
 
-	var copts []nats.Option
-	if natsCreds != "" {
-		copts = append(copts, nats.UserCredentials(natsCreds))
+	handleSettingsQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		entry, err := settings.Get(account)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			// Not stored yet, e.g. the account predates the bucket.
+			return rebuildSettings(ctx, es, settings, account)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return tr.UnmarshalType(entry.Value(), "account-settings")
 	}
 
-	if natsContext != "" {
-		return natscontext.Connect(natsContext, copts...)
+	handleAccountInfoQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		var s kmm.AccountInfo
+
+		if err := evolveAccount(ctx, account, &s); err != nil {
+			return nil, err
+		}
+
+		return &s, nil
 	}
 
-	return nats.Connect(natsUrl, copts...)
-}
+	handleDescriptionsQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		var s kmm.RecentDescriptions
 
-func main() {
-	if err := app.Run(os.Args); err != nil {
-		log.SetFlags(0)
-		log.Print(err)
+		if err := evolveAccount(ctx, account, &s); err != nil {
+			return nil, err
+		}
+
+		return &s, nil
 	}
-}
 
-func decodeUserCredsToFile(s string) (string, error) {
-	b, err := base64.StdEncoding.DecodeString(s)
-	if err != nil {
-		return "", err
+	handleInterestProjectionQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		v, err := requestRegistry(msg).UnmarshalType(msg.Data, "project-interest")
+		if err != nil {
+			return nil, err
+		}
+
+		q, _ := v.(*kmm.ProjectInterest)
+		if err := q.Validate(); err != nil {
+			return nil, err
+		}
+
+		var s kmm.CurrentFunds
+
+		if err := evolveAccount(ctx, account, &s); err != nil {
+			return nil, err
+		}
+
+		return kmm.NewInterestProjection(s.Amount, q, time.Now()), nil
 	}
-	f, err := ioutil.TempFile("", "")
-	if err != nil {
-		return "", err
+
+	handleBalanceSeriesQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		v, err := requestRegistry(msg).UnmarshalType(msg.Data, "get-balance-series")
+		if err != nil {
+			return nil, err
+		}
+
+		q, _ := v.(*kmm.GetBalanceSeries)
+		if err := q.Validate(); err != nil {
+			return nil, err
+		}
+
+		s := kmm.NewBalanceSeries(q)
+		if err := evolveAccount(ctx, account, s); err != nil {
+			return nil, err
+		}
+		s.Complete()
+
+		return s, nil
 	}
-	_, err = f.Write(b)
-	if err != nil {
-		return "", err
+
+	handleBalanceAsOfQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		v, err := requestRegistry(msg).UnmarshalType(msg.Data, "get-balance-as-of")
+		if err != nil {
+			return nil, err
+		}
+
+		q, _ := v.(*kmm.GetBalanceAsOf)
+		if err := q.Validate(); err != nil {
+			return nil, err
+		}
+
+		b := &kmm.BalanceAsOf{Time: q.Time}
+		if err := evolveAccount(ctx, account, b); err != nil {
+			return nil, err
+		}
+
+		return &b.Funds, nil
 	}
-	return f.Name(), f.Close()
-}
 
-func runServer(c *cli.Context) error {
-	natsEmbed := c.Bool("nats.embed")
-	httpAddr := c.String("http.addr")
+	handleCarryoverQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		h := kmm.NewPeriodHistory(maxClosedPeriods)
 
-	var (
-		nc  *nats.Conn
-		err error
-	)
+		if err := evolveAccount(ctx, account, h); err != nil {
+			return nil, err
+		}
 
-	if natsEmbed {
-		ns := testutil.NewNatsServer(4837)
-		defer ns.Shutdown()
-		nc, err = nats.Connect(ns.ClientURL())
-	} else {
-		nc, err = connectNats(c)
+		return kmm.NewCarryoverReport(h), nil
 	}
-	if err != nil {
-		return err
+
+	handleStatsQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		var s kmm.TransactionStats
+		if err := evolveAccount(ctx, account, &s); err != nil {
+			return nil, err
+		}
+		return &s, nil
 	}
-	defer nc.Drain() //nolint
 
-	js, err := nc.JetStream()
-	if err != nil {
-		return err
+	handleSpendingReportQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		v, err := requestRegistry(msg).UnmarshalType(msg.Data, "get-spending-report")
+		if err != nil {
+			return nil, err
+		}
+
+		q, _ := v.(*kmm.GetSpendingReport)
+		if err := q.Validate(); err != nil {
+			return nil, err
+		}
+
+		s := kmm.NewCategorySpending(q, time.Now())
+		if err := evolveAccount(ctx, account, s); err != nil {
+			return nil, err
+		}
+		return s, nil
 	}
 
-	// Initialize a new Rita instance.
-	rt, err := rita.New(nc, rita.TypeRegistry(tr))
-	if err != nil {
-		return err
+	handleNetFlowQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		v, err := requestRegistry(msg).UnmarshalType(msg.Data, "get-net-flow")
+		if err != nil {
+			return nil, err
+		}
+
+		q, _ := v.(*kmm.GetNetFlow)
+		if err := q.Validate(); err != nil {
+			return nil, err
+		}
+
+		f := kmm.NewNetFlow(q, time.Now())
+		if err := evolveAccount(ctx, account, f); err != nil {
+			return nil, err
+		}
+		return f, nil
 	}
 
-	// Create an event store. (this is idempotent)
-	es := rt.EventStore("kmm")
-	if natsEmbed {
-		_ = es.Delete()
+	// addLedgerConsumer creates an ephemeral consumer delivering the ledger
+	// of the account to the subject. It returns the name of the consumer,
+	// the balance before the first delivered event and the sequence of the
+	// last event of the history delivered.
+	addLedgerConsumer := func(ctx context.Context, account, subject string, q ledgerQuery) (string, decimal.Decimal, uint64, error) {
+		filter := fmt.Sprintf("kmm.events.accounts.%s", account)
+
+		config := &nats.ConsumerConfig{
+			DeliverSubject:    subject,
+			DeliverPolicy:     nats.DeliverAllPolicy,
+			FilterSubject:     filter,
+			InactiveThreshold: 5 * time.Second,
+			AckPolicy:         nats.AckNonePolicy,
+		}
+
+		events, lastSeq, err := es.Load(ctx, filter)
+		if err != nil {
+			return "", decimal.Zero, 0, err
+		}
+
+		// The time is resolved to the first event since it, so the
+		// consumer starts at a sequence which the last transactions to
+		// replay only move forward. Without events since the time, only
+		// new ones are delivered.
+		start := q.StartSequence
+		if !q.Since.IsZero() {
+			since := lastSeq + 1
+			for _, e := range events {
+				if e.Sequence >= start && !e.Time.Before(q.Since) {
+					since = e.Sequence
+					break
+				}
+			}
+			start = since
+		}
+		if q.Last > 0 {
+			i := sort.Search(len(events), func(i int) bool {
+				return events[i].Sequence >= start
+			})
+			if seq := ledgerStartSequence(events[i:], q.Last); seq > start {
+				start = seq
+			}
+		}
+		if start > 0 {
+			config.DeliverPolicy = nats.DeliverByStartSequencePolicy
+			config.OptStartSeq = start
+		}
+
+		// The balance before the first delivered event and the last event
+		// of the history delivered.
+		var (
+			funds kmm.CurrentFunds
+			last  uint64
+		)
+		for _, e := range events {
+			if e.Sequence < start {
+				_ = funds.Evolve(e)
+			} else {
+				last = e.Sequence
+			}
+		}
+
+		info, err := js.AddConsumer("kmm", config)
+		if err != nil {
+			return "", decimal.Zero, 0, err
+		}
+
+		return info.Name, funds.Amount, last, nil
 	}
-	err = es.Create(&nats.StreamConfig{
-		Subjects: []string{"kmm.events.>"},
-		MaxBytes: 512 * 1000 * 1000, // 512MiB
-	})
-	if err != nil {
+
+	handleLedgerQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
+		id, q := decodeLedgerQuery(msg.Data)
+		subject := fmt.Sprintf("kmm.streams.%s", id)
+
+		_, balance, last, err := addLedgerConsumer(ctx, account, subject, q)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(map[string]string{
+			"subject": subject,
+			"balance": balance.String(),
+			"last":    strconv.FormatUint(last, 10),
+		})
+	}
+
+	decideFamily := func(ctx context.Context, family string, cmd any) error {
+		subject := fmt.Sprintf("kmm.events.families.%s", family)
+
+		f := kmm.NewFamily(maxFamilyMembers)
+		seq, err := es.Evolve(ctx, subject, f)
+		if err != nil {
+			return err
+		}
+
+		events, err := f.Decide(&rita.Command{
+			Data: cmd,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = es.Append(ctx, subject, events, rita.ExpectSequence(seq))
 		return err
 	}
 
-	handleCommand := func(ctx context.Context, msg *nats.Msg, account, operation string) (any, error) {
-		// Unmarshal the command based on the type.
-		cmd, err := tr.UnmarshalType(msg.Data, operation)
+	handleFamilyCommand := func(ctx context.Context, msg *nats.Msg, family, operation string) (any, error) {
+		cmd, err := requestRegistry(msg).UnmarshalType(msg.Data, operation)
 		if err != nil {
 			if err == types.ErrTypeNotRegistered {
 				return nil, fmt.Errorf("unknown command: %s", operation)
@@ -492,81 +7052,141 @@ func runServer(c *cli.Context) error {
 			}
 		}
 
-		subject := fmt.Sprintf("kmm.events.accounts.%s", account)
+		// Only an open account can be added. An account can only be a
+		// member of one family, so check the index across all families and
+		// remove it from the other family if moving. It is added to the
+		// family first, so a failed add leaves it in the other family rather
+		// than in none.
+		if c, ok := cmd.(*kmm.AddFamilyMember); ok {
+			s, _, err := loadAccount(ctx, es, snapshots, c.Account)
+			if err != nil {
+				return nil, err
+			}
+			if !s.Account.Opened {
+				return nil, fmt.Errorf("%w: %s", kmm.ErrAccountNotOpen, c.Account)
+			}
 
-		// Initialize the aggregate and evolve the state.
-		a := kmm.NewAccount()
-		seq, err := es.Evolve(ctx, subject, a)
-		if err != nil {
-			return nil, err
+			var idx kmm.FamilyIndex
+			if _, err := es.Evolve(ctx, "kmm.events.families.*", &idx); err != nil {
+				return nil, err
+			}
+
+			other, err := idx.Check(c.Account, family, c.Move)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", err, idx.Accounts[c.Account])
+			}
+
+			if err := decideFamily(ctx, family, cmd); err != nil {
+				return nil, err
+			}
+
+			if other != "" {
+				err := decideFamily(ctx, other, &kmm.RemoveFamilyMember{Account: c.Account})
+				if err != nil {
+					return nil, fmt.Errorf("added %s to %s, but not removed from %s: %w", c.Account, family, other, err)
+				}
+			}
+			return nil, nil
 		}
 
-		// Decide if accepted and the resulting events.
-		// TODO: extract out additional headers as command fields, e.g. rita-command-id
-		events, err := a.Decide(&rita.Command{
-			Data: cmd,
-		})
+		return nil, decideFamily(ctx, family, cmd)
+	}
+
+	handleFamilyMembersQuery := func(ctx context.Context, msg *nats.Msg, family string) (any, error) {
+		f := kmm.NewFamily(maxFamilyMembers)
+
+		subject := fmt.Sprintf("kmm.events.families.%s", family)
+		_, err := es.Evolve(ctx, subject, f)
 		if err != nil {
 			return nil, err
 		}
 
-		// Append new events.
-		_, err = es.Append(ctx, subject, events, rita.ExpectSequence(seq))
+		return f, nil
+	}
+
+	// handleSearchQuery searches withdrawals across all accounts or only the
+	// accounts in the family, if set. Across all accounts, only those the
+	// user may operate on are searched.
+	handleSearchQuery := func(ctx context.Context, msg *nats.Msg, family string) (any, error) {
+		v, err := requestRegistry(msg).UnmarshalType(msg.Data, "search-transactions")
 		if err != nil {
 			return nil, err
 		}
 
-		return nil, nil
-	}
+		q, _ := v.(*kmm.SearchTransactions)
+		if err := q.Validate(); err != nil {
+			return nil, err
+		}
 
-	handleCurrentFundsQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
-		var s kmm.CurrentFunds
+		var accounts []string
+		if family != "" {
+			f := kmm.NewFamily(maxFamilyMembers)
+			_, err := es.Evolve(ctx, fmt.Sprintf("kmm.events.families.%s", family), f)
+			if err != nil {
+				return nil, err
+			}
+			accounts = f.Members
+			if accounts == nil {
+				accounts = []string{}
+			}
+		} else if auth != nil {
+			all, err := listAccounts(ctx, nc)
+			if err != nil {
+				return nil, err
+			}
+			if accounts, err = auth.allowedAccounts(msg, all); err != nil {
+				return nil, err
+			}
+		}
 
-		subject := fmt.Sprintf("kmm.events.accounts.%s", account)
-		_, err := es.Evolve(ctx, subject, &s)
+		s := kmm.NewTransactionSearch(q, accounts)
+		_, err = es.Evolve(ctx, "kmm.events.accounts.*", s)
 		if err != nil {
 			return nil, err
 		}
 
-		return &s, nil
+		return s, nil
 	}
 
-	handleBudgetSummaryQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
-		var s kmm.BudgetPeriod
-
-		subject := fmt.Sprintf("kmm.events.accounts.%s", account)
-		_, err := es.Evolve(ctx, subject, &s)
+	// authorizeFamily returns an error if the request is not signed by a user
+	// allowed to operate on all members of the family and, if a member is
+	// added or removed, on the account of the member.
+	authorizeFamily := func(ctx context.Context, msg *nats.Msg, family, operation string) error {
+		f := kmm.NewFamily(maxFamilyMembers)
+		_, err := es.Evolve(ctx, fmt.Sprintf("kmm.events.families.%s", family), f)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		accounts := f.Members
 
-		return &s, nil
-	}
+		switch operation {
+		case "add-family-member", "remove-family-member":
+			cmd, err := requestRegistry(msg).UnmarshalType(msg.Data, operation)
+			if err != nil {
+				return err
+			}
+			switch c := cmd.(type) {
+			case *kmm.AddFamilyMember:
+				accounts = append(accounts, c.Account)
+			case *kmm.RemoveFamilyMember:
+				accounts = append(accounts, c.Account)
+			}
+		}
 
-	handleLedgerQuery := func(ctx context.Context, msg *nats.Msg, account string) (any, error) {
-		var m map[string]string
-		_ = json.Unmarshal(msg.Data, &m)
-		subject := fmt.Sprintf("kmm.streams.%s", m["id"])
+		return auth.authorize(msg, accounts...)
+	}
 
-		_, err := js.AddConsumer("kmm", &nats.ConsumerConfig{
-			DeliverSubject:    subject,
-			DeliverPolicy:     nats.DeliverAllPolicy,
-			FilterSubject:     fmt.Sprintf("kmm.events.accounts.%s", account),
-			InactiveThreshold: 5 * time.Second,
-			AckPolicy:         nats.AckNonePolicy,
-		})
-		if err != nil {
-			return nil, err
+	respondError := func(msg *nats.Msg, err error) {
+		if legacyErrors {
+			_ = msg.Respond([]byte(err.Error()))
+			return
 		}
-
-		return json.Marshal(map[string]string{
-			"subject": subject,
-		})
+		_ = msg.RespondMsg(serviceErrorMsg(err))
 	}
 
 	respondMsg := func(msg *nats.Msg, result any, err error) {
 		if err != nil {
-			_ = msg.Respond([]byte(err.Error()))
+			respondError(msg, err)
 			return
 		}
 
@@ -582,16 +7202,16 @@ func runServer(c *cli.Context) error {
 		}
 
 		// Otherwise assume its part of the type registry.
-		b, err := tr.Marshal(result)
+		b, err := responseRegistry(msg).Marshal(result)
 		if err != nil {
-			_ = msg.Respond([]byte(err.Error()))
+			respondError(msg, err)
 		} else {
 			_ = msg.Respond(b)
 		}
 	}
 
 	// Service to handle services (request/reply).
-	sub1, err := nc.QueueSubscribe("kmm.services.*.*", "services", func(msg *nats.Msg) {
+	sub1, err := nc.QueueSubscribe("kmm.services.*.*", "services", instrument(func(msg *nats.Msg) error {
 		ctx := context.Background()
 
 		// Extract out account and command from subject.
@@ -606,39 +7226,570 @@ func runServer(c *cli.Context) error {
 			err    error
 		)
 
+		// Only a user allowed to operate on the account may.
+		if auth != nil {
+			if err = auth.authorize(msg, account); err != nil {
+				respondMsg(msg, nil, err)
+				return err
+			}
+		}
+
 		switch operation {
-		// Commands.
-		case "deposit-funds", "withdraw-funds", "set-budget", "remove-budget":
-			result, err = handleCommand(ctx, msg, account, operation)
+		case "restore":
+			result, err = handleRestore(ctx, msg, account)
+
+		case "merge":
+			result, err = handleMerge(ctx, msg, account)
+
+		case "rebuild":
+			result, err = handleRebuild(ctx, msg, account)
+
+		case "dry-run":
+			result, err = handleDryRun(ctx, msg, account)
 
 		// Queries.
+		case "events":
+			result, err = handleEventsQuery(ctx, msg, account)
+
+		case "audit":
+			result, err = handleAuditQuery(ctx, account)
+
 		case "balance":
-			result, err = handleCurrentFundsQuery(ctx, msg, account)
+			result, err = handleCurrentFundsQuery(ctx, account)
 
 		case "last-budget-period":
-			result, err = handleBudgetSummaryQuery(ctx, msg, account)
+			result, err = handleBudgetSummaryQuery(ctx, account)
+
+		case "budget-state":
+			result, err = handleBudgetStateQuery(ctx, msg, account)
+
+		case "category-periods":
+			result, err = handleCategoryPeriodsQuery(ctx, msg, account)
+
+		case "goals":
+			result, err = handleGoalsQuery(ctx, msg, account)
+
+		case "settings":
+			result, err = handleSettingsQuery(ctx, msg, account)
+
+		case "explain-withdraw":
+			result, err = handleExplainWithdrawQuery(ctx, msg, account)
+
+		case "balance-series":
+			result, err = handleBalanceSeriesQuery(ctx, msg, account)
+
+		case "balance-as-of":
+			result, err = handleBalanceAsOfQuery(ctx, msg, account)
+
+		case "carryover":
+			result, err = handleCarryoverQuery(ctx, msg, account)
+
+		case "stats":
+			result, err = handleStatsQuery(ctx, msg, account)
+
+		case "spending-report":
+			result, err = handleSpendingReportQuery(ctx, msg, account)
+
+		case "net-flow":
+			result, err = handleNetFlowQuery(ctx, msg, account)
 
 		case "ledger":
 			result, err = handleLedgerQuery(ctx, msg, account)
 
+		case "descriptions":
+			result, err = handleDescriptionsQuery(ctx, msg, account)
+
+		case "info":
+			result, err = handleAccountInfoQuery(ctx, msg, account)
+
+		case "interest-projection":
+			result, err = handleInterestProjectionQuery(ctx, msg, account)
+
+		// Commands.
 		default:
-			err = errors.New("unknown service operation")
+			if commands.has(operation) {
+				result, err = handleCommand(ctx, requestRegistry(msg), msg.Data, account, operation, msg.Header.Get(idempotencyKeyHdr))
+			} else {
+				err = errUnknownOperation
+			}
 		}
 
 		// Respond with result, error, or nil.
 		respondMsg(msg, result, err)
-	})
+		return err
+	}))
 	if err != nil {
 		return err
 	}
 	defer sub1.Unsubscribe() //nolint
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// Service to handle family management (request/reply).
+	sub2, err := nc.QueueSubscribe("kmm.families.*.*", "services", instrument(func(msg *nats.Msg) error {
+		ctx := context.Background()
+
+		// Extract out family and operation from subject.
+		toks := strings.Split(msg.Subject, ".")
+
+		family := toks[2]
+		operation := toks[3]
+
+		var (
+			result any
+			err    error
+		)
+
+		// Only a user allowed to operate on the accounts of the family may.
+		if auth != nil {
+			if err = authorizeFamily(ctx, msg, family, operation); err != nil {
+				respondMsg(msg, nil, err)
+				return err
+			}
+		}
+
+		switch operation {
+		// Commands.
+		case "add-family-member", "remove-family-member":
+			result, err = handleFamilyCommand(ctx, msg, family, operation)
+
+		// Queries.
+		case "members":
+			result, err = handleFamilyMembersQuery(ctx, msg, family)
+
+		case "search":
+			result, err = handleSearchQuery(ctx, msg, family)
+
+		default:
+			err = errUnknownOperation
+		}
+
+		respondMsg(msg, result, err)
+		return err
+	}))
+	if err != nil {
+		return err
+	}
+	defer sub2.Unsubscribe() //nolint
+
+	// Roll over the budget periods of all accounts which have ended, so
+	// periods without withdrawals are recorded.
+	if rolloverInterval > 0 {
+		go func() {
+			t := time.NewTicker(rolloverInterval)
+			defer t.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+				}
+
+				accounts, err := listAccounts(ctx, nc)
+				if err != nil {
+					log.Printf("rollover: %s", err)
+					continue
+				}
+
+				for _, account := range accounts {
+					_, err := decideAccount(ctx, account, &kmm.RollOverPeriod{})
+					switch {
+					case err == nil, errors.Is(err, kmm.ErrNoBudget), errors.Is(err, kmm.ErrAccountArchived), errors.Is(err, kmm.ErrAccountClosed):
+					default:
+						log.Printf("rollover of %s: %s", account, err)
+					}
+				}
+			}
+		}()
+	}
+
+	// Deposit the allowances which are due. Missed allowances, e.g. while
+	// the server was down, are deposited on the first tick.
+	if allowanceInterval > 0 {
+		go func() {
+			t := time.NewTicker(allowanceInterval)
+			defer t.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+				}
+
+				accounts, err := listAccounts(ctx, nc)
+				if err != nil {
+					log.Printf("allowance: %s", err)
+					continue
+				}
+
+				for _, account := range accounts {
+					_, err := decideAccount(ctx, account, &kmm.DepositAllowance{})
+					switch {
+					case err == nil, errors.Is(err, kmm.ErrNoAllowance), errors.Is(err, kmm.ErrAccountArchived), errors.Is(err, kmm.ErrAccountClosed):
+					default:
+						log.Printf("allowance of %s: %s", account, err)
+					}
+				}
+			}
+		}()
+	}
+
+	// Accrue the interest which is due.
+	if interestInterval > 0 {
+		go func() {
+			t := time.NewTicker(interestInterval)
+			defer t.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+				}
+
+				accounts, err := listAccounts(ctx, nc)
+				if err != nil {
+					log.Printf("interest: %s", err)
+					continue
+				}
+
+				for _, account := range accounts {
+					_, err := decideAccount(ctx, account, &kmm.AccrueInterest{})
+					switch {
+					case err == nil, errors.Is(err, kmm.ErrNoInterestRate), errors.Is(err, kmm.ErrAccountArchived), errors.Is(err, kmm.ErrAccountClosed):
+					default:
+						log.Printf("interest of %s: %s", account, err)
+					}
+				}
+			}
+		}()
+	}
+
+	// Publish the alerts raised by withdrawals appended from now on.
+	var alertSub *nats.Subscription
+	if alertsEnabled {
+		alerts, err := alertBucket(js)
+		if err != nil {
+			return err
+		}
+
+		alertSub, err = subscribeAlerts(js, es, rt, alerts, func(account string, a *kmm.Alert) {
+			b, err := tr.Marshal(a)
+			if err == nil {
+				err = nc.Publish(fmt.Sprintf("kmm.alerts.accounts.%s", account), b)
+			}
+			if err != nil {
+				log.Printf("alert of %s: %s", account, err)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		defer alertSub.Unsubscribe() //nolint
+	}
+
+	// Search across all accounts.
+	sub3, err := nc.QueueSubscribe("kmm.search", "services", instrument(func(msg *nats.Msg) error {
+		result, err := handleSearchQuery(context.Background(), msg, "")
+		respondMsg(msg, result, err)
+		return err
+	}))
+	if err != nil {
+		return err
+	}
+	defer sub3.Unsubscribe() //nolint
+
+	// List all accounts with their balances, or only those the user may
+	// operate on.
+	sub4, err := nc.QueueSubscribe("kmm.accounts", "services", instrument(func(msg *nats.Msg) error {
+		l := kmm.NewAccountList()
+		_, err := es.Evolve(context.Background(), "kmm.events.accounts.*", l)
+		if err == nil && auth != nil {
+			names := make([]string, len(l.Accounts))
+			for i, b := range l.Accounts {
+				names[i] = b.Account
+			}
+
+			var allowed []string
+			allowed, err = auth.allowedAccounts(msg, names)
+			if err == nil && allowed != nil {
+				keep := make(map[string]bool, len(allowed))
+				for _, a := range allowed {
+					keep[a] = true
+				}
+				accounts := l.Accounts[:0]
+				for _, b := range l.Accounts {
+					if keep[b.Account] {
+						accounts = append(accounts, b)
+					}
+				}
+				l.Accounts = accounts
+			}
+		}
+		respondMsg(msg, l, err)
+		return err
+	}))
+	if err != nil {
+		return err
+	}
+	defer sub4.Unsubscribe() //nolint
+
+	registerMetrics.Do(func() {
+		prometheus.MustRegister(commandsHandled, commandErrors, commandDuration)
+	})
+
+	// streamsCtx is done on shutdown, ending the ledger streams.
+	streamsCtx, closeStreams := context.WithCancel(context.Background())
+	defer closeStreams()
+
+	// handleLedgerStream streams the ledger of the account as server-sent
+	// events until the client disconnects. The query parameters are the
+	// same as of the ledger command, limit and since. A client which does
+	// not keep up is sent an error event and disconnected rather than
+	// missing events. It resumes after the last event it received by
+	// reconnecting with its ID as Last-Event-ID.
+	handleLedgerStream := func(w http.ResponseWriter, r *http.Request, account string) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeHTTPError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeHTTPError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+			return
+		}
+
+		var (
+			q   ledgerQuery
+			err error
+		)
+		if v := r.URL.Query().Get("limit"); v != "" {
+			if q.Last, err = strconv.Atoi(v); err != nil || q.Last < 0 {
+				writeHTTPError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+				return
+			}
+		}
+		if v := r.URL.Query().Get("since"); v != "" {
+			if q.Since, err = parseLedgerTime(v, time.Now()); err != nil {
+				writeHTTPError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if v := r.Header.Get("Last-Event-ID"); v != "" {
+			seq, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				writeHTTPError(w, http.StatusBadRequest, fmt.Errorf("invalid Last-Event-ID %q", v))
+				return
+			}
+			q = ledgerQuery{StartSequence: seq + 1}
+		}
+
+		ctx := r.Context()
+
+		// Subscribe before the consumer is created so no events are
+		// missed.
+		subject := fmt.Sprintf("kmm.streams.%s", nuid.Next())
+		msgs := make(chan *nats.Msg, 256)
+		sub, err := nc.ChanSubscribe(subject, msgs)
+		if err != nil {
+			writeHTTPError(w, http.StatusInternalServerError, err)
+			return
+		}
+		defer sub.Unsubscribe() //nolint
+
+		name, balance, _, err := addLedgerConsumer(ctx, account, subject, q)
+		if err != nil {
+			writeHTTPError(w, httpStatus(err), err)
+			return
+		}
+		defer js.DeleteConsumer("kmm", name) //nolint
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		// Messages are dropped once the channel is full, so the stream is
+		// checked for drops while idle too, e.g. if the last was dropped.
+		check := time.NewTicker(time.Second)
+		defer check.Stop()
+
+		for {
+			var msg *nats.Msg
+			select {
+			case <-ctx.Done():
+				return
+			case <-streamsCtx.Done():
+				return
+			case <-check.C:
+			case msg = <-msgs:
+			}
+
+			if n, _ := sub.Dropped(); n > 0 {
+				fmt.Fprint(w, "event: error\ndata: the stream fell behind, reconnect to resume\n\n")
+				flusher.Flush()
+				return
+			}
+			if msg == nil {
+				continue
+			}
+
+			event, err := rt.UnpackEvent(msg)
+			if err != nil {
+				log.Printf("ledger stream of %s: %s", account, err)
+				continue
+			}
+
+			balance = ledgerBalance(balance, event)
+			if _, ok := formatLedgerEvent(event); !ok {
+				continue
+			}
+
+			b, err := json.Marshal(&ledgerEvent{
+				Event:   event,
+				Balance: balance,
+			})
+			if err != nil {
+				log.Printf("ledger stream of %s: %s", account, err)
+				continue
+			}
+
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.Sequence, b); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+
+	// REST API mirroring the account services, e.g.
+	// POST /accounts/alice/deposit.
+	handleAccountHTTP := func(w http.ResponseWriter, r *http.Request) {
+		// HTTP requests are not signed, so none can be authorized.
+		if auth != nil {
+			writeHTTPError(w, http.StatusForbidden, fmt.Errorf("%w: the HTTP API is disabled by the auth policy", errPermissionDenied))
+			return
+		}
+
+		toks := strings.Split(strings.TrimPrefix(r.URL.Path, "/accounts/"), "/")
+		if len(toks) == 3 && toks[0] != "" && toks[1] == "ledger" && toks[2] == "stream" {
+			handleLedgerStream(w, r, toks[0])
+			return
+		}
+		if len(toks) != 2 || toks[0] == "" {
+			writeHTTPError(w, http.StatusNotFound, errors.New("not found"))
+			return
+		}
+		account, resource := toks[0], toks[1]
+
+		op, ok := accountResources[resource]
+		if !ok {
+			writeHTTPError(w, http.StatusNotFound, errors.New("not found"))
+			return
+		}
+		if r.Method != op.method {
+			w.Header().Set("Allow", op.method)
+			writeHTTPError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		ctx := r.Context()
+
+		var (
+			result any
+			err    error
+		)
+
+		switch op.operation {
+		case "deposit-funds", "withdraw-funds":
+			var data []byte
+			data, err = io.ReadAll(io.LimitReader(r.Body, 1<<20))
+			if err == nil {
+				result, err = handleCommand(ctx, contentTypeRegistry(r.Header.Get("Content-Type")), data, account, op.operation, r.Header.Get(idempotencyKeyHdr))
+			}
+		case "balance":
+			result, err = handleCurrentFundsQuery(ctx, account)
+		case "last-budget-period":
+			result, err = handleBudgetSummaryQuery(ctx, account)
+		}
+
+		if err != nil {
+			writeHTTPError(w, httpStatus(err), err)
+			return
+		}
+		if result == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result) //nolint
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/accounts/", handleAccountHTTP)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		msg := fmt.Sprintf(`Kids Money Manager - hosted on Fly.io, connected with Synadia's NGS
 	Connect %s
 `, nc.ConnectedUrl())
 		w.Write([]byte(msg)) //nolint
 	})
 
-	return http.ListenAndServe(httpAddr, nil)
+	srv := &http.Server{
+		Addr:    httpAddr,
+		Handler: mux,
+	}
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errch:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Print("shutting down")
+
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Ledger streams never finish on their own, so they are ended first.
+	// Their ephemeral consumers are deleted as they return.
+	log.Print("shutdown: closing ledger streams")
+	closeStreams()
+
+	log.Print("shutdown: waiting for http requests")
+	if err := srv.Shutdown(sctx); err != nil {
+		log.Printf("shutdown: http server: %s", err)
+	}
+
+	// Stop taking requests, but let the pending ones be handled.
+	log.Print("shutdown: unsubscribing services")
+	for _, sub := range []*nats.Subscription{sub1, sub2, sub3, sub4} {
+		if err := sub.Drain(); err != nil {
+			log.Printf("shutdown: unsubscribe %s: %s", sub.Subject, err)
+		}
+	}
+
+	// Alerts of the events appended by the pending requests are still
+	// published while draining.
+	if alertSub != nil {
+		log.Print("shutdown: stopping alerts")
+		if err := alertSub.Drain(); err != nil {
+			log.Printf("shutdown: stop alerts: %s", err)
+		}
+	}
+
+	log.Print("shutdown: draining nats")
+	if err := drainNats(sctx, nc); err != nil {
+		log.Printf("shutdown: drain nats: %s", err)
+	}
+
+	log.Print("shutdown complete")
+	return nil
 }
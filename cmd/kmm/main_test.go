@@ -0,0 +1,2095 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bruth/kmm"
+	"github.com/bruth/kmm/money"
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+	"github.com/bruth/rita/types"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopspring/decimal"
+	"github.com/urfave/cli/v2"
+)
+
+// d returns the decimal of the string, which is valid in tests.
+func d(s string) decimal.Decimal {
+	v, _ := decimal.NewFromString(s)
+	return v
+}
+
+func TestPrintReply(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	var buf bytes.Buffer
+
+	// Successful commands reply with no data.
+	printReply(&buf, &nats.Msg{}, false, "ok: deposited 10 into alice")
+	is.Equal(buf.String(), "ok: deposited 10 into alice\n")
+
+	buf.Reset()
+	printReply(&buf, &nats.Msg{}, true, "ok: deposited 10 into alice")
+	is.Equal(buf.String(), "")
+
+	// Errors are printed even when quiet.
+	buf.Reset()
+	printReply(&buf, serviceErrorMsg(kmm.ErrInsufficientFunds), true, "ok: withdrew 10 from alice")
+	is.Equal(buf.String(), "kmm: insufficient funds (insufficient_funds)\n")
+
+	buf.Reset()
+	printReply(&buf, &nats.Msg{Data: []byte("kmm: insufficient funds")}, true, "ok: withdrew 10 from alice")
+	is.Equal(buf.String(), "kmm: insufficient funds\n")
+}
+
+func TestPrintReplyJSON(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	var buf bytes.Buffer
+
+	confirm := map[string]string{"Account": "alice", "Amount": "10"}
+
+	is.NoErr(printReplyJSON(&buf, &nats.Msg{}, confirm))
+	is.Equal(buf.String(), "{\n  \"Account\": \"alice\",\n  \"Amount\": \"10\"\n}\n")
+
+	buf.Reset()
+	is.NoErr(printReplyJSON(&buf, serviceErrorMsg(kmm.ErrInsufficientFunds), confirm))
+	is.Equal(buf.String(), "{\n  \"Code\": \"insufficient_funds\",\n  \"Error\": \"kmm: insufficient funds\"\n}\n")
+
+	buf.Reset()
+	is.NoErr(printReplyJSON(&buf, &nats.Msg{Data: []byte("kmm: insufficient funds")}, confirm))
+	is.Equal(buf.String(), "{\n  \"Error\": \"kmm: insufficient funds\"\n}\n")
+}
+
+func TestApplyLines(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	input := `10,allowance
+2.50, candy
+
+abc,bad amount
+5
+`
+
+	t.Run("all", func(t *testing.T) {
+		var (
+			buf     bytes.Buffer
+			applied []string
+		)
+
+		err := applyLines(strings.NewReader(input), &buf, false, func(amount, description string) error {
+			applied = append(applied, amount+"|"+description)
+			return nil
+		})
+		is.Err(err, nil)
+		is.Equal(applied, []string{"10|allowance", "2.50|candy", "5|"})
+		is.Equal(buf.String(), `line 1: ok
+line 2: ok
+line 4: error: invalid amount "abc"
+line 5: ok
+3 succeeded, 1 failed
+`)
+	})
+
+	t.Run("fail-fast", func(t *testing.T) {
+		var (
+			buf     bytes.Buffer
+			applied []string
+		)
+
+		err := applyLines(strings.NewReader(input), &buf, true, func(amount, description string) error {
+			applied = append(applied, amount)
+			if amount == "2.50" {
+				return errors.New("kmm: insufficient funds")
+			}
+			return nil
+		})
+		is.Err(err, nil)
+		is.Equal(applied, []string{"10", "2.50"})
+		is.Equal(buf.String(), `line 1: ok
+line 2: error: kmm: insufficient funds
+1 succeeded, 1 failed
+`)
+	})
+}
+
+func TestRequest(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ns := testutil.NewNatsServer(-1)
+	defer testutil.ShutdownNatsServer(ns)
+
+	nc, err := nats.Connect(ns.ClientURL(), nats.CustomInboxPrefix("kmm.inbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	// Reply with the reply subject to assert the inbox prefix.
+	sub, err := nc.Subscribe("kmm.services.alice.balance", func(msg *nats.Msg) {
+		_ = msg.Respond([]byte(msg.Reply))
+	})
+	is.NoErr(err)
+	defer sub.Unsubscribe() //nolint
+
+	rep, err := request(nc, "kmm.services.alice.balance", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.True(strings.HasPrefix(string(rep.Data), "kmm.inbox."))
+
+	// No server handling the subject fails fast.
+	_, err = request(nc, "kmm.services.alice.unknown", nil)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	is.Equal(err.Error(), "kmm server not reachable for account alice")
+}
+
+func TestSelfTest(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ns := testutil.NewNatsServer(-1)
+	defer testutil.ShutdownNatsServer(ns)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	is.NoErr(err)
+
+	rt, err := rita.New(nc, rita.TypeRegistry(tr))
+	is.NoErr(err)
+
+	es := rt.EventStore("kmm")
+	ctx := context.Background()
+
+	// The stream does not exist.
+	is.Err(selfTest(ctx, js, es), nil)
+
+	is.NoErr(es.Create(&nats.StreamConfig{
+		Subjects: []string{"kmm.events.>"},
+	}))
+
+	is.NoErr(selfTest(ctx, js, es))
+
+	// Nothing is left behind.
+	info, err := js.StreamInfo("kmm")
+	is.NoErr(err)
+	is.Equal(info.State.Msgs, uint64(0))
+}
+
+func TestAccountSnapshot(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	tm := time.Date(2019, time.May, 3, 12, 0, 0, 0, time.UTC)
+
+	events := []*rita.Event{
+		{Data: &kmm.AccountOpened{Owner: "Alice", Time: tm}},
+		{Data: &kmm.FundsDeposited{Amount: d("20"), Time: tm}},
+		{Data: &kmm.BudgetSet{MaxWithdrawAmount: d("10"), Period: kmm.Weekly, PeriodStartTime: tm, NextPeriodStartTime: tm.AddDate(0, 0, 7)}},
+		{Data: &kmm.BudgetSet{MaxWithdrawAmount: d("5"), Period: kmm.Daily, Category: "snacks", PeriodStartTime: tm, NextPeriodStartTime: tm.AddDate(0, 0, 1)}},
+		{Data: &kmm.FundsWithdrawn{Amount: d("3"), Category: "snacks", Time: tm.Add(time.Hour)}},
+		{Data: &kmm.SavingsGoalCreated{Name: "bike", TargetAmount: d("50"), Time: tm}},
+		{Data: &kmm.FundsDeposited{Amount: d("5"), GoalName: "bike", Time: tm.Add(2 * time.Hour)}},
+		{Data: &kmm.AccountNoteSet{Note: "saving up", Time: tm}},
+	}
+	for i, e := range events {
+		e.Sequence = uint64(i + 1)
+	}
+
+	full := kmm.NewAccount()
+	for _, e := range events {
+		is.NoErr(full.Evolve(e))
+	}
+	want, err := tr.Marshal(full)
+	is.NoErr(err)
+
+	// A snapshot as of any event evolved over the events after it matches
+	// the full replay.
+	for i := range events {
+		s := newAccountSnapshot()
+		for _, e := range events[:i+1] {
+			is.NoErr(s.Account.Evolve(e))
+			s.Sequence = e.Sequence
+		}
+
+		data, err := json.Marshal(s)
+		is.NoErr(err)
+		s, err = decodeSnapshot(data)
+		is.NoErr(err)
+		is.Equal(s.Sequence, uint64(i+1))
+
+		for _, e := range events[i+1:] {
+			is.NoErr(s.Account.Evolve(e))
+		}
+
+		got, err := tr.Marshal(s.Account)
+		is.NoErr(err)
+		is.Equal(string(got), string(want))
+	}
+
+	// A snapshot of another version of the state is not used.
+	s := newAccountSnapshot()
+	s.Version = kmm.AccountVersion - 1
+	data, err := json.Marshal(s)
+	is.NoErr(err)
+	_, err = decodeSnapshot(data)
+	is.Err(err, errSnapshotVersion)
+}
+
+func TestSettingsBucket(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ns := testutil.NewNatsServer(-1)
+	defer testutil.ShutdownNatsServer(ns)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	is.NoErr(err)
+
+	rt, err := rita.New(nc, rita.TypeRegistry(tr))
+	is.NoErr(err)
+
+	es := rt.EventStore("kmm")
+	is.NoErr(es.Create(&nats.StreamConfig{
+		Subjects: []string{"kmm.events.>"},
+	}))
+
+	kv, err := settingsBucket(js)
+	is.NoErr(err)
+
+	ctx := context.Background()
+	subject := "kmm.events.accounts.alice"
+
+	_, err = rebuildSettings(ctx, es, kv, "alice")
+	is.Err(err, kmm.ErrAccountNotFound)
+
+	seq, err := es.Append(ctx, subject, []*rita.Event{
+		{Data: &kmm.AccountNoteSet{Note: "bike fund"}},
+	})
+	is.NoErr(err)
+
+	s, err := rebuildSettings(ctx, es, kv, "alice")
+	is.NoErr(err)
+	is.Equal(s.Note, "bike fund")
+
+	// Changing a setting updates the entry.
+	_, err = es.Append(ctx, subject, []*rita.Event{
+		{Data: &kmm.AccountNoteSet{Note: "skateboard fund"}},
+	}, rita.ExpectSequence(seq))
+	is.NoErr(err)
+
+	_, err = rebuildSettings(ctx, es, kv, "alice")
+	is.NoErr(err)
+
+	entry, err := kv.Get("alice")
+	is.NoErr(err)
+	v, err := tr.UnmarshalType(entry.Value(), "account-settings")
+	is.NoErr(err)
+	is.Equal(v.(*kmm.AccountSettings).Note, "skateboard fund")
+
+	// Rebuilt from the stream.
+	is.NoErr(kv.Delete("alice"))
+	s, err = rebuildSettings(ctx, es, kv, "alice")
+	is.NoErr(err)
+	is.Equal(s.Note, "skateboard fund")
+	is.Equal(s.Sequence, uint64(2))
+}
+
+func TestDecodeProjection(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	p := &kmm.CurrentFunds{Amount: decimal.NewFromInt(5)}
+	state, err := tr.Marshal(p)
+	is.NoErr(err)
+	data, err := json.Marshal(&cachedProjection{Sequence: 3, State: state})
+	is.NoErr(err)
+
+	v, seq, err := decodeProjection(data, "current-funds")
+	is.NoErr(err)
+	is.Equal(seq, uint64(3))
+	is.True(v.(*kmm.CurrentFunds).Amount.Equal(decimal.NewFromInt(5)))
+
+	_, _, err = decodeProjection(data, "account")
+	is.Err(err, kmm.ErrUnknownProjection)
+
+	_, _, err = decodeProjection([]byte("{"), "current-funds")
+	is.True(err != nil)
+}
+
+// newProjectionStore returns an event store and projections bucket on the
+// server.
+func newProjectionStore(tb testing.TB, url string) (*nats.Conn, *rita.EventStore, nats.KeyValue) {
+	nc, err := nats.Connect(url)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(nc.Close)
+
+	js, err := nc.JetStream()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	rt, err := rita.New(nc, rita.TypeRegistry(tr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	es := rt.EventStore("kmm")
+	if err := es.Create(&nats.StreamConfig{Subjects: []string{"kmm.events.>"}}); err != nil {
+		tb.Fatal(err)
+	}
+
+	kv, err := projectionBucket(js)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return nc, es, kv
+}
+
+func TestProjectionCache(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ns := testutil.NewNatsServer(-1)
+	defer testutil.ShutdownNatsServer(ns)
+
+	nc, es, kv := newProjectionStore(t, ns.ClientURL())
+
+	ctx := context.Background()
+	subject := "kmm.events.accounts.alice"
+
+	_, err := loadProjection(ctx, nc, es, kv, "alice", "current-funds")
+	is.Err(err, kmm.ErrAccountNotFound)
+
+	seq, err := es.Append(ctx, subject, []*rita.Event{
+		{Data: &kmm.FundsDeposited{Amount: decimal.NewFromInt(5)}},
+	})
+	is.NoErr(err)
+
+	p, err := loadProjection(ctx, nc, es, kv, "alice", "current-funds")
+	is.NoErr(err)
+	is.True(p.(*kmm.CurrentFunds).Amount.Equal(decimal.NewFromInt(5)))
+
+	entry, err := kv.Get(projectionKey("alice", "current-funds"))
+	is.NoErr(err)
+	_, cached, err := decodeProjection(entry.Value(), "current-funds")
+	is.NoErr(err)
+	is.Equal(cached, seq)
+
+	// Only the new events are evolved over the cached state.
+	seq, err = es.Append(ctx, subject, []*rita.Event{
+		{Data: &kmm.FundsWithdrawn{Amount: decimal.NewFromInt(2)}},
+	}, rita.ExpectSequence(seq))
+	is.NoErr(err)
+
+	p, err = loadProjection(ctx, nc, es, kv, "alice", "current-funds")
+	is.NoErr(err)
+	is.True(p.(*kmm.CurrentFunds).Amount.Equal(decimal.NewFromInt(3)))
+
+	entry, err = kv.Get(projectionKey("alice", "current-funds"))
+	is.NoErr(err)
+	_, cached, err = decodeProjection(entry.Value(), "current-funds")
+	is.NoErr(err)
+	is.Equal(cached, seq)
+
+	// A cached state ahead of the events is invalidated.
+	is.NoErr(storeProjection(kv, "alice", "current-funds", seq+10, &kmm.CurrentFunds{Amount: decimal.NewFromInt(100)}))
+	p, err = loadProjection(ctx, nc, es, kv, "alice", "current-funds")
+	is.NoErr(err)
+	is.True(p.(*kmm.CurrentFunds).Amount.Equal(decimal.NewFromInt(3)))
+}
+
+// BenchmarkProjectionCache compares the balance query of an account with
+// many events evolved over all events and read through the cache.
+func BenchmarkProjectionCache(b *testing.B) {
+	ns := testutil.NewNatsServer(-1)
+	defer testutil.ShutdownNatsServer(ns)
+
+	nc, es, kv := newProjectionStore(b, ns.ClientURL())
+
+	ctx := context.Background()
+	subject := "kmm.events.accounts.alice"
+
+	var seq uint64
+	for i := 0; i < 10; i++ {
+		events := make([]*rita.Event, 100)
+		for j := range events {
+			events[j] = &rita.Event{Data: &kmm.FundsDeposited{Amount: decimal.NewFromInt(1)}}
+		}
+		var err error
+		seq, err = es.Append(ctx, subject, events, rita.ExpectSequence(seq))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("cold", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := loadProjection(ctx, nc, es, nil, "alice", "current-funds"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := loadProjection(ctx, nc, es, kv, "alice", "current-funds"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// captureStdout returns what fn writes to stdout.
+func captureStdout(t *testing.T, fn func() error) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- b
+	}()
+
+	stdout := os.Stdout
+	os.Stdout = w
+	err = fn()
+	os.Stdout = stdout
+
+	w.Close()
+	return string(<-out), err
+}
+
+// startServer runs the server in-process until the context is done and
+// waits for the services to be subscribed. The returned channel receives
+// the error the server stopped with.
+func startServer(t *testing.T, ctx context.Context, url string, args ...string) <-chan error {
+	t.Helper()
+
+	// The writers are set so the app does not read stdout while it is
+	// being captured.
+	srv := &cli.App{
+		Name:      "kmm",
+		Reader:    strings.NewReader(""),
+		Writer:    io.Discard,
+		ErrWriter: io.Discard,
+		Commands:  []*cli.Command{serve},
+	}
+
+	errch := make(chan error, 1)
+	go func() {
+		args = append([]string{"kmm", "serve", "--nats.url", url, "--http.addr", "127.0.0.1:0"}, args...)
+		errch <- srv.RunContext(ctx, args)
+	}()
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := nc.Request("kmm.services.alice.balance", nil, time.Second)
+		if !errors.Is(err, nats.ErrNoResponders) {
+			return errch
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start")
+		}
+		select {
+		case err := <-errch:
+			t.Fatalf("server stopped: %s", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestConcurrentDeposits(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ns := testutil.NewNatsServer(-1)
+	defer testutil.ShutdownNatsServer(ns)
+
+	url := ns.ClientURL()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Deposits are decided concurrently by servers in the queue group. Each
+	// conflict means another deposit was appended, so one attempt per
+	// deposit is enough for all to succeed.
+	const deposits = 10
+	for i := 0; i < 3; i++ {
+		startServer(t, ctx, url, "--commands.max-attempts", strconv.Itoa(deposits))
+	}
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	rep, err := nc.Request("kmm.services.alice.open-account", []byte(`{"Owner":"Alice"}`), 5*time.Second)
+	is.NoErr(err)
+	is.Equal(string(rep.Data), "")
+
+	var wg sync.WaitGroup
+	replies := make(chan string, deposits)
+	for i := 0; i < deposits; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rep, err := nc.Request("kmm.services.alice.deposit-funds", []byte(`{"Amount":"1"}`), 5*time.Second)
+			if err != nil {
+				replies <- err.Error()
+				return
+			}
+			if err := replyError(rep); err != nil {
+				replies <- err.Error()
+				return
+			}
+			replies <- string(rep.Data)
+		}()
+	}
+	wg.Wait()
+	close(replies)
+
+	for r := range replies {
+		is.Equal(r, "")
+	}
+
+	rep, err = nc.Request("kmm.services.alice.balance", nil, 5*time.Second)
+	is.NoErr(err)
+	v, err := unmarshalReply(rep, "current-funds")
+	is.NoErr(err)
+	is.True(v.(*kmm.CurrentFunds).Amount.Equal(decimal.NewFromInt(deposits)))
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ns := testutil.NewNatsServer(-1)
+	defer testutil.ShutdownNatsServer(ns)
+
+	url := ns.ClientURL()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	startServer(t, ctx, url)
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	for _, account := range []string{"alice", "bob"} {
+		rep, err := nc.Request(fmt.Sprintf("kmm.services.%s.open-account", account), []byte(`{"Owner":"Someone"}`), 5*time.Second)
+		is.NoErr(err)
+		is.Equal(string(rep.Data), "")
+	}
+
+	sendAmount := func(account, operation, key, amount string) string {
+		subject := fmt.Sprintf("kmm.services.%s.%s", account, operation)
+		data := []byte(fmt.Sprintf(`{"Amount":"%s"}`, amount))
+		rep, err := nc.RequestMsg(commandMsg(subject, data, key), 5*time.Second)
+		is.NoErr(err)
+		if err := replyError(rep); err != nil {
+			return err.Error()
+		}
+		return string(rep.Data)
+	}
+
+	send := func(account, operation, key string) string {
+		return sendAmount(account, operation, key, "5")
+	}
+
+	balance := func(account string) decimal.Decimal {
+		rep, err := nc.Request(fmt.Sprintf("kmm.services.%s.balance", account), nil, 5*time.Second)
+		is.NoErr(err)
+		v, err := unmarshalReply(rep, "current-funds")
+		is.NoErr(err)
+		return v.(*kmm.CurrentFunds).Amount
+	}
+
+	// The retry is not applied again.
+	is.Equal(send("alice", "deposit-funds", "k1"), "")
+	is.Equal(send("alice", "deposit-funds", "k1"), "")
+	is.True(balance("alice").Equal(decimal.NewFromInt(5)))
+
+	// Keys are per account.
+	is.Equal(send("bob", "deposit-funds", "k1"), "")
+	is.True(balance("bob").Equal(decimal.NewFromInt(5)))
+
+	// A key cannot be reused for another command.
+	is.Equal(send("alice", "withdraw-funds", "k1"), errIdempotencyKeyReused.Error())
+
+	// A failed command is not recorded, so it can be retried.
+	is.Equal(send("alice", "withdraw-funds", "k2"), "")
+	is.True(strings.HasPrefix(send("alice", "withdraw-funds", "k3"), kmm.ErrInsufficientFunds.Error()))
+	is.Equal(send("alice", "deposit-funds", "k4"), "")
+	is.Equal(send("alice", "withdraw-funds", "k3"), "")
+	is.True(balance("alice").IsZero())
+
+	// A key cannot be reused for another payload.
+	is.Equal(sendAmount("alice", "deposit-funds", "k4", "7"), errIdempotencyKeyReused.Error())
+	is.True(balance("alice").IsZero())
+
+	// A key left pending past the lease is taken over.
+	js, err := nc.JetStream()
+	is.NoErr(err)
+	kv, err := js.KeyValue(idempotencyBucketName)
+	is.NoErr(err)
+	b, _ := json.Marshal(&idempotencyRecord{
+		Operation: "deposit-funds",
+		Hash:      idempotencyHash([]byte(`{"Amount":"5"}`)),
+		Reserved:  time.Now().Add(-idempotencyLease),
+	})
+	_, err = kv.Put(idempotencyBucketKey("alice", "k5"), b)
+	is.NoErr(err)
+	is.Equal(send("alice", "deposit-funds", "k5"), "")
+	is.True(balance("alice").Equal(decimal.NewFromInt(5)))
+}
+
+func TestRoundUpTransfer(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ns := testutil.NewNatsServer(-1)
+	defer testutil.ShutdownNatsServer(ns)
+
+	url := ns.ClientURL()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	startServer(t, ctx, url)
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	send := func(account, operation, data string) string {
+		rep, err := nc.Request(fmt.Sprintf("kmm.services.%s.%s", account, operation), []byte(data), 5*time.Second)
+		is.NoErr(err)
+		if err := replyError(rep); err != nil {
+			return err.Error()
+		}
+		return string(rep.Data)
+	}
+
+	balance := func(account string) decimal.Decimal {
+		rep, err := nc.Request(fmt.Sprintf("kmm.services.%s.balance", account), nil, 5*time.Second)
+		is.NoErr(err)
+		v, err := unmarshalReply(rep, "current-funds")
+		is.NoErr(err)
+		return v.(*kmm.CurrentFunds).Amount
+	}
+
+	for _, account := range []string{"alice", "savings"} {
+		is.Equal(send(account, "open-account", `{"Owner":"Someone"}`), "")
+	}
+	is.Equal(send("alice", "deposit-funds", `{"Amount":"10"}`), "")
+
+	// The round-up account must be open.
+	is.True(strings.HasPrefix(send("alice", "set-round-up", `{"Account":"nobody"}`), kmm.ErrAccountNotOpen.Error()))
+	is.Equal(send("alice", "set-round-up", `{"Account":"savings"}`), "")
+
+	is.Equal(send("alice", "withdraw-funds", `{"Amount":"1.75"}`), "")
+	is.True(balance("alice").Equal(d("8")))
+	is.True(balance("savings").Equal(d("0.25")))
+
+	// The deposit of 0.37 is rejected by the step of the round-up account,
+	// so the round-up is refunded.
+	is.Equal(send("savings", "set-amount-step", `{"Step":"0.25"}`), "")
+	is.Equal(send("alice", "withdraw-funds", `{"Amount":"1.63"}`), "")
+	is.True(balance("alice").Equal(d("6.37")))
+	is.True(balance("savings").Equal(d("0.25")))
+}
+
+func TestAddFamilyMember(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ns := testutil.NewNatsServer(-1)
+	defer testutil.ShutdownNatsServer(ns)
+
+	url := ns.ClientURL()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	startServer(t, ctx, url)
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	add := func(account string) error {
+		rep, err := nc.Request("kmm.families.smith.add-family-member", []byte(fmt.Sprintf(`{"Account":%q}`, account)), 5*time.Second)
+		is.NoErr(err)
+		return replyError(rep)
+	}
+
+	// The account must exist and be open.
+	err = add("alice")
+	is.True(err != nil && strings.HasPrefix(err.Error(), kmm.ErrAccountNotOpen.Error()))
+
+	rep, err := nc.Request("kmm.services.alice.open-account", []byte(`{"Owner":"Alice"}`), 5*time.Second)
+	is.NoErr(err)
+	is.NoErr(replyError(rep))
+	is.NoErr(add("alice"))
+
+	members, err := queryFamilyMembers(nc, "smith")
+	is.NoErr(err)
+	is.Equal(members, []string{"alice"})
+}
+
+func TestEndToEnd(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ns := testutil.NewNatsServer(-1)
+	defer testutil.ShutdownNatsServer(ns)
+
+	url := ns.ClientURL()
+	config := filepath.Join(t.TempDir(), "config.json")
+
+	// Amounts are printed in the system locale.
+	t.Setenv("LC_ALL", "en_US.UTF-8")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errch := startServer(t, ctx, url)
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	run := func(args ...string) (string, error) {
+		a := &cli.App{
+			Name:  "kmm",
+			Flags: app.Flags,
+			Commands: []*cli.Command{
+				openAccount,
+				deposit,
+				withdraw,
+				currentBalance,
+				setBudget,
+				lastBudgetPeriod,
+			},
+		}
+
+		args = append([]string{"kmm", "--config", config, args[0], "--nats.url", url}, args[1:]...)
+		return captureStdout(t, func() error {
+			return a.RunContext(ctx, args)
+		})
+	}
+
+	ok := func(args ...string) string {
+		out, err := run(args...)
+		is.NoErr(err)
+		return out
+	}
+
+	_, err = run("balance", "alice")
+	is.Err(err, kmm.ErrAccountNotFound)
+
+	// Accounts must be opened first.
+	is.Equal(ok("deposit", "alice", "20"), "kmm: account is not open: alice (account_not_open)\n")
+	is.Equal(ok("open", "alice", "Alice"), "ok: opened alice for Alice\n")
+
+	is.Equal(ok("deposit", "alice", "20", "allowance"), "ok: deposited 20 into alice\n")
+	is.Equal(ok("last-budget-period", "alice"), "no budget set\n")
+	is.Equal(ok("set-budget", "alice", "5", "weekly"), "ok: set weekly budget of 5 on alice\n")
+	is.Equal(ok("withdraw", "alice", "3", "candy"), "ok: withdrew 3 from alice\n")
+
+	// Rejected by the budget.
+	is.Equal(ok("withdraw", "alice", "3"), kmm.ErrExceedWithinPeriod.Error()+": remaining 2.00, requested 3.00 (exceed_within_period)\n")
+
+	is.Equal(ok("balance", "alice"), "$17.00\n")
+
+	out := ok("last-budget-period", "alice")
+	is.True(strings.Contains(out, "withdrawals: 1\n"))
+	is.True(strings.Contains(out, "total withdrawn: $3.00\n"))
+
+	// The state matches when read directly from the stream.
+	rt, err := rita.New(nc, rita.TypeRegistry(tr))
+	is.NoErr(err)
+
+	a := kmm.NewAccount()
+	_, err = rt.EventStore("kmm").Evolve(ctx, "kmm.events.accounts.alice", a)
+	is.NoErr(err)
+	is.True(a.CurrentFunds.Equal(decimal.NewFromInt(17)))
+	is.True(a.MaxWithdrawAmount.Equal(decimal.NewFromInt(5)))
+	is.Equal(a.PolicyPeriod, kmm.Weekly)
+
+	cancel()
+	is.NoErr(<-errch)
+}
+
+func TestPin(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	input := func(s string) *bufio.Reader {
+		return bufio.NewReader(strings.NewReader(s))
+	}
+
+	var (
+		cfg config
+		out bytes.Buffer
+	)
+
+	// No PIN set.
+	is.NoErr(checkPin(&cfg, "alice", input(""), &out))
+	is.Equal(out.String(), "")
+
+	is.Err(setPin(&cfg, "alice", input("12\n12\n"), &out), nil)
+	is.Err(setPin(&cfg, "alice", input("1234\n4321\n"), &out), nil)
+	is.NoErr(setPin(&cfg, "alice", input("1234\n1234\n"), &out))
+	is.True(!strings.Contains(cfg.Pins["alice"], "1234"))
+	is.True(strings.HasPrefix(cfg.Pins["alice"], "$2a$"))
+
+	// Correct PIN.
+	out.Reset()
+	is.NoErr(checkPin(&cfg, "alice", input("1234\n"), &out))
+	is.Equal(out.String(), "PIN for alice: ")
+
+	// Wrong PIN.
+	is.Err(checkPin(&cfg, "alice", input("4321\n"), &out), errWrongPin)
+	is.Err(checkPin(&cfg, "alice", input(""), &out), nil)
+
+	// Other accounts are not affected.
+	is.NoErr(checkPin(&cfg, "bob", input(""), &out))
+
+	// Changing the PIN requires the current one.
+	is.Err(setPin(&cfg, "alice", input("0000\n5678\n5678\n"), &out), errWrongPin)
+	is.NoErr(setPin(&cfg, "alice", input("1234\n5678\n5678\n"), &out))
+	is.NoErr(checkPin(&cfg, "alice", input("5678\n"), &out))
+
+	// From the environment.
+	t.Setenv("KMM_PIN", "5678")
+	is.NoErr(checkPin(&cfg, "alice", input(""), &out))
+	t.Setenv("KMM_PIN", "1234")
+	is.Err(checkPin(&cfg, "alice", input(""), &out), errWrongPin)
+
+	// No terminal is needed.
+	in, done, err := openPinInput()
+	is.NoErr(err)
+	is.Err(checkPin(&cfg, "alice", in, &out), errWrongPin)
+	done()
+	t.Setenv("KMM_PIN", "")
+
+	is.Err(removePin(&cfg, "alice", input("1234\n"), &out), errWrongPin)
+	is.NoErr(removePin(&cfg, "alice", input("5678\n"), &out))
+	is.NoErr(checkPin(&cfg, "alice", input(""), &out))
+	is.Err(removePin(&cfg, "alice", input(""), &out), nil)
+
+	// Round-trip through the config file.
+	path := filepath.Join(t.TempDir(), "kmm", "config.json")
+	is.NoErr(updatePins(path, func(cfg *config) error {
+		return setPin(cfg, "bob", input("2468\n2468\n"), &out)
+	}))
+	c, err := readConfig(path)
+	is.NoErr(err)
+	is.NoErr(checkPin(c, "bob", input("2468\n"), &out))
+}
+
+func TestHTTPStatus(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	is.Equal(httpStatus(&requestError{kmm.ErrNonZeroAmount}), http.StatusBadRequest)
+	is.Equal(httpStatus(&requestError{errors.New("invalid character 'x' looking for beginning of value")}), http.StatusBadRequest)
+	is.Equal(httpStatus(fmt.Errorf("gave up: %w", rita.ErrSequenceConflict)), http.StatusConflict)
+	is.Equal(httpStatus(kmm.ErrAccountNotFound), http.StatusNotFound)
+	is.Equal(httpStatus(fmt.Errorf("%w: balance 3.00, requested 5.00", kmm.ErrInsufficientFunds)), http.StatusUnprocessableEntity)
+	is.Equal(httpStatus(errors.New("nats: timeout")), http.StatusInternalServerError)
+}
+
+func TestServiceError(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	is.Equal(serviceErrorCode(fmt.Errorf("%w: balance 3.00, requested 5.00", kmm.ErrInsufficientFunds)), "insufficient_funds")
+	is.Equal(serviceErrorCode(kmm.ErrExceedWithinPeriod), "exceed_within_period")
+	is.Equal(serviceErrorCode(&requestError{errors.New("invalid character 'x' looking for beginning of value")}), "bad_request")
+	is.Equal(serviceErrorCode(fmt.Errorf("gave up: %w", rita.ErrSequenceConflict)), "conflict")
+	is.Equal(serviceErrorCode(kmm.ErrGoalExists), "rejected")
+	is.Equal(serviceErrorCode(errors.New("nats: timeout")), "internal")
+
+	msg := serviceErrorMsg(fmt.Errorf("%w: balance 3.00, requested 5.00", kmm.ErrInsufficientFunds))
+	is.Equal(msg.Header.Get(serviceErrorCodeHdr), "insufficient_funds")
+	is.Equal(string(msg.Data), `{"code":"insufficient_funds","message":"kmm: insufficient funds: balance 3.00, requested 5.00"}`)
+
+	err := replyError(msg)
+	is.Err(err, kmm.ErrInsufficientFunds)
+	is.Equal(err.Error(), "kmm: insufficient funds: balance 3.00, requested 5.00")
+
+	// Successful replies and legacy error replies have no header.
+	is.NoErr(replyError(&nats.Msg{}))
+	is.NoErr(replyError(&nats.Msg{Data: []byte("kmm: insufficient funds")}))
+}
+
+func TestAuditRecord(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	now := time.Date(2019, 9, 20, 14, 0, 0, 0, time.UTC)
+
+	r := newAuditRecord(now, "deposit-funds", []byte(`{"Amount":"5"}`), nil)
+	is.Equal(r.Outcome, auditAccepted)
+	is.Equal(string(r.Command), `{"Amount":"5"}`)
+	is.Equal(formatAuditRecord(r), "Fri Sep 20 14:00:00 2019 | deposit-funds | accepted")
+
+	r = newAuditRecord(now, "withdraw-funds", []byte(`{"Amount":"50"}`), fmt.Errorf("%w: balance 5.00, requested 50.00", kmm.ErrInsufficientFunds))
+	is.Equal(r.Outcome, auditRejected)
+	is.Equal(formatAuditRecord(r), "Fri Sep 20 14:00:00 2019 | withdraw-funds | rejected: kmm: insufficient funds: balance 5.00, requested 50.00")
+
+	// Commands which are not JSON are not retained.
+	r = newAuditRecord(now, "deposit-funds", []byte{0x0a, 0x01}, &requestError{errors.New("invalid character")})
+	is.True(r.Command == nil)
+
+	b, err := json.Marshal(r)
+	is.NoErr(err)
+	is.Equal(string(b), `{"time":"2019-09-20T14:00:00Z","operation":"deposit-funds","outcome":"rejected","error":"invalid character"}`)
+}
+
+type fakeCommand struct {
+	Name string
+}
+
+func (c *fakeCommand) Validate() error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+func TestAuthorizer(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	akp, err := nkeys.CreateAccount()
+	is.NoErr(err)
+	issuer, _ := akp.PublicKey()
+
+	// Credentials of a user issued by the account.
+	creds := func(kp nkeys.KeyPair, name string) string {
+		ukp, err := nkeys.CreateUser()
+		is.NoErr(err)
+		pub, _ := ukp.PublicKey()
+		seed, _ := ukp.Seed()
+
+		uc := jwt.NewUserClaims(pub)
+		uc.Name = name
+		token, err := uc.Encode(kp)
+		is.NoErr(err)
+
+		b, err := jwt.FormatUserConfig(token, seed)
+		is.NoErr(err)
+		path := filepath.Join(t.TempDir(), "user.creds")
+		is.NoErr(os.WriteFile(path, b, 0600))
+		return path
+	}
+
+	policy := filepath.Join(t.TempDir(), "policy.json")
+	is.NoErr(os.WriteFile(policy, []byte(`{"parent": ["alice", "bob"], "admin": ["*"]}`), 0600))
+	p, err := newAuthPolicy(nil, "file:"+policy)
+	is.NoErr(err)
+
+	_, err = newAuthPolicy(nil, "policy.json")
+	is.True(err != nil)
+
+	tm := time.Date(2022, time.June, 1, 12, 0, 0, 0, time.UTC)
+	auth := newAuthorizer([]string{issuer}, p, memoryNonces{})
+	auth.now = func() time.Time { return tm }
+
+	signed := func(creds, account, data string, t time.Time) *nats.Msg {
+		s, err := newRequestSigner(creds)
+		is.NoErr(err)
+		msg := &nats.Msg{
+			Subject: fmt.Sprintf("kmm.services.%s.withdraw-funds", account),
+			Data:    []byte(data),
+		}
+		is.NoErr(s.sign(msg, t))
+		return msg
+	}
+
+	parent := creds(akp, "parent")
+	is.NoErr(auth.authorize(signed(parent, "alice", `{"Amount": "5"}`, tm), "alice"))
+	is.Err(auth.authorize(signed(parent, "carol", `{"Amount": "5"}`, tm), "carol"), errPermissionDenied)
+	is.NoErr(auth.authorize(signed(creds(akp, "admin"), "carol", `{"Amount": "5"}`, tm), "carol"))
+
+	// The account of the subject is authorized rather than of the signed
+	// request.
+	is.Err(auth.authorize(signed(parent, "alice", `{"Amount": "5"}`, tm), "carol"), errPermissionDenied)
+
+	// Changed after signing.
+	msg := signed(parent, "alice", `{"Amount": "5"}`, tm)
+	msg.Data = []byte(`{"Amount": "500"}`)
+	is.Err(auth.authorize(msg, "alice"), errPermissionDenied)
+
+	// Signed too long ago.
+	is.Err(auth.authorize(signed(parent, "alice", `{"Amount": "5"}`, tm.Add(-time.Hour)), "alice"), errPermissionDenied)
+
+	// Not signed or issued by an untrusted account.
+	is.Err(auth.authorize(&nats.Msg{Subject: "kmm.services.alice.balance"}, "alice"), errPermissionDenied)
+	other, err := nkeys.CreateAccount()
+	is.NoErr(err)
+	is.Err(auth.authorize(signed(creds(other, "parent"), "alice", `{"Amount": "5"}`, tm), "alice"), errPermissionDenied)
+
+	// Replayed.
+	msg = signed(parent, "alice", `{"Amount": "5"}`, tm)
+	is.NoErr(auth.authorize(msg, "alice"))
+	is.Err(auth.authorize(msg, "alice"), errPermissionDenied)
+
+	// A nonce is chosen by the client, so it may have any characters.
+	s, err := newRequestSigner(parent)
+	is.NoErr(err)
+	msg = &nats.Msg{Subject: "kmm.services.alice.balance"}
+	ts := tm.Format(time.RFC3339Nano)
+	sig, err := s.kp.Sign(authPayload(msg, ts, "a nonce *"))
+	is.NoErr(err)
+	msg.Header = nats.Header{}
+	msg.Header.Set(authJWTHdr, s.jwt)
+	msg.Header.Set(authTimeHdr, ts)
+	msg.Header.Set(authNonceHdr, "a nonce *")
+	msg.Header.Set(authSigHdr, base64.RawURLEncoding.EncodeToString(sig))
+	is.NoErr(auth.authorize(msg, "alice"))
+	is.Err(auth.authorize(msg, "alice"), errPermissionDenied)
+
+	// All accounts must be allowed.
+	is.NoErr(auth.authorize(signed(parent, "alice", "", tm), "alice", "bob"))
+	is.Err(auth.authorize(signed(parent, "alice", "", tm), "alice", "carol"), errPermissionDenied)
+
+	allowed, err := auth.allowedAccounts(signed(parent, "alice", "", tm), []string{"alice", "carol", "bob"})
+	is.NoErr(err)
+	is.Equal(allowed, []string{"alice", "bob"})
+	allowed, err = auth.allowedAccounts(signed(creds(akp, "admin"), "alice", "", tm), []string{"alice", "carol"})
+	is.NoErr(err)
+	is.True(allowed == nil)
+}
+
+// memoryNonces is a nonceStore in memory. Like a bucket, it rejects keys
+// with characters other than those of nonceKeyChars.
+type memoryNonces map[string]bool
+
+const nonceKeyChars = "-/_=.abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func (n memoryNonces) Create(key string, value []byte) (uint64, error) {
+	if key == "" || strings.Trim(key, nonceKeyChars) != "" {
+		return 0, errors.New("invalid key")
+	}
+	if n[key] {
+		return 0, errors.New("key exists")
+	}
+	n[key] = true
+	return uint64(len(n)), nil
+}
+
+func TestCommandRegistry(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	reg, err := types.NewRegistry(map[string]*types.Type{
+		"fake-command": {Init: func() any { return &fakeCommand{} }},
+	})
+	is.NoErr(err)
+
+	commands := commandRegistry{}
+	commands.register("fake-command", func(ctx context.Context, account string, cmd any) ([]*rita.Event, error) {
+		c := cmd.(*fakeCommand)
+		return []*rita.Event{{Data: fmt.Sprintf("%s by %s", account, c.Name)}}, nil
+	})
+	commands.register("unknown-type", func(ctx context.Context, account string, cmd any) ([]*rita.Event, error) {
+		return nil, nil
+	})
+
+	is.True(commands.has("fake-command"))
+	is.True(!commands.has("deposit-funds"))
+
+	var rerr *requestError
+
+	_, _, err = commands.decode(reg, []byte(`{}`), "deposit-funds")
+	is.True(errors.As(err, &rerr))
+	is.Equal(err.Error(), "unknown command: deposit-funds")
+
+	// Registered without a type.
+	_, _, err = commands.decode(reg, []byte(`{}`), "unknown-type")
+	is.Equal(err.Error(), "unknown command: unknown-type")
+
+	_, _, err = commands.decode(reg, []byte(`{}`), "fake-command")
+	is.True(errors.As(err, &rerr))
+	is.Equal(err.Error(), "name is required")
+
+	cmd, handle, err := commands.decode(reg, []byte(`{"Name":"fake"}`), "fake-command")
+	is.NoErr(err)
+	events, err := handle(context.Background(), "alice", cmd)
+	is.NoErr(err)
+	is.Equal(events[0].Data, "alice by fake")
+
+	defer func() {
+		is.True(recover() != nil)
+	}()
+	commands.register("fake-command", nil)
+}
+
+func TestNoRespondersError(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	is.Equal(noRespondersError("kmm.services.alice.balance").Error(), "kmm server not reachable for account alice")
+	is.Equal(noRespondersError("kmm.families.smith.members").Error(), "kmm server not reachable for family smith")
+	is.Equal(noRespondersError("kmm.search").Error(), "kmm server not reachable: no server handling kmm.search")
+}
+
+func TestInstrument(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	is.Equal(errorType(kmm.ErrInsufficientFunds), "insufficient funds")
+	is.Equal(errorType(fmt.Errorf("%w: balance 3.00, requested 5.00", kmm.ErrInsufficientFunds)), "insufficient funds")
+	is.Equal(errorType(fmt.Errorf("gave up: %w", rita.ErrSequenceConflict)), "sequence conflict")
+	is.Equal(errorType(errors.New("unexpected end of JSON input")), "other")
+
+	handle := instrument(func(msg *nats.Msg) error {
+		if string(msg.Data) == "fail" {
+			return kmm.ErrNonZeroAmount
+		}
+		return nil
+	})
+
+	handled := promtestutil.ToFloat64(commandsHandled.WithLabelValues("deposit-funds"))
+	failed := promtestutil.ToFloat64(commandErrors.WithLabelValues("deposit-funds", "amount must be greater than zero"))
+
+	handle(&nats.Msg{Subject: "kmm.services.alice.deposit-funds"})
+	handle(&nats.Msg{Subject: "kmm.services.alice.deposit-funds", Data: []byte("fail")})
+
+	is.Equal(promtestutil.ToFloat64(commandsHandled.WithLabelValues("deposit-funds")), handled+2)
+	is.Equal(promtestutil.ToFloat64(commandErrors.WithLabelValues("deposit-funds", "amount must be greater than zero")), failed+1)
+}
+
+func TestResponseRegistry(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ten, _ := decimal.NewFromString("10")
+	funds := &kmm.CurrentFunds{Amount: ten}
+
+	// Default to JSON.
+	msg := nats.NewMsg("kmm.services.alice.balance")
+	b, err := responseRegistry(msg).Marshal(funds)
+	is.NoErr(err)
+	is.Equal(string(b), `{"Amount":"10"}`)
+
+	msg.Header.Set("Accept", "msgpack")
+	b, err = responseRegistry(msg).Marshal(funds)
+	is.NoErr(err)
+
+	v, err := trMsgPack.UnmarshalType(b, "current-funds")
+	is.NoErr(err)
+	is.True(v.(*kmm.CurrentFunds).Amount.Equal(ten))
+
+	// Not decodable as JSON.
+	_, err = tr.UnmarshalType(b, "current-funds")
+	is.Err(err, nil)
+}
+
+func TestSnakeCaseRegistry(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ten, _ := decimal.NewFromString("10")
+
+	msg := nats.NewMsg("kmm.services.alice.set-budget")
+	msg.Header.Set("Content-Type", "json-snake")
+	msg.Data = []byte(`{"max_amount":"10","period":"weekly","pro_rate":true}`)
+
+	v, err := requestRegistry(msg).UnmarshalType(msg.Data, "set-budget")
+	is.NoErr(err)
+	c := v.(*kmm.SetBudget)
+	is.True(c.MaxAmount.Equal(ten))
+	is.Equal(c.Period, kmm.Weekly)
+	is.True(c.ProRate)
+
+	// Snake case names are not matched by the default registry.
+	msg.Header.Del("Content-Type")
+	v, err = requestRegistry(msg).UnmarshalType(msg.Data, "set-budget")
+	is.NoErr(err)
+	is.True(v.(*kmm.SetBudget).MaxAmount.IsZero())
+
+	msg.Header.Set("Accept", "json-snake")
+	b, err := responseRegistry(msg).Marshal(&kmm.BudgetState{Period: kmm.Weekly, MaxWithdrawAmount: ten})
+	is.NoErr(err)
+	is.True(strings.Contains(string(b), `"max_withdraw_amount":"10"`))
+	is.True(strings.Contains(string(b), `"next_period_start_time":`))
+}
+
+func TestLedgerStartSequence(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ten, _ := decimal.NewFromString("10")
+
+	// Transactions at sequences 1, 3, 4 and 6.
+	events := []*rita.Event{
+		{Sequence: 1, Data: &kmm.FundsDeposited{Amount: ten}},
+		{Sequence: 2, Data: &kmm.BudgetSet{MaxWithdrawAmount: ten, Period: kmm.Weekly}},
+		{Sequence: 3, Data: &kmm.FundsWithdrawn{Amount: ten}},
+		{Sequence: 4, Data: &kmm.FundsDeposited{Amount: ten}},
+		{Sequence: 5, Data: &kmm.AccountNoteSet{Note: "saving up"}},
+		{Sequence: 6, Data: &kmm.FundsWithdrawn{Amount: ten}},
+	}
+
+	is.Equal(ledgerStartSequence(events, 1), uint64(6))
+	is.Equal(ledgerStartSequence(events, 2), uint64(4))
+	is.Equal(ledgerStartSequence(events, 3), uint64(3))
+	is.Equal(ledgerStartSequence(events, 4), uint64(1))
+
+	// Fewer transactions than the limit.
+	is.Equal(ledgerStartSequence(events, 5), uint64(0))
+	is.Equal(ledgerStartSequence(nil, 1), uint64(0))
+}
+
+func TestLedgerQuery(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	since := time.Date(2019, time.May, 3, 12, 0, 0, 0, time.UTC)
+
+	id, q := decodeLedgerQuery(encodeLedgerQuery("s1", ledgerQuery{Since: since, StartSequence: 42}))
+	is.Equal(id, "s1")
+	is.Equal(q.Last, 0)
+	is.True(q.Since.Equal(since))
+	is.Equal(q.StartSequence, uint64(42))
+
+	// Requests of older clients only have a limit.
+	_, q = decodeLedgerQuery([]byte(`{"id":"s2","limit":"5"}`))
+	is.Equal(q.Last, 5)
+	is.True(q.Since.IsZero())
+	is.Equal(q.StartSequence, uint64(0))
+}
+
+func TestLedgerSince(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ns := testutil.NewNatsServer(-1)
+	defer testutil.ShutdownNatsServer(ns)
+
+	url := ns.ClientURL()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	startServer(t, ctx, url)
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	send := func(operation, data string) {
+		rep, err := nc.Request(fmt.Sprintf("kmm.services.alice.%s", operation), []byte(data), 5*time.Second)
+		is.NoErr(err)
+		is.NoErr(replyError(rep))
+	}
+
+	send("open-account", `{"Owner":"Alice"}`)
+	for _, amount := range []string{"1", "2"} {
+		send("deposit-funds", fmt.Sprintf(`{"Amount":"%s"}`, amount))
+	}
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	for _, amount := range []string{"3", "4", "5"} {
+		send("deposit-funds", fmt.Sprintf(`{"Amount":"%s"}`, amount))
+	}
+
+	rt, err := rita.New(nc, rita.TypeRegistry(tr))
+	is.NoErr(err)
+
+	// replay returns the amounts and balances of the history delivered
+	// for the query.
+	replay := func(q ledgerQuery) []string {
+		lines := make(chan string, 10)
+		sub, ok, err := subscribeLedger(nc, rt, "alice", q, func(e *ledgerEvent) {
+			if dep, ok := e.Event.Data.(*kmm.FundsDeposited); ok {
+				lines <- fmt.Sprintf("%s=%s", dep.Amount, e.Balance)
+			}
+			if e.Last {
+				close(lines)
+			}
+		})
+		is.NoErr(err)
+		defer sub.Unsubscribe() //nolint
+		if !ok {
+			return nil
+		}
+
+		var out []string
+		for l := range lines {
+			out = append(out, l)
+		}
+		return out
+	}
+
+	is.Equal(replay(ledgerQuery{Since: since}), []string{"3=6", "4=10", "5=15"})
+
+	// The last transactions are the last since the time.
+	is.Equal(replay(ledgerQuery{Since: since, Last: 2}), []string{"4=10", "5=15"})
+	is.Equal(replay(ledgerQuery{Since: since, Last: 4}), []string{"3=6", "4=10", "5=15"})
+
+	// Nothing is since a later time.
+	is.Equal(len(replay(ledgerQuery{Since: time.Now()})), 0)
+
+	// The flags of the ledger command combine the same way.
+	t.Setenv("LC_ALL", "en_US.UTF-8")
+	config := filepath.Join(t.TempDir(), "config.json")
+
+	ledgerLines := func(args ...string) []string {
+		a := &cli.App{
+			Name:     "kmm",
+			Flags:    app.Flags,
+			Commands: []*cli.Command{ledger},
+		}
+
+		args = append([]string{"kmm", "--config", config, "ledger", "--nats.url", url, "--since", since.Format(time.RFC3339Nano)}, args...)
+		out, err := captureStdout(t, func() error {
+			return a.RunContext(ctx, append(args, "alice"))
+		})
+		is.NoErr(err)
+
+		var amounts []string
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			amounts = append(amounts, strings.Fields(line)[0])
+		}
+		return amounts
+	}
+
+	until := time.Now().Format(time.RFC3339Nano)
+	is.Equal(ledgerLines("--limit", "2", "--until", until), []string{"+$4.00", "+$5.00"})
+	is.Equal(ledgerLines("--page-size", "2"), []string{"+$3.00", "+$4.00"})
+	is.Equal(ledgerLines("--limit", "2", "--page-size", "1"), []string{"+$4.00"})
+
+	// The start sequence is after the first event since the time.
+	seq, err := lastSequence(ctx, nc, "kmm", "kmm.events.accounts.alice")
+	is.NoErr(err)
+	is.Equal(ledgerLines("--start-seq", strconv.FormatUint(seq, 10), "--page-size", "5"), []string{"+$5.00"})
+}
+
+func TestFormatLedgerLine(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	tm := time.Date(2019, time.May, 3, 12, 20, 30, 0, time.UTC)
+
+	events := []*rita.Event{
+		{Data: &kmm.FundsDeposited{Amount: d("10"), Time: tm, Description: "allowance"}},
+		{Data: &kmm.FundsWithdrawn{Amount: d("2.5"), Time: tm}},
+		{Data: &kmm.FundsDeposited{Amount: d("2.5"), Time: tm, ReversalOf: "a1"}},
+		{Data: &kmm.BudgetRemoved{PolicyRemoveTime: tm}},
+		{Data: &kmm.TransactionMerged{Amount: d("-1"), Time: tm, Account: "bob"}},
+	}
+
+	// Starts from the balance before the first replayed transaction.
+	balance := d("5")
+
+	var lines []string
+	for _, e := range events {
+		balance = ledgerBalance(balance, e)
+		if line, ok := formatLedgerLine(e, balance, decimal.Decimal.String); ok {
+			lines = append(lines, line)
+		}
+	}
+
+	is.Equal(lines, []string{
+		"+10 | Fri May  3 12:20:30 2019 | allowance                | 15",
+		"-2.5 | Fri May  3 12:20:30 2019 |                          | 12.5",
+		"+2.5 | Fri May  3 12:20:30 2019 | reversal of a1           | 15",
+		"-1 | Fri May  3 12:20:30 2019 | merged from bob          | 14",
+	})
+
+	// Amounts in a currency.
+	f, err := money.NewFormatter("USD", "en-US")
+	is.NoErr(err)
+	line, _ := formatLedgerLine(events[1], d("1234.5"), f.Format)
+	is.Equal(line, "-$2.50 | Fri May  3 12:20:30 2019 |                          | $1,234.50")
+}
+
+func TestFormatBalances(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	funds := &kmm.CurrentFunds{
+		Amount: decimal.RequireFromString("12.5"),
+		Balances: map[string]decimal.Decimal{
+			"GBP": decimal.RequireFromString("3"),
+			"EUR": decimal.RequireFromString("50"),
+		},
+	}
+
+	f, err := money.NewFormatter("USD", "en-US")
+	is.NoErr(err)
+	lines := formatBalances(funds, f.Format)
+	is.Equal(lines, []string{"$12.50", money.Format(funds.Balances["EUR"], "EUR"), money.Format(funds.Balances["GBP"], "GBP")})
+
+	// Updates of a watched balance.
+	var buf bytes.Buffer
+	printBalanceUpdate(&buf, "$12.50", false)
+	printBalanceUpdate(&buf, "$10.00", false)
+	is.Equal(buf.String(), "$12.50\n$10.00\n")
+
+	buf.Reset()
+	printBalanceUpdate(&buf, "$12.50", true)
+	printBalanceUpdate(&buf, "$10.00", true)
+	is.Equal(buf.String(), "\r\033[K$12.50\r\033[K$10.00")
+}
+
+func TestPrintDryRun(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	var buf bytes.Buffer
+	printDryRun(&buf, &kmm.DryRun{
+		Events:  []*rita.Event{{Type: "funds-withdrawn"}},
+		Balance: d("11"),
+		Budget: &kmm.BudgetState{
+			Period:            kmm.Weekly,
+			MaxWithdrawAmount: d("10"),
+			FundsWithdrawn:    d("4"),
+			Remaining:         d("6"),
+		},
+	})
+	is.Equal(buf.String(), `dry run: nothing committed
+events: funds-withdrawn
+balance: 11
+budget: 4 of 10 withdrawn in weekly period | 6 remaining
+`)
+
+	buf.Reset()
+	printDryRun(&buf, &kmm.DryRun{Balance: d("11")})
+	is.Equal(buf.String(), "dry run: nothing committed\nevents: none\nbalance: 11\n")
+}
+
+func TestPrintSpendingReport(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	s := &kmm.CategorySpending{
+		Categories: map[string]*kmm.CategoryTotal{
+			"games":           {Total: d("4"), Count: 1},
+			"snacks":          {Total: d("12.5"), Count: 5},
+			kmm.Uncategorized: {Total: d("4"), Count: 2},
+		},
+	}
+
+	var buf bytes.Buffer
+	printSpendingReport(&buf, s)
+
+	is.Equal(buf.String(), `CATEGORY       TOTAL  COUNT
+snacks         12.50  5
+games          4.00   1
+uncategorized  4.00   2
+`)
+}
+
+func TestFormatAlert(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	tm := time.Date(2019, time.May, 3, 12, 20, 30, 0, time.UTC)
+
+	is.Equal(formatAlert(&kmm.Alert{
+		Kind:       kmm.AlertLowBalance,
+		Balance:    decimal.RequireFromString("4"),
+		LowBalance: decimal.RequireFromString("5"),
+		Time:       tm,
+	}), "Fri May  3 12:20:30 2019 | low balance | 4.00 is below 5.00")
+
+	is.Equal(formatAlert(&kmm.Alert{
+		Kind: kmm.AlertBudgetNearlyExhausted,
+		Budget: &kmm.BudgetState{
+			Period:            kmm.Weekly,
+			MaxWithdrawAmount: decimal.RequireFromString("10"),
+			FundsWithdrawn:    decimal.RequireFromString("9.5"),
+		},
+		BudgetPercent: 90,
+		Time:          tm,
+	}), "Fri May  3 12:20:30 2019 | budget nearly exhausted | 9.50 of 10.00 withdrawn in weekly period, at least 90%")
+}
+
+func TestSubscribeAlerts(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ns := testutil.NewNatsServer(-1)
+	defer testutil.ShutdownNatsServer(ns)
+
+	nc, es, _ := newProjectionStore(t, ns.ClientURL())
+	js, err := nc.JetStream()
+	is.NoErr(err)
+	rt, err := rita.New(nc, rita.TypeRegistry(tr))
+	is.NoErr(err)
+	kv, err := alertBucket(js)
+	is.NoErr(err)
+
+	ctx := context.Background()
+	subject := "kmm.events.accounts.alice"
+
+	// The state before subscribing is loaded from the events.
+	seq, err := es.Append(ctx, subject, []*rita.Event{
+		{Data: &kmm.AlertThresholdSet{LowBalance: decimal.NewFromInt(5)}},
+		{Data: &kmm.FundsDeposited{Amount: decimal.NewFromInt(10)}},
+	})
+	is.NoErr(err)
+
+	// Two servers raise the alert, but only one passes it on.
+	alerts := make(chan string, 10)
+	for _, server := range []string{"a", "b"} {
+		server := server
+		sub, err := subscribeAlerts(js, es, rt, kv, func(account string, a *kmm.Alert) {
+			alerts <- fmt.Sprintf("%s %s %s", server, account, a.Kind)
+		})
+		is.NoErr(err)
+		defer sub.Unsubscribe() //nolint
+	}
+
+	_, err = es.Append(ctx, subject, []*rita.Event{
+		{Data: &kmm.FundsWithdrawn{Amount: decimal.NewFromInt(6)}},
+	}, rita.ExpectSequence(seq))
+	is.NoErr(err)
+
+	select {
+	case a := <-alerts:
+		is.True(strings.HasSuffix(a, " alice low-balance"))
+	case <-time.After(2 * time.Second):
+		t.Fatal("no alert")
+	}
+	select {
+	case a := <-alerts:
+		t.Fatalf("alert passed on twice: %s", a)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// The least recently used state is dropped.
+	states := newAlertStates(2)
+	states.put("alice", kmm.NewAccount())
+	states.put("bob", kmm.NewAccount())
+	is.True(states.get("alice") != nil)
+	states.put("carol", kmm.NewAccount())
+	is.True(states.get("bob") == nil)
+	is.True(states.get("alice") != nil)
+	is.True(states.get("carol") != nil)
+}
+
+func TestPrintNetFlow(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	f := &kmm.NetFlow{
+		PeriodStartTime: time.Date(2019, time.May, 1, 0, 0, 0, 0, time.UTC),
+		Deposited:       decimal.RequireFromString("20.25"),
+		Withdrawn:       decimal.RequireFromString("54"),
+		Net:             decimal.RequireFromString("-33.75"),
+	}
+
+	var buf bytes.Buffer
+	printNetFlow(&buf, f)
+
+	is.Equal(buf.String(), `since Wed May  1 00:00:00 2019
+deposited  20.25
+withdrawn  54.00
+net        -33.75
+`)
+}
+
+func TestParseLedgerTime(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	now := time.Date(2019, time.May, 3, 12, 0, 0, 0, time.UTC)
+
+	tm, err := parseLedgerTime("2019-05-01T08:00:00Z", now)
+	is.NoErr(err)
+	is.True(tm.Equal(time.Date(2019, time.May, 1, 8, 0, 0, 0, time.UTC)))
+
+	tm, err = parseLedgerTime("7d", now)
+	is.NoErr(err)
+	is.True(tm.Equal(time.Date(2019, time.April, 26, 12, 0, 0, 0, time.UTC)))
+
+	tm, err = parseLedgerTime("90m", now)
+	is.NoErr(err)
+	is.True(tm.Equal(time.Date(2019, time.May, 3, 10, 30, 0, 0, time.UTC)))
+
+	for _, s := range []string{"", "d", "-1d", "-2h", "yesterday"} {
+		_, err = parseLedgerTime(s, now)
+		is.Err(err, nil)
+	}
+}
+
+func TestFormatTailEvent(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ten, _ := decimal.NewFromString("10")
+	tm := time.Date(2019, time.May, 3, 12, 20, 30, 0, time.UTC)
+
+	var lines []string
+
+	events := []struct {
+		Account string
+		Event   *rita.Event
+	}{
+		{"alice", &rita.Event{Data: &kmm.FundsDeposited{Amount: ten, Time: tm, Description: "allowance"}}},
+		{"bob", &rita.Event{Data: &kmm.FundsWithdrawn{Amount: ten, Time: tm}}},
+		{"bob", &rita.Event{Data: &kmm.BudgetRemoved{PolicyRemoveTime: tm}}},
+	}
+
+	for _, e := range events {
+		if line, ok := formatTailEvent(e.Account, e.Event); ok {
+			lines = append(lines, line)
+		}
+	}
+
+	is.Equal(lines, []string{
+		"alice | +10 | Fri May  3 12:20:30 2019 | allowance",
+		"bob | -10 | Fri May  3 12:20:30 2019",
+	})
+}
+
+func TestPrintWithdrawalExplanation(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	d := decimal.RequireFromString
+
+	var buf bytes.Buffer
+	printWithdrawalExplanation(&buf, &kmm.WithdrawalExplanation{
+		Amount:  d("4"),
+		Balance: d("13"),
+		Budget: &kmm.BudgetState{
+			Period:            kmm.Weekly,
+			MaxWithdrawAmount: d("10"),
+			FundsWithdrawn:    d("7"),
+			Remaining:         d("3"),
+		},
+		Rule:   kmm.RuleBudgetExceeded,
+		Reason: kmm.ErrExceedWithinPeriod.Error(),
+	})
+	is.Equal(buf.String(), `amount: 4
+balance: 13
+budget: weekly
+max amount: 10
+withdrawn: 7
+remaining: 3
+result: rejected by budget-exceeded: kmm: withdrawal would exceed max amount allowed in current period
+`)
+
+	buf.Reset()
+	printWithdrawalExplanation(&buf, &kmm.WithdrawalExplanation{
+		Amount:  d("4"),
+		Balance: d("13"),
+		Rule:    kmm.RuleAllowed,
+	})
+	is.Equal(buf.String(), `amount: 4
+balance: 13
+budget: none
+result: allowed
+`)
+}
+
+func TestPrintPeriods(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	now := time.Date(2019, time.May, 3, 12, 20, 30, 0, time.UTC)
+
+	var buf bytes.Buffer
+	printPeriods(&buf, now)
+	is.Equal(buf.String(), `minutely: Starts every minute, for demos.
+period start: Fri May  3 12:20:00 2019
+next period start: Fri May  3 12:21:00 2019
+
+daily: Starts every day at midnight.
+period start: Fri May  3 00:00:00 2019
+next period start: Sat May  4 00:00:00 2019
+
+weekly: Starts every Monday at midnight.
+period start: Mon Apr 29 00:00:00 2019
+next period start: Mon May  6 00:00:00 2019
+
+monthly: Starts on the 1st of every month at midnight.
+period start: Wed May  1 00:00:00 2019
+next period start: Sat Jun  1 00:00:00 2019
+`)
+
+	// Each period is described.
+	for _, p := range kmm.Periods {
+		is.True(p.Description() != "")
+	}
+}
+
+func TestPrintPeriodWindow(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	now := time.Date(2019, time.May, 3, 12, 20, 30, 0, time.UTC)
+
+	tests := map[kmm.Period]string{
+		kmm.Minutely: `period start: Fri May  3 12:20:00 2019
+next period start: Fri May  3 12:21:00 2019
+`,
+		kmm.Daily: `period start: Fri May  3 00:00:00 2019
+next period start: Sat May  4 00:00:00 2019
+`,
+		kmm.Weekly: `period start: Mon Apr 29 00:00:00 2019
+next period start: Mon May  6 00:00:00 2019
+`,
+		kmm.Monthly: `period start: Wed May  1 00:00:00 2019
+next period start: Sat Jun  1 00:00:00 2019
+`,
+	}
+
+	for p, out := range tests {
+		t.Run(string(p), func(t *testing.T) {
+			var buf bytes.Buffer
+			printPeriodWindow(&buf, p, now)
+			is.Equal(buf.String(), out)
+		})
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	tm := time.Date(2019, time.May, 3, 12, 20, 30, 0, time.UTC)
+
+	events := []*rita.Event{
+		{Type: "funds-deposited", Time: tm, Data: &kmm.FundsDeposited{Amount: d("30"), Time: tm}},
+		{Type: "budget-set", Time: tm.Add(time.Minute), Data: &kmm.BudgetSet{MaxWithdrawAmount: d("10"), Period: kmm.Daily}},
+		{Type: "funds-withdrawn", Time: tm.Add(time.Hour), Data: &kmm.FundsWithdrawn{Amount: d("7.25"), Time: tm.Add(time.Hour), Description: "toy"}},
+	}
+
+	b, err := encodeBackup(events)
+	is.NoErr(err)
+
+	restored, err := decodeBackup(b)
+	is.NoErr(err)
+	is.Equal(len(restored), len(events))
+
+	for i, e := range restored {
+		is.Equal(e.Type, events[i].Type)
+		is.Equal(e.Time, events[i].Time)
+	}
+
+	// Evolve equivalent state.
+	var (
+		a1 = kmm.NewAccount()
+		a2 = kmm.NewAccount()
+	)
+	for i := range events {
+		is.NoErr(a1.Evolve(events[i]))
+		is.NoErr(a2.Evolve(restored[i]))
+	}
+	is.True(a2.CurrentFunds.Equal(d("22.75")))
+	is.True(a1.CurrentFunds.Equal(a2.CurrentFunds))
+	is.True(a1.MaxWithdrawAmount.Equal(a2.MaxWithdrawAmount))
+	is.Equal(a1.PolicyPeriod, a2.PolicyPeriod)
+
+	_, err = decodeBackup([]byte(`[{"type": "unknown-event", "data": {}}]`))
+	is.Err(err, nil)
+}
+
+func TestResolveProfile(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{
+  "profiles": {
+    "prod": {
+      "nats_url": "tls://connect.ngs.global",
+      "nats_creds": "/etc/kmm/prod.creds",
+      "nats_inbox_prefix": "_INBOX.kmm"
+    }
+  }
+}`), 0600)
+	is.NoErr(err)
+
+	resolve := func(args ...string) (*natsOptions, error) {
+		var (
+			opts *natsOptions
+			err  error
+		)
+		a := &cli.App{
+			Flags: app.Flags,
+			Commands: []*cli.Command{
+				{
+					Name:  "test",
+					Flags: natsFlags,
+					Action: func(c *cli.Context) error {
+						opts, err = resolveNatsOptions(c)
+						return nil
+					},
+				},
+			},
+		}
+		is.NoErr(a.Run(append([]string{"kmm", "--config", path}, args...)))
+		return opts, err
+	}
+
+	o, err := resolve("--profile", "prod", "test")
+	is.NoErr(err)
+	is.Equal(o.URL, "tls://connect.ngs.global")
+	is.Equal(o.Creds, "/etc/kmm/prod.creds")
+	is.Equal(o.Context, "")
+	is.Equal(o.InboxPrefix, "_INBOX.kmm")
+
+	// Explicit flags take precedence over the profile.
+	o, err = resolve("--profile", "prod", "test", "--nats.creds", "/tmp/dev.creds")
+	is.NoErr(err)
+	is.Equal(o.URL, "tls://connect.ngs.global")
+	is.Equal(o.Creds, "/tmp/dev.creds")
+
+	_, err = resolve("--profile", "staging", "test")
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), `profile "staging" not found`))
+}
+
+func TestUnmarshalReply(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	// Query of a never-used account.
+	_, err := unmarshalReply(serviceErrorMsg(kmm.ErrAccountNotFound), "current-funds")
+	is.Err(err, kmm.ErrAccountNotFound)
+
+	_, err = unmarshalReply(&nats.Msg{Data: []byte(kmm.ErrAccountNotFound.Error())}, "current-funds")
+	is.Err(err, kmm.ErrAccountNotFound)
+
+	// Account with zero funds.
+	v, err := unmarshalReply(&nats.Msg{Data: []byte(`{"Amount":"0"}`)}, "current-funds")
+	is.NoErr(err)
+	is.True(v.(*kmm.CurrentFunds).Amount.Equal(decimal.Zero))
+
+	_, err = unmarshalReply(&nats.Msg{Data: []byte("kmm: invalid period")}, "budget-period")
+	is.Equal(err.Error(), "kmm: invalid period")
+}
+
+func TestApplyMembers(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ten, _ := decimal.NewFromString("10")
+
+	accounts := map[string]*kmm.Account{
+		"alice": kmm.NewAccount(),
+		"bob":   kmm.NewAccount(),
+		"carol": kmm.NewAccount(),
+	}
+
+	setBudget := func(account string) error {
+		a, ok := accounts[account]
+		if !ok {
+			return kmm.ErrAccountNotFound
+		}
+		events, err := a.Decide(&rita.Command{
+			Data: &kmm.SetBudget{MaxAmount: ten, Period: kmm.Weekly},
+		})
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			is.NoErr(a.Evolve(e))
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	err := applyMembers([]string{"alice", "bob", "carol"}, &buf, setBudget)
+	is.NoErr(err)
+	is.Equal(buf.String(), `alice: ok
+bob: ok
+carol: ok
+3 succeeded, 0 failed
+`)
+
+	for _, a := range accounts {
+		is.Equal(a.PolicyPeriod, kmm.Weekly)
+		is.True(a.MaxWithdrawAmount.Equal(ten))
+	}
+
+	// A rejected account does not stop the rest.
+	buf.Reset()
+	err = applyMembers([]string{"alice", "dave", "carol"}, &buf, setBudget)
+	is.Err(err, nil)
+	is.Equal(buf.String(), `alice: ok
+dave: error: kmm: account not found
+carol: ok
+2 succeeded, 1 failed
+`)
+}
+
+func TestRestorePlan(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	b := []byte(`[
+  {"type": "funds-deposited", "time": "2019-05-03T12:00:00Z", "data": {"Amount": "12"}},
+  {"type": "funds-withdrawn", "time": "2019-05-03T13:00:00Z", "data": {"Amount": "2.50"}}
+]`)
+
+	events, err := decodeBackup(b)
+	is.NoErr(err)
+
+	p := newRestorePlan(events, 3, 7)
+	is.Equal(p.Events, 2)
+	is.Equal(p.Replaced, 3)
+	is.Equal(p.Sequence, uint64(7))
+	is.True(p.Balance.Equal(decimal.RequireFromString("9.5")))
+}
+
+func TestRestoreForce(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ns := testutil.NewNatsServer(-1)
+	defer testutil.ShutdownNatsServer(ns)
+
+	url := ns.ClientURL()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Snapshots of every event, so a stale snapshot would be read.
+	startServer(t, ctx, url, "--snapshots.interval", "1")
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	send := func(operation string, data []byte) error {
+		rep, err := nc.Request(fmt.Sprintf("kmm.services.alice.%s", operation), data, 5*time.Second)
+		is.NoErr(err)
+		return replyError(rep)
+	}
+
+	backup := func() ([]byte, []*rita.Event) {
+		rep, err := nc.Request("kmm.services.alice.events", nil, 5*time.Second)
+		is.NoErr(err)
+		is.NoErr(replyError(rep))
+		events, err := decodeBackup(rep.Data)
+		is.NoErr(err)
+		return rep.Data, events
+	}
+
+	balance := func() decimal.Decimal {
+		rep, err := nc.Request("kmm.services.alice.balance", nil, 5*time.Second)
+		is.NoErr(err)
+		v, err := unmarshalReply(rep, "current-funds")
+		is.NoErr(err)
+		return v.(*kmm.CurrentFunds).Amount
+	}
+
+	// withdrawal returns the ID of the withdrawal of the events.
+	withdrawal := func(events []*rita.Event) string {
+		for _, e := range events {
+			if w, ok := e.Data.(*kmm.FundsWithdrawn); ok && w.ReversalOf == "" {
+				return e.ID
+			}
+		}
+		return ""
+	}
+
+	is.NoErr(send("open-account", []byte(`{"Owner":"Alice"}`)))
+	is.NoErr(send("deposit-funds", []byte(`{"Amount":"10"}`)))
+	is.NoErr(send("withdraw-funds", []byte(`{"Amount":"3"}`)))
+
+	_, events := backup()
+	id := withdrawal(events)
+	is.NoErr(send("reverse-transaction", []byte(fmt.Sprintf(`{"TransactionID":%q}`, id))))
+	is.True(balance().Equal(d("10")))
+
+	b, events := backup()
+
+	restore := func(force bool) error {
+		data, _ := json.Marshal(&restoreRequest{Force: force, Events: b})
+		return send("restore", data)
+	}
+
+	is.Err(restore(false), nil)
+
+	// The events are replaced rather than appended to.
+	is.NoErr(restore(true))
+	is.True(balance().Equal(d("10")))
+
+	_, restored := backup()
+	is.Equal(len(restored), len(events))
+
+	// The reversal references the restored withdrawal.
+	rid := withdrawal(restored)
+	is.True(rid != id)
+	var reversalOf string
+	for _, e := range restored {
+		if dep, ok := e.Data.(*kmm.FundsDeposited); ok && dep.ReversalOf != "" {
+			reversalOf = dep.ReversalOf
+		}
+	}
+	is.Equal(reversalOf, rid)
+
+	err = send("reverse-transaction", []byte(fmt.Sprintf(`{"TransactionID":%q}`, rid)))
+	is.True(strings.HasPrefix(err.Error(), kmm.ErrAlreadyReversed.Error()))
+}
+
+func TestSelectContext(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	isKnown := func(name string) bool {
+		return name == "dev" || name == "prod"
+	}
+	known := func() []string {
+		return []string{"dev", "prod"}
+	}
+
+	tests := []struct {
+		Name    string
+		Options natsOptions
+		Context string
+		Err     string
+	}{
+		{"none", natsOptions{URL: "nats://localhost:4222"}, "", ""},
+		{"explicit", natsOptions{Context: "prod", contextSet: true}, "prod", ""},
+		{"explicit-with-url", natsOptions{URL: "nats://localhost:4222", Context: "prod", contextSet: true}, "prod", ""},
+		{"explicit-missing", natsOptions{Context: "staging", contextSet: true}, "", `unknown NATS context "staging", available: dev, prod`},
+		{"selected", natsOptions{Context: "dev"}, "dev", ""},
+		{"selected-with-url", natsOptions{URL: "nats://localhost:4222", Context: "dev"}, "", ""},
+		{"selected-missing", natsOptions{URL: "nats://localhost:4222", Context: "staging"}, "", ""},
+		{"selected-missing-no-url", natsOptions{Context: "staging"}, "", ""},
+	}
+
+	for _, x := range tests {
+		x := x
+		t.Run(x.Name, func(t *testing.T) {
+			ctx, err := selectContext(&x.Options, isKnown, known)
+			if x.Err != "" {
+				is.Equal(err.Error(), x.Err)
+				return
+			}
+			is.NoErr(err)
+			is.Equal(ctx, x.Context)
+		})
+	}
+
+	_, err := selectContext(&natsOptions{Context: "dev", contextSet: true}, func(string) bool { return false }, func() []string { return nil })
+	is.Equal(err.Error(), `unknown NATS context "dev", no contexts are available`)
+}
@@ -0,0 +1,94 @@
+package kmm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bruth/kmm/money"
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrInvalidCurrency      = errors.New("kmm: currency must be a three letter ISO 4217 code, e.g. EUR")
+	ErrNoCurrencyBalance    = errors.New("kmm: no balance in currency")
+	ErrCurrencyNotSupported = errors.New("kmm: only supported in the default currency")
+)
+
+// DefaultCurrency is the currency of transactions without a currency.
+// Budgets, limits, goals, round-ups, allowances and interest are all in the
+// default currency.
+var DefaultCurrency = "USD"
+
+// checkCurrency returns an error if the currency is set, but not an upper
+// case ISO 4217 code.
+func checkCurrency(currency string) error {
+	if currency == "" {
+		return nil
+	}
+	if len(currency) != 3 {
+		return fmt.Errorf("%w: %q", ErrInvalidCurrency, currency)
+	}
+	for _, r := range currency {
+		if r < 'A' || r > 'Z' {
+			return fmt.Errorf("%w: %q", ErrInvalidCurrency, currency)
+		}
+	}
+	return nil
+}
+
+// isForeign returns true if the currency is set and not the default
+// currency.
+func isForeign(currency string) bool {
+	return currency != "" && currency != DefaultCurrency
+}
+
+// addBalance adds the amount to the balance of the foreign currency in the
+// map of balances, which is created if nil.
+func addBalance(balances map[string]decimal.Decimal, currency string, amount decimal.Decimal) map[string]decimal.Decimal {
+	if balances == nil {
+		balances = make(map[string]decimal.Decimal)
+	}
+	balances[currency] = balances[currency].Add(amount)
+	return balances
+}
+
+// decideForeignWithdrawal decides a withdrawal in a currency other than the
+// default currency. The budget is not checked since it is in the default
+// currency. The amount step, per-transaction limit and minimum balance are
+// not converted, so they apply to the amount and balance of the currency as
+// is, as the approval threshold does.
+func (a *Account) decideForeignWithdrawal(c *WithdrawFunds) ([]*rita.Event, error) {
+	if a.Frozen {
+		return nil, ErrAccountFrozen
+	}
+	if err := a.checkAmountStep(c.Amount); err != nil {
+		return nil, err
+	}
+
+	balance, ok := a.Balances[c.Currency]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoCurrencyBalance, c.Currency)
+	}
+	if balance.LessThan(c.Amount) {
+		return nil, insufficientFunds(balance, c.Amount)
+	}
+	if !a.MinimumBalance.IsZero() && balance.Sub(c.Amount).LessThan(a.MinimumBalance) {
+		return nil, fmt.Errorf("%w: minimum %s, balance %s %s, requested %s", ErrBelowMinimumBalance, a.MinimumBalance.StringFixed(money.Places), balance.StringFixed(money.Places), c.Currency, c.Amount.StringFixed(money.Places))
+	}
+	if err := checkPerTransaction("", a.MaxPerTransaction, c.Amount); err != nil {
+		return nil, err
+	}
+
+	return []*rita.Event{
+		{
+			Data: &FundsWithdrawn{
+				Amount:      c.Amount,
+				Description: c.Description,
+				Category:    c.Category,
+				Currency:    c.Currency,
+				Time:        a.clock.Now(),
+			},
+		},
+	}, nil
+}
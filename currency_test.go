@@ -0,0 +1,90 @@
+package kmm
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+	"github.com/shopspring/decimal"
+)
+
+func TestCurrencyBalances(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Minute)
+	a := Account{clock: clock}
+
+	var (
+		funds CurrentFunds
+		seq   int
+	)
+
+	decide := func(cmd any) error {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			seq++
+			e.ID = fmt.Sprintf("e%d", seq)
+			is.NoErr(a.Evolve(e))
+			is.NoErr(funds.Evolve(e))
+		}
+		return err
+	}
+
+	is.Err((&DepositFunds{Amount: d("1"), Currency: "eur"}).Validate(), ErrInvalidCurrency)
+	is.Err((&WithdrawFunds{Amount: d("1"), Currency: "EURO"}).Validate(), ErrInvalidCurrency)
+
+	is.NoErr(decide(&SetBudget{MaxAmount: d("10"), Period: Daily}))
+	is.NoErr(decide(&DepositFunds{Amount: d("20")}))
+	is.NoErr(decide(&DepositFunds{Amount: d("50"), Currency: "EUR"}))
+	is.True(a.CurrentFunds.Equal(d("20")))
+	is.True(a.Balances["EUR"].Equal(d("50")))
+
+	// The default currency may be set explicitly.
+	is.NoErr(decide(&DepositFunds{Amount: d("1"), Currency: DefaultCurrency}))
+	is.True(a.CurrentFunds.Equal(d("21")))
+
+	// No balance in the currency.
+	is.Err(decide(&WithdrawFunds{Amount: d("1"), Currency: "GBP"}), ErrNoCurrencyBalance)
+	is.Err(decide(&WithdrawFunds{Amount: d("51"), Currency: "EUR"}), ErrInsufficientFunds)
+
+	// Not counted against the budget of the default currency.
+	is.NoErr(decide(&WithdrawFunds{Amount: d("30"), Currency: "EUR"}))
+	is.True(a.Balances["EUR"].Equal(d("20")))
+	is.True(a.FundsWithdrawnInPeriod.IsZero())
+	is.NoErr(decide(&WithdrawFunds{Amount: d("10")}))
+
+	is.Err(decide(&DepositFunds{Amount: d("5"), Currency: "EUR", GoalName: "bike"}), ErrCurrencyNotSupported)
+
+	// Reversals are in the currency of the transaction.
+	eur := fmt.Sprintf("e%d", seq-1)
+	is.NoErr(decide(&ReverseTransaction{TransactionID: eur}))
+	is.True(a.Balances["EUR"].Equal(d("50")))
+	is.True(a.CurrentFunds.Equal(d("11")))
+
+	balances := funds.ByCurrency()
+	is.Equal(len(balances), 2)
+	is.True(balances[DefaultCurrency].Equal(d("11")))
+	is.True(balances["EUR"].Equal(d("50")))
+
+	// The limits apply to the amount in the currency as is.
+	is.NoErr(decide(&SetApprovalThreshold{Amount: d("8")}))
+	is.Err(decide(&WithdrawFunds{Amount: d("9"), Currency: "EUR"}), ErrApprovalRequired)
+	is.NoErr(decide(&SetApprovalThreshold{}))
+
+	is.NoErr(decide(&SetBudget{MaxAmount: d("10"), Period: Daily, MaxPerTransaction: d("5")}))
+	is.Err(decide(&WithdrawFunds{Amount: d("6"), Currency: "EUR"}), ErrExceedsPerTransactionLimit)
+	is.NoErr(decide(&SetBudget{MaxAmount: d("10"), Period: Daily}))
+
+	is.NoErr(decide(&SetMinimumBalance{Amount: d("45")}))
+	is.Err(decide(&WithdrawFunds{Amount: d("6"), Currency: "EUR"}), ErrBelowMinimumBalance)
+	is.NoErr(decide(&RemoveMinimumBalance{}))
+
+	is.NoErr(decide(&SetAmountStep{Step: d("0.25")}))
+	is.Err(decide(&WithdrawFunds{Amount: d("0.10"), Currency: "EUR"}), ErrInvalidDenomination)
+	is.NoErr(decide(&SetAmountStep{Step: decimal.Zero}))
+
+	is.NoErr(decide(&WithdrawFunds{Amount: d("6"), Currency: "EUR"}))
+	is.True(a.Balances["EUR"].Equal(d("44")))
+}
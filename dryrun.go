@@ -0,0 +1,47 @@
+package kmm
+
+import (
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+// DryRun describes the events a command would append to the account and the
+// resulting state. Nothing is committed.
+type DryRun struct {
+	// Committed is always false, since the events are not appended.
+	Committed bool
+	Events    []*rita.Event
+	// Balance is the resulting balance and Balances the resulting balances
+	// in other currencies.
+	Balance  decimal.Decimal
+	Balances map[string]decimal.Decimal
+	// Budget is the resulting state of the budget, or nil if no budget is
+	// set.
+	Budget *BudgetState
+}
+
+// NewDryRun decides the command against the account and evolves the account
+// with the resulting events, without appending them. The account is changed,
+// so it must not be used afterwards. An error is returned if the command
+// would be rejected.
+func NewDryRun(a *Account, cmd any) (*DryRun, error) {
+	events, err := a.Decide(&rita.Command{Data: cmd})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		if err := a.Evolve(e); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &DryRun{
+		Events:   events,
+		Balance:  a.CurrentFunds,
+		Balances: a.Balances,
+	}
+	if a.PolicyPeriod != "" {
+		d.Budget = NewBudgetState(a, a.clock.Now())
+	}
+	return d, nil
+}
@@ -0,0 +1,46 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestDryRun(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Second)
+	a := &Account{clock: clock}
+
+	decide := func(cmd any) {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		is.NoErr(err)
+		for _, e := range events {
+			is.NoErr(a.Evolve(e))
+		}
+	}
+
+	decide(&DepositFunds{Amount: d("20")})
+
+	// The account is evolved with the events, as if appended.
+	r, err := NewDryRun(a, &WithdrawFunds{Amount: d("5")})
+	is.NoErr(err)
+	is.True(!r.Committed)
+	is.Equal(len(r.Events), 1)
+	is.True(r.Balance.Equal(d("15")))
+	is.True(r.Budget == nil)
+
+	decide(&SetBudget{MaxAmount: d("10"), Period: Weekly})
+
+	r, err = NewDryRun(a, &WithdrawFunds{Amount: d("4")})
+	is.NoErr(err)
+	is.True(r.Balance.Equal(d("11")))
+	is.True(r.Budget.FundsWithdrawn.Equal(d("4")))
+	is.True(r.Budget.Remaining.Equal(d("6")))
+
+	// Rejected against the resulting state.
+	_, err = NewDryRun(a, &WithdrawFunds{Amount: d("7")})
+	is.Err(err, ErrExceedWithinPeriod)
+}
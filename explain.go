@@ -0,0 +1,90 @@
+package kmm
+
+import (
+	"errors"
+
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+// Rules a withdrawal can be rejected by.
+const (
+	RuleAllowed           = "allowed"
+	RuleInvalidAmount     = "invalid-amount"
+	RuleArchived          = "archived"
+	RuleClosed            = "closed"
+	RuleFrozen            = "frozen"
+	RuleApprovalRequired  = "approval-required"
+	RuleInsufficientFunds = "insufficient-funds"
+	RuleMinimumBalance    = "minimum-balance"
+	RuleBudgetExceeded    = "budget-exceeded"
+	RulePerTransaction    = "per-transaction-limit"
+	RuleOther             = "other"
+)
+
+// WithdrawalExplanation describes whether a withdrawal would be accepted and
+// the state it was decided against. Nothing is changed.
+type WithdrawalExplanation struct {
+	Amount  decimal.Decimal
+	Balance decimal.Decimal
+	// Budget is the state of the budget at the time of the decision, or nil
+	// if no budget is set.
+	Budget *BudgetState
+	// Rule is the rule which would reject the withdrawal, or allowed.
+	Rule string
+	// Reason is the error the withdrawal would be rejected with.
+	Reason string
+}
+
+func (e *WithdrawalExplanation) Allowed() bool {
+	return e.Rule == RuleAllowed
+}
+
+// NewWithdrawalExplanation decides the withdrawal against the account without
+// applying it and explains the result.
+func NewWithdrawalExplanation(a *Account, c *WithdrawFunds) *WithdrawalExplanation {
+	e := &WithdrawalExplanation{
+		Amount:  c.Amount,
+		Balance: a.CurrentFunds,
+		Rule:    RuleAllowed,
+	}
+
+	if a.PolicyPeriod != "" {
+		e.Budget = NewBudgetState(a, a.clock.Now())
+	}
+
+	err := c.Validate()
+	if err == nil {
+		_, err = a.Decide(&rita.Command{Data: c})
+	}
+	if err == nil {
+		return e
+	}
+
+	e.Reason = err.Error()
+
+	switch {
+	case errors.Is(err, ErrNonZeroAmount), errors.Is(err, ErrInvalidDenomination):
+		e.Rule = RuleInvalidAmount
+	case errors.Is(err, ErrAccountArchived):
+		e.Rule = RuleArchived
+	case errors.Is(err, ErrAccountClosed):
+		e.Rule = RuleClosed
+	case errors.Is(err, ErrAccountFrozen):
+		e.Rule = RuleFrozen
+	case errors.Is(err, ErrApprovalRequired):
+		e.Rule = RuleApprovalRequired
+	case errors.Is(err, ErrInsufficientFunds):
+		e.Rule = RuleInsufficientFunds
+	case errors.Is(err, ErrBelowMinimumBalance):
+		e.Rule = RuleMinimumBalance
+	case errors.Is(err, ErrExceedWithinPeriod):
+		e.Rule = RuleBudgetExceeded
+	case errors.Is(err, ErrExceedsPerTransactionLimit):
+		e.Rule = RulePerTransaction
+	default:
+		e.Rule = RuleOther
+	}
+
+	return e
+}
@@ -0,0 +1,67 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestWithdrawalExplanation(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Second)
+	a := &Account{clock: clock}
+
+	decide := func(cmd any) {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		is.NoErr(err)
+		for _, e := range events {
+			is.NoErr(a.Evolve(e))
+		}
+	}
+
+	explain := func(amount string) *WithdrawalExplanation {
+		return NewWithdrawalExplanation(a, &WithdrawFunds{Amount: d(amount)})
+	}
+
+	decide(&DepositFunds{Amount: d("20")})
+
+	e := explain("5")
+	is.True(e.Allowed())
+	is.Equal(e.Reason, "")
+	is.True(e.Balance.Equal(d("20")))
+	is.True(e.Budget == nil)
+
+	e = explain("0")
+	is.Equal(e.Rule, RuleInvalidAmount)
+	is.Equal(e.Reason, ErrNonZeroAmount.Error())
+
+	e = explain("25")
+	is.Equal(e.Rule, RuleInsufficientFunds)
+	is.Equal(e.Reason, "kmm: insufficient funds: balance 20.00, requested 25.00")
+
+	decide(&SetBudget{MaxAmount: d("10"), Period: Weekly})
+	decide(&WithdrawFunds{Amount: d("7")})
+
+	e = explain("4")
+	is.Equal(e.Rule, RuleBudgetExceeded)
+	is.Equal(e.Reason, "kmm: withdrawal would exceed max amount allowed in current period: remaining 3.00, requested 4.00")
+	is.True(e.Balance.Equal(d("13")))
+	is.True(e.Budget.MaxWithdrawAmount.Equal(d("10")))
+	is.True(e.Budget.FundsWithdrawn.Equal(d("7")))
+	is.True(e.Budget.Remaining.Equal(d("3")))
+
+	is.True(explain("3").Allowed())
+
+	// Nothing is changed.
+	is.True(a.CurrentFunds.Equal(d("13")))
+	is.True(a.FundsWithdrawnInPeriod.Equal(d("7")))
+
+	decide(&ArchiveAccount{})
+
+	e = explain("1")
+	is.Equal(e.Rule, RuleArchived)
+	is.Equal(e.Reason, ErrAccountArchived.Error())
+}
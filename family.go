@@ -0,0 +1,186 @@
+package kmm
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/clock"
+)
+
+var (
+	ErrAccountRequired     = errors.New("kmm: account is required")
+	ErrFamilyFull          = errors.New("kmm: family has reached the max number of members")
+	ErrAlreadyFamilyMember = errors.New("kmm: account is already a member of the family")
+	ErrNotFamilyMember     = errors.New("kmm: account is not a member of the family")
+	ErrInOtherFamily       = errors.New("kmm: account is a member of another family")
+)
+
+// DefaultMaxFamilyMembers is the max number of accounts in a family if
+// not otherwise configured.
+const DefaultMaxFamilyMembers = 8
+
+var (
+	_ DeciderEvolver = &Family{}
+	_ rita.Evolver   = &FamilyIndex{}
+)
+
+type AddFamilyMember struct {
+	Account string
+	// Move the account out of the family it is currently a member of.
+	Move bool
+}
+
+func (c *AddFamilyMember) Validate() error {
+	if c.Account == "" {
+		return ErrAccountRequired
+	}
+	return nil
+}
+
+type FamilyMemberAdded struct {
+	Account string
+	Time    time.Time
+}
+
+type RemoveFamilyMember struct {
+	Account string
+}
+
+func (c *RemoveFamilyMember) Validate() error {
+	if c.Account == "" {
+		return ErrAccountRequired
+	}
+	return nil
+}
+
+type FamilyMemberRemoved struct {
+	Account string
+	Time    time.Time
+}
+
+func NewFamily(maxMembers int) *Family {
+	return &Family{
+		maxMembers: maxMembers,
+		clock:      clock.Time,
+	}
+}
+
+// Family aggregate which groups a set of accounts, e.g. siblings, into a
+// manageable unit. It decides whether an account can be added given the
+// max number of members.
+//
+// An account can only be a member of one family, however that constraint
+// spans families so it is checked using the FamilyIndex prior to deciding.
+type Family struct {
+	Members []string
+
+	maxMembers int
+	clock      clock.Clock
+}
+
+func (f *Family) IsMember(account string) bool {
+	for _, m := range f.Members {
+		if m == account {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Family) Decide(command *rita.Command) ([]*rita.Event, error) {
+	switch c := command.Data.(type) {
+	case *AddFamilyMember:
+		if f.IsMember(c.Account) {
+			return nil, ErrAlreadyFamilyMember
+		}
+
+		if len(f.Members) >= f.maxMembers {
+			return nil, ErrFamilyFull
+		}
+
+		return []*rita.Event{
+			{
+				Data: &FamilyMemberAdded{
+					Account: c.Account,
+					Time:    f.clock.Now(),
+				},
+			},
+		}, nil
+
+	case *RemoveFamilyMember:
+		if !f.IsMember(c.Account) {
+			return nil, ErrNotFamilyMember
+		}
+
+		return []*rita.Event{
+			{
+				Data: &FamilyMemberRemoved{
+					Account: c.Account,
+					Time:    f.clock.Now(),
+				},
+			},
+		}, nil
+	}
+
+	return nil, ErrUnknownCommand
+}
+
+func (f *Family) Evolve(event *rita.Event) error {
+	switch e := event.Data.(type) {
+	case *FamilyMemberAdded:
+		f.Members = append(f.Members, e.Account)
+
+	case *FamilyMemberRemoved:
+		for i, m := range f.Members {
+			if m == e.Account {
+				f.Members = append(f.Members[:i], f.Members[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// FamilyIndex maps each account to the family it is a member of. It is
+// evolved over the events of all families, using the last token of the
+// event subject as the family name.
+type FamilyIndex struct {
+	Accounts map[string]string
+}
+
+func (x *FamilyIndex) Evolve(event *rita.Event) error {
+	family := event.Subject[strings.LastIndexByte(event.Subject, '.')+1:]
+
+	switch e := event.Data.(type) {
+	case *FamilyMemberAdded:
+		if x.Accounts == nil {
+			x.Accounts = make(map[string]string)
+		}
+		x.Accounts[e.Account] = family
+
+	case *FamilyMemberRemoved:
+		if x.Accounts[e.Account] == family {
+			delete(x.Accounts, e.Account)
+		}
+	}
+
+	return nil
+}
+
+// Check returns the family the account must be removed from once it is
+// added to the target family. An empty string is returned if the account is
+// not a member of any other family. If move is false, ErrInOtherFamily is
+// returned for an account that is a member of another family.
+func (x *FamilyIndex) Check(account, family string, move bool) (string, error) {
+	other, ok := x.Accounts[account]
+	if !ok || other == family {
+		return "", nil
+	}
+	if !move {
+		return "", ErrInOtherFamily
+	}
+	return other, nil
+}
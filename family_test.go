@@ -0,0 +1,91 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestFamily(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	t.Run("add-members", func(t *testing.T) {
+		f := Family{
+			maxMembers: 2,
+			clock:      testutil.NewClock(time.Minute),
+		}
+
+		for _, a := range []string{"alice", "bob"} {
+			events, err := f.Decide(&rita.Command{
+				Data: &AddFamilyMember{Account: a},
+			})
+			is.NoErr(err)
+			f.Evolve(events[0])
+		}
+		is.Equal(f.Members, []string{"alice", "bob"})
+
+		// Exceeds the limit.
+		_, err := f.Decide(&rita.Command{
+			Data: &AddFamilyMember{Account: "carol"},
+		})
+		is.Err(err, ErrFamilyFull)
+
+		// Already a member.
+		_, err = f.Decide(&rita.Command{
+			Data: &AddFamilyMember{Account: "alice"},
+		})
+		is.Err(err, ErrAlreadyFamilyMember)
+
+		// Remove frees up a spot.
+		events, err := f.Decide(&rita.Command{
+			Data: &RemoveFamilyMember{Account: "alice"},
+		})
+		is.NoErr(err)
+		f.Evolve(events[0])
+		is.Equal(f.Members, []string{"bob"})
+
+		_, err = f.Decide(&rita.Command{
+			Data: &RemoveFamilyMember{Account: "alice"},
+		})
+		is.Err(err, ErrNotFamilyMember)
+
+		_, err = f.Decide(&rita.Command{
+			Data: &AddFamilyMember{Account: "carol"},
+		})
+		is.NoErr(err)
+	})
+
+	t.Run("move-member", func(t *testing.T) {
+		var idx FamilyIndex
+
+		idx.Evolve(&rita.Event{
+			Subject: "kmm.events.families.smith",
+			Data:    &FamilyMemberAdded{Account: "alice"},
+		})
+		is.Equal(idx.Accounts, map[string]string{"alice": "smith"})
+
+		// Adding to the same family is decided by the family itself.
+		other, err := idx.Check("alice", "smith", false)
+		is.NoErr(err)
+		is.Equal(other, "")
+
+		_, err = idx.Check("alice", "jones", false)
+		is.Err(err, ErrInOtherFamily)
+
+		other, err = idx.Check("alice", "jones", true)
+		is.NoErr(err)
+		is.Equal(other, "smith")
+
+		idx.Evolve(&rita.Event{
+			Subject: "kmm.events.families.smith",
+			Data:    &FamilyMemberRemoved{Account: "alice"},
+		})
+		idx.Evolve(&rita.Event{
+			Subject: "kmm.events.families.jones",
+			Data:    &FamilyMemberAdded{Account: "alice"},
+		})
+		is.Equal(idx.Accounts, map[string]string{"alice": "jones"})
+	})
+}
@@ -0,0 +1,154 @@
+package kmm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrGoalNameRequired  = errors.New("kmm: goal name is required")
+	ErrInvalidGoalTarget = errors.New("kmm: goal target amount must be greater than zero")
+	ErrGoalExists        = errors.New("kmm: goal already exists")
+	ErrGoalNotFound      = errors.New("kmm: goal not found")
+)
+
+var (
+	_ rita.Evolver = &SavingsGoalProgress{}
+)
+
+// CreateSavingsGoal creates a goal to save toward, e.g. a skateboard.
+// Deposits tagged with the goal name count toward the target amount.
+type CreateSavingsGoal struct {
+	Name         string
+	TargetAmount decimal.Decimal
+}
+
+func (c *CreateSavingsGoal) Validate() error {
+	if strings.TrimSpace(c.Name) == "" {
+		return ErrGoalNameRequired
+	}
+	if c.TargetAmount.LessThanOrEqual(decimal.Zero) {
+		return ErrInvalidGoalTarget
+	}
+	return nil
+}
+
+type SavingsGoalCreated struct {
+	Name         string
+	TargetAmount decimal.Decimal
+	Time         time.Time
+}
+
+// GoalReached is emitted with the deposit whose contribution crosses the
+// target amount of the goal.
+type GoalReached struct {
+	Name         string
+	TargetAmount decimal.Decimal
+	Time         time.Time
+}
+
+// SavingsGoal is the state of a goal of the account.
+type SavingsGoal struct {
+	TargetAmount decimal.Decimal
+	Contributed  decimal.Decimal
+	Reached      bool
+}
+
+// goalReached returns the event if a deposit of the amount reaches the goal
+// or nil otherwise. An error is returned if the goal does not exist.
+func (a *Account) goalReached(name string, amount decimal.Decimal, now time.Time) (*rita.Event, error) {
+	g, ok := a.Goals[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrGoalNotFound, name)
+	}
+	if g.Reached || g.Contributed.Add(amount).LessThan(g.TargetAmount) {
+		return nil, nil
+	}
+	return &rita.Event{
+		Data: &GoalReached{
+			Name:         name,
+			TargetAmount: g.TargetAmount,
+			Time:         now,
+		},
+	}, nil
+}
+
+func (a *Account) evolveSavingsGoal(event *rita.Event) {
+	switch e := event.Data.(type) {
+	case *SavingsGoalCreated:
+		if a.Goals == nil {
+			a.Goals = make(map[string]*SavingsGoal)
+		}
+		a.Goals[e.Name] = &SavingsGoal{TargetAmount: e.TargetAmount}
+
+	case *FundsDeposited:
+		if g, ok := a.Goals[e.GoalName]; ok {
+			g.Contributed = g.Contributed.Add(e.Amount)
+		}
+
+	case *GoalReached:
+		if g, ok := a.Goals[e.Name]; ok {
+			g.Reached = true
+		}
+	}
+}
+
+// GoalProgress is the progress toward a savings goal.
+type GoalProgress struct {
+	Name         string
+	TargetAmount decimal.Decimal
+	Contributed  decimal.Decimal
+	Reached      bool
+	ReachedTime  time.Time
+}
+
+// Percent returns the whole percent of the target amount contributed, which
+// may exceed 100.
+func (g *GoalProgress) Percent() decimal.Decimal {
+	return g.Contributed.Mul(decimal.NewFromInt(100)).Div(g.TargetAmount).Truncate(0)
+}
+
+// SavingsGoalProgress is the progress of each savings goal of the account in
+// the order they were created.
+type SavingsGoalProgress struct {
+	Goals []*GoalProgress
+}
+
+func (p *SavingsGoalProgress) goal(name string) *GoalProgress {
+	for _, g := range p.Goals {
+		if g.Name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+func (p *SavingsGoalProgress) Evolve(event *rita.Event) error {
+	switch e := event.Data.(type) {
+	case *SavingsGoalCreated:
+		p.Goals = append(p.Goals, &GoalProgress{
+			Name:         e.Name,
+			TargetAmount: e.TargetAmount,
+		})
+
+	case *FundsDeposited:
+		if e.GoalName == "" {
+			break
+		}
+		if g := p.goal(e.GoalName); g != nil {
+			g.Contributed = g.Contributed.Add(e.Amount)
+		}
+
+	case *GoalReached:
+		if g := p.goal(e.Name); g != nil {
+			g.Reached = true
+			g.ReachedTime = e.Time
+		}
+	}
+	return nil
+}
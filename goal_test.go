@@ -0,0 +1,70 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestSavingsGoal(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Second)
+	a := Account{clock: clock}
+
+	var p SavingsGoalProgress
+
+	decide := func(cmd any) ([]*rita.Event, error) {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			is.NoErr(a.Evolve(e))
+			is.NoErr(p.Evolve(e))
+		}
+		return events, err
+	}
+
+	is.Err((&CreateSavingsGoal{Name: " ", TargetAmount: d("50")}).Validate(), ErrGoalNameRequired)
+	is.Err((&CreateSavingsGoal{Name: "skateboard"}).Validate(), ErrInvalidGoalTarget)
+
+	_, err := decide(&CreateSavingsGoal{Name: "skateboard", TargetAmount: d("50")})
+	is.NoErr(err)
+	_, err = decide(&CreateSavingsGoal{Name: "skateboard", TargetAmount: d("60")})
+	is.Err(err, ErrGoalExists)
+
+	_, err = decide(&DepositFunds{Amount: d("5"), GoalName: "bike"})
+	is.Err(err, ErrGoalNotFound)
+
+	// Deposits not tagged to the goal do not count.
+	_, err = decide(&DepositFunds{Amount: d("10")})
+	is.NoErr(err)
+	events, err := decide(&DepositFunds{Amount: d("20"), GoalName: "skateboard"})
+	is.NoErr(err)
+	is.Equal(len(events), 1)
+
+	g := p.Goals[0]
+	is.Equal(g.Name, "skateboard")
+	is.True(g.Contributed.Equal(d("20")))
+	is.True(g.Percent().Equal(d("40")))
+	is.True(!g.Reached)
+
+	// Crossing the target emits the goal being reached once.
+	events, err = decide(&DepositFunds{Amount: d("35"), GoalName: "skateboard"})
+	is.NoErr(err)
+	is.Equal(len(events), 2)
+	reached, ok := events[1].Data.(*GoalReached)
+	is.True(ok)
+	is.Equal(reached.Name, "skateboard")
+
+	events, err = decide(&DepositFunds{Amount: d("5"), GoalName: "skateboard"})
+	is.NoErr(err)
+	is.Equal(len(events), 1)
+
+	is.True(g.Reached)
+	is.True(g.ReachedTime.Equal(reached.Time))
+	is.True(g.Contributed.Equal(d("60")))
+	is.True(g.Percent().Equal(d("120")))
+	is.True(a.Goals["skateboard"].Reached)
+	is.True(a.CurrentFunds.Equal(d("70")))
+}
@@ -0,0 +1,9 @@
+package kmm
+
+import "github.com/shopspring/decimal"
+
+// d returns the decimal of the string, which is valid in tests.
+func d(s string) decimal.Decimal {
+	v, _ := decimal.NewFromString(s)
+	return v
+}
@@ -0,0 +1,192 @@
+package kmm
+
+import (
+	"errors"
+	"time"
+
+	"github.com/bruth/kmm/money"
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrNegativeRate   = errors.New("kmm: interest rate must not be negative")
+	ErrInvalidPeriods = errors.New("kmm: number of periods must be between 1 and 1000")
+	ErrNoInterestRate = errors.New("kmm: no interest rate set")
+)
+
+// MaxProjectionPeriods is the max number of periods that can be projected.
+const MaxProjectionPeriods = 1000
+
+// MaxInterestAccruals is the max number of periods interest is accrued for
+// at once, e.g. after the server was down for a while.
+const MaxInterestAccruals = 100
+
+// periodsPerYear returns the number of periods in a year which is used
+// to derive the per-period rate from an annual rate.
+func periodsPerYear(p Period) int64 {
+	switch p {
+	case Minutely:
+		return 365 * 24 * 60
+	case Daily:
+		return 365
+	case Weekly:
+		return 52
+	case Monthly:
+		return 12
+	}
+	return 0
+}
+
+// ProjectInterest is a query for the projected balances of an account
+// given an annual interest rate compounded each period.
+type ProjectInterest struct {
+	// Rate is the annual rate as a fraction, e.g. 0.05 for 5%.
+	Rate    decimal.Decimal
+	Period  Period
+	Periods int
+}
+
+func (q *ProjectInterest) Validate() error {
+	if q.Rate.LessThan(decimal.Zero) {
+		return ErrNegativeRate
+	}
+
+	if err := q.Period.Validate(); err != nil {
+		return err
+	}
+
+	if q.Periods < 1 || q.Periods > MaxProjectionPeriods {
+		return ErrInvalidPeriods
+	}
+	return nil
+}
+
+type InterestProjectionPoint struct {
+	Time     time.Time
+	Interest decimal.Decimal
+	Balance  decimal.Decimal
+}
+
+// InterestProjection is the schedule of compounded balances. This is
+// computed and not stored.
+type InterestProjection struct {
+	Rate    decimal.Decimal
+	Period  Period
+	Balance decimal.Decimal
+	Points  []*InterestProjectionPoint
+}
+
+// NewInterestProjection computes the projected balance at the start of each
+// of the next periods relative to the time t. Interest is compounded each
+// period and rounded to cents.
+func NewInterestProjection(balance decimal.Decimal, q *ProjectInterest, t time.Time) *InterestProjection {
+	p := &InterestProjection{
+		Rate:    q.Rate,
+		Period:  q.Period,
+		Balance: balance,
+	}
+
+	rate := q.Rate.Div(decimal.NewFromInt(periodsPerYear(q.Period)))
+
+	_, nst := periodWindow(t, q.Period)
+	for i := 0; i < q.Periods; i++ {
+		interest := money.Round(balance.Mul(rate))
+		balance = balance.Add(interest)
+
+		p.Points = append(p.Points, &InterestProjectionPoint{
+			Time:     nst,
+			Interest: interest,
+			Balance:  balance,
+		})
+
+		_, nst = periodWindow(nst, q.Period)
+	}
+
+	return p
+}
+
+// SetInterestRate sets the annual rate interest is accrued at, compounded
+// each period beginning with the next period. A zero rate stops accruing
+// interest.
+type SetInterestRate struct {
+	// Rate is the annual rate as a fraction, e.g. 0.05 for 5%.
+	Rate   decimal.Decimal
+	Period Period
+}
+
+func (c *SetInterestRate) Validate() error {
+	if c.Rate.LessThan(decimal.Zero) {
+		return ErrNegativeRate
+	}
+	if c.Rate.IsZero() {
+		return nil
+	}
+	return c.Period.Validate()
+}
+
+type InterestRateSet struct {
+	Rate            decimal.Decimal
+	Period          Period
+	NextAccrualTime time.Time
+	Time            time.Time
+}
+
+// AccrueInterest accrues interest for each period which has begun since the
+// last accrual. It is expected to be sent periodically, e.g. by a ticker,
+// and results in no events if no interest is due.
+type AccrueInterest struct{}
+
+// InterestAccrued is interest on the balance at the start of the period,
+// which is treated like a deposit. It is recorded even if the interest is
+// zero, so the period is not accrued again.
+type InterestAccrued struct {
+	Amount          decimal.Decimal
+	Rate            decimal.Decimal
+	PeriodStartTime time.Time
+	Time            time.Time
+}
+
+func (a *Account) decideAccrueInterest() ([]*rita.Event, error) {
+	if a.InterestRate.IsZero() {
+		return nil, ErrNoInterestRate
+	}
+
+	now := a.clock.Now()
+	rate := a.InterestRate.Div(decimal.NewFromInt(periodsPerYear(a.InterestPeriod)))
+	balance := a.CurrentFunds
+
+	var events []*rita.Event
+	t := a.NextInterestTime
+	for !now.Before(t) && len(events) < MaxInterestAccruals {
+		interest := money.Round(balance.Mul(rate))
+		balance = balance.Add(interest)
+
+		events = append(events, &rita.Event{
+			Data: &InterestAccrued{
+				Amount:          interest,
+				Rate:            a.InterestRate,
+				PeriodStartTime: t,
+				Time:            now,
+			},
+		})
+		_, t = periodWindow(t, a.InterestPeriod)
+	}
+
+	return events, nil
+}
+
+func (a *Account) evolveInterest(event *rita.Event) {
+	switch e := event.Data.(type) {
+	case *InterestRateSet:
+		a.InterestRate = e.Rate
+		a.InterestPeriod = e.Period
+		a.NextInterestTime = e.NextAccrualTime
+
+	case *InterestAccrued:
+		a.CurrentFunds = a.CurrentFunds.Add(e.Amount)
+		if a.InterestPeriod != "" {
+			_, a.NextInterestTime = periodWindow(e.PeriodStartTime, a.InterestPeriod)
+		}
+	}
+}
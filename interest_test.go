@@ -0,0 +1,121 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+	"github.com/shopspring/decimal"
+)
+
+func TestInterestProjection(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	pt := time.Date(2019, time.May, 3, 12, 20, 30, 0, time.UTC)
+
+	t.Run("monthly", func(t *testing.T) {
+		q := &ProjectInterest{Rate: d("0.12"), Period: Monthly, Periods: 3}
+		is.NoErr(q.Validate())
+
+		p := NewInterestProjection(d("100"), q, pt)
+		is.Equal(len(p.Points), 3)
+
+		// 1% per month, compounded and rounded to cents.
+		expected := []struct {
+			Time     time.Time
+			Interest string
+			Balance  string
+		}{
+			{time.Date(2019, time.June, 1, 0, 0, 0, 0, time.UTC), "1", "101"},
+			{time.Date(2019, time.July, 1, 0, 0, 0, 0, time.UTC), "1.01", "102.01"},
+			{time.Date(2019, time.August, 1, 0, 0, 0, 0, time.UTC), "1.02", "103.03"},
+		}
+
+		for i, e := range expected {
+			is.Equal(p.Points[i].Time, e.Time)
+			is.True(p.Points[i].Interest.Equal(d(e.Interest)))
+			is.True(p.Points[i].Balance.Equal(d(e.Balance)))
+		}
+	})
+
+	t.Run("zero-rate", func(t *testing.T) {
+		q := &ProjectInterest{Rate: decimal.Zero, Period: Weekly, Periods: 4}
+		is.NoErr(q.Validate())
+
+		p := NewInterestProjection(d("25"), q, pt)
+		for _, x := range p.Points {
+			is.True(x.Interest.IsZero())
+			is.True(x.Balance.Equal(d("25")))
+		}
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		is.Err((&ProjectInterest{Rate: d("-0.01"), Period: Monthly, Periods: 1}).Validate(), ErrNegativeRate)
+		is.Err((&ProjectInterest{Rate: d("0.01"), Period: "yearly", Periods: 1}).Validate(), ErrInvalidPeriod)
+		is.Err((&ProjectInterest{Rate: d("0.01"), Period: Monthly, Periods: 0}).Validate(), ErrInvalidPeriods)
+	})
+}
+
+func TestAccrueInterest(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Second)
+	a := Account{clock: clock}
+
+	var f CurrentFunds
+
+	decide := func(cmd any) ([]*rita.Event, error) {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			is.NoErr(a.Evolve(e))
+			is.NoErr(f.Evolve(e))
+		}
+		return events, err
+	}
+
+	amounts := func(events []*rita.Event) []string {
+		var s []string
+		for _, e := range events {
+			s = append(s, e.Data.(*InterestAccrued).Amount.String())
+		}
+		return s
+	}
+
+	_, err := decide(&AccrueInterest{})
+	is.Err(err, ErrNoInterestRate)
+
+	is.Err((&SetInterestRate{Rate: d("-0.1"), Period: Monthly}).Validate(), ErrNegativeRate)
+
+	_, err = decide(&DepositFunds{Amount: d("100")})
+	is.NoErr(err)
+
+	// 12% a year is 1% each month, starting with the next month.
+	_, err = decide(&SetInterestRate{Rate: d("0.12"), Period: Monthly})
+	is.NoErr(err)
+	is.True(a.NextInterestTime.Equal(time.Date(2019, time.October, 1, 0, 0, 0, 0, time.UTC)))
+
+	events, err := decide(&AccrueInterest{})
+	is.NoErr(err)
+	is.Equal(len(events), 0)
+
+	clock.Add(12 * 24 * time.Hour)
+	events, err = decide(&AccrueInterest{})
+	is.NoErr(err)
+	is.Equal(amounts(events), []string{"1"})
+
+	// Missed periods are compounded and rounded to cents.
+	clock.Add(61 * 24 * time.Hour)
+	events, err = decide(&AccrueInterest{})
+	is.NoErr(err)
+	is.Equal(amounts(events), []string{"1.01", "1.02"})
+
+	is.True(a.CurrentFunds.Equal(d("103.03")))
+	is.True(f.Amount.Equal(a.CurrentFunds))
+	is.True(a.NextInterestTime.Equal(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)))
+
+	_, err = decide(&SetInterestRate{})
+	is.NoErr(err)
+	_, err = decide(&AccrueInterest{})
+	is.Err(err, ErrNoInterestRate)
+}
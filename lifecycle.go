@@ -0,0 +1,58 @@
+package kmm
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrOwnerRequired      = errors.New("kmm: owner is required")
+	ErrAccountAlreadyOpen = errors.New("kmm: account is already open")
+	ErrAccountNotOpen     = errors.New("kmm: account is not open")
+	ErrAccountClosed      = errors.New("kmm: account is closed")
+	ErrAccountFrozen      = errors.New("kmm: account is frozen")
+	ErrAccountNotFrozen   = errors.New("kmm: account is not frozen")
+)
+
+// OpenAccount opens a new account. An account must be opened before any
+// other command is accepted, so a mistyped account name is rejected rather
+// than implicitly creating a new account.
+type OpenAccount struct {
+	Owner string
+}
+
+func (c *OpenAccount) Validate() error {
+	if strings.TrimSpace(c.Owner) == "" {
+		return ErrOwnerRequired
+	}
+	return nil
+}
+
+type AccountOpened struct {
+	Owner string
+	Time  time.Time
+}
+
+// CloseAccount closes the account. A closed account rejects all further
+// commands.
+type CloseAccount struct{}
+
+type AccountClosed struct {
+	Time time.Time
+}
+
+// FreezeAccount temporarily freezes the account. A frozen account rejects
+// withdrawals and withdrawal requests until it is unfrozen. Deposits and
+// reversals are still accepted.
+type FreezeAccount struct{}
+
+type AccountFrozen struct {
+	Time time.Time
+}
+
+type UnfreezeAccount struct{}
+
+type AccountUnfrozen struct {
+	Time time.Time
+}
@@ -0,0 +1,121 @@
+package kmm
+
+import (
+	"errors"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrAccountArchived  = errors.New("kmm: account is archived")
+	ErrMergeSameAccount = errors.New("kmm: cannot merge an account into itself")
+)
+
+// ArchiveAccount archives the account. An archived account rejects all
+// further commands.
+type ArchiveAccount struct {
+	// MergedInto is the account the transactions were merged into, if any.
+	MergedInto string
+}
+
+type AccountArchived struct {
+	MergedInto string
+	Time       time.Time
+}
+
+// TransactionMerged is a transaction of another account merged into this
+// one. The amount is negative for withdrawals. Merged transactions affect
+// the balance, but not the budget since they occurred in the other account.
+type TransactionMerged struct {
+	Account     string
+	Amount      decimal.Decimal
+	Description string
+	// Currency is the currency of the amount, if not the default currency.
+	Currency string
+	Time     time.Time
+}
+
+// MergeTransactions returns the transactions of the source account as events
+// to append to the target account, in the order they occurred. The original
+// times are retained.
+//
+// The event store is append-only, so the merged transactions follow the
+// existing events of the target rather than being interleaved with them.
+func MergeTransactions(source string, events []*rita.Event) []*rita.Event {
+	var merged []*rita.Event
+
+	add := func(account string, amount decimal.Decimal, desc, currency string, t time.Time) {
+		merged = append(merged, &rita.Event{
+			Data: &TransactionMerged{
+				Account:     account,
+				Amount:      amount,
+				Description: desc,
+				Currency:    currency,
+				Time:        t,
+			},
+		})
+	}
+
+	for _, event := range events {
+		switch e := event.Data.(type) {
+		case *FundsDeposited:
+			add(source, e.Amount, e.Description, e.Currency, e.Time)
+		case *FundsWithdrawn:
+			add(source, e.Amount.Neg(), e.Description, e.Currency, e.Time)
+		case *RoundUpWithdrawn:
+			add(source, e.Amount.Neg(), "round-up to "+e.Account, "", e.Time)
+		case *InterestAccrued:
+			if e.Amount.IsPositive() {
+				add(source, e.Amount, "interest", "", e.Time)
+			}
+		case *TransactionMerged:
+			// Retain the account the transaction originally occurred in.
+			add(e.Account, e.Amount, e.Description, e.Currency, e.Time)
+		}
+	}
+
+	return merged
+}
+
+// MergePlan describes the changes a merge would make without making them.
+type MergePlan struct {
+	Source string
+	Target string
+	// Last sequences of the source and target the changes would be
+	// appended after.
+	SourceSequence uint64
+	TargetSequence uint64
+	// Number of transactions merged into the target.
+	Transactions     int
+	SourceBalance    decimal.Decimal
+	TargetBalance    decimal.Decimal
+	ResultingBalance decimal.Decimal
+}
+
+// NewMergePlan returns the plan for merging the source events into the
+// target account.
+func NewMergePlan(source, target string, events []*rita.Event, t *Account) *MergePlan {
+	p := &MergePlan{
+		Source:        source,
+		Target:        target,
+		TargetBalance: t.CurrentFunds,
+	}
+
+	var f CurrentFunds
+	for _, e := range events {
+		_ = f.Evolve(e)
+	}
+	p.SourceBalance = f.Amount
+
+	for _, e := range MergeTransactions(source, events) {
+		p.Transactions++
+		if m := e.Data.(*TransactionMerged); !isForeign(m.Currency) {
+			p.ResultingBalance = p.ResultingBalance.Add(m.Amount)
+		}
+	}
+	p.ResultingBalance = p.ResultingBalance.Add(t.CurrentFunds)
+
+	return p
+}
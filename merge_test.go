@@ -0,0 +1,105 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestMergeTransactions(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Hour)
+
+	var (
+		piggy        = Account{clock: clock}
+		wallet       = Account{clock: clock}
+		piggyEvents  []*rita.Event
+		walletEvents []*rita.Event
+	)
+
+	decide := func(a *Account, events *[]*rita.Event, cmd any) error {
+		es, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range es {
+			a.Evolve(e)
+		}
+		*events = append(*events, es...)
+		return err
+	}
+
+	is.NoErr(decide(&piggy, &piggyEvents, &DepositFunds{Amount: d("20"), Description: "birthday"}))
+	is.NoErr(decide(&wallet, &walletEvents, &DepositFunds{Amount: d("5")}))
+	is.NoErr(decide(&piggy, &piggyEvents, &SetBudget{MaxAmount: d("10"), Period: Monthly}))
+	is.NoErr(decide(&piggy, &piggyEvents, &WithdrawFunds{Amount: d("7.50"), Description: "book"}))
+	is.NoErr(decide(&wallet, &walletEvents, &WithdrawFunds{Amount: d("2")}))
+
+	merged := MergeTransactions("piggy", piggyEvents)
+	is.Equal(len(merged), 2)
+
+	m0 := merged[0].Data.(*TransactionMerged)
+	is.Equal(m0.Account, "piggy")
+	is.True(m0.Amount.Equal(d("20")))
+	is.Equal(m0.Description, "birthday")
+	is.Equal(m0.Time, piggyEvents[0].Data.(*FundsDeposited).Time)
+
+	m1 := merged[1].Data.(*TransactionMerged)
+	is.True(m1.Amount.Equal(d("-7.50")))
+	is.Equal(m1.Description, "book")
+	is.True(m0.Time.Before(m1.Time))
+
+	// Archive the source.
+	is.NoErr(decide(&piggy, &piggyEvents, &ArchiveAccount{MergedInto: "wallet"}))
+	is.True(piggy.Archived)
+	is.Err(decide(&piggy, &piggyEvents, &DepositFunds{Amount: d("1")}), ErrAccountArchived)
+
+	// Append to the target.
+	walletEvents = append(walletEvents, merged...)
+	for _, e := range merged {
+		is.NoErr(wallet.Evolve(e))
+	}
+
+	var f CurrentFunds
+	for _, e := range walletEvents {
+		is.NoErr(f.Evolve(e))
+	}
+	is.True(wallet.CurrentFunds.Equal(d("15.50")))
+	is.True(f.Amount.Equal(d("15.50")))
+
+	// Merged withdrawals do not count against the budget of the target.
+	is.NoErr(decide(&wallet, &walletEvents, &SetBudget{MaxAmount: d("10"), Period: Monthly}))
+	is.NoErr(decide(&wallet, &walletEvents, &WithdrawFunds{Amount: d("10")}))
+
+	// Merging the target into another account retains the original account.
+	merged = MergeTransactions("wallet", walletEvents)
+	is.Equal(len(merged), 5)
+	is.Equal(merged[2].Data.(*TransactionMerged).Account, "piggy")
+	is.Equal(merged[4].Data.(*TransactionMerged).Account, "wallet")
+}
+
+func TestMergePlan(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	events := []*rita.Event{
+		{Data: &FundsDeposited{Amount: d("20")}},
+		{Data: &BudgetSet{MaxWithdrawAmount: d("5"), Period: Daily}},
+		{Data: &FundsWithdrawn{Amount: d("4.25")}},
+	}
+
+	target := NewAccount()
+	is.NoErr(target.Evolve(&rita.Event{Data: &FundsDeposited{Amount: d("3")}}))
+
+	p := NewMergePlan("piggy", "wallet", events, target)
+	is.Equal(p.Source, "piggy")
+	is.Equal(p.Target, "wallet")
+	is.Equal(p.Transactions, 2)
+	is.True(p.SourceBalance.Equal(d("15.75")))
+	is.True(p.TargetBalance.Equal(d("3")))
+	is.True(p.ResultingBalance.Equal(d("18.75")))
+
+	// Nothing is changed.
+	is.Equal(len(events), 3)
+	is.True(target.CurrentFunds.Equal(d("3")))
+	is.True(!target.Archived)
+}
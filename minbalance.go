@@ -0,0 +1,50 @@
+package kmm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bruth/kmm/money"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrBelowMinimumBalance   = errors.New("kmm: withdrawal would drop the balance below the minimum balance")
+	ErrInvalidMinimumBalance = errors.New("kmm: minimum balance must be greater than zero")
+	ErrNoMinimumBalance      = errors.New("kmm: no minimum balance set")
+)
+
+// SetMinimumBalance sets a floor the balance cannot be withdrawn below,
+// e.g. to always keep some money saved. It does not apply to deposits, so
+// the balance may be below the floor until enough is deposited.
+type SetMinimumBalance struct {
+	Amount decimal.Decimal
+}
+
+func (c *SetMinimumBalance) Validate() error {
+	if c.Amount.LessThanOrEqual(decimal.Zero) {
+		return ErrInvalidMinimumBalance
+	}
+	return checkDecimalPlaces(c.Amount)
+}
+
+type MinimumBalanceSet struct {
+	Amount decimal.Decimal
+	Time   time.Time
+}
+
+type RemoveMinimumBalance struct{}
+
+type MinimumBalanceRemoved struct {
+	Time time.Time
+}
+
+// checkMinimumBalance returns an error if withdrawing the amount would drop
+// the balance below the minimum balance.
+func (a *Account) checkMinimumBalance(amount decimal.Decimal) error {
+	if a.MinimumBalance.IsZero() || !a.CurrentFunds.Sub(amount).LessThan(a.MinimumBalance) {
+		return nil
+	}
+	return fmt.Errorf("%w: minimum %s, balance %s, requested %s", ErrBelowMinimumBalance, a.MinimumBalance.StringFixed(money.Places), a.CurrentFunds.StringFixed(money.Places), amount.StringFixed(money.Places))
+}
@@ -0,0 +1,48 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestMinimumBalance(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Second)
+	a := Account{clock: clock}
+
+	decide := func(cmd any) error {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			is.NoErr(a.Evolve(e))
+		}
+		return err
+	}
+
+	is.Err((&SetMinimumBalance{}).Validate(), ErrInvalidMinimumBalance)
+	is.Err((&SetMinimumBalance{Amount: d("-1")}).Validate(), ErrInvalidMinimumBalance)
+	is.Err(decide(&RemoveMinimumBalance{}), ErrNoMinimumBalance)
+
+	is.NoErr(decide(&DepositFunds{Amount: d("25")}))
+	is.NoErr(decide(&SetMinimumBalance{Amount: d("10")}))
+	is.True(a.MinimumBalance.Equal(d("10")))
+
+	// Down to the minimum balance can be withdrawn.
+	is.NoErr(decide(&WithdrawFunds{Amount: d("10")}))
+	err := decide(&WithdrawFunds{Amount: d("5.01")})
+	is.Err(err, ErrBelowMinimumBalance)
+	is.Equal(err.Error(), "kmm: withdrawal would drop the balance below the minimum balance: minimum 10.00, balance 15.00, requested 5.01")
+	is.Equal(NewWithdrawalExplanation(&a, &WithdrawFunds{Amount: d("6")}).Rule, RuleMinimumBalance)
+	is.NoErr(decide(&WithdrawFunds{Amount: d("5")}))
+	is.True(a.CurrentFunds.Equal(d("10")))
+
+	// Requests are checked too.
+	is.Err(decide(&RequestWithdrawal{ID: "r1", Amount: d("1")}), ErrBelowMinimumBalance)
+
+	is.NoErr(decide(&RemoveMinimumBalance{}))
+	is.True(a.MinimumBalance.IsZero())
+	is.NoErr(decide(&WithdrawFunds{Amount: d("10")}))
+}
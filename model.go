@@ -2,21 +2,49 @@ package kmm
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/bruth/kmm/money"
 	"github.com/bruth/rita"
 	"github.com/bruth/rita/clock"
 	"github.com/shopspring/decimal"
 )
 
 var (
-	ErrUnknownCommand     = errors.New("unknown command")
-	ErrNonZeroAmount      = errors.New("kmm: amount must be greater than zero")
-	ErrInvalidPeriod      = errors.New("kmm: period must be minutely, daily, weekly, monthly")
-	ErrInsufficientFunds  = errors.New("kmm: insufficient funds")
-	ErrExceedWithinPeriod = errors.New("kmm: withdrawal would exceed max amount allowed in current period")
+	ErrUnknownCommand             = errors.New("unknown command")
+	ErrNonZeroAmount              = errors.New("kmm: amount must be greater than zero")
+	ErrInvalidPeriod              = errors.New("kmm: period must be minutely, daily, weekly, monthly")
+	ErrInvalidTimeZone            = errors.New("kmm: unknown time zone")
+	ErrInsufficientFunds          = errors.New("kmm: insufficient funds")
+	ErrExceedWithinPeriod         = errors.New("kmm: withdrawal would exceed max amount allowed in current period")
+	ErrNoteTooLong                = errors.New("kmm: note exceeds max length")
+	ErrAccountNotFound            = errors.New("kmm: account not found")
+	ErrNoBudget                   = errors.New("kmm: no budget is set")
+	ErrBudgetBelowSpent           = errors.New("kmm: max amount is below the funds already withdrawn in current period")
+	ErrInvalidDepositLimit        = errors.New("kmm: max deposits must not be negative")
+	ErrDepositFrequencyExceeded   = errors.New("kmm: deposit would exceed max number of deposits allowed in current period")
+	ErrInvalidAmountStep          = errors.New("kmm: amount step must not be negative or a fraction of a cent")
+	ErrInvalidDenomination        = errors.New("kmm: amount is not a multiple of the amount step")
+	ErrTooManyDecimalPlaces       = errors.New("kmm: amount has too many decimal places")
+	ErrInvalidMaxPerTransaction   = errors.New("kmm: max amount per transaction must not be negative")
+	ErrExceedsPerTransactionLimit = errors.New("kmm: withdrawal exceeds the max amount per transaction")
 )
 
+// MaxDecimalPlaces is the max number of decimal places of an amount.
+var MaxDecimalPlaces int32 = 2
+
+// checkDecimalPlaces returns an error if the amount has more decimal places
+// than allowed. Trailing zeros are not counted, e.g. 1.500.
+func checkDecimalPlaces(amount decimal.Decimal) error {
+	if !amount.Equal(amount.Truncate(MaxDecimalPlaces)) {
+		return fmt.Errorf("%w: max %d", ErrTooManyDecimalPlaces, MaxDecimalPlaces)
+	}
+	return nil
+}
+
 type DeciderEvolver interface {
 	rita.Decider
 	rita.Evolver
@@ -26,36 +54,65 @@ var (
 	_ DeciderEvolver = &Account{}
 	_ rita.Evolver   = &BudgetPeriod{}
 	_ rita.Evolver   = &CurrentFunds{}
+	_ rita.Evolver   = &RecentDescriptions{}
+	_ rita.Evolver   = &AccountInfo{}
+	_ rita.Evolver   = &PeriodHistory{}
 )
 
 type DepositFunds struct {
 	Amount      decimal.Decimal
 	Description string
+	// GoalName is the savings goal the deposit contributes to, if any.
+	GoalName string
+	// Currency is the ISO 4217 code of the currency of the amount.
+	// Defaults to the default currency.
+	Currency string
 }
 
 func (c *DepositFunds) Validate() error {
 	if c.Amount.LessThanOrEqual(decimal.Zero) {
 		return ErrNonZeroAmount
 	}
-	return nil
+	if err := checkCurrency(c.Currency); err != nil {
+		return err
+	}
+	return checkDecimalPlaces(c.Amount)
 }
 
 type FundsDeposited struct {
 	Amount      decimal.Decimal
 	Description string
-	Time        time.Time
+	GoalName    string
+	// AllowanceTime is the start of the period the allowance is deposited
+	// for, if the deposit is an allowance.
+	AllowanceTime time.Time
+	// ReversalOf is the ID of the withdrawal or round-up the deposit
+	// reverses, if any.
+	ReversalOf string
+	// Currency is the currency of the amount, if not the default currency.
+	Currency string
+	Time     time.Time
 }
 
 type WithdrawFunds struct {
 	Amount      decimal.Decimal
 	Description string
+	// Category is counted against the budget of the category, if any.
+	Category string
+	// Currency is the ISO 4217 code of the currency of the amount.
+	// Defaults to the default currency. Withdrawals in other currencies
+	// are not counted against budgets.
+	Currency string
 }
 
 func (c *WithdrawFunds) Validate() error {
 	if c.Amount.LessThanOrEqual(decimal.Zero) {
 		return ErrNonZeroAmount
 	}
-	return nil
+	if err := checkCurrency(c.Currency); err != nil {
+		return err
+	}
+	return checkDecimalPlaces(c.Amount)
 }
 
 type FundsWithdrawn struct {
@@ -63,6 +120,17 @@ type FundsWithdrawn struct {
 	Description   string
 	Time          time.Time
 	PeriodChanged bool
+	Category      string
+	// CategoryPeriodChanged is true if the period of the category budget
+	// changed.
+	CategoryPeriodChanged bool
+	// ReversalOf is the ID of the deposit the withdrawal reverses, if any.
+	ReversalOf string
+	// RolledOverAmount is the unspent funds of the previous period added
+	// to the max amount of the new period, if the period changed.
+	RolledOverAmount decimal.Decimal
+	// Currency is the currency of the amount, if not the default currency.
+	Currency string
 }
 
 type Period string
@@ -74,23 +142,89 @@ const (
 	Monthly  Period = "monthly"
 )
 
+// Periods are the supported periods.
+var Periods = []Period{Minutely, Daily, Weekly, Monthly}
+
+func (p Period) Validate() error {
+	for _, x := range Periods {
+		if p == x {
+			return nil
+		}
+	}
+	return ErrInvalidPeriod
+}
+
+// Description describes the boundaries of the period.
+func (p Period) Description() string {
+	switch p {
+	case Minutely:
+		return "Starts every minute, for demos."
+	case Daily:
+		return "Starts every day at midnight."
+	case Weekly:
+		return "Starts every Monday at midnight."
+	case Monthly:
+		return "Starts on the 1st of every month at midnight."
+	}
+	return ""
+}
+
+// Window returns the start time of the period containing t and the start
+// time of the next period.
+func (p Period) Window(t time.Time) (time.Time, time.Time) {
+	return periodWindow(t, p)
+}
+
 type SetBudget struct {
 	MaxAmount decimal.Decimal
 	Period    Period
+	// ProRate reduces the max amount of the first period by the fraction
+	// of the period that has already passed.
+	ProRate bool
+	// TimeZone is the IANA time zone the period boundaries are computed
+	// in, e.g. America/New_York. Defaults to the time zone of the clock.
+	TimeZone string
+	// Category sets the budget of withdrawals of the category rather than
+	// the budget of the account.
+	Category string
+	// MaxPerTransaction is the max amount of a single withdrawal, if
+	// non-zero. It applies independent of the period.
+	MaxPerTransaction decimal.Decimal
+	// Rollover adds the unspent funds of each period to the max amount of
+	// the next period, up to the rollover cap if non-zero. It is not
+	// supported for category budgets.
+	Rollover    bool
+	RolloverCap decimal.Decimal
 }
 
 func (c *SetBudget) Validate() error {
 	if c.MaxAmount.LessThan(decimal.Zero) {
 		return ErrNonZeroAmount
 	}
-
-	// Validate period.
-	switch c.Period {
-	case Minutely, Daily, Weekly, Monthly:
-	default:
-		return ErrInvalidPeriod
+	if err := checkDecimalPlaces(c.MaxAmount); err != nil {
+		return err
 	}
-	return nil
+	if c.MaxPerTransaction.IsNegative() {
+		return ErrInvalidMaxPerTransaction
+	}
+	if err := checkDecimalPlaces(c.MaxPerTransaction); err != nil {
+		return err
+	}
+	if c.RolloverCap.IsNegative() {
+		return ErrInvalidRolloverCap
+	}
+	if err := checkDecimalPlaces(c.RolloverCap); err != nil {
+		return err
+	}
+	if c.Rollover && c.Category != "" {
+		return ErrCategoryRollover
+	}
+	if c.TimeZone != "" {
+		if _, err := time.LoadLocation(c.TimeZone); err != nil {
+			return ErrInvalidTimeZone
+		}
+	}
+	return c.Period.Validate()
 }
 
 type BudgetSet struct {
@@ -99,12 +233,143 @@ type BudgetSet struct {
 	PolicyStartTime     time.Time
 	PeriodStartTime     time.Time
 	NextPeriodStartTime time.Time
+	// Max amount of the first period if pro-rated.
+	ProRated             bool
+	FirstPeriodMaxAmount decimal.Decimal
+	TimeZone             string
+	Category             string
+	MaxPerTransaction    decimal.Decimal
+	Rollover             bool
+	RolloverCap          decimal.Decimal
+}
+
+// periodMaxAmount returns the max amount of the first period of the budget.
+func (e *BudgetSet) periodMaxAmount() decimal.Decimal {
+	if e.ProRated {
+		return e.FirstPeriodMaxAmount
+	}
+	return e.MaxWithdrawAmount
+}
+
+// proRate returns the max amount reduced by the fraction of the period
+// which has passed at time t, rounded to cents.
+func proRate(amount decimal.Decimal, t, st, nst time.Time) decimal.Decimal {
+	total := nst.Sub(st)
+	if total <= 0 {
+		return amount
+	}
+	remaining := decimal.NewFromInt(int64(nst.Sub(t)))
+	return money.Round(amount.Mul(remaining).Div(decimal.NewFromInt(int64(total))))
+}
+
+// AdjustBudget changes the max amount of the current budget without
+// resetting the funds already withdrawn in the current period.
+type AdjustBudget struct {
+	MaxAmount decimal.Decimal
+}
+
+func (c *AdjustBudget) Validate() error {
+	if c.MaxAmount.LessThan(decimal.Zero) {
+		return ErrNonZeroAmount
+	}
+	return checkDecimalPlaces(c.MaxAmount)
+}
+
+type BudgetAdjusted struct {
+	MaxWithdrawAmount decimal.Decimal
+	Time              time.Time
 }
 
-type RemoveBudget struct{}
+// RemoveBudget removes the budget of the account or, if set, the category.
+type RemoveBudget struct {
+	Category string
+}
 
 type BudgetRemoved struct {
 	PolicyRemoveTime time.Time
+	Category         string
+}
+
+// MaxPeriodRollovers is the max number of periods rolled over at once. If
+// more boundaries have passed, only the most recent periods are recorded.
+const MaxPeriodRollovers = 100
+
+// RollOverPeriod records the start of each budget period which has begun
+// since the current one, including periods without any withdrawals. It is
+// expected to be sent periodically, e.g. by a ticker.
+type RollOverPeriod struct{}
+
+// PeriodRolledOver is the start of a new budget period.
+type PeriodRolledOver struct {
+	PeriodStartTime     time.Time
+	NextPeriodStartTime time.Time
+	Time                time.Time
+	// RolledOverAmount is the unspent funds of the previous period added
+	// to the max amount of the period.
+	RolledOverAmount decimal.Decimal
+}
+
+// SetDepositLimit limits the number of deposits within each period. Zero
+// removes the limit.
+type SetDepositLimit struct {
+	MaxDeposits int
+	Period      Period
+}
+
+func (c *SetDepositLimit) Validate() error {
+	if c.MaxDeposits < 0 {
+		return ErrInvalidDepositLimit
+	}
+	if c.MaxDeposits == 0 {
+		return nil
+	}
+	return c.Period.Validate()
+}
+
+type DepositLimitSet struct {
+	MaxDeposits         int
+	Period              Period
+	PeriodStartTime     time.Time
+	NextPeriodStartTime time.Time
+}
+
+// SetAmountStep requires deposit and withdrawal amounts to be multiples of
+// the step, e.g. 0.25 for quarters. Zero removes the restriction.
+type SetAmountStep struct {
+	Step decimal.Decimal
+}
+
+func (c *SetAmountStep) Validate() error {
+	if c.Step.IsNegative() || !c.Step.Equal(money.Round(c.Step)) {
+		return ErrInvalidAmountStep
+	}
+	return nil
+}
+
+type AmountStepSet struct {
+	Step decimal.Decimal
+	Time time.Time
+}
+
+// MaxNoteLength is the max number of characters of an account note.
+const MaxNoteLength = 140
+
+// SetAccountNote sets a free-text note on the account, e.g. "college fund".
+// An empty note clears it.
+type SetAccountNote struct {
+	Note string
+}
+
+func (c *SetAccountNote) Validate() error {
+	if utf8.RuneCountInString(c.Note) > MaxNoteLength {
+		return ErrNoteTooLong
+	}
+	return nil
+}
+
+type AccountNoteSet struct {
+	Note string
+	Time time.Time
 }
 
 // periodWindow takes the time value and determines the current start time
@@ -125,9 +390,10 @@ func periodWindow(t time.Time, p Period) (time.Time, time.Time) {
 		nst := st.AddDate(0, 0, 1)
 		return st, nst
 
-	// Week starts on Monday at midnight
+	// Week starts on Monday at midnight. Sunday is the last day of the week.
 	case Weekly:
-		sd := t.Day() - int(t.Weekday()-time.Monday)
+		days := (int(t.Weekday()) + 6) % 7
+		sd := t.Day() - days
 		st := time.Date(t.Year(), t.Month(), sd, 0, 0, 0, 0, t.Location())
 		nst := st.AddDate(0, 0, 7)
 		return st, nst
@@ -142,12 +408,28 @@ func periodWindow(t time.Time, p Period) (time.Time, time.Time) {
 	return time.Time{}, time.Time{}
 }
 
+// budgetWindow returns the window of the budget period containing t with
+// the boundaries computed in the time zone of the budget, if set.
+func budgetWindow(t time.Time, p Period, tz string) (time.Time, time.Time) {
+	if tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			t = t.In(loc)
+		}
+	}
+	return periodWindow(t, p)
+}
+
 func NewAccount() *Account {
 	return &Account{
 		clock: clock.Time,
 	}
 }
 
+// AccountVersion is the version of the state of Account. Increment it when
+// a field of Account is added, removed or changes meaning, so state stored
+// by a previous version, e.g. a snapshot, is rebuilt from the events.
+const AccountVersion = 1
+
 // Account aggregate which primarily decides on whether a withdrawal is
 // allowed given the current funds and if a policy is set.
 //
@@ -158,179 +440,1108 @@ func NewAccount() *Account {
 // The Set/RemoveWithdrawPolicy are in the same category and does not really need
 // any aggregated state for them to be accepted.
 type Account struct {
+	// CurrentFunds is the balance in the default currency.
 	CurrentFunds decimal.Decimal
+	// Balances are the balances in other currencies, by currency.
+	Balances map[string]decimal.Decimal
+	Note     string
+
+	// Lifecycle related. Accounts which predate opening are considered
+	// open once they have any events.
+	Owner  string
+	Opened bool
+	Closed bool
+	// Withdrawals are rejected while frozen.
+	Frozen bool
 
 	// Policy related.
 	MaxWithdrawAmount      decimal.Decimal
 	PolicyPeriod           Period
+	PolicyTimeZone         string
 	PeriodStartTime        time.Time
 	NextPeriodStartTime    time.Time
 	FundsWithdrawnInPeriod decimal.Decimal
+	// Max amount of the current period, which differs from the max amount
+	// if the first period was pro-rated.
+	PeriodMaxWithdrawAmount decimal.Decimal
+	// Max amount of a single withdrawal, if non-zero.
+	MaxPerTransaction decimal.Decimal
+	// Unspent funds roll over to the next period, up to the cap if set.
+	// The amount rolled over is included in the max amount of the period.
+	Rollover         bool
+	RolloverCap      decimal.Decimal
+	RolledOverAmount decimal.Decimal
+
+	// Round-up related.
+	RoundUpAccount   string
+	RoundUpIncrement decimal.Decimal
+
+	SpendReflection bool
+
+	Archived bool
+
+	// Deposit limit related.
+	MaxDeposits                int
+	DepositPeriod              Period
+	DepositPeriodStartTime     time.Time
+	NextDepositPeriodStartTime time.Time
+	DepositsInPeriod           int
+
+	// Budgets of withdrawal categories.
+	CategoryBudgets map[string]*CategoryBudget
+
+	// Amounts must be a multiple of the step if set.
+	AmountStep decimal.Decimal
+
+	// Savings goals by name.
+	Goals map[string]*SavingsGoal
+
+	// Withdrawals of more than the threshold must be requested and are
+	// pending until approved or denied, by request ID.
+	ApprovalThreshold  decimal.Decimal
+	PendingWithdrawals map[string]*WithdrawalRequest
+
+	// Allowance related.
+	AllowanceAmount   decimal.Decimal
+	AllowancePeriod   Period
+	NextAllowanceTime time.Time
+
+	// Interest related.
+	InterestRate     decimal.Decimal
+	InterestPeriod   Period
+	NextInterestTime time.Time
+
+	// Most recent transactions which can be reversed.
+	Transactions []*Transaction
+
+	// Withdrawals cannot drop the balance below the minimum balance.
+	MinimumBalance decimal.Decimal
+
+	// Thresholds withdrawals alert at, disabled if zero.
+	AlertLowBalance    decimal.Decimal
+	AlertBudgetPercent int
 
 	clock clock.Clock
 }
 
+// checkAmountStep returns an error if the amount is not a multiple of the
+// amount step.
+func (a *Account) checkAmountStep(amount decimal.Decimal) error {
+	if a.AmountStep.IsZero() || amount.Mod(a.AmountStep).IsZero() {
+		return nil
+	}
+	return ErrInvalidDenomination
+}
+
+// insufficientFunds returns ErrInsufficientFunds with the balance and the
+// requested amount.
+func insufficientFunds(balance, amount decimal.Decimal) error {
+	return fmt.Errorf("%w: balance %s, requested %s", ErrInsufficientFunds, balance.StringFixed(money.Places), amount.StringFixed(money.Places))
+}
+
+// checkPerTransaction returns an error if the amount exceeds the max amount
+// per transaction, if set, prefixed by the category if any.
+func checkPerTransaction(category string, limit, amount decimal.Decimal) error {
+	if limit.IsZero() || !amount.GreaterThan(limit) {
+		return nil
+	}
+	detail := fmt.Sprintf("max %s, requested %s", limit.StringFixed(money.Places), amount.StringFixed(money.Places))
+	if category != "" {
+		return fmt.Errorf("%w: %s: %s", ErrExceedsPerTransactionLimit, category, detail)
+	}
+	return fmt.Errorf("%w: %s", ErrExceedsPerTransactionLimit, detail)
+}
+
+// budgetExceeded returns ErrExceedWithinPeriod with the budget remaining in
+// the period and the requested amount, prefixed by the category if any.
+func budgetExceeded(category string, remaining, amount decimal.Decimal) error {
+	if remaining.IsNegative() {
+		remaining = decimal.Zero
+	}
+	detail := fmt.Sprintf("remaining %s, requested %s", remaining.StringFixed(money.Places), amount.StringFixed(money.Places))
+	if category != "" {
+		return fmt.Errorf("%w: %s: %s", ErrExceedWithinPeriod, category, detail)
+	}
+	return fmt.Errorf("%w: %s", ErrExceedWithinPeriod, detail)
+}
+
+// periodMaxAmount returns the max amount that can be withdrawn in the
+// current period or, if the period changed, the period containing t.
+func (a *Account) periodMaxAmount(t time.Time) decimal.Decimal {
+	if !t.Before(a.NextPeriodStartTime) {
+		return a.MaxWithdrawAmount.Add(a.rolloverAt(t))
+	}
+	return a.PeriodMaxWithdrawAmount
+}
+
 func (a *Account) Decide(command *rita.Command) ([]*rita.Event, error) {
+	if a.Archived {
+		return nil, ErrAccountArchived
+	}
+	if a.Closed {
+		return nil, ErrAccountClosed
+	}
+
 	switch c := command.Data.(type) {
-	case *DepositFunds:
-		// As much money can be deposited as desired, so no
-		// decision needs to be made.
+	case *OpenAccount:
+		if a.Opened {
+			return nil, ErrAccountAlreadyOpen
+		}
+
+		return []*rita.Event{
+			{
+				Data: &AccountOpened{
+					Owner: strings.TrimSpace(c.Owner),
+					Time:  a.clock.Now(),
+				},
+			},
+		}, nil
+
+	case *CloseAccount:
+		if !a.Opened {
+			return nil, ErrAccountNotOpen
+		}
+
+		return []*rita.Event{
+			{
+				Data: &AccountClosed{
+					Time: a.clock.Now(),
+				},
+			},
+		}, nil
+
+	case *FreezeAccount:
+		if a.Frozen {
+			return nil, ErrAccountFrozen
+		}
+
+		return []*rita.Event{
+			{
+				Data: &AccountFrozen{
+					Time: a.clock.Now(),
+				},
+			},
+		}, nil
+
+	case *UnfreezeAccount:
+		if !a.Frozen {
+			return nil, ErrAccountNotFrozen
+		}
+
 		return []*rita.Event{
+			{
+				Data: &AccountUnfrozen{
+					Time: a.clock.Now(),
+				},
+			},
+		}, nil
+
+	case *DepositFunds:
+		// As much money can be deposited as desired, however the number
+		// of deposits may be limited.
+		foreign := isForeign(c.Currency)
+		if foreign && c.GoalName != "" {
+			return nil, fmt.Errorf("%w: savings goals", ErrCurrencyNotSupported)
+		}
+		if !foreign {
+			if err := a.checkAmountStep(c.Amount); err != nil {
+				return nil, err
+			}
+		}
+
+		now := a.clock.Now()
+
+		if a.MaxDeposits > 0 {
+			deposits := a.DepositsInPeriod
+			if !now.Before(a.NextDepositPeriodStartTime) {
+				deposits = 0
+			}
+
+			if deposits+1 > a.MaxDeposits {
+				return nil, ErrDepositFrequencyExceeded
+			}
+		}
+
+		events := []*rita.Event{
 			{
 				Data: &FundsDeposited{
 					Amount:      c.Amount,
 					Description: c.Description,
-					Time:        a.clock.Now(),
+					GoalName:    c.GoalName,
+					Currency:    c.Currency,
+					Time:        now,
+				},
+			},
+		}
+
+		if c.GoalName != "" {
+			e, err := a.goalReached(c.GoalName, c.Amount, now)
+			if err != nil {
+				return nil, err
+			}
+			if e != nil {
+				events = append(events, e)
+			}
+		}
+
+		return events, nil
+
+	case *CreateSavingsGoal:
+		name := strings.TrimSpace(c.Name)
+		if _, ok := a.Goals[name]; ok {
+			return nil, fmt.Errorf("%w: %s", ErrGoalExists, name)
+		}
+
+		return []*rita.Event{
+			{
+				Data: &SavingsGoalCreated{
+					Name:         name,
+					TargetAmount: c.TargetAmount,
+					Time:         a.clock.Now(),
 				},
 			},
 		}, nil
 
 	case *WithdrawFunds:
-		// Ensure funds do not go below zero.
-		if a.CurrentFunds.Sub(c.Amount).LessThan(decimal.Zero) {
-			return nil, ErrInsufficientFunds
+		if a.requiresApproval(c.Amount) {
+			return nil, ErrApprovalRequired
 		}
+		if isForeign(c.Currency) {
+			return a.decideForeignWithdrawal(c)
+		}
+		return a.decideWithdrawal(c)
 
-		now := a.clock.Now()
+	case *RequestWithdrawal:
+		return a.decideRequestWithdrawal(c)
 
-		var periodChanged bool
+	case *ApproveWithdrawal:
+		return a.decideApproveWithdrawal(c)
 
-		// Check if the withdraw is allowed given the policy.
-		if a.PolicyPeriod != "" {
-			// Next period start time has not been reached.
-			periodChanged = !now.Before(a.NextPeriodStartTime)
+	case *DenyWithdrawal:
+		return a.decideDenyWithdrawal(c)
 
-			if !periodChanged {
-				if a.FundsWithdrawnInPeriod.Add(c.Amount).GreaterThan(a.MaxWithdrawAmount) {
-					return nil, ErrExceedWithinPeriod
-				}
-			}
+	case *SetAllowance:
+		now := a.clock.Now()
+		_, next := periodWindow(now, c.Period)
+
+		return []*rita.Event{
+			{
+				Data: &AllowanceSet{
+					Amount:          c.Amount,
+					Period:          c.Period,
+					NextDepositTime: next,
+					Time:            now,
+				},
+			},
+		}, nil
+
+	case *RemoveAllowance:
+		if a.AllowancePeriod == "" {
+			return nil, ErrNoAllowance
 		}
 
-		// Could emit PeriodChanged event as well, however this can be lazily
-		// detected on the evolve side. Alternatively, an indepedent actor could
-		// monitor the policy changes and a ticker to emit period change events..
 		return []*rita.Event{
 			{
-				Data: &FundsWithdrawn{
-					Amount:        c.Amount,
-					Description:   c.Description,
-					Time:          now,
-					PeriodChanged: periodChanged,
+				Data: &AllowanceRemoved{
+					Time: a.clock.Now(),
 				},
 			},
 		}, nil
 
-	case *SetBudget:
-		now := a.clock.Now()
-		st, nst := periodWindow(now, c.Period)
+	case *DepositAllowance:
+		return a.decideDepositAllowance()
+
+	case *SetInterestRate:
+		e := &InterestRateSet{
+			Rate: c.Rate,
+			Time: a.clock.Now(),
+		}
+		if c.Rate.IsPositive() {
+			e.Period = c.Period
+			_, e.NextAccrualTime = periodWindow(e.Time, c.Period)
+		}
+
+		return []*rita.Event{{Data: e}}, nil
+
+	case *AccrueInterest:
+		return a.decideAccrueInterest()
+
+	case *ReverseTransaction:
+		return a.decideReverseTransaction(c)
 
+	case *SetMinimumBalance:
 		return []*rita.Event{
 			{
-				Data: &BudgetSet{
-					MaxWithdrawAmount:   c.MaxAmount,
-					Period:              c.Period,
-					PolicyStartTime:     now,
-					PeriodStartTime:     st,
-					NextPeriodStartTime: nst,
+				Data: &MinimumBalanceSet{
+					Amount: c.Amount,
+					Time:   a.clock.Now(),
 				},
 			},
 		}, nil
 
-	case *RemoveBudget:
+	case *RemoveMinimumBalance:
+		if a.MinimumBalance.IsZero() {
+			return nil, ErrNoMinimumBalance
+		}
+
 		return []*rita.Event{
 			{
-				Data: &BudgetRemoved{
-					PolicyRemoveTime: a.clock.Now(),
+				Data: &MinimumBalanceRemoved{
+					Time: a.clock.Now(),
 				},
 			},
 		}, nil
-	}
 
-	return nil, ErrUnknownCommand
-}
+	case *SetApprovalThreshold:
+		return []*rita.Event{
+			{
+				Data: &ApprovalThresholdSet{
+					Amount: c.Amount,
+					Time:   a.clock.Now(),
+				},
+			},
+		}, nil
 
-func (a *Account) Evolve(event *rita.Event) error {
-	switch e := event.Data.(type) {
-	case *FundsDeposited:
-		a.CurrentFunds = a.CurrentFunds.Add(e.Amount)
+	case *SetAlertThreshold:
+		return []*rita.Event{
+			{
+				Data: &AlertThresholdSet{
+					LowBalance:    c.LowBalance,
+					BudgetPercent: c.BudgetPercent,
+					Time:          a.clock.Now(),
+				},
+			},
+		}, nil
 
-	case *FundsWithdrawn:
-		a.CurrentFunds = a.CurrentFunds.Sub(e.Amount)
+	case *SetBudget:
+		now := a.clock.Now()
+		st, nst := budgetWindow(now, c.Period, c.TimeZone)
 
-		if a.PolicyPeriod != "" {
-			if e.PeriodChanged {
-				a.FundsWithdrawnInPeriod = e.Amount
-				a.PeriodStartTime, a.NextPeriodStartTime = periodWindow(e.Time, a.PolicyPeriod)
-			} else {
-				a.FundsWithdrawnInPeriod = a.FundsWithdrawnInPeriod.Add(e.Amount)
-			}
+		e := &BudgetSet{
+			MaxWithdrawAmount:   c.MaxAmount,
+			Period:              c.Period,
+			PolicyStartTime:     now,
+			PeriodStartTime:     st,
+			NextPeriodStartTime: nst,
+			TimeZone:            c.TimeZone,
+			Category:            c.Category,
+			MaxPerTransaction:   c.MaxPerTransaction,
+			Rollover:            c.Rollover,
+			RolloverCap:         c.RolloverCap,
+		}
+		if c.ProRate {
+			e.ProRated = true
+			e.FirstPeriodMaxAmount = proRate(c.MaxAmount, now, st, nst)
 		}
 
-	case *BudgetSet:
-		a.MaxWithdrawAmount = e.MaxWithdrawAmount
-		a.PolicyPeriod = e.Period
-		a.PeriodStartTime = e.PeriodStartTime
-		a.NextPeriodStartTime = e.NextPeriodStartTime
-		a.FundsWithdrawnInPeriod = decimal.Zero
+		return []*rita.Event{{Data: e}}, nil
 
-	case *BudgetRemoved:
-		a.MaxWithdrawAmount = decimal.Zero
-		a.PolicyPeriod = ""
-		a.PeriodStartTime = time.Time{}
-		a.NextPeriodStartTime = time.Time{}
-		a.FundsWithdrawnInPeriod = decimal.Zero
-	}
+	case *AdjustBudget:
+		if a.PolicyPeriod == "" {
+			return nil, ErrNoBudget
+		}
 
-	return nil
-}
+		now := a.clock.Now()
 
-type CurrentFunds struct {
-	Amount decimal.Decimal
-}
+		// The max amount cannot be adjusted below what has already been
+		// withdrawn in the current period. Adjusting to the withdrawn amount
+		// leaves nothing remaining for the period.
+		// The amount rolled over to the period is kept.
+		withdrawn := a.FundsWithdrawnInPeriod
+		rolled := a.RolledOverAmount
+		if !now.Before(a.NextPeriodStartTime) {
+			withdrawn = decimal.Zero
+			rolled = a.rolloverAt(now)
+		}
+
+		if c.MaxAmount.Add(rolled).LessThan(withdrawn) {
+			return nil, ErrBudgetBelowSpent
+		}
+
+		return []*rita.Event{
+			{
+				Data: &BudgetAdjusted{
+					MaxWithdrawAmount: c.MaxAmount,
+					Time:              now,
+				},
+			},
+		}, nil
+
+	case *RollOverPeriod:
+		if a.PolicyPeriod == "" {
+			return nil, ErrNoBudget
+		}
+
+		now := a.clock.Now()
+
+		var events []*rita.Event
+		limit, withdrawn := a.PeriodMaxWithdrawAmount, a.FundsWithdrawnInPeriod
+		for st := a.NextPeriodStartTime; !now.Before(st); {
+			pst, nst := budgetWindow(st, a.PolicyPeriod, a.PolicyTimeZone)
+			rolled := a.rolledOverAmount(limit, withdrawn)
+			events = append(events, &rita.Event{
+				Data: &PeriodRolledOver{
+					PeriodStartTime:     pst,
+					NextPeriodStartTime: nst,
+					Time:                now,
+					RolledOverAmount:    rolled,
+				},
+			})
+			limit, withdrawn = a.MaxWithdrawAmount.Add(rolled), decimal.Zero
+			st = nst
+		}
+
+		if n := len(events) - MaxPeriodRollovers; n > 0 {
+			events = events[n:]
+		}
+
+		return events, nil
+
+	case *RemoveBudget:
+		if _, ok := a.CategoryBudgets[c.Category]; c.Category != "" && !ok {
+			return nil, ErrNoBudget
+		}
+
+		return []*rita.Event{
+			{
+				Data: &BudgetRemoved{
+					PolicyRemoveTime: a.clock.Now(),
+					Category:         c.Category,
+				},
+			},
+		}, nil
+
+	case *SetRoundUp:
+		increment := c.Increment
+		if increment.IsZero() {
+			increment = DefaultRoundUpIncrement
+		}
+
+		return []*rita.Event{
+			{
+				Data: &RoundUpSet{
+					Account:   c.Account,
+					Increment: increment,
+					Time:      a.clock.Now(),
+				},
+			},
+		}, nil
+
+	case *RemoveRoundUp:
+		return []*rita.Event{
+			{
+				Data: &RoundUpRemoved{
+					Time: a.clock.Now(),
+				},
+			},
+		}, nil
+
+	case *RefundRoundUp:
+		return []*rita.Event{
+			{
+				Data: &FundsDeposited{
+					Amount:      c.Amount,
+					Description: "round-up refund",
+					ReversalOf:  c.RoundUpID,
+					Time:        a.clock.Now(),
+				},
+			},
+		}, nil
+
+	case *ArchiveAccount:
+		return []*rita.Event{
+			{
+				Data: &AccountArchived{
+					MergedInto: c.MergedInto,
+					Time:       a.clock.Now(),
+				},
+			},
+		}, nil
+
+	case *SetDepositLimit:
+		e := &DepositLimitSet{
+			MaxDeposits: c.MaxDeposits,
+		}
+		if c.MaxDeposits > 0 {
+			e.Period = c.Period
+			e.PeriodStartTime, e.NextPeriodStartTime = periodWindow(a.clock.Now(), c.Period)
+		}
+
+		return []*rita.Event{{Data: e}}, nil
+
+	case *SetAmountStep:
+		return []*rita.Event{
+			{
+				Data: &AmountStepSet{
+					Step: c.Step,
+					Time: a.clock.Now(),
+				},
+			},
+		}, nil
+
+	case *SetSpendReflection:
+		return []*rita.Event{
+			{
+				Data: &SpendReflectionSet{
+					Enabled: c.Enabled,
+					Time:    a.clock.Now(),
+				},
+			},
+		}, nil
+
+	case *SetAccountNote:
+		return []*rita.Event{
+			{
+				Data: &AccountNoteSet{
+					Note: c.Note,
+					Time: a.clock.Now(),
+				},
+			},
+		}, nil
+	}
+
+	return nil, ErrUnknownCommand
+}
+
+// decideWithdrawal decides the withdrawal against the funds and budgets of
+// the account. The approval threshold is not checked.
+func (a *Account) decideWithdrawal(c *WithdrawFunds) ([]*rita.Event, error) {
+	if a.Frozen {
+		return nil, ErrAccountFrozen
+	}
+	if err := a.checkAmountStep(c.Amount); err != nil {
+		return nil, err
+	}
+
+	// Ensure funds do not go below zero.
+	if a.CurrentFunds.Sub(c.Amount).LessThan(decimal.Zero) {
+		return nil, insufficientFunds(a.CurrentFunds, c.Amount)
+	}
+	if err := a.checkMinimumBalance(c.Amount); err != nil {
+		return nil, err
+	}
+
+	now := a.clock.Now()
+
+	var (
+		periodChanged bool
+		rolled        decimal.Decimal
+	)
+
+	if err := checkPerTransaction("", a.MaxPerTransaction, c.Amount); err != nil {
+		return nil, err
+	}
+
+	// Check if the withdraw is allowed given the policy.
+	if a.PolicyPeriod != "" {
+		// One or more period boundaries may have passed since the last
+		// withdrawal, e.g. minutely periods, so nothing has been withdrawn
+		// in the new period yet.
+		periodChanged = !now.Before(a.NextPeriodStartTime)
+
+		withdrawn := a.FundsWithdrawnInPeriod
+		if periodChanged {
+			withdrawn = decimal.Zero
+		}
+
+		if periodChanged {
+			rolled = a.rolloverAt(now)
+		}
+
+		limit := a.periodMaxAmount(now)
+		if withdrawn.Add(c.Amount).GreaterThan(limit) {
+			return nil, budgetExceeded("", limit.Sub(withdrawn), c.Amount)
+		}
+	}
+
+	categoryPeriodChanged, err := a.checkCategoryBudget(c, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// Period changes are recorded by RollOverPeriod, however if it has
+	// not been sent since the boundary passed, the change is detected
+	// lazily on the evolve side.
+	events := []*rita.Event{
+		{
+			Data: &FundsWithdrawn{
+				Amount:                c.Amount,
+				Description:           c.Description,
+				Time:                  now,
+				PeriodChanged:         periodChanged,
+				Category:              c.Category,
+				CategoryPeriodChanged: categoryPeriodChanged,
+				RolledOverAmount:      rolled,
+			},
+		},
+	}
+
+	balance := a.CurrentFunds.Sub(c.Amount)
+
+	// The round-up is not counted against the budget and is skipped if
+	// the remaining funds above the minimum balance do not cover it.
+	if a.RoundUpAccount != "" {
+		delta := RoundUpAmount(c.Amount, a.RoundUpIncrement)
+		if delta.GreaterThan(decimal.Zero) && !balance.Sub(a.MinimumBalance).LessThan(delta) {
+			balance = balance.Sub(delta)
+			events = append(events, &rita.Event{
+				Data: &RoundUpWithdrawn{
+					Amount:  delta,
+					Account: a.RoundUpAccount,
+					Time:    now,
+				},
+			})
+		}
+	}
+
+	if a.SpendReflection {
+		r := &SpendReflection{
+			Balance: balance,
+			Time:    now,
+		}
+
+		if a.PolicyPeriod != "" {
+			withdrawn := a.FundsWithdrawnInPeriod
+			nst := a.NextPeriodStartTime
+			if periodChanged {
+				withdrawn = decimal.Zero
+				_, nst = budgetWindow(now, a.PolicyPeriod, a.PolicyTimeZone)
+			}
+
+			r.Period = a.PolicyPeriod
+			r.RemainingBudget = a.periodMaxAmount(now).Sub(withdrawn).Sub(c.Amount)
+			r.NextPeriodStartTime = nst
+		}
+
+		events = append(events, &rita.Event{Data: r})
+	}
+
+	return events, nil
+}
+
+// Evolve assumes events are in time order, which holds for events decided
+// by the aggregate. A backdated transaction, e.g. appended by a restore,
+// occurred in a past period. It changes the balance, but is not counted in
+// the current budget or deposit period.
+func (a *Account) Evolve(event *rita.Event) error {
+	a.Opened = true
+
+	switch e := event.Data.(type) {
+	case *AccountOpened:
+		a.Owner = e.Owner
+
+	case *AccountClosed:
+		a.Closed = true
+
+	case *AccountFrozen:
+		a.Frozen = true
+
+	case *AccountUnfrozen:
+		a.Frozen = false
 
-func (c *CurrentFunds) Evolve(event *rita.Event) error {
-	switch e := event.Data.(type) {
 	case *FundsDeposited:
-		c.Amount = c.Amount.Add(e.Amount)
+		a.evolveTransaction(event)
+
+		if isForeign(e.Currency) {
+			a.Balances = addBalance(a.Balances, e.Currency, e.Amount)
+		} else {
+			a.CurrentFunds = a.CurrentFunds.Add(e.Amount)
+		}
+
+		// Allowances and reversals are not counted against the deposit
+		// limit.
+		if !e.AllowanceTime.IsZero() {
+			a.evolveAllowance(event)
+		} else if a.MaxDeposits > 0 && e.ReversalOf == "" && !e.Time.Before(a.DepositPeriodStartTime) {
+			// Unlike withdrawals, the period change is detected from the
+			// time of the deposit.
+			if !e.Time.Before(a.NextDepositPeriodStartTime) {
+				a.DepositsInPeriod = 0
+				a.DepositPeriodStartTime, a.NextDepositPeriodStartTime = periodWindow(e.Time, a.DepositPeriod)
+			}
+			a.DepositsInPeriod++
+		}
+
+		if e.GoalName != "" {
+			a.evolveSavingsGoal(event)
+		}
+
+	case *SavingsGoalCreated, *GoalReached:
+		a.evolveSavingsGoal(event)
+
+	case *ApprovalThresholdSet:
+		a.ApprovalThreshold = e.Amount
+
+	case *AlertThresholdSet:
+		a.AlertLowBalance = e.LowBalance
+		a.AlertBudgetPercent = e.BudgetPercent
+
+	case *MinimumBalanceSet:
+		a.MinimumBalance = e.Amount
+
+	case *MinimumBalanceRemoved:
+		a.MinimumBalance = decimal.Zero
+
+	case *AllowanceSet, *AllowanceRemoved:
+		a.evolveAllowance(event)
+
+	case *InterestRateSet, *InterestAccrued:
+		a.evolveInterest(event)
+
+	case *WithdrawalRequested, *WithdrawalApproved, *WithdrawalDenied:
+		a.evolveWithdrawalRequest(event)
+
+	case *FundsWithdrawn:
+		a.evolveTransaction(event)
+
+		// Withdrawals in other currencies are not counted against budgets.
+		if isForeign(e.Currency) {
+			a.Balances = addBalance(a.Balances, e.Currency, e.Amount.Neg())
+			break
+		}
+
+		a.CurrentFunds = a.CurrentFunds.Sub(e.Amount)
+
+		if e.ReversalOf != "" {
+			break
+		}
+
+		if a.PolicyPeriod != "" && !e.Time.Before(a.PeriodStartTime) {
+			if e.PeriodChanged {
+				a.FundsWithdrawnInPeriod = e.Amount
+				a.RolledOverAmount = e.RolledOverAmount
+				a.PeriodMaxWithdrawAmount = a.MaxWithdrawAmount.Add(e.RolledOverAmount)
+				a.PeriodStartTime, a.NextPeriodStartTime = budgetWindow(e.Time, a.PolicyPeriod, a.PolicyTimeZone)
+			} else {
+				a.FundsWithdrawnInPeriod = a.FundsWithdrawnInPeriod.Add(e.Amount)
+			}
+		}
+
+		if e.Category != "" {
+			a.evolveCategoryBudget(event)
+		}
+
+	case *BudgetSet:
+		if e.Category != "" {
+			a.evolveCategoryBudget(event)
+			break
+		}
+
+		a.MaxWithdrawAmount = e.MaxWithdrawAmount
+		a.PeriodMaxWithdrawAmount = e.periodMaxAmount()
+		a.MaxPerTransaction = e.MaxPerTransaction
+		a.Rollover = e.Rollover
+		a.RolloverCap = e.RolloverCap
+		a.RolledOverAmount = decimal.Zero
+		a.PolicyPeriod = e.Period
+		a.PolicyTimeZone = e.TimeZone
+		a.PeriodStartTime = e.PeriodStartTime
+		a.NextPeriodStartTime = e.NextPeriodStartTime
+		a.FundsWithdrawnInPeriod = decimal.Zero
+
+	case *BudgetAdjusted:
+		a.MaxWithdrawAmount = e.MaxWithdrawAmount
+		a.PeriodMaxWithdrawAmount = e.MaxWithdrawAmount.Add(a.RolledOverAmount)
+
+	case *PeriodRolledOver:
+		a.FundsWithdrawnInPeriod = decimal.Zero
+		a.RolledOverAmount = e.RolledOverAmount
+		a.PeriodMaxWithdrawAmount = a.MaxWithdrawAmount.Add(e.RolledOverAmount)
+		a.PeriodStartTime = e.PeriodStartTime
+		a.NextPeriodStartTime = e.NextPeriodStartTime
+
+	case *BudgetRemoved:
+		if e.Category != "" {
+			a.evolveCategoryBudget(event)
+			break
+		}
+
+		a.MaxWithdrawAmount = decimal.Zero
+		a.PeriodMaxWithdrawAmount = decimal.Zero
+		a.MaxPerTransaction = decimal.Zero
+		a.Rollover = false
+		a.RolloverCap = decimal.Zero
+		a.RolledOverAmount = decimal.Zero
+		a.PolicyPeriod = ""
+		a.PolicyTimeZone = ""
+		a.PeriodStartTime = time.Time{}
+		a.NextPeriodStartTime = time.Time{}
+		a.FundsWithdrawnInPeriod = decimal.Zero
+
+	case *RoundUpSet:
+		a.RoundUpAccount = e.Account
+		a.RoundUpIncrement = e.Increment
+
+	case *RoundUpRemoved:
+		a.RoundUpAccount = ""
+		a.RoundUpIncrement = decimal.Zero
+
+	case *RoundUpWithdrawn:
+		a.CurrentFunds = a.CurrentFunds.Sub(e.Amount)
+
+	case *TransactionMerged:
+		if isForeign(e.Currency) {
+			a.Balances = addBalance(a.Balances, e.Currency, e.Amount)
+		} else {
+			a.CurrentFunds = a.CurrentFunds.Add(e.Amount)
+		}
+
+	case *AccountArchived:
+		a.Archived = true
+
+	case *SpendReflectionSet:
+		a.SpendReflection = e.Enabled
+
+	case *DepositLimitSet:
+		a.MaxDeposits = e.MaxDeposits
+		a.DepositPeriod = e.Period
+		a.DepositPeriodStartTime = e.PeriodStartTime
+		a.NextDepositPeriodStartTime = e.NextPeriodStartTime
+		a.DepositsInPeriod = 0
+
+	case *AmountStepSet:
+		a.AmountStep = e.Step
+
+	case *AccountNoteSet:
+		a.Note = e.Note
+	}
+
+	return nil
+}
+
+type CurrentFunds struct {
+	// Amount is the balance in the default currency.
+	Amount decimal.Decimal
+	// Balances are the balances in other currencies, by currency.
+	Balances map[string]decimal.Decimal `json:",omitempty"`
+}
+
+func (c *CurrentFunds) add(currency string, amount decimal.Decimal) {
+	if isForeign(currency) {
+		c.Balances = addBalance(c.Balances, currency, amount)
+	} else {
+		c.Amount = c.Amount.Add(amount)
+	}
+}
+
+// ByCurrency returns the balance of each currency, including the default
+// currency.
+func (c *CurrentFunds) ByCurrency() map[string]decimal.Decimal {
+	m := map[string]decimal.Decimal{
+		DefaultCurrency: c.Amount,
+	}
+	for currency, amount := range c.Balances {
+		m[currency] = amount
+	}
+	return m
+}
+
+func (c *CurrentFunds) Evolve(event *rita.Event) error {
+	switch e := event.Data.(type) {
+	case *FundsDeposited:
+		c.add(e.Currency, e.Amount)
 	case *FundsWithdrawn:
+		c.add(e.Currency, e.Amount.Neg())
+	case *RoundUpWithdrawn:
 		c.Amount = c.Amount.Sub(e.Amount)
+	case *TransactionMerged:
+		c.add(e.Currency, e.Amount)
+	case *InterestAccrued:
+		c.Amount = c.Amount.Add(e.Amount)
 	}
 	return nil
 }
 
+// AccountInfo is a summary of the account for display purposes. The balance
+// is in the default currency.
+type AccountInfo struct {
+	Owner   string
+	Note    string
+	Balance decimal.Decimal
+}
+
+func (i *AccountInfo) Evolve(event *rita.Event) error {
+	switch e := event.Data.(type) {
+	case *FundsDeposited:
+		if !isForeign(e.Currency) {
+			i.Balance = i.Balance.Add(e.Amount)
+		}
+	case *FundsWithdrawn:
+		if !isForeign(e.Currency) {
+			i.Balance = i.Balance.Sub(e.Amount)
+		}
+	case *RoundUpWithdrawn:
+		i.Balance = i.Balance.Sub(e.Amount)
+	case *TransactionMerged:
+		if !isForeign(e.Currency) {
+			i.Balance = i.Balance.Add(e.Amount)
+		}
+	case *InterestAccrued:
+		i.Balance = i.Balance.Add(e.Amount)
+	case *AccountNoteSet:
+		i.Note = e.Note
+	case *AccountOpened:
+		i.Owner = e.Owner
+	}
+	return nil
+}
+
+// BudgetState is a snapshot of the budget as of a point in time. It is
+// derived from the Account aggregate so it matches what would be decided on
+// a withdrawal at that time.
+type BudgetState struct {
+	Period              Period
+	MaxWithdrawAmount   decimal.Decimal
+	FundsWithdrawn      decimal.Decimal
+	Remaining           decimal.Decimal
+	PeriodStartTime     time.Time
+	NextPeriodStartTime time.Time
+	// RolledOverAmount is the unspent funds of the previous period which
+	// are included in the max amount.
+	RolledOverAmount decimal.Decimal
+}
+
+// NewBudgetState returns the state of the budget of the account at time t.
+// If one or more period boundaries have passed since the last withdrawal,
+// the state is of the period containing t.
+func NewBudgetState(a *Account, t time.Time) *BudgetState {
+	if a.PolicyPeriod == "" {
+		return &BudgetState{}
+	}
+
+	s := &BudgetState{
+		Period:              a.PolicyPeriod,
+		MaxWithdrawAmount:   a.PeriodMaxWithdrawAmount,
+		FundsWithdrawn:      a.FundsWithdrawnInPeriod,
+		PeriodStartTime:     a.PeriodStartTime,
+		NextPeriodStartTime: a.NextPeriodStartTime,
+		RolledOverAmount:    a.RolledOverAmount,
+	}
+
+	if !t.Before(a.NextPeriodStartTime) {
+		s.RolledOverAmount = a.rolloverAt(t)
+		s.MaxWithdrawAmount = a.MaxWithdrawAmount.Add(s.RolledOverAmount)
+		s.FundsWithdrawn = decimal.Zero
+		s.PeriodStartTime, s.NextPeriodStartTime = budgetWindow(t, a.PolicyPeriod, a.PolicyTimeZone)
+	}
+
+	s.Remaining = s.MaxWithdrawAmount.Sub(s.FundsWithdrawn)
+	if s.Remaining.LessThan(decimal.Zero) {
+		s.Remaining = decimal.Zero
+	}
+
+	return s
+}
+
+// BudgetPeriod is the state of the current budget period. Like the Account,
+// it assumes events are in time order.
 type BudgetPeriod struct {
+	// Category is the category of the budget, if not the budget of the
+	// account. Only withdrawals of the category are counted.
+	Category string
+
 	PolicyPeriod            Period
+	PolicyTimeZone          string
 	PolicyStartTime         time.Time
 	PolicyMaxWithdrawAmount decimal.Decimal
 	WithdrawalsInPeriod     int
 	FundsWithdrawnInPeriod  decimal.Decimal
 	PeriodStartTime         time.Time
 	NextPeriodStartTime     time.Time
+
+	// NextMaxWithdrawAmount is the max amount of later periods if the
+	// first period was pro-rated.
+	NextMaxWithdrawAmount decimal.Decimal
+
+	// RolledOverAmount is the unspent funds of the previous period which
+	// are included in the max amount of the period.
+	RolledOverAmount decimal.Decimal
+
+	// BackdatedWithdrawals is the number of withdrawals which occurred
+	// before the current period, but were appended during it. They are
+	// not counted in the period.
+	BackdatedWithdrawals int
 }
 
 func (p *BudgetPeriod) Evolve(event *rita.Event) error {
 	switch e := event.Data.(type) {
 	case *BudgetSet:
+		if e.Category != p.Category {
+			return nil
+		}
 		p.PolicyPeriod = e.Period
-		p.PolicyMaxWithdrawAmount = e.MaxWithdrawAmount
+		p.PolicyTimeZone = e.TimeZone
+		p.PolicyMaxWithdrawAmount = e.periodMaxAmount()
+		p.NextMaxWithdrawAmount = decimal.Decimal{}
+		if e.ProRated {
+			p.NextMaxWithdrawAmount = e.MaxWithdrawAmount
+		}
+		p.RolledOverAmount = decimal.Zero
 		p.PolicyStartTime = e.PolicyStartTime
 		p.WithdrawalsInPeriod = 0
+		p.BackdatedWithdrawals = 0
 		p.FundsWithdrawnInPeriod = decimal.Zero
-		p.PeriodStartTime, p.NextPeriodStartTime = periodWindow(e.PolicyStartTime, p.PolicyPeriod)
+		p.PeriodStartTime, p.NextPeriodStartTime = budgetWindow(e.PolicyStartTime, p.PolicyPeriod, p.PolicyTimeZone)
+
+	case *BudgetAdjusted:
+		if p.Category != "" {
+			return nil
+		}
+		p.PolicyMaxWithdrawAmount = e.MaxWithdrawAmount.Add(p.RolledOverAmount)
+		p.NextMaxWithdrawAmount = decimal.Decimal{}
+
+	case *PeriodRolledOver:
+		if p.Category != "" {
+			return nil
+		}
+		p.rollOver(e.RolledOverAmount)
+		p.WithdrawalsInPeriod = 0
+		p.BackdatedWithdrawals = 0
+		p.FundsWithdrawnInPeriod = decimal.Zero
+		p.PeriodStartTime = e.PeriodStartTime
+		p.NextPeriodStartTime = e.NextPeriodStartTime
 
 	case *BudgetRemoved:
+		if e.Category != p.Category {
+			return nil
+		}
 		p.PolicyPeriod = ""
+		p.PolicyTimeZone = ""
 		p.PolicyMaxWithdrawAmount = decimal.Zero
+		p.NextMaxWithdrawAmount = decimal.Decimal{}
+		p.RolledOverAmount = decimal.Zero
 		p.PolicyStartTime = time.Time{}
 		p.PeriodStartTime = time.Time{}
 		p.NextPeriodStartTime = time.Time{}
 
 	case *FundsWithdrawn:
-		if e.PeriodChanged {
+		// Reversals and withdrawals in other currencies are not counted
+		// against the budget.
+		if e.ReversalOf != "" || isForeign(e.Currency) {
+			return nil
+		}
+
+		changed := e.PeriodChanged
+		rolled := e.RolledOverAmount
+		if p.Category != "" {
+			if e.Category != p.Category {
+				return nil
+			}
+			changed = e.CategoryPeriodChanged
+			rolled = decimal.Zero
+		}
+
+		if p.PolicyPeriod != "" && e.Time.Before(p.PeriodStartTime) {
+			p.BackdatedWithdrawals++
+			return nil
+		}
+
+		if changed {
+			p.rollOver(rolled)
 			p.WithdrawalsInPeriod = 0
+			p.BackdatedWithdrawals = 0
 			p.FundsWithdrawnInPeriod = decimal.Zero
-			p.PeriodStartTime, p.NextPeriodStartTime = periodWindow(e.Time, p.PolicyPeriod)
+			p.PeriodStartTime, p.NextPeriodStartTime = budgetWindow(e.Time, p.PolicyPeriod, p.PolicyTimeZone)
 		}
 
 		p.WithdrawalsInPeriod++
@@ -339,3 +1550,185 @@ func (p *BudgetPeriod) Evolve(event *rita.Event) error {
 
 	return nil
 }
+
+// rollOver sets the max amount of the next period, which includes the
+// amount rolled over from the current period.
+func (p *BudgetPeriod) rollOver(rolled decimal.Decimal) {
+	base := p.PolicyMaxWithdrawAmount.Sub(p.RolledOverAmount)
+	if p.NextMaxWithdrawAmount.GreaterThan(decimal.Zero) {
+		base = p.NextMaxWithdrawAmount
+		p.NextMaxWithdrawAmount = decimal.Decimal{}
+	}
+	p.RolledOverAmount = rolled
+	p.PolicyMaxWithdrawAmount = base.Add(rolled)
+}
+
+// MaxRecentDescriptions is the number of distinct descriptions retained by
+// the RecentDescriptions projection.
+var MaxRecentDescriptions = 10
+
+// RecentDescriptions tracks the distinct descriptions used on deposits and
+// withdrawals, most recent first. This is used to suggest descriptions for
+// recurring transactions.
+type RecentDescriptions struct {
+	Descriptions []string
+}
+
+func (d *RecentDescriptions) Evolve(event *rita.Event) error {
+	var desc string
+	switch e := event.Data.(type) {
+	case *FundsDeposited:
+		desc = e.Description
+	case *FundsWithdrawn:
+		desc = e.Description
+	}
+
+	if desc == "" {
+		return nil
+	}
+
+	// Move the description to the front, dropping the previous occurrence
+	// and any beyond the max.
+	ds := []string{desc}
+	for _, x := range d.Descriptions {
+		if len(ds) == MaxRecentDescriptions {
+			break
+		}
+		if x != desc {
+			ds = append(ds, x)
+		}
+	}
+	d.Descriptions = ds
+
+	return nil
+}
+
+// unspentInPeriod returns the unspent budget of a period, if any.
+func unspentInPeriod(p *BudgetPeriod) decimal.Decimal {
+	unspent := p.PolicyMaxWithdrawAmount.Sub(p.FundsWithdrawnInPeriod)
+	if unspent.LessThan(decimal.Zero) {
+		return decimal.Zero
+	}
+	return unspent
+}
+
+// PriorPeriods is a roll-up of closed periods which have been compacted.
+type PriorPeriods struct {
+	Periods           int
+	Withdrawals       int
+	MaxWithdrawAmount decimal.Decimal
+	FundsWithdrawn    decimal.Decimal
+	Unspent           decimal.Decimal
+}
+
+func (r *PriorPeriods) add(p *BudgetPeriod) {
+	r.Periods++
+	r.Withdrawals += p.WithdrawalsInPeriod
+	r.MaxWithdrawAmount = r.MaxWithdrawAmount.Add(p.PolicyMaxWithdrawAmount)
+	r.FundsWithdrawn = r.FundsWithdrawn.Add(p.FundsWithdrawnInPeriod)
+	r.Unspent = r.Unspent.Add(unspentInPeriod(p))
+}
+
+// NewPeriodHistory returns a period history which retains at most maxClosed
+// periods. Older periods are compacted into the prior periods roll-up. Zero
+// means all closed periods are retained.
+func NewPeriodHistory(maxClosed int) *PeriodHistory {
+	return &PeriodHistory{
+		maxClosedPeriods: maxClosed,
+	}
+}
+
+// PeriodHistory tracks the current budget period as well as the periods
+// which have closed. A period is closed when a withdrawal occurs in a later
+// period or when the budget is changed or removed.
+type PeriodHistory struct {
+	Current       BudgetPeriod
+	ClosedPeriods []*BudgetPeriod
+	PriorPeriods  PriorPeriods
+
+	maxClosedPeriods int
+}
+
+func (h *PeriodHistory) closePeriod() {
+	if h.Current.PolicyPeriod == "" {
+		return
+	}
+	p := h.Current
+	h.ClosedPeriods = append(h.ClosedPeriods, &p)
+
+	if h.maxClosedPeriods > 0 && len(h.ClosedPeriods) > h.maxClosedPeriods {
+		n := len(h.ClosedPeriods) - h.maxClosedPeriods
+		for _, p := range h.ClosedPeriods[:n] {
+			h.PriorPeriods.add(p)
+		}
+		h.ClosedPeriods = h.ClosedPeriods[n:]
+	}
+}
+
+func (h *PeriodHistory) Evolve(event *rita.Event) error {
+	switch e := event.Data.(type) {
+	case *BudgetSet:
+		if e.Category == "" {
+			h.closePeriod()
+		}
+
+	case *BudgetRemoved:
+		if e.Category == "" {
+			h.closePeriod()
+		}
+
+	case *PeriodRolledOver:
+		h.closePeriod()
+
+	case *FundsWithdrawn:
+		if e.PeriodChanged {
+			h.closePeriod()
+		}
+	}
+
+	return h.Current.Evolve(event)
+}
+
+type PeriodCarryover struct {
+	PeriodStartTime     time.Time
+	NextPeriodStartTime time.Time
+	MaxWithdrawAmount   decimal.Decimal
+	FundsWithdrawn      decimal.Decimal
+	Unspent             decimal.Decimal
+}
+
+// CarryoverReport summarizes the unspent budget of closed periods. This is
+// informational only. Unspent funds are added to later periods only if the
+// budget rolls them over.
+type CarryoverReport struct {
+	PriorPeriods PriorPeriods
+	Periods      []*PeriodCarryover
+	TotalUnspent decimal.Decimal
+}
+
+func NewCarryoverReport(h *PeriodHistory) *CarryoverReport {
+	r := &CarryoverReport{
+		PriorPeriods: h.PriorPeriods,
+		TotalUnspent: h.PriorPeriods.Unspent,
+	}
+
+	for _, p := range h.ClosedPeriods {
+		// Period without a budget.
+		if p.PolicyPeriod == "" {
+			continue
+		}
+
+		unspent := unspentInPeriod(p)
+
+		r.Periods = append(r.Periods, &PeriodCarryover{
+			PeriodStartTime:     p.PeriodStartTime,
+			NextPeriodStartTime: p.NextPeriodStartTime,
+			MaxWithdrawAmount:   p.PolicyMaxWithdrawAmount,
+			FundsWithdrawn:      p.FundsWithdrawnInPeriod,
+			Unspent:             unspent,
+		})
+		r.TotalUnspent = r.TotalUnspent.Add(unspent)
+	}
+
+	return r
+}
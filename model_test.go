@@ -3,6 +3,7 @@ package kmm
 
 import (
 	"encoding/json"
+	"sync"
 	"testing"
 	"time"
 
@@ -50,6 +51,20 @@ func TestPeriodWindow(t *testing.T) {
 			is.Equal(nst, test.NextStartTime)
 		})
 	}
+
+	// Sunday is the last day of the week, not the start of the next.
+	t.Run("weekly-sunday", func(t *testing.T) {
+		st, nst := periodWindow(time.Date(2019, time.May, 5, 18, 0, 0, 0, time.UTC), Weekly)
+		is.Equal(st, time.Date(2019, time.April, 29, 0, 0, 0, 0, time.UTC))
+		is.Equal(nst, time.Date(2019, time.May, 6, 0, 0, 0, 0, time.UTC))
+	})
+
+	// Monday is the first day of the week.
+	t.Run("weekly-monday", func(t *testing.T) {
+		st, nst := periodWindow(time.Date(2019, time.May, 6, 0, 0, 0, 0, time.UTC), Weekly)
+		is.Equal(st, time.Date(2019, time.May, 6, 0, 0, 0, 0, time.UTC))
+		is.Equal(nst, time.Date(2019, time.May, 13, 0, 0, 0, 0, time.UTC))
+	})
 }
 
 func TestAccount(t *testing.T) {
@@ -280,3 +295,974 @@ func TestPeriodSummary(t *testing.T) {
 		NextPeriodStartTime:     nst,
 	})
 }
+
+func TestRecentDescriptions(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ten, _ := decimal.NewFromString("10")
+
+	n := MaxRecentDescriptions
+	MaxRecentDescriptions = 3
+	defer func() { MaxRecentDescriptions = n }()
+
+	var d RecentDescriptions
+
+	for _, desc := range []string{"candy", "", "toy", "candy", "book", "movie"} {
+		d.Evolve(&rita.Event{
+			Data: &FundsWithdrawn{
+				Amount:      ten,
+				Description: desc,
+			},
+		})
+	}
+
+	d.Evolve(&rita.Event{
+		Data: &FundsDeposited{
+			Amount:      ten,
+			Description: "allowance",
+		},
+	})
+
+	is.Equal(d, RecentDescriptions{
+		Descriptions: []string{"allowance", "movie", "book"},
+	})
+
+	d.Evolve(&rita.Event{
+		Data: &FundsWithdrawn{
+			Amount:      ten,
+			Description: "book",
+		},
+	})
+
+	is.Equal(d, RecentDescriptions{
+		Descriptions: []string{"book", "allowance", "movie"},
+	})
+}
+
+func TestAccountNote(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	ten, _ := decimal.NewFromString("10")
+
+	clock := testutil.NewClock(time.Minute)
+	a := Account{clock: clock}
+
+	long := &SetAccountNote{Note: string(make([]byte, MaxNoteLength+1))}
+	is.Err(long.Validate(), ErrNoteTooLong)
+
+	cmd := &SetAccountNote{Note: "emma's college fund"}
+	is.NoErr(cmd.Validate())
+
+	events, err := a.Decide(&rita.Command{Data: cmd})
+	is.NoErr(err)
+	a.Evolve(events[0])
+	is.Equal(a.Note, "emma's college fund")
+
+	var i AccountInfo
+	i.Evolve(&rita.Event{Data: &FundsDeposited{Amount: ten}})
+	i.Evolve(events[0])
+	is.Equal(i, AccountInfo{
+		Note:    "emma's college fund",
+		Balance: ten,
+	})
+}
+
+func TestCarryoverReport(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	var h PeriodHistory
+
+	pt := time.Date(2019, time.May, 3, 12, 20, 30, 0, time.UTC)
+	st, nst := periodWindow(pt, Daily)
+
+	// Withdrawal without a budget does not create a period.
+	h.Evolve(&rita.Event{Data: &FundsWithdrawn{Amount: d("1"), Time: pt.Add(-time.Hour)}})
+
+	h.Evolve(&rita.Event{
+		Data: &BudgetSet{
+			Period:              Daily,
+			MaxWithdrawAmount:   d("5"),
+			PolicyStartTime:     pt,
+			PeriodStartTime:     st,
+			NextPeriodStartTime: nst,
+		},
+	})
+
+	// Day one, spend 2.
+	h.Evolve(&rita.Event{Data: &FundsWithdrawn{Amount: d("2"), Time: pt.Add(time.Hour)}})
+
+	// Day two, spend 4.50.
+	h.Evolve(&rita.Event{Data: &FundsWithdrawn{Amount: d("4.50"), Time: pt.Add(24 * time.Hour), PeriodChanged: true}})
+
+	// Day three, spend 1 which closes day two.
+	h.Evolve(&rita.Event{Data: &FundsWithdrawn{Amount: d("1"), Time: pt.Add(48 * time.Hour), PeriodChanged: true}})
+
+	is.Equal(len(h.ClosedPeriods), 2)
+
+	r := NewCarryoverReport(&h)
+	is.Equal(len(r.Periods), 2)
+
+	is.Equal(r.Periods[0].PeriodStartTime, st)
+	is.True(r.Periods[0].FundsWithdrawn.Equal(d("2")))
+	is.True(r.Periods[0].Unspent.Equal(d("3")))
+
+	is.Equal(r.Periods[1].PeriodStartTime, nst)
+	is.True(r.Periods[1].FundsWithdrawn.Equal(d("4.50")))
+	is.True(r.Periods[1].Unspent.Equal(d("0.50")))
+
+	is.True(r.TotalUnspent.Equal(d("3.50")))
+
+	// Removing the budget closes the current period.
+	h.Evolve(&rita.Event{Data: &BudgetRemoved{PolicyRemoveTime: pt.Add(49 * time.Hour)}})
+	is.Equal(len(h.ClosedPeriods), 3)
+
+	r = NewCarryoverReport(&h)
+	is.True(r.TotalUnspent.Equal(d("7.50")))
+}
+
+func TestMinutelyPeriodRollover(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Second)
+	a := Account{clock: clock}
+
+	var p BudgetPeriod
+
+	decide := func(cmd any) ([]*rita.Event, error) {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			a.Evolve(e)
+			p.Evolve(e)
+		}
+		return events, err
+	}
+
+	_, err := decide(&DepositFunds{Amount: d("100")})
+	is.NoErr(err)
+
+	_, err = decide(&SetBudget{MaxAmount: d("10"), Period: Minutely})
+	is.NoErr(err)
+
+	_, err = decide(&WithdrawFunds{Amount: d("6")})
+	is.NoErr(err)
+
+	// Several minute boundaries pass between withdrawals.
+	clock.Add(5 * time.Minute)
+
+	// Exceeds the max even though the period changed.
+	_, err = decide(&WithdrawFunds{Amount: d("11")})
+	is.Err(err, ErrExceedWithinPeriod)
+
+	events, err := decide(&WithdrawFunds{Amount: d("7")})
+	is.NoErr(err)
+
+	e, _ := events[0].Data.(*FundsWithdrawn)
+	is.True(e.PeriodChanged)
+
+	st, nst := periodWindow(e.Time, Minutely)
+
+	is.True(a.FundsWithdrawnInPeriod.Equal(d("7")))
+	is.Equal(a.PeriodStartTime, st)
+	is.Equal(a.NextPeriodStartTime, nst)
+
+	is.Equal(p.WithdrawalsInPeriod, 1)
+	is.True(p.FundsWithdrawnInPeriod.Equal(d("7")))
+	is.Equal(p.PeriodStartTime, st)
+	is.Equal(p.NextPeriodStartTime, nst)
+
+	// Same period.
+	_, err = decide(&WithdrawFunds{Amount: d("4")})
+	is.Err(err, ErrExceedWithinPeriod)
+
+	_, err = decide(&WithdrawFunds{Amount: d("3")})
+	is.NoErr(err)
+	is.Equal(p.WithdrawalsInPeriod, 2)
+	is.True(p.FundsWithdrawnInPeriod.Equal(d("10")))
+}
+
+func TestRollOverPeriod(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	day := func(n int) time.Time {
+		return time.Date(2019, time.September, n, 0, 0, 0, 0, time.UTC)
+	}
+
+	clock := testutil.NewClock(time.Second)
+	a := Account{clock: clock}
+
+	var p BudgetPeriod
+	h := NewPeriodHistory(0)
+
+	decide := func(cmd any) ([]*rita.Event, error) {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			a.Evolve(e)
+			p.Evolve(e)
+			h.Evolve(e)
+		}
+		return events, err
+	}
+
+	_, err := decide(&DepositFunds{Amount: d("100")})
+	is.NoErr(err)
+
+	_, err = decide(&RollOverPeriod{})
+	is.Err(err, ErrNoBudget)
+
+	_, err = decide(&SetBudget{MaxAmount: d("10"), Period: Daily})
+	is.NoErr(err)
+
+	_, err = decide(&WithdrawFunds{Amount: d("4")})
+	is.NoErr(err)
+
+	// Nothing to roll over within the period.
+	events, err := decide(&RollOverPeriod{})
+	is.NoErr(err)
+	is.Equal(len(events), 0)
+
+	// Three days pass without any withdrawals.
+	clock.Add(3 * 24 * time.Hour)
+
+	events, err = decide(&RollOverPeriod{})
+	is.NoErr(err)
+	is.Equal(len(events), 3)
+
+	for i, e := range events {
+		r := e.Data.(*PeriodRolledOver)
+		is.Equal(r.PeriodStartTime, day(21+i))
+		is.Equal(r.NextPeriodStartTime, day(22+i))
+	}
+
+	is.True(a.FundsWithdrawnInPeriod.Equal(decimal.Zero))
+	is.Equal(a.PeriodStartTime, day(23))
+	is.Equal(a.NextPeriodStartTime, day(24))
+
+	is.Equal(p.WithdrawalsInPeriod, 0)
+	is.Equal(p.PeriodStartTime, day(23))
+
+	// The idle periods are recorded.
+	is.Equal(len(h.ClosedPeriods), 3)
+	is.True(h.ClosedPeriods[0].FundsWithdrawnInPeriod.Equal(d("4")))
+	is.Equal(h.ClosedPeriods[1].PeriodStartTime, day(21))
+	is.Equal(h.ClosedPeriods[1].WithdrawalsInPeriod, 0)
+	is.Equal(h.ClosedPeriods[2].PeriodStartTime, day(22))
+
+	// The next withdrawal is within the rolled over period.
+	events, err = decide(&WithdrawFunds{Amount: d("10")})
+	is.NoErr(err)
+	is.True(!events[0].Data.(*FundsWithdrawn).PeriodChanged)
+	is.Equal(p.WithdrawalsInPeriod, 1)
+
+	_, err = decide(&WithdrawFunds{Amount: d("1")})
+	is.Err(err, ErrExceedWithinPeriod)
+
+	// Only the most recent periods are recorded after a long idle stretch.
+	clock.Add(time.Duration(MaxPeriodRollovers+10) * 24 * time.Hour)
+
+	events, err = decide(&RollOverPeriod{})
+	is.NoErr(err)
+	is.Equal(len(events), MaxPeriodRollovers)
+	is.True(!clock.Last().Before(a.PeriodStartTime))
+	is.True(clock.Last().Before(a.NextPeriodStartTime))
+}
+
+func TestPeriodHistoryCompaction(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	h := NewPeriodHistory(2)
+
+	pt := time.Date(2019, time.May, 3, 12, 20, 30, 0, time.UTC)
+	st, nst := periodWindow(pt, Daily)
+
+	h.Evolve(&rita.Event{
+		Data: &BudgetSet{
+			Period:              Daily,
+			MaxWithdrawAmount:   d("5"),
+			PolicyStartTime:     pt,
+			PeriodStartTime:     st,
+			NextPeriodStartTime: nst,
+		},
+	})
+
+	// Spend 1, 2, 3, 4, 5 on consecutive days, closing four periods.
+	for i := 0; i < 5; i++ {
+		h.Evolve(&rita.Event{
+			Data: &FundsWithdrawn{
+				Amount:        decimal.NewFromInt(int64(i + 1)),
+				Time:          pt.Add(time.Duration(i) * 24 * time.Hour),
+				PeriodChanged: i > 0,
+			},
+		})
+	}
+
+	is.Equal(len(h.ClosedPeriods), 2)
+	is.True(h.ClosedPeriods[0].FundsWithdrawnInPeriod.Equal(d("3")))
+	is.True(h.ClosedPeriods[1].FundsWithdrawnInPeriod.Equal(d("4")))
+
+	is.Equal(h.PriorPeriods.Periods, 2)
+	is.Equal(h.PriorPeriods.Withdrawals, 2)
+	is.True(h.PriorPeriods.MaxWithdrawAmount.Equal(d("10")))
+	is.True(h.PriorPeriods.FundsWithdrawn.Equal(d("3")))
+	is.True(h.PriorPeriods.Unspent.Equal(d("7")))
+
+	// Totals include the compacted periods: 4 + 3 + 2 + 1.
+	r := NewCarryoverReport(h)
+	is.Equal(len(r.Periods), 2)
+	is.True(r.TotalUnspent.Equal(d("10")))
+}
+
+func TestAdjustBudget(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	a := Account{clock: testutil.NewClock(time.Second)}
+
+	var p BudgetPeriod
+
+	decide := func(cmd any) ([]*rita.Event, error) {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			a.Evolve(e)
+			p.Evolve(e)
+		}
+		return events, err
+	}
+
+	_, err := decide(&AdjustBudget{MaxAmount: d("10")})
+	is.Err(err, ErrNoBudget)
+
+	is.Err((&AdjustBudget{MaxAmount: d("10.005")}).Validate(), ErrTooManyDecimalPlaces)
+
+	_, err = decide(&DepositFunds{Amount: d("100")})
+	is.NoErr(err)
+
+	_, err = decide(&SetBudget{MaxAmount: d("20"), Period: Monthly})
+	is.NoErr(err)
+
+	_, err = decide(&WithdrawFunds{Amount: d("8")})
+	is.NoErr(err)
+
+	// Below current spend.
+	_, err = decide(&AdjustBudget{MaxAmount: d("7.99")})
+	is.Err(err, ErrBudgetBelowSpent)
+	is.True(a.MaxWithdrawAmount.Equal(d("20")))
+
+	// Equal to current spend, nothing remaining.
+	_, err = decide(&AdjustBudget{MaxAmount: d("8")})
+	is.NoErr(err)
+	is.True(a.MaxWithdrawAmount.Equal(d("8")))
+	is.True(a.FundsWithdrawnInPeriod.Equal(d("8")))
+	is.True(unspentInPeriod(&p).Equal(decimal.Zero))
+
+	_, err = decide(&WithdrawFunds{Amount: d("0.01")})
+	is.Err(err, ErrExceedWithinPeriod)
+
+	// Above current spend, spend is retained.
+	_, err = decide(&AdjustBudget{MaxAmount: d("12")})
+	is.NoErr(err)
+	is.True(a.FundsWithdrawnInPeriod.Equal(d("8")))
+	is.True(p.PolicyMaxWithdrawAmount.Equal(d("12")))
+	is.True(unspentInPeriod(&p).Equal(d("4")))
+
+	_, err = decide(&WithdrawFunds{Amount: d("4.01")})
+	is.Err(err, ErrExceedWithinPeriod)
+
+	_, err = decide(&WithdrawFunds{Amount: d("4")})
+	is.NoErr(err)
+}
+
+// TestConcurrentWithdrawals mirrors how the server handles commands: each
+// request evolves its own Account from the events and appends only if no
+// other event was appended in the meantime, otherwise it retries. Run with
+// -race to detect any shared state across account instances.
+func TestConcurrentWithdrawals(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	var (
+		mu     sync.Mutex
+		events = []*rita.Event{
+			{Data: &FundsDeposited{Amount: d("50")}},
+			{Data: &SetBudget{MaxAmount: d("30"), Period: Monthly}},
+		}
+	)
+
+	// Replace the command with the decided event.
+	a := NewAccount()
+	es, err := a.Decide(&rita.Command{Data: events[1].Data})
+	is.NoErr(err)
+	events[1] = es[0]
+
+	load := func() ([]*rita.Event, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*rita.Event(nil), events...), len(events)
+	}
+
+	appendEvents := func(es []*rita.Event, seq int) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(events) != seq {
+			return false
+		}
+		events = append(events, es...)
+		return true
+	}
+
+	withdraw := func() error {
+		for {
+			loaded, seq := load()
+
+			a := NewAccount()
+			for _, e := range loaded {
+				a.Evolve(e)
+			}
+
+			es, err := a.Decide(&rita.Command{Data: &WithdrawFunds{Amount: d("2")}})
+			if err != nil {
+				return err
+			}
+
+			if appendEvents(es, seq) {
+				return nil
+			}
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		accepted int
+		rejected int
+		rmu      sync.Mutex
+	)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := withdraw()
+
+			rmu.Lock()
+			defer rmu.Unlock()
+			if err == nil {
+				accepted++
+			} else {
+				is.Err(err, ErrExceedWithinPeriod)
+				rejected++
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Only the budget limits the withdrawals.
+	is.Equal(accepted, 15)
+	is.Equal(rejected, 5)
+
+	var f CurrentFunds
+	for _, e := range events {
+		f.Evolve(e)
+	}
+	is.True(f.Amount.Equal(d("20")))
+}
+
+func TestDepositLimit(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Minute)
+	a := Account{clock: clock}
+
+	decide := func(cmd any) error {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			a.Evolve(e)
+		}
+		return err
+	}
+
+	// Unlimited by default.
+	for i := 0; i < 5; i++ {
+		is.NoErr(decide(&DepositFunds{Amount: d("1")}))
+	}
+
+	is.Err((&SetDepositLimit{MaxDeposits: -1}).Validate(), ErrInvalidDepositLimit)
+	is.Err((&SetDepositLimit{MaxDeposits: 2}).Validate(), ErrInvalidPeriod)
+
+	is.NoErr(decide(&SetDepositLimit{MaxDeposits: 2, Period: Daily}))
+
+	is.NoErr(decide(&DepositFunds{Amount: d("1")}))
+	is.NoErr(decide(&DepositFunds{Amount: d("1")}))
+	is.Err(decide(&DepositFunds{Amount: d("1")}), ErrDepositFrequencyExceeded)
+	is.Equal(a.DepositsInPeriod, 2)
+
+	// Next day.
+	clock.Add(24 * time.Hour)
+
+	is.NoErr(decide(&DepositFunds{Amount: d("1")}))
+	is.Equal(a.DepositsInPeriod, 1)
+	is.Equal(a.DepositPeriodStartTime, time.Date(2019, time.September, 21, 0, 0, 0, 0, time.UTC))
+
+	is.NoErr(decide(&DepositFunds{Amount: d("1")}))
+	is.Err(decide(&DepositFunds{Amount: d("1")}), ErrDepositFrequencyExceeded)
+	is.True(a.CurrentFunds.Equal(d("9")))
+
+	// Removed.
+	is.NoErr(decide(&SetDepositLimit{}))
+	is.NoErr(decide(&DepositFunds{Amount: d("1")}))
+}
+
+func TestAmountStep(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Minute)
+	a := Account{clock: clock}
+
+	decide := func(cmd any) error {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			a.Evolve(e)
+		}
+		return err
+	}
+
+	// No restriction by default.
+	is.NoErr(decide(&DepositFunds{Amount: d("10.10")}))
+
+	is.Err((&SetAmountStep{Step: d("-0.25")}).Validate(), ErrInvalidAmountStep)
+	is.Err((&SetAmountStep{Step: d("0.125")}).Validate(), ErrInvalidAmountStep)
+	is.NoErr((&SetAmountStep{Step: d("0.25")}).Validate())
+
+	is.NoErr(decide(&SetAmountStep{Step: d("0.25")}))
+	is.True(a.AmountStep.Equal(d("0.25")))
+
+	for _, v := range []string{"0.25", "0.5", "0.75", "1", "2.25"} {
+		is.NoErr(decide(&DepositFunds{Amount: d(v)}))
+		is.NoErr(decide(&WithdrawFunds{Amount: d(v)}))
+	}
+
+	for _, v := range []string{"0.10", "0.30", "1.01", "2.20"} {
+		is.Err(decide(&DepositFunds{Amount: d(v)}), ErrInvalidDenomination)
+		is.Err(decide(&WithdrawFunds{Amount: d(v)}), ErrInvalidDenomination)
+	}
+	is.True(a.CurrentFunds.Equal(d("10.10")))
+
+	// Removed.
+	is.NoErr(decide(&SetAmountStep{Step: decimal.Zero}))
+	is.NoErr(decide(&WithdrawFunds{Amount: d("0.10")}))
+	is.True(a.CurrentFunds.Equal(d("10")))
+}
+
+func TestAccountLifecycle(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Minute)
+	a := Account{clock: clock}
+
+	decide := func(cmd any) error {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			a.Evolve(e)
+		}
+		return err
+	}
+
+	is.Err((&OpenAccount{Owner: " "}).Validate(), ErrOwnerRequired)
+
+	is.Err(decide(&CloseAccount{}), ErrAccountNotOpen)
+
+	is.NoErr(decide(&OpenAccount{Owner: "Alice"}))
+	is.True(a.Opened)
+	is.Equal(a.Owner, "Alice")
+
+	is.Err(decide(&OpenAccount{Owner: "Alice"}), ErrAccountAlreadyOpen)
+	is.NoErr(decide(&DepositFunds{Amount: decimal.NewFromInt(5)}))
+
+	is.NoErr(decide(&CloseAccount{}))
+	is.True(a.Closed)
+
+	is.Err(decide(&DepositFunds{Amount: decimal.NewFromInt(5)}), ErrAccountClosed)
+	is.Err(decide(&OpenAccount{Owner: "Alice"}), ErrAccountClosed)
+	is.Err(decide(&CloseAccount{}), ErrAccountClosed)
+
+	// Accounts which predate opening are open once they have events.
+	b := Account{clock: clock}
+	is.NoErr(b.Evolve(&rita.Event{Data: &FundsDeposited{Amount: decimal.NewFromInt(5)}}))
+	is.True(b.Opened)
+}
+
+func TestBudgetTimeZone(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	loc, err := time.LoadLocation("America/New_York")
+	is.NoErr(err)
+
+	// Noon in New York the day before the DST transition on 2019-03-10.
+	clock := testutil.NewClock(time.Second)
+	clock.Start = time.Date(2019, time.March, 9, 17, 0, 0, 0, time.UTC)
+	a := Account{clock: clock}
+
+	decide := func(cmd any) error {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			a.Evolve(e)
+		}
+		return err
+	}
+
+	is.Err((&SetBudget{MaxAmount: d("5"), Period: Daily, TimeZone: "Mars/Olympus"}).Validate(), ErrInvalidTimeZone)
+	is.NoErr((&SetBudget{MaxAmount: d("5"), Period: Daily, TimeZone: "America/New_York"}).Validate())
+
+	is.NoErr(decide(&DepositFunds{Amount: d("100")}))
+	is.NoErr(decide(&SetBudget{MaxAmount: d("5"), Period: Daily, TimeZone: "America/New_York"}))
+
+	// Midnight in New York, not UTC.
+	is.Equal(a.PeriodStartTime, time.Date(2019, time.March, 9, 0, 0, 0, 0, loc))
+	is.Equal(a.NextPeriodStartTime, time.Date(2019, time.March, 10, 5, 0, 0, 0, time.UTC))
+
+	is.NoErr(decide(&WithdrawFunds{Amount: d("5")}))
+
+	// Past midnight UTC, but still the 9th in New York.
+	clock.Add(8 * time.Hour)
+	is.Err(decide(&WithdrawFunds{Amount: d("1")}), ErrExceedWithinPeriod)
+
+	// Midnight in New York starts the next period, which is only 23 hours
+	// long since the clocks spring forward.
+	clock.Add(4 * time.Hour)
+	is.NoErr(decide(&WithdrawFunds{Amount: d("5")}))
+	is.Equal(a.PeriodStartTime, time.Date(2019, time.March, 10, 5, 0, 0, 0, time.UTC))
+	is.Equal(a.NextPeriodStartTime, time.Date(2019, time.March, 11, 4, 0, 0, 0, time.UTC))
+
+	// An hour before midnight EDT is still the 10th.
+	clock.Add(a.NextPeriodStartTime.Sub(clock.Last()) - time.Hour)
+	is.Err(decide(&WithdrawFunds{Amount: d("1")}), ErrExceedWithinPeriod)
+
+	clock.Add(time.Hour)
+	is.NoErr(decide(&WithdrawFunds{Amount: d("1")}))
+	is.Equal(a.PeriodStartTime, time.Date(2019, time.March, 11, 0, 0, 0, 0, loc))
+
+	// The budget state reports the same window.
+	s := NewBudgetState(&a, a.NextPeriodStartTime)
+	is.Equal(s.PeriodStartTime, time.Date(2019, time.March, 12, 0, 0, 0, 0, loc))
+	is.True(s.Remaining.Equal(d("5")))
+}
+
+func TestBudgetState(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Minute)
+	a := Account{clock: clock}
+
+	decide := func(cmd any) {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		is.NoErr(err)
+		for _, e := range events {
+			a.Evolve(e)
+		}
+	}
+
+	s := NewBudgetState(&a, clock.Now())
+	is.Equal(s.Period, Period(""))
+
+	decide(&DepositFunds{Amount: d("50")})
+	decide(&SetBudget{MaxAmount: d("10"), Period: Daily})
+	decide(&WithdrawFunds{Amount: d("4")})
+	decide(&AdjustBudget{MaxAmount: d("12")})
+
+	s = NewBudgetState(&a, clock.Now())
+	is.Equal(s.Period, Daily)
+	is.True(s.MaxWithdrawAmount.Equal(d("12")))
+	is.True(s.FundsWithdrawn.Equal(d("4")))
+	is.True(s.Remaining.Equal(d("8")))
+	is.Equal(s.NextPeriodStartTime, time.Date(2019, time.September, 21, 0, 0, 0, 0, time.UTC))
+
+	// Next period without a withdrawal yet.
+	s = NewBudgetState(&a, clock.Add(24*time.Hour))
+	is.True(s.FundsWithdrawn.Equal(decimal.Zero))
+	is.True(s.Remaining.Equal(d("12")))
+	is.Equal(s.PeriodStartTime, time.Date(2019, time.September, 21, 0, 0, 0, 0, time.UTC))
+	is.Equal(s.NextPeriodStartTime, time.Date(2019, time.September, 22, 0, 0, 0, 0, time.UTC))
+}
+
+func TestProRatedBudget(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	// Wednesday at midnight, two days into the week.
+	wednesday := time.Date(2019, time.September, 18, 0, 0, 0, 0, time.UTC)
+
+	setup := func(proRate bool) (*Account, *BudgetPeriod, *testutil.Clock) {
+		clock := testutil.NewClock(time.Second)
+		clock.Start = wednesday
+
+		a := &Account{clock: clock}
+		p := &BudgetPeriod{}
+
+		events, err := a.Decide(&rita.Command{Data: &DepositFunds{Amount: d("100")}})
+		is.NoErr(err)
+		a.Evolve(events[0])
+
+		events, err = a.Decide(&rita.Command{Data: &SetBudget{MaxAmount: d("14"), Period: Weekly, ProRate: proRate}})
+		is.NoErr(err)
+		a.Evolve(events[0])
+		p.Evolve(events[0])
+
+		return a, p, clock
+	}
+
+	withdraw := func(a *Account, p *BudgetPeriod, amount string) error {
+		events, err := a.Decide(&rita.Command{Data: &WithdrawFunds{Amount: d(amount)}})
+		for _, e := range events {
+			a.Evolve(e)
+			p.Evolve(e)
+		}
+		return err
+	}
+
+	t.Run("full", func(t *testing.T) {
+		a, p, _ := setup(false)
+		is.True(a.PeriodMaxWithdrawAmount.Equal(d("14")))
+		is.NoErr(withdraw(a, p, "14"))
+	})
+
+	t.Run("pro-rated", func(t *testing.T) {
+		a, p, clock := setup(true)
+
+		// Five of seven days remain.
+		is.True(a.MaxWithdrawAmount.Equal(d("14")))
+		is.True(a.PeriodMaxWithdrawAmount.Equal(d("10")))
+		is.True(p.PolicyMaxWithdrawAmount.Equal(d("10")))
+
+		is.Err(withdraw(a, p, "10.01"), ErrExceedWithinPeriod)
+		is.NoErr(withdraw(a, p, "10"))
+
+		s := NewBudgetState(a, clock.Now())
+		is.True(s.MaxWithdrawAmount.Equal(d("10")))
+		is.True(s.Remaining.Equal(decimal.Zero))
+
+		// Full max amount in the next week.
+		clock.Add(7 * 24 * time.Hour)
+
+		s = NewBudgetState(a, clock.Now())
+		is.True(s.MaxWithdrawAmount.Equal(d("14")))
+
+		is.Err(withdraw(a, p, "14.01"), ErrExceedWithinPeriod)
+		is.NoErr(withdraw(a, p, "14"))
+		is.True(a.PeriodMaxWithdrawAmount.Equal(d("14")))
+		is.True(p.PolicyMaxWithdrawAmount.Equal(d("14")))
+	})
+}
+
+func TestBackdatedWithdrawal(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	// Friday.
+	pt := time.Date(2019, time.September, 20, 14, 0, 0, 0, time.UTC)
+	st, nst := periodWindow(pt, Weekly)
+	next := nst.Add(time.Hour)
+
+	events := []*rita.Event{
+		{Data: &FundsDeposited{Amount: d("50"), Time: pt}},
+		{Data: &BudgetSet{MaxWithdrawAmount: d("10"), Period: Weekly, PolicyStartTime: pt, PeriodStartTime: st, NextPeriodStartTime: nst}},
+		{Data: &DepositLimitSet{MaxDeposits: 2, Period: Weekly, PeriodStartTime: st, NextPeriodStartTime: nst}},
+		{Data: &FundsWithdrawn{Amount: d("4"), Time: pt.Add(time.Hour)}},
+		{Data: &FundsWithdrawn{Amount: d("3"), Time: next, PeriodChanged: true}},
+		{Data: &FundsDeposited{Amount: d("1"), Time: next}},
+		// Occurred in the prior week, but appended in this one.
+		{Data: &FundsWithdrawn{Amount: d("5"), Time: pt.Add(2 * time.Hour)}},
+		{Data: &FundsDeposited{Amount: d("2"), Time: pt.Add(2 * time.Hour)}},
+	}
+
+	a := NewAccount()
+	var p BudgetPeriod
+	for _, e := range events {
+		is.NoErr(a.Evolve(e))
+		is.NoErr(p.Evolve(e))
+	}
+
+	// The balance includes the backdated transactions.
+	is.True(a.CurrentFunds.Equal(d("41")))
+
+	// The current period does not.
+	is.True(a.FundsWithdrawnInPeriod.Equal(d("3")))
+	is.Equal(a.DepositsInPeriod, 1)
+	is.True(p.FundsWithdrawnInPeriod.Equal(d("3")))
+	is.Equal(p.WithdrawalsInPeriod, 1)
+	is.Equal(p.BackdatedWithdrawals, 1)
+	is.Equal(p.PeriodStartTime, nst)
+}
+
+func TestDecimalPlaces(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	for _, v := range []string{"1.23", "1.230", "5", "100"} {
+		is.NoErr((&DepositFunds{Amount: d(v)}).Validate())
+		is.NoErr((&WithdrawFunds{Amount: d(v)}).Validate())
+		is.NoErr((&SetBudget{MaxAmount: d(v), Period: Weekly}).Validate())
+	}
+
+	for _, v := range []string{"1.234", "0.001", "1.23456789"} {
+		is.Err((&DepositFunds{Amount: d(v)}).Validate(), ErrTooManyDecimalPlaces)
+		is.Err((&WithdrawFunds{Amount: d(v)}).Validate(), ErrTooManyDecimalPlaces)
+		is.Err((&SetBudget{MaxAmount: d(v), Period: Weekly}).Validate(), ErrTooManyDecimalPlaces)
+	}
+
+	defer func(n int32) { MaxDecimalPlaces = n }(MaxDecimalPlaces)
+	MaxDecimalPlaces = 0
+
+	is.NoErr((&DepositFunds{Amount: d("5")}).Validate())
+	is.Err((&DepositFunds{Amount: d("1.5")}).Validate(), ErrTooManyDecimalPlaces)
+}
+
+func TestMaxPerTransaction(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Second)
+	a := Account{clock: clock}
+
+	decide := func(cmd any) error {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			is.NoErr(a.Evolve(e))
+		}
+		return err
+	}
+
+	is.Err((&SetBudget{MaxAmount: d("20"), Period: Weekly, MaxPerTransaction: d("-1")}).Validate(), ErrInvalidMaxPerTransaction)
+
+	is.NoErr(decide(&DepositFunds{Amount: d("100")}))
+	is.NoErr(decide(&SetBudget{MaxAmount: d("20"), Period: Weekly, MaxPerTransaction: d("8")}))
+	is.NoErr(decide(&SetBudget{MaxAmount: d("10"), Period: Weekly, Category: "snacks", MaxPerTransaction: d("3")}))
+
+	// Checked before the period, so the budget is not used up.
+	err := decide(&WithdrawFunds{Amount: d("9")})
+	is.Err(err, ErrExceedsPerTransactionLimit)
+	is.Equal(err.Error(), "kmm: withdrawal exceeds the max amount per transaction: max 8.00, requested 9.00")
+	is.True(a.FundsWithdrawnInPeriod.IsZero())
+	is.Equal(NewWithdrawalExplanation(&a, &WithdrawFunds{Amount: d("9")}).Rule, RulePerTransaction)
+
+	is.NoErr(decide(&WithdrawFunds{Amount: d("8")}))
+	is.Err(decide(&WithdrawFunds{Amount: d("4"), Category: "snacks"}), ErrExceedsPerTransactionLimit)
+	is.NoErr(decide(&WithdrawFunds{Amount: d("3"), Category: "snacks"}))
+
+	// The period budget still applies.
+	is.NoErr(decide(&WithdrawFunds{Amount: d("8")}))
+	is.Err(decide(&WithdrawFunds{Amount: d("8")}), ErrExceedWithinPeriod)
+
+	is.NoErr(decide(&RemoveBudget{}))
+	is.True(a.MaxPerTransaction.IsZero())
+	is.NoErr(decide(&WithdrawFunds{Amount: d("50")}))
+}
+
+func TestBudgetRollover(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Second)
+	a := Account{clock: clock}
+
+	var p BudgetPeriod
+
+	decide := func(cmd any) error {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			is.NoErr(a.Evolve(e))
+			is.NoErr(p.Evolve(e))
+		}
+		return err
+	}
+
+	is.Err((&SetBudget{MaxAmount: d("10"), Period: Daily, Rollover: true, RolloverCap: d("-1")}).Validate(), ErrInvalidRolloverCap)
+	is.Err((&SetBudget{MaxAmount: d("10"), Period: Daily, Rollover: true, Category: "snacks"}).Validate(), ErrCategoryRollover)
+
+	is.NoErr(decide(&DepositFunds{Amount: d("100")}))
+	is.NoErr(decide(&SetBudget{MaxAmount: d("10"), Period: Daily, Rollover: true, RolloverCap: d("8")}))
+
+	// First period, 6 is unspent.
+	is.NoErr(decide(&WithdrawFunds{Amount: d("4")}))
+
+	// Second period, detected on withdrawal. The unspent funds are added.
+	clock.Add(24 * time.Hour)
+	is.NoErr(decide(&WithdrawFunds{Amount: d("3")}))
+	is.True(a.RolledOverAmount.Equal(d("6")))
+	is.True(a.PeriodMaxWithdrawAmount.Equal(d("16")))
+	is.True(p.RolledOverAmount.Equal(d("6")))
+	is.True(p.PolicyMaxWithdrawAmount.Equal(d("16")))
+
+	err := decide(&WithdrawFunds{Amount: d("14")})
+	is.Err(err, ErrExceedWithinPeriod)
+	is.Equal(err.Error(), "kmm: withdrawal would exceed max amount allowed in current period: remaining 13.00, requested 14.00")
+	is.NoErr(decide(&WithdrawFunds{Amount: d("10")}))
+
+	// Third period, rolled over explicitly, 3 is unspent.
+	clock.Add(24 * time.Hour)
+	is.NoErr(decide(&RollOverPeriod{}))
+	is.True(a.RolledOverAmount.Equal(d("3")))
+	is.True(a.PeriodMaxWithdrawAmount.Equal(d("13")))
+	is.True(p.RolledOverAmount.Equal(d("3")))
+	is.True(p.PolicyMaxWithdrawAmount.Equal(d("13")))
+
+	// Nothing is withdrawn in the third period or the one after, so the
+	// rolled over amount is bounded by the cap.
+	clock.Add(48 * time.Hour)
+	s := NewBudgetState(&a, clock.Last())
+	is.True(s.RolledOverAmount.Equal(d("8")))
+	is.True(s.MaxWithdrawAmount.Equal(d("18")))
+
+	is.Err(decide(&WithdrawFunds{Amount: d("19")}), ErrExceedWithinPeriod)
+	is.NoErr(decide(&WithdrawFunds{Amount: d("18")}))
+	is.True(a.RolledOverAmount.Equal(d("8")))
+	is.True(p.PolicyMaxWithdrawAmount.Equal(d("18")))
+
+	// Adjusting the budget keeps the amount rolled over.
+	is.NoErr(decide(&AdjustBudget{MaxAmount: d("12")}))
+	is.True(a.PeriodMaxWithdrawAmount.Equal(d("20")))
+	is.True(p.PolicyMaxWithdrawAmount.Equal(d("20")))
+
+	// Without rollover, the unspent funds are not added.
+	is.NoErr(decide(&SetBudget{MaxAmount: d("10"), Period: Daily}))
+	clock.Add(24 * time.Hour)
+	is.NoErr(decide(&RollOverPeriod{}))
+	is.True(a.RolledOverAmount.IsZero())
+	is.True(a.PeriodMaxWithdrawAmount.Equal(d("10")))
+}
+
+func TestFreezeAccount(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Minute)
+	a := Account{clock: clock}
+
+	var s AccountSettings
+
+	decide := func(cmd any) error {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			is.NoErr(a.Evolve(e))
+			is.NoErr(s.Evolve(e))
+		}
+		return err
+	}
+
+	is.Err(decide(&UnfreezeAccount{}), ErrAccountNotFrozen)
+
+	is.NoErr(decide(&DepositFunds{Amount: d("20")}))
+	is.NoErr(decide(&SetApprovalThreshold{Amount: d("10")}))
+	is.NoErr(decide(&RequestWithdrawal{ID: "r1", Amount: d("12")}))
+
+	is.NoErr(decide(&FreezeAccount{}))
+	is.True(a.Frozen)
+	is.True(s.Frozen)
+	is.Err(decide(&FreezeAccount{}), ErrAccountFrozen)
+
+	// Withdrawals are rejected, including approving pending requests.
+	is.Err(decide(&WithdrawFunds{Amount: d("5")}), ErrAccountFrozen)
+	is.Err(decide(&RequestWithdrawal{ID: "r2", Amount: d("12")}), ErrAccountFrozen)
+	is.Err(decide(&ApproveWithdrawal{ID: "r1"}), ErrAccountFrozen)
+	is.Equal(NewWithdrawalExplanation(&a, &WithdrawFunds{Amount: d("5")}).Rule, RuleFrozen)
+
+	// Deposits still work.
+	is.NoErr(decide(&DepositFunds{Amount: d("5")}))
+	is.True(a.CurrentFunds.Equal(d("25")))
+
+	is.NoErr(decide(&UnfreezeAccount{}))
+	is.True(!a.Frozen)
+	is.True(!s.Frozen)
+	is.NoErr(decide(&WithdrawFunds{Amount: d("5")}))
+	is.NoErr(decide(&ApproveWithdrawal{ID: "r1"}))
+	is.True(a.CurrentFunds.Equal(d("8")))
+}
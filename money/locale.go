@@ -0,0 +1,137 @@
+package money
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/shopspring/decimal"
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+var (
+	ErrInvalidCurrency = errors.New("money: invalid currency")
+	ErrInvalidLocale   = errors.New("money: invalid locale")
+)
+
+// DefaultLocale is the locale amounts are formatted in if the system locale
+// is not set.
+const DefaultLocale = "en-US"
+
+// SystemLocale returns the locale of the environment, e.g. en-US for
+// LANG=en_US.UTF-8, or the default locale if not set.
+func SystemLocale() string {
+	for _, env := range []string{"LC_ALL", "LC_MONETARY", "LANG"} {
+		v := os.Getenv(env)
+		// Strip the encoding and modifier, e.g. .UTF-8 or @euro.
+		if i := strings.IndexAny(v, ".@"); i >= 0 {
+			v = v[:i]
+		}
+		if v == "" || v == "C" || v == "POSIX" {
+			continue
+		}
+		return strings.ReplaceAll(v, "_", "-")
+	}
+	return DefaultLocale
+}
+
+// currencyPatterns are where the CLDR currency format of a language or
+// language-region places the symbol, ¤, relative to the number, #. The
+// space is a no-break space. x/text/currency does not include these
+// patterns and always places the symbol first, so the common locales are
+// listed here. Locales not listed place the symbol first with no space.
+var currencyPatterns = map[string]string{
+	"bg": "# ¤",
+	"ca": "# ¤",
+	"cs": "# ¤",
+	"da": "# ¤",
+	"de": "# ¤",
+	"el": "# ¤",
+	"es": "# ¤",
+	"et": "# ¤",
+	"fi": "# ¤",
+	"fr": "# ¤",
+	"hr": "# ¤",
+	"hu": "# ¤",
+	"it": "# ¤",
+	"lt": "# ¤",
+	"lv": "# ¤",
+	"nb": "# ¤",
+	"nl": "¤ #",
+	"pl": "# ¤",
+	"pt": "¤ #",
+	"ro": "# ¤",
+	"ru": "# ¤",
+	"sk": "# ¤",
+	"sl": "# ¤",
+	"sv": "# ¤",
+	"uk": "# ¤",
+	"vi": "# ¤",
+
+	"de-AT": "¤ #",
+	"de-CH": "¤ #",
+	"es-MX": "¤#",
+	"es-US": "¤#",
+	"it-CH": "¤ #",
+	"pt-PT": "# ¤",
+}
+
+// currencyPattern returns the currency pattern of the locale.
+func currencyPattern(tag language.Tag) string {
+	base, _ := tag.Base()
+	region, _ := tag.Region()
+	if p, ok := currencyPatterns[base.String()+"-"+region.String()]; ok {
+		return p
+	}
+	if p, ok := currencyPatterns[base.String()]; ok {
+		return p
+	}
+	return "¤#"
+}
+
+// Formatter formats amounts in a currency with the grouping, decimal
+// separator and currency symbol placement of a locale, e.g. $1,234.50 in
+// en-US or 1.234,50 € in de-DE. Amounts always have two decimal places.
+type Formatter struct {
+	printer *message.Printer
+	symbol  string
+	pattern string
+}
+
+// NewFormatter returns a formatter of the ISO 4217 currency, e.g. USD, and
+// the BCP 47 locale, e.g. en-US.
+func NewFormatter(cur, locale string) (*Formatter, error) {
+	unit, err := currency.ParseISO(cur)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidCurrency, cur)
+	}
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidLocale, locale)
+	}
+
+	p := message.NewPrinter(tag)
+	return &Formatter{
+		printer: p,
+		symbol:  p.Sprint(currency.Symbol(unit)),
+		pattern: strings.ReplaceAll(currencyPattern(tag), " ", "\u00a0"),
+	}, nil
+}
+
+// Format formats the amount rounded to cents. The sign precedes the amount
+// with its symbol, e.g. -$12.50 or -12,50 €.
+func (f *Formatter) Format(v decimal.Decimal) string {
+	v = Round(v)
+
+	sign := ""
+	if v.IsNegative() {
+		sign, v = "-", v.Neg()
+	}
+
+	n := f.printer.Sprint(number.Decimal(v.InexactFloat64(), number.Scale(Places)))
+	return sign + strings.NewReplacer("¤", f.symbol, "#", n).Replace(f.pattern)
+}
@@ -0,0 +1,173 @@
+// Package money parses, validates, rounds and formats amounts.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrInvalidAmount  = errors.New("money: invalid amount")
+	ErrNotPositive    = errors.New("money: amount must be positive")
+	ErrExceedsMax     = errors.New("money: amount exceeds max")
+	ErrFractionalCent = errors.New("money: amount has fractions of a cent")
+	ErrInvalidPercent = errors.New("money: invalid percentage")
+)
+
+// Places is the number of decimal places of an amount.
+const Places = 2
+
+// DefaultCurrency is the currency amounts are formatted in if not specified.
+const DefaultCurrency = "USD"
+
+var (
+	hundred = decimal.NewFromInt(100)
+	one     = decimal.NewFromInt(1)
+
+	// Symbols of the supported currencies.
+	symbols = map[string]string{
+		"USD": "$",
+		"CAD": "$",
+		"AUD": "$",
+		"EUR": "€",
+		"GBP": "£",
+		"JPY": "¥",
+	}
+)
+
+// Parse parses an amount such as 5, 5.25, $5.25 or $1,000.50. A leading sign
+// may precede the currency symbol. Commas must separate groups of three
+// digits.
+func Parse(s string) (decimal.Decimal, error) {
+	t := strings.TrimSpace(s)
+
+	sign := ""
+	if strings.HasPrefix(t, "-") || strings.HasPrefix(t, "+") {
+		sign, t = t[:1], t[1:]
+	}
+	for _, sym := range symbols {
+		if strings.HasPrefix(t, sym) {
+			t = t[len(sym):]
+			break
+		}
+	}
+
+	if strings.Contains(t, ",") {
+		var ok bool
+		t, ok = stripGroups(t)
+		if !ok {
+			return decimal.Zero, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+		}
+	}
+
+	// Signs and symbols in any other position are rejected.
+	if t == "" || strings.ContainsAny(t, "+-") {
+		return decimal.Zero, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+
+	if sign == "+" {
+		sign = ""
+	}
+	v, err := decimal.NewFromString(sign + t)
+	if err != nil {
+		return decimal.Zero, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	return v, nil
+}
+
+// stripGroups removes the commas separating groups of three digits of the
+// integer part.
+func stripGroups(s string) (string, bool) {
+	i, f, hasFrac := strings.Cut(s, ".")
+	groups := strings.Split(i, ",")
+	for j, g := range groups {
+		if g == "" || len(g) > 3 || (j > 0 && len(g) != 3) {
+			return "", false
+		}
+	}
+	i = strings.Join(groups, "")
+	if hasFrac {
+		return i + "." + f, true
+	}
+	return i, true
+}
+
+// ParsePercent parses a percentage as a fraction. Accepted formats are 5%,
+// 0.05, and 5. Since a plain number is ambiguous, values less than one are
+// treated as a fraction and values of one or more as a percentage. Negative
+// values and values greater than 100% are rejected.
+func ParsePercent(s string) (decimal.Decimal, error) {
+	t := strings.TrimSpace(s)
+	percent := strings.HasSuffix(t, "%")
+	t = strings.TrimSpace(strings.TrimSuffix(t, "%"))
+
+	v, err := decimal.NewFromString(t)
+	if err != nil {
+		return decimal.Zero, fmt.Errorf("%w: %q", ErrInvalidPercent, s)
+	}
+
+	if percent || v.GreaterThanOrEqual(one) {
+		v = v.Div(hundred)
+	}
+
+	if v.LessThan(decimal.Zero) || v.GreaterThan(one) {
+		return decimal.Zero, fmt.Errorf("%w: %q must be between 0%% and 100%%", ErrInvalidPercent, s)
+	}
+
+	return v, nil
+}
+
+// Validate checks the amount is positive, in whole cents and, if limit is
+// non-zero, not greater than limit.
+func Validate(v, limit decimal.Decimal) error {
+	if !v.IsPositive() {
+		return ErrNotPositive
+	}
+	if !v.Equal(Round(v)) {
+		return ErrFractionalCent
+	}
+	if !limit.IsZero() && v.GreaterThan(limit) {
+		return fmt.Errorf("%w: %s", ErrExceedsMax, limit)
+	}
+	return nil
+}
+
+// Round rounds the amount to cents, rounding half away from zero.
+func Round(v decimal.Decimal) decimal.Decimal {
+	return v.Round(Places)
+}
+
+// Format formats the amount rounded to cents with the symbol of the currency
+// and commas separating groups of three digits, e.g. $1,000.50. Unknown
+// currencies are formatted with the code as a suffix, e.g. 1,000.50 CHF.
+func Format(v decimal.Decimal, currency string) string {
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+
+	v = Round(v)
+
+	sign := ""
+	if v.IsNegative() {
+		sign, v = "-", v.Neg()
+	}
+
+	i, f, _ := strings.Cut(v.StringFixed(Places), ".")
+
+	var b strings.Builder
+	for j, c := range i {
+		if j > 0 && (len(i)-j)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+	n := b.String() + "." + f
+
+	if sym, ok := symbols[strings.ToUpper(currency)]; ok {
+		return sign + sym + n
+	}
+	return sign + n + " " + strings.ToUpper(currency)
+}
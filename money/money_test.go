@@ -0,0 +1,177 @@
+package money
+
+import (
+	"testing"
+
+	"github.com/bruth/rita/testutil"
+	"github.com/shopspring/decimal"
+)
+
+func TestParse(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	valid := map[string]string{
+		"5":           "5",
+		"5.25":        "5.25",
+		" 5.25 ":      "5.25",
+		"$5.25":       "5.25",
+		"£5":          "5",
+		"€0.50":       "0.5",
+		"-$3":         "-3",
+		"+$3":         "3",
+		"-3.10":       "-3.1",
+		"1,000":       "1000",
+		"$1,000.50":   "1000.5",
+		"12,345,678":  "12345678",
+		"0.001":       "0.001",
+		"$999,999.99": "999999.99",
+	}
+
+	for in, out := range valid {
+		v, err := Parse(in)
+		is.NoErr(err)
+		is.True(v.Equal(decimal.RequireFromString(out)))
+	}
+
+	invalid := []string{"", "$", "-", "abc", "5$", "$-5", "--5", "1,00", "1,0000", ",100", "100,", "1,,000", "5.2.1", "5%"}
+	for _, in := range invalid {
+		_, err := Parse(in)
+		is.Err(err, ErrInvalidAmount)
+	}
+}
+
+func TestParsePercent(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	valid := map[string]string{
+		"5%":   "0.05",
+		"0.05": "0.05",
+		"0.5":  "0.5",
+		"0":    "0",
+		"5":    "0.05",
+		"1":    "0.01",
+		"12.5": "0.125",
+		"100":  "1",
+		" 7% ": "0.07",
+	}
+
+	for in, out := range valid {
+		v, err := ParsePercent(in)
+		is.NoErr(err)
+		is.True(v.Equal(decimal.RequireFromString(out)))
+	}
+
+	for _, in := range []string{"", "%", "abc", "5%%", "-5%", "-0.05", "101%", "150"} {
+		_, err := ParsePercent(in)
+		is.Err(err, ErrInvalidPercent)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	d := decimal.RequireFromString
+
+	is.NoErr(Validate(d("5"), decimal.Zero))
+	is.NoErr(Validate(d("0.01"), decimal.Zero))
+	is.NoErr(Validate(d("10"), d("10")))
+
+	is.Err(Validate(decimal.Zero, decimal.Zero), ErrNotPositive)
+	is.Err(Validate(d("-1"), decimal.Zero), ErrNotPositive)
+	is.Err(Validate(d("0.005"), decimal.Zero), ErrFractionalCent)
+	is.Err(Validate(d("10.01"), d("10")), ErrExceedsMax)
+}
+
+func TestRound(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	tests := map[string]string{
+		"1":      "1",
+		"1.234":  "1.23",
+		"1.235":  "1.24",
+		"1.005":  "1.01",
+		"-1.005": "-1.01",
+		"0.004":  "0",
+	}
+
+	for in, out := range tests {
+		is.True(Round(decimal.RequireFromString(in)).Equal(decimal.RequireFromString(out)))
+	}
+}
+
+func TestFormat(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	tests := []struct {
+		Amount   string
+		Currency string
+		Out      string
+	}{
+		{"0", "", "$0.00"},
+		{"5", "USD", "$5.00"},
+		{"5.5", "usd", "$5.50"},
+		{"1.005", "", "$1.01"},
+		{"-3.2", "", "-$3.20"},
+		{"-0.001", "", "$0.00"},
+		{"999", "", "$999.00"},
+		{"1000", "", "$1,000.00"},
+		{"1234567.891", "", "$1,234,567.89"},
+		{"20", "EUR", "€20.00"},
+		{"20", "GBP", "£20.00"},
+		{"1500", "CHF", "1,500.00 CHF"},
+	}
+
+	for _, tt := range tests {
+		is.Equal(Format(decimal.RequireFromString(tt.Amount), tt.Currency), tt.Out)
+	}
+}
+
+func TestFormatter(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	cases := []struct {
+		currency string
+		locale   string
+		amount   string
+		out      string
+	}{
+		{"USD", "en-US", "12.5", "$12.50"},
+		{"USD", "en-US", "1234567.891", "$1,234,567.89"},
+		{"USD", "en-US", "-3", "-$3.00"},
+		{"EUR", "de-DE", "1234.5", "1.234,50\u00a0€"},
+		{"EUR", "de-DE", "-3", "-3,00\u00a0€"},
+		{"EUR", "fr-FR", "12.5", "12,50\u00a0€"},
+		{"CHF", "de-CH", "12.5", "CHF\u00a012.50"},
+		{"BRL", "pt-BR", "12.5", "R$\u00a012,50"},
+		{"GBP", "en-GB", "0", "£0.00"},
+		// Always two decimal places.
+		{"JPY", "ja-JP", "1000", "￥1,000.00"},
+	}
+
+	for _, c := range cases {
+		f, err := NewFormatter(c.currency, c.locale)
+		is.NoErr(err)
+		is.Equal(f.Format(decimal.RequireFromString(c.amount)), c.out)
+	}
+
+	_, err := NewFormatter("XYZW", "en-US")
+	is.Err(err, ErrInvalidCurrency)
+	_, err = NewFormatter("USD", "not a locale")
+	is.Err(err, ErrInvalidLocale)
+}
+
+func TestSystemLocale(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	t.Setenv("LC_ALL", "")
+	t.Setenv("LC_MONETARY", "")
+
+	t.Setenv("LANG", "de_DE.UTF-8")
+	is.Equal(SystemLocale(), "de-DE")
+
+	t.Setenv("LANG", "C")
+	is.Equal(SystemLocale(), DefaultLocale)
+
+	t.Setenv("LC_MONETARY", "fr_FR@euro")
+	is.Equal(SystemLocale(), "fr-FR")
+}
@@ -0,0 +1,155 @@
+package kmm
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/bruth/rita/codec"
+)
+
+var (
+	_ codec.Codec = SnakeCaseJSON
+)
+
+// SnakeCaseJSON is a JSON codec which names fields in snake case, e.g.
+// max_amount rather than MaxAmount, for clients expecting that convention.
+// The types keep their Go field names. When decoding, fields are matched by
+// either name. The keys of maps are data and are left as is.
+var SnakeCaseJSON = &snakeCaseJSON{}
+
+type snakeCaseJSON struct{}
+
+func (*snakeCaseJSON) Name() string {
+	return "json-snake"
+}
+
+func (*snakeCaseJSON) Marshal(v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	x, err := decodeJSON(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(renameFields(x, reflect.TypeOf(v), true))
+}
+
+func (*snakeCaseJSON) Unmarshal(b []byte, v any) error {
+	x, err := decodeJSON(b)
+	if err != nil {
+		return err
+	}
+
+	b, err = json.Marshal(renameFields(x, reflect.TypeOf(v), false))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// decodeJSON decodes into generic values retaining numbers as is.
+func decodeJSON(b []byte) (any, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var x any
+	if err := d.Decode(&x); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// renameFields walks the decoded value x of type t renaming the fields of
+// structs to snake case, or back to the Go field name.
+func renameFields(x any, t reflect.Type, toSnake bool) any {
+	if t == nil || x == nil {
+		return x
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		// Encoded by the type itself, e.g. decimals and times.
+		if t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType) {
+			return x
+		}
+
+		m, ok := x.(map[string]any)
+		if !ok {
+			return x
+		}
+
+		out := make(map[string]any, len(m))
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+
+			from, to := f.Name, snakeCase(f.Name)
+			if !toSnake {
+				from, to = to, from
+			}
+
+			v, ok := m[from]
+			if !ok {
+				if v, ok = m[to]; !ok {
+					continue
+				}
+			}
+			out[to] = renameFields(v, f.Type, toSnake)
+		}
+		return out
+
+	case reflect.Slice, reflect.Array:
+		l, ok := x.([]any)
+		if !ok {
+			return x
+		}
+		for i, v := range l {
+			l[i] = renameFields(v, t.Elem(), toSnake)
+		}
+		return l
+
+	case reflect.Map:
+		m, ok := x.(map[string]any)
+		if !ok {
+			return x
+		}
+		for k, v := range m {
+			m[k] = renameFields(v, t.Elem(), toSnake)
+		}
+		return m
+	}
+
+	return x
+}
+
+// snakeCase converts a Go field name to snake case. A run of upper case
+// letters is treated as one word, e.g. HTTPServer is http_server.
+func snakeCase(s string) string {
+	r := []rune(s)
+
+	var b strings.Builder
+	for i, c := range r {
+		if unicode.IsUpper(c) {
+			if i > 0 && (unicode.IsLower(r[i-1]) || (i+1 < len(r) && unicode.IsLower(r[i+1]) && unicode.IsUpper(r[i-1]))) {
+				b.WriteByte('_')
+			}
+			c = unicode.ToLower(c)
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,102 @@
+package kmm
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+	"unicode"
+
+	"github.com/bruth/rita/testutil"
+)
+
+func TestSnakeCase(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	tests := map[string]string{
+		"Amount":              "amount",
+		"MaxAmount":           "max_amount",
+		"NextPeriodStartTime": "next_period_start_time",
+		"HTTPServer":          "http_server",
+		"AccountID":           "account_id",
+	}
+
+	for in, out := range tests {
+		is.Equal(snakeCase(in), out)
+	}
+}
+
+func TestSnakeCaseJSON(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	t.Run("command", func(t *testing.T) {
+		b, err := SnakeCaseJSON.Marshal(&SetBudget{MaxAmount: d("10"), Period: Weekly})
+		is.NoErr(err)
+		is.Equal(string(b), `{"category":"","max_amount":"10","max_per_transaction":"0","period":"weekly","pro_rate":false,"rollover":false,"rollover_cap":"0","time_zone":""}`)
+
+		var c SetBudget
+		is.NoErr(SnakeCaseJSON.Unmarshal(b, &c))
+		is.True(c.MaxAmount.Equal(d("10")))
+		is.Equal(c.Period, Weekly)
+
+		// Go field names are accepted.
+		var c2 SetBudget
+		is.NoErr(SnakeCaseJSON.Unmarshal([]byte(`{"MaxAmount":"5","Period":"daily"}`), &c2))
+		is.True(c2.MaxAmount.Equal(d("5")))
+		is.Equal(c2.Period, Daily)
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		now := time.Date(2019, time.September, 20, 14, 0, 0, 0, time.UTC)
+
+		s := &TransactionSearch{
+			Text:  "Candy",
+			Count: 1,
+			Total: d("2.50"),
+			Matches: []*TransactionMatch{
+				{Account: "alice", Amount: d("2.50"), Description: "candy", Time: now},
+			},
+		}
+
+		b, err := SnakeCaseJSON.Marshal(s)
+		is.NoErr(err)
+
+		var m map[string]any
+		is.NoErr(json.Unmarshal(b, &m))
+		_, ok := m["truncated"]
+		is.True(ok)
+		match := m["matches"].([]any)[0].(map[string]any)
+		is.Equal(match["description"], "candy")
+		is.Equal(match["time"], "2019-09-20T14:00:00Z")
+
+		var s2 TransactionSearch
+		is.NoErr(SnakeCaseJSON.Unmarshal(b, &s2))
+		is.Equal(s2.Text, "Candy")
+		is.Equal(s2.Count, 1)
+		is.True(s2.Total.Equal(d("2.50")))
+		is.Equal(len(s2.Matches), 1)
+		is.Equal(s2.Matches[0].Account, "alice")
+		is.Equal(s2.Matches[0].Time, now)
+	})
+
+	t.Run("types", func(t *testing.T) {
+		for name, typ := range Types {
+			b, err := SnakeCaseJSON.Marshal(typ.Init())
+			is.NoErr(err)
+
+			var m map[string]any
+			if err := json.Unmarshal(b, &m); err != nil {
+				// Not an object.
+				continue
+			}
+			for k := range m {
+				for _, r := range k {
+					if unicode.IsUpper(r) {
+						t.Errorf("%s: field %q is not snake case", name, k)
+					}
+				}
+			}
+
+			is.NoErr(SnakeCaseJSON.Unmarshal(b, typ.Init()))
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package kmm
+
+import (
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	_ rita.Evolver = &NetFlow{}
+)
+
+// GetNetFlow is a query for the funds deposited into and withdrawn from the
+// account within the current period, e.g. this month.
+type GetNetFlow struct {
+	Period Period
+}
+
+func (q *GetNetFlow) Validate() error {
+	return q.Period.Validate()
+}
+
+// NetFlow is the total deposited, the total withdrawn and the net change of
+// the balance within a period, in the default currency. Round-ups, merged
+// transactions and interest are counted as deposits or withdrawals by sign.
+// This is computed and not stored.
+type NetFlow struct {
+	Period              Period
+	PeriodStartTime     time.Time
+	NextPeriodStartTime time.Time
+	Deposited           decimal.Decimal
+	Withdrawn           decimal.Decimal
+	Net                 decimal.Decimal
+
+	// IDs of the transactions in the period, so reversals of them are
+	// subtracted from their total rather than counted.
+	transactions map[string]struct{}
+}
+
+// NewNetFlow returns the net flow of the period of the query containing
+// time t. Without transactions in the period, the totals are zero.
+func NewNetFlow(q *GetNetFlow, t time.Time) *NetFlow {
+	st, nst := periodWindow(t, q.Period)
+	return &NetFlow{
+		Period:              q.Period,
+		PeriodStartTime:     st,
+		NextPeriodStartTime: nst,
+		transactions:        make(map[string]struct{}),
+	}
+}
+
+func (f *NetFlow) Evolve(event *rita.Event) error {
+	var (
+		amount     decimal.Decimal
+		reversalOf string
+		t          time.Time
+	)
+
+	switch e := event.Data.(type) {
+	case *FundsDeposited:
+		if isForeign(e.Currency) {
+			return nil
+		}
+		amount, reversalOf, t = e.Amount, e.ReversalOf, e.Time
+	case *FundsWithdrawn:
+		if isForeign(e.Currency) {
+			return nil
+		}
+		amount, reversalOf, t = e.Amount.Neg(), e.ReversalOf, e.Time
+	case *RoundUpWithdrawn:
+		amount, t = e.Amount.Neg(), e.Time
+	case *TransactionMerged:
+		if isForeign(e.Currency) {
+			return nil
+		}
+		amount, t = e.Amount, e.Time
+	case *InterestAccrued:
+		amount, t = e.Amount, e.Time
+	default:
+		return nil
+	}
+
+	if t.Before(f.PeriodStartTime) || !t.Before(f.NextPeriodStartTime) {
+		return nil
+	}
+
+	f.Net = f.Net.Add(amount)
+
+	// A reversal of a transaction in the period undoes it.
+	if _, ok := f.transactions[reversalOf]; ok && reversalOf != "" {
+		delete(f.transactions, reversalOf)
+		if amount.IsNegative() {
+			f.Deposited = f.Deposited.Add(amount)
+		} else {
+			f.Withdrawn = f.Withdrawn.Sub(amount)
+		}
+		return nil
+	}
+
+	if amount.IsNegative() {
+		f.Withdrawn = f.Withdrawn.Sub(amount)
+	} else {
+		f.Deposited = f.Deposited.Add(amount)
+	}
+	if event.ID != "" {
+		f.transactions[event.ID] = struct{}{}
+	}
+	return nil
+}
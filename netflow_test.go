@@ -0,0 +1,56 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestNetFlow(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	day := func(m time.Month, n int) time.Time {
+		return time.Date(2019, m, n, 12, 0, 0, 0, time.UTC)
+	}
+
+	is.Err((&GetNetFlow{Period: "yearly"}).Validate(), ErrInvalidPeriod)
+
+	events := []*rita.Event{
+		// Prior to the period.
+		{ID: "1", Data: &FundsDeposited{Amount: d("50"), Time: day(time.April, 30)}},
+		{ID: "2", Data: &FundsDeposited{Amount: d("20"), Time: day(time.May, 1)}},
+		{ID: "3", Data: &FundsWithdrawn{Amount: d("2.50"), Time: day(time.May, 2)}},
+		{ID: "4", Data: &RoundUpWithdrawn{Amount: d("0.50"), Time: day(time.May, 2)}},
+		{ID: "5", Data: &FundsWithdrawn{Amount: d("6"), Time: day(time.May, 5)}},
+		{ID: "6", Data: &FundsDeposited{Amount: d("10"), Currency: "EUR", Time: day(time.May, 5)}},
+		{ID: "7", Data: &InterestAccrued{Amount: d("0.25"), Time: day(time.May, 6)}},
+		// Reversed within the period, so not counted.
+		{ID: "8", Data: &FundsDeposited{Amount: d("6"), ReversalOf: "5", Time: day(time.May, 6)}},
+		// Reversal of a deposit before the period is a withdrawal.
+		{ID: "9", Data: &FundsWithdrawn{Amount: d("50"), ReversalOf: "1", Time: day(time.May, 7)}},
+		{ID: "10", Data: &TransactionMerged{Amount: d("-1"), Time: day(time.May, 8), Account: "bob"}},
+		// After the period.
+		{ID: "11", Data: &FundsWithdrawn{Amount: d("3"), Time: day(time.June, 1)}},
+	}
+
+	f := NewNetFlow(&GetNetFlow{Period: Monthly}, day(time.May, 15))
+	for _, e := range events {
+		is.NoErr(f.Evolve(e))
+	}
+
+	is.Equal(f.PeriodStartTime, time.Date(2019, time.May, 1, 0, 0, 0, 0, time.UTC))
+	is.True(f.Deposited.Equal(d("20.25")))
+	is.True(f.Withdrawn.Equal(d("54")))
+	is.True(f.Net.Equal(d("-33.75")))
+
+	// No transactions in the period.
+	f = NewNetFlow(&GetNetFlow{Period: Monthly}, day(time.July, 15))
+	for _, e := range events {
+		is.NoErr(f.Evolve(e))
+	}
+	is.True(f.Deposited.IsZero())
+	is.True(f.Withdrawn.IsZero())
+	is.True(f.Net.IsZero())
+}
@@ -0,0 +1,46 @@
+package kmm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/bruth/rita"
+)
+
+var (
+	ErrUnknownProjection = errors.New("kmm: unknown projection")
+)
+
+// Projections are the projections of the events of an account which can be
+// rebuilt from history, by the name the type of the state is registered
+// under.
+var Projections = map[string]func() rita.Evolver{
+	"current-funds":         func() rita.Evolver { return &CurrentFunds{} },
+	"budget-period":         func() rita.Evolver { return &BudgetPeriod{} },
+	"category-periods":      func() rita.Evolver { return &CategoryPeriods{} },
+	"account-info":          func() rita.Evolver { return &AccountInfo{} },
+	"account-settings":      func() rita.Evolver { return &AccountSettings{} },
+	"recent-descriptions":   func() rita.Evolver { return &RecentDescriptions{} },
+	"transaction-stats":     func() rita.Evolver { return &TransactionStats{} },
+	"savings-goal-progress": func() rita.Evolver { return &SavingsGoalProgress{} },
+}
+
+// NewProjection returns the empty state of the projection with the name.
+func NewProjection(name string) (rita.Evolver, error) {
+	fn, ok := Projections[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProjection, name)
+	}
+	return fn(), nil
+}
+
+// ProjectionNames returns the names of the projections, sorted.
+func ProjectionNames() []string {
+	names := make([]string, 0, len(Projections))
+	for name := range Projections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
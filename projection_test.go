@@ -0,0 +1,44 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+	"github.com/bruth/rita/types"
+	"github.com/shopspring/decimal"
+)
+
+func TestProjections(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	tr, err := types.NewRegistry(Types)
+	is.NoErr(err)
+
+	// The state of each projection can be returned by name.
+	for _, name := range ProjectionNames() {
+		p, err := NewProjection(name)
+		is.NoErr(err)
+
+		typ, err := tr.Lookup(p)
+		is.NoErr(err)
+		is.Equal(typ, name)
+	}
+
+	_, err = NewProjection("account")
+	is.Err(err, ErrUnknownProjection)
+
+	tm := time.Date(2019, time.September, 20, 14, 0, 0, 0, time.UTC)
+	events := []*rita.Event{
+		{Sequence: 1, Time: tm, Data: &FundsDeposited{Amount: decimal.NewFromInt(5)}},
+		{Sequence: 2, Time: tm.Add(time.Minute), Data: &FundsWithdrawn{Amount: decimal.NewFromInt(2)}},
+	}
+
+	p, err := NewProjection("current-funds")
+	is.NoErr(err)
+	for _, e := range events {
+		is.NoErr(p.Evolve(e))
+	}
+	is.True(p.(*CurrentFunds).Amount.Equal(decimal.NewFromInt(3)))
+}
@@ -0,0 +1,29 @@
+package kmm
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// SetSpendReflection enables or disables spend reflections on an account.
+type SetSpendReflection struct {
+	Enabled bool
+}
+
+type SpendReflectionSet struct {
+	Enabled bool
+	Time    time.Time
+}
+
+// SpendReflection is emitted after each withdrawal if enabled on the account.
+// It captures what remains after the withdrawal so the ledger can be replayed
+// into a teaching UI, e.g. "you have 7 left and 3 of budget until Monday".
+type SpendReflection struct {
+	Balance decimal.Decimal
+	// Budget related, only set if a budget is set.
+	Period              Period
+	RemainingBudget     decimal.Decimal
+	NextPeriodStartTime time.Time
+	Time                time.Time
+}
@@ -0,0 +1,93 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestSpendReflection(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Second)
+	a := Account{clock: clock}
+
+	decide := func(cmd any) ([]*rita.Event, error) {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			a.Evolve(e)
+		}
+		return events, err
+	}
+
+	_, err := decide(&DepositFunds{Amount: d("20")})
+	is.NoErr(err)
+
+	// Not enabled.
+	events, err := decide(&WithdrawFunds{Amount: d("3")})
+	is.NoErr(err)
+	is.Equal(len(events), 1)
+
+	_, err = decide(&SetSpendReflection{Enabled: true})
+	is.NoErr(err)
+
+	// No budget.
+	events, err = decide(&WithdrawFunds{Amount: d("2")})
+	is.NoErr(err)
+	is.Equal(len(events), 2)
+
+	r := events[1].Data.(*SpendReflection)
+	is.True(r.Balance.Equal(d("15")))
+	is.Equal(r.Period, Period(""))
+	is.True(r.NextPeriodStartTime.IsZero())
+
+	_, err = decide(&SetBudget{MaxAmount: d("10"), Period: Weekly})
+	is.NoErr(err)
+
+	_, err = decide(&WithdrawFunds{Amount: d("4")})
+	is.NoErr(err)
+
+	events, err = decide(&WithdrawFunds{Amount: d("3")})
+	is.NoErr(err)
+	is.Equal(len(events), 2)
+
+	// The clock starts on a Friday.
+	r = events[1].Data.(*SpendReflection)
+	is.True(r.Balance.Equal(d("8")))
+	is.Equal(r.Period, Weekly)
+	is.True(r.RemainingBudget.Equal(d("3")))
+	is.Equal(r.NextPeriodStartTime, time.Date(2019, time.September, 23, 0, 0, 0, 0, time.UTC))
+	is.Equal(r.Time, events[0].Data.(*FundsWithdrawn).Time)
+
+	// Includes the round-up in the balance.
+	_, err = decide(&SetRoundUp{Account: "savings"})
+	is.NoErr(err)
+
+	events, err = decide(&WithdrawFunds{Amount: d("1.50")})
+	is.NoErr(err)
+	is.Equal(len(events), 3)
+
+	r = events[2].Data.(*SpendReflection)
+	is.True(r.Balance.Equal(d("6")))
+	is.True(r.RemainingBudget.Equal(d("1.50")))
+
+	// New period.
+	clock.Add(7 * 24 * time.Hour)
+
+	events, err = decide(&WithdrawFunds{Amount: d("1")})
+	is.NoErr(err)
+
+	r = events[1].Data.(*SpendReflection)
+	is.True(r.Balance.Equal(d("5")))
+	is.True(r.RemainingBudget.Equal(d("9")))
+	is.Equal(r.NextPeriodStartTime, time.Date(2019, time.September, 30, 0, 0, 0, 0, time.UTC))
+
+	_, err = decide(&SetSpendReflection{Enabled: false})
+	is.NoErr(err)
+
+	events, err = decide(&WithdrawFunds{Amount: d("1")})
+	is.NoErr(err)
+	is.Equal(len(events), 1)
+}
@@ -0,0 +1,134 @@
+package kmm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrTransactionIDRequired = errors.New("kmm: transaction id is required")
+	ErrTransactionNotFound   = errors.New("kmm: transaction not found")
+	ErrAlreadyReversed       = errors.New("kmm: transaction is already reversed")
+)
+
+// MaxReversibleTransactions is the number of most recent transactions which
+// can be reversed. It bounds the state kept by the aggregate.
+const MaxReversibleTransactions = 100
+
+// ReverseTransaction reverses a deposit or withdrawal, referenced by the ID
+// of its event, with a compensating transaction. Reversals are not counted
+// against budgets or deposit limits and cannot be reversed themselves.
+type ReverseTransaction struct {
+	TransactionID string
+}
+
+func (c *ReverseTransaction) Validate() error {
+	if strings.TrimSpace(c.TransactionID) == "" {
+		return ErrTransactionIDRequired
+	}
+	return nil
+}
+
+// Transaction is a deposit or withdrawal which can be reversed.
+type Transaction struct {
+	ID       string
+	Amount   decimal.Decimal
+	Currency string
+	Deposit  bool
+	Reversed bool
+}
+
+func (a *Account) transaction(id string) *Transaction {
+	for _, t := range a.Transactions {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+func (a *Account) decideReverseTransaction(c *ReverseTransaction) ([]*rita.Event, error) {
+	t := a.transaction(c.TransactionID)
+	if t == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTransactionNotFound, c.TransactionID)
+	}
+	if t.Reversed {
+		return nil, fmt.Errorf("%w: %s", ErrAlreadyReversed, c.TransactionID)
+	}
+
+	now := a.clock.Now()
+
+	if !t.Deposit {
+		return []*rita.Event{
+			{
+				Data: &FundsDeposited{
+					Amount:     t.Amount,
+					ReversalOf: t.ID,
+					Currency:   t.Currency,
+					Time:       now,
+				},
+			},
+		}, nil
+	}
+
+	// The funds of a deposit may have been withdrawn since.
+	balance := a.CurrentFunds
+	if isForeign(t.Currency) {
+		balance = a.Balances[t.Currency]
+	}
+	if balance.LessThan(t.Amount) {
+		return nil, insufficientFunds(balance, t.Amount)
+	}
+
+	return []*rita.Event{
+		{
+			Data: &FundsWithdrawn{
+				Amount:     t.Amount,
+				ReversalOf: t.ID,
+				Currency:   t.Currency,
+				Time:       now,
+			},
+		},
+	}, nil
+}
+
+// evolveTransaction records a deposit or withdrawal as reversible or marks
+// the transaction it reverses.
+func (a *Account) evolveTransaction(event *rita.Event) {
+	var (
+		t          *Transaction
+		reversalOf string
+	)
+
+	switch e := event.Data.(type) {
+	case *FundsDeposited:
+		t = &Transaction{ID: event.ID, Amount: e.Amount, Currency: e.Currency, Deposit: true}
+		reversalOf = e.ReversalOf
+	case *FundsWithdrawn:
+		t = &Transaction{ID: event.ID, Amount: e.Amount, Currency: e.Currency}
+		reversalOf = e.ReversalOf
+	default:
+		return
+	}
+
+	if reversalOf != "" {
+		if r := a.transaction(reversalOf); r != nil {
+			r.Reversed = true
+		}
+		return
+	}
+
+	// Events without an ID cannot be referenced.
+	if t.ID == "" {
+		return
+	}
+
+	a.Transactions = append(a.Transactions, t)
+	if n := len(a.Transactions) - MaxReversibleTransactions; n > 0 {
+		a.Transactions = append([]*Transaction(nil), a.Transactions[n:]...)
+	}
+}
@@ -0,0 +1,73 @@
+package kmm
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestReverseTransaction(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Second)
+	a := Account{clock: clock}
+
+	// Event IDs are assigned on append.
+	var n int
+	decide := func(cmd any) ([]*rita.Event, error) {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			n++
+			e.ID = fmt.Sprintf("e%d", n)
+			is.NoErr(a.Evolve(e))
+		}
+		return events, err
+	}
+
+	is.Err((&ReverseTransaction{}).Validate(), ErrTransactionIDRequired)
+
+	_, err := decide(&DepositFunds{Amount: d("30")})
+	is.NoErr(err)
+	_, err = decide(&SetBudget{MaxAmount: d("10"), Period: Weekly})
+	is.NoErr(err)
+	_, err = decide(&WithdrawFunds{Amount: d("10")})
+	is.NoErr(err)
+
+	_, err = decide(&ReverseTransaction{TransactionID: "e2"})
+	is.Err(err, ErrTransactionNotFound)
+
+	events, err := decide(&ReverseTransaction{TransactionID: "e3"})
+	is.NoErr(err)
+	is.Equal(len(events), 1)
+	e, ok := events[0].Data.(*FundsDeposited)
+	is.True(ok)
+	is.Equal(e.ReversalOf, "e3")
+	is.True(e.Amount.Equal(d("10")))
+	is.True(a.CurrentFunds.Equal(d("30")))
+
+	_, err = decide(&ReverseTransaction{TransactionID: "e3"})
+	is.Err(err, ErrAlreadyReversed)
+	// Reversals cannot be reversed.
+	_, err = decide(&ReverseTransaction{TransactionID: "e4"})
+	is.Err(err, ErrTransactionNotFound)
+
+	// The reversed withdrawal still counts against the budget, the
+	// reversal of a deposit is not counted.
+	_, err = decide(&ReverseTransaction{TransactionID: "e1"})
+	is.NoErr(err)
+	is.True(a.CurrentFunds.Equal(d("0")))
+	is.True(a.FundsWithdrawnInPeriod.Equal(d("10")))
+
+	// The funds of a deposit may have been withdrawn since.
+	_, err = decide(&RemoveBudget{})
+	is.NoErr(err)
+	_, err = decide(&DepositFunds{Amount: d("5")})
+	is.NoErr(err)
+	_, err = decide(&WithdrawFunds{Amount: d("5")})
+	is.NoErr(err)
+	_, err = decide(&ReverseTransaction{TransactionID: "e7"})
+	is.Err(err, ErrInsufficientFunds)
+}
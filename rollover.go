@@ -0,0 +1,51 @@
+package kmm
+
+import (
+	"errors"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrInvalidRolloverCap = errors.New("kmm: rollover cap must not be negative")
+	ErrCategoryRollover   = errors.New("kmm: rollover is not supported for category budgets")
+)
+
+// rolledOverAmount returns the unspent funds of a period with the max amount
+// and funds withdrawn which roll over to the next period, if enabled.
+func (a *Account) rolledOverAmount(limit, withdrawn decimal.Decimal) decimal.Decimal {
+	if !a.Rollover {
+		return decimal.Zero
+	}
+	unspent := limit.Sub(withdrawn)
+	if unspent.IsNegative() {
+		return decimal.Zero
+	}
+	if !a.RolloverCap.IsZero() && unspent.GreaterThan(a.RolloverCap) {
+		return a.RolloverCap
+	}
+	return unspent
+}
+
+// rolloverAt returns the amount rolled over to the period containing t,
+// which is after the current period. Nothing was withdrawn in the periods
+// skipped in between, so their full max amount is unspent.
+func (a *Account) rolloverAt(t time.Time) decimal.Decimal {
+	if !a.Rollover {
+		return decimal.Zero
+	}
+
+	rolled := a.rolledOverAmount(a.PeriodMaxWithdrawAmount, a.FundsWithdrawnInPeriod)
+	_, st := budgetWindow(a.NextPeriodStartTime, a.PolicyPeriod, a.PolicyTimeZone)
+	for !t.Before(st) {
+		next := a.rolledOverAmount(a.MaxWithdrawAmount.Add(rolled), decimal.Zero)
+		// Once capped, the amount no longer changes.
+		if next.Equal(rolled) {
+			break
+		}
+		rolled = next
+		_, st = budgetWindow(st, a.PolicyPeriod, a.PolicyTimeZone)
+	}
+	return rolled
+}
@@ -0,0 +1,86 @@
+package kmm
+
+import (
+	"errors"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrRoundUpSameAccount = errors.New("kmm: round-up account must be a different account")
+)
+
+// DefaultRoundUpIncrement is the increment withdrawals are rounded up to
+// if not otherwise set.
+var DefaultRoundUpIncrement = decimal.NewFromInt(1)
+
+// SetRoundUp enables round-ups on withdrawals. Each withdrawal is rounded up
+// to the next increment and the difference is moved to the round-up account,
+// e.g. a savings account.
+type SetRoundUp struct {
+	Account   string
+	Increment decimal.Decimal
+}
+
+func (c *SetRoundUp) Validate() error {
+	if c.Account == "" {
+		return ErrAccountRequired
+	}
+	if c.Increment.LessThan(decimal.Zero) {
+		return ErrNonZeroAmount
+	}
+	return nil
+}
+
+type RoundUpSet struct {
+	Account   string
+	Increment decimal.Decimal
+	Time      time.Time
+}
+
+type RemoveRoundUp struct{}
+
+type RoundUpRemoved struct {
+	Time time.Time
+}
+
+// RoundUpWithdrawn is the difference withdrawn when a withdrawal is rounded
+// up, which is deposited into the round-up account.
+type RoundUpWithdrawn struct {
+	Amount  decimal.Decimal
+	Account string
+	Time    time.Time
+}
+
+// RefundRoundUp refunds a round-up which could not be deposited into the
+// round-up account, referenced by the ID of its event. Like a reversal, the
+// refund is not counted against the deposit limit.
+type RefundRoundUp struct {
+	RoundUpID string
+	Amount    decimal.Decimal
+}
+
+func (c *RefundRoundUp) Validate() error {
+	if c.RoundUpID == "" {
+		return ErrTransactionIDRequired
+	}
+	if !c.Amount.GreaterThan(decimal.Zero) {
+		return ErrNonZeroAmount
+	}
+	return nil
+}
+
+// RoundUpAmount returns the difference between the amount and the amount
+// rounded up to the next multiple of the increment. Zero is returned if the
+// amount is already a multiple.
+func RoundUpAmount(amount, increment decimal.Decimal) decimal.Decimal {
+	if !increment.GreaterThan(decimal.Zero) {
+		return decimal.Zero
+	}
+	r := amount.Mod(increment)
+	if r.IsZero() {
+		return decimal.Zero
+	}
+	return increment.Sub(r)
+}
@@ -0,0 +1,131 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+	"github.com/shopspring/decimal"
+)
+
+func TestRoundUpAmount(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	tests := []struct {
+		Amount    string
+		Increment string
+		RoundUp   string
+	}{
+		{"3.25", "1", "0.75"},
+		{"3.99", "1", "0.01"},
+		{"0.01", "1", "0.99"},
+		{"4", "1", "0"},
+		{"12.30", "5", "2.7"},
+		{"15", "5", "0"},
+		{"2.34", "0.25", "0.16"},
+		{"3.25", "0", "0"},
+	}
+
+	for _, x := range tests {
+		r := RoundUpAmount(d(x.Amount), d(x.Increment))
+		is.True(r.Equal(d(x.RoundUp)))
+	}
+}
+
+func TestRoundUp(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	clock := testutil.NewClock(time.Second)
+
+	var (
+		a       = Account{clock: clock}
+		savings = Account{clock: clock}
+	)
+
+	// Applies the events and deposits round-ups into savings as done
+	// by the server.
+	decide := func(cmd any) ([]*rita.Event, error) {
+		events, err := a.Decide(&rita.Command{Data: cmd})
+		for _, e := range events {
+			a.Evolve(e)
+
+			if r, ok := e.Data.(*RoundUpWithdrawn); ok {
+				is.Equal(r.Account, "savings")
+				deposits, err := savings.Decide(&rita.Command{Data: &DepositFunds{Amount: r.Amount}})
+				is.NoErr(err)
+				savings.Evolve(deposits[0])
+			}
+		}
+		return events, err
+	}
+
+	_, err := decide(&DepositFunds{Amount: d("20")})
+	is.NoErr(err)
+
+	is.Err((&SetRoundUp{}).Validate(), ErrAccountRequired)
+
+	_, err = decide(&SetRoundUp{Account: "savings"})
+	is.NoErr(err)
+	is.True(a.RoundUpIncrement.Equal(DefaultRoundUpIncrement))
+
+	events, err := decide(&WithdrawFunds{Amount: d("3.25")})
+	is.NoErr(err)
+	is.Equal(len(events), 2)
+	is.True(a.CurrentFunds.Equal(d("16")))
+	is.True(savings.CurrentFunds.Equal(d("0.75")))
+
+	// Already a whole amount.
+	events, err = decide(&WithdrawFunds{Amount: d("4")})
+	is.NoErr(err)
+	is.Equal(len(events), 1)
+	is.True(savings.CurrentFunds.Equal(d("0.75")))
+
+	// Round-ups are not counted against the budget.
+	_, err = decide(&SetBudget{MaxAmount: d("5"), Period: Monthly})
+	is.NoErr(err)
+
+	_, err = decide(&WithdrawFunds{Amount: d("4.90")})
+	is.NoErr(err)
+	is.True(a.FundsWithdrawnInPeriod.Equal(d("4.90")))
+	is.True(a.CurrentFunds.Equal(d("7")))
+	is.True(savings.CurrentFunds.Equal(d("0.85")))
+
+	_, err = decide(&RemoveBudget{})
+	is.NoErr(err)
+
+	// Remaining funds exactly cover the round-up.
+	events, err = decide(&WithdrawFunds{Amount: d("6.50")})
+	is.NoErr(err)
+	is.Equal(len(events), 2)
+	is.True(a.CurrentFunds.Equal(decimal.Zero))
+	is.True(savings.CurrentFunds.Equal(d("1.35")))
+
+	// Remaining funds do not cover the round-up.
+	_, err = decide(&DepositFunds{Amount: d("0.50")})
+	is.NoErr(err)
+
+	events, err = decide(&WithdrawFunds{Amount: d("0.25")})
+	is.NoErr(err)
+	is.Equal(len(events), 1)
+	is.True(a.CurrentFunds.Equal(d("0.25")))
+
+	// Larger increment.
+	_, err = decide(&DepositFunds{Amount: d("20")})
+	is.NoErr(err)
+
+	_, err = decide(&SetRoundUp{Account: "savings", Increment: d("5")})
+	is.NoErr(err)
+
+	_, err = decide(&WithdrawFunds{Amount: d("12.30")})
+	is.NoErr(err)
+	is.True(a.CurrentFunds.Equal(d("5.25")))
+	is.True(savings.CurrentFunds.Equal(d("4.05")))
+
+	_, err = decide(&RemoveRoundUp{})
+	is.NoErr(err)
+
+	events, err = decide(&WithdrawFunds{Amount: d("0.25")})
+	is.NoErr(err)
+	is.Equal(len(events), 1)
+}
@@ -0,0 +1,132 @@
+package kmm
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrSearchTextRequired = errors.New("kmm: search text is required")
+	ErrInvalidPage        = errors.New("kmm: offset must not be negative and limit must be between 0 and 100")
+)
+
+const (
+	// DefaultSearchLimit is the number of matches returned if no limit is set.
+	DefaultSearchLimit = 20
+
+	// MaxSearchLimit is the max number of matches returned in one page.
+	MaxSearchLimit = 100
+)
+
+// MaxSearchScan is the max number of account events scanned by a search.
+// Once reached, the search is marked as truncated.
+var MaxSearchScan = 10000
+
+var (
+	_ rita.Evolver = &TransactionSearch{}
+)
+
+// SearchTransactions is a query for withdrawals across accounts whose
+// description contains the text, ignoring case. If a family is set, only
+// the accounts in the family are searched.
+type SearchTransactions struct {
+	Text   string
+	Family string
+	Offset int
+	Limit  int
+}
+
+func (q *SearchTransactions) Validate() error {
+	if strings.TrimSpace(q.Text) == "" {
+		return ErrSearchTextRequired
+	}
+	if q.Offset < 0 || q.Limit < 0 || q.Limit > MaxSearchLimit {
+		return ErrInvalidPage
+	}
+	return nil
+}
+
+type TransactionMatch struct {
+	Account     string
+	Amount      decimal.Decimal
+	Description string
+	Time        time.Time
+}
+
+// TransactionSearch is the result of a search. Count and Total cover all
+// matches while Matches only contains the requested page.
+type TransactionSearch struct {
+	Text      string
+	Offset    int
+	Limit     int
+	Count     int
+	Total     decimal.Decimal
+	Matches   []*TransactionMatch
+	Truncated bool
+
+	text     string
+	accounts map[string]bool
+	scanned  int
+}
+
+// NewTransactionSearch returns a search to be evolved over the events of
+// all accounts. If accounts is non-nil, events of other accounts are
+// ignored.
+func NewTransactionSearch(q *SearchTransactions, accounts []string) *TransactionSearch {
+	limit := q.Limit
+	if limit == 0 {
+		limit = DefaultSearchLimit
+	}
+
+	s := &TransactionSearch{
+		Text:   q.Text,
+		Offset: q.Offset,
+		Limit:  limit,
+		text:   strings.ToLower(strings.TrimSpace(q.Text)),
+	}
+
+	if accounts != nil {
+		s.accounts = make(map[string]bool, len(accounts))
+		for _, a := range accounts {
+			s.accounts[a] = true
+		}
+	}
+
+	return s
+}
+
+func (s *TransactionSearch) Evolve(event *rita.Event) error {
+	account := event.Subject[strings.LastIndexByte(event.Subject, '.')+1:]
+	if s.accounts != nil && !s.accounts[account] {
+		return nil
+	}
+
+	if s.scanned == MaxSearchScan {
+		s.Truncated = true
+		return nil
+	}
+	s.scanned++
+
+	e, ok := event.Data.(*FundsWithdrawn)
+	if !ok || !strings.Contains(strings.ToLower(e.Description), s.text) {
+		return nil
+	}
+
+	s.Count++
+	s.Total = s.Total.Add(e.Amount)
+
+	if s.Count > s.Offset && len(s.Matches) < s.Limit {
+		s.Matches = append(s.Matches, &TransactionMatch{
+			Account:     account,
+			Amount:      e.Amount,
+			Description: e.Description,
+			Time:        e.Time,
+		})
+	}
+
+	return nil
+}
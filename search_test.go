@@ -0,0 +1,80 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestTransactionSearch(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	tm := time.Date(2019, time.May, 3, 12, 20, 30, 0, time.UTC)
+
+	withdrawn := func(account, amount, desc string) *rita.Event {
+		tm = tm.Add(time.Hour)
+		return &rita.Event{
+			Subject: "kmm.events.accounts." + account,
+			Data: &FundsWithdrawn{
+				Amount:      d(amount),
+				Description: desc,
+				Time:        tm,
+			},
+		}
+	}
+
+	events := []*rita.Event{
+		{Subject: "kmm.events.accounts.alice", Data: &FundsDeposited{Amount: d("50"), Description: "school supplies refund"}},
+		withdrawn("alice", "4.50", "School supplies"),
+		withdrawn("bob", "3", "candy"),
+		withdrawn("bob", "12.25", "school supplies: backpack"),
+		withdrawn("carol", "2", "school supplies"),
+		withdrawn("alice", "1.25", "more SCHOOL SUPPLIES"),
+	}
+
+	search := func(q *SearchTransactions, accounts []string) *TransactionSearch {
+		is.NoErr(q.Validate())
+		s := NewTransactionSearch(q, accounts)
+		for _, e := range events {
+			is.NoErr(s.Evolve(e))
+		}
+		return s
+	}
+
+	s := search(&SearchTransactions{Text: "school supplies"}, []string{"alice", "bob"})
+	is.Equal(s.Count, 3)
+	is.True(s.Total.Equal(d("18")))
+	is.Equal(len(s.Matches), 3)
+	is.Equal(s.Matches[0].Account, "alice")
+	is.Equal(s.Matches[1].Account, "bob")
+	is.True(s.Matches[1].Amount.Equal(d("12.25")))
+	is.Equal(s.Matches[2].Account, "alice")
+	is.True(!s.Truncated)
+
+	// All accounts.
+	s = search(&SearchTransactions{Text: "school supplies"}, nil)
+	is.Equal(s.Count, 4)
+	is.True(s.Total.Equal(d("20")))
+
+	// Second page.
+	s = search(&SearchTransactions{Text: "school supplies", Offset: 1, Limit: 2}, nil)
+	is.Equal(s.Count, 4)
+	is.True(s.Total.Equal(d("20")))
+	is.Equal(len(s.Matches), 2)
+	is.Equal(s.Matches[0].Account, "bob")
+	is.Equal(s.Matches[1].Account, "carol")
+
+	// Bounded scan.
+	MaxSearchScan = 2
+	defer func() { MaxSearchScan = 10000 }()
+
+	s = search(&SearchTransactions{Text: "school supplies"}, nil)
+	is.Equal(s.Count, 1)
+	is.True(s.Truncated)
+
+	is.Err((&SearchTransactions{Text: " "}).Validate(), ErrSearchTextRequired)
+	is.Err((&SearchTransactions{Text: "x", Limit: 101}).Validate(), ErrInvalidPage)
+	is.Err((&SearchTransactions{Text: "x", Offset: -1}).Validate(), ErrInvalidPage)
+}
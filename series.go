@@ -0,0 +1,185 @@
+package kmm
+
+import (
+	"errors"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	ErrInvalidRange  = errors.New("kmm: from time must not be after to time")
+	ErrTooManyPoints = errors.New("kmm: range exceeds max number of points")
+	ErrTimeRequired  = errors.New("kmm: time is required")
+)
+
+// MaxBalancePoints is the max number of points in a balance series.
+const MaxBalancePoints = 1000
+
+var (
+	_ rita.Evolver = &BalanceSeries{}
+	_ rita.Evolver = &BalanceAsOf{}
+)
+
+// GetBalanceSeries is a query for the balance at the end of each interval
+// within the time range.
+type GetBalanceSeries struct {
+	From     time.Time
+	To       time.Time
+	Interval Period
+}
+
+func (q *GetBalanceSeries) Validate() error {
+	if err := q.Interval.Validate(); err != nil {
+		return err
+	}
+	if q.From.After(q.To) {
+		return ErrInvalidRange
+	}
+	if len(seriesWindows(q.From, q.To, q.Interval)) > MaxBalancePoints {
+		return ErrTooManyPoints
+	}
+	return nil
+}
+
+// seriesWindows returns the start time of each interval overlapping the
+// range, bounded to one more than the max number of points.
+func seriesWindows(from, to time.Time, p Period) []time.Time {
+	var starts []time.Time
+	st, _ := periodWindow(from, p)
+	for !st.After(to) && len(starts) <= MaxBalancePoints {
+		starts = append(starts, st)
+		_, st = periodWindow(st, p)
+	}
+	return starts
+}
+
+type BalancePoint struct {
+	// Time is the start of the interval.
+	Time time.Time
+	// Balance is the balance at the end of the interval.
+	Balance decimal.Decimal
+}
+
+// BalanceSeries is a series of balances in the default currency at the end
+// of each interval. This is computed and not stored.
+type BalanceSeries struct {
+	Interval Period
+	Points   []*BalancePoint
+
+	// End of each interval.
+	ends    []time.Time
+	filled  int
+	balance decimal.Decimal
+}
+
+func NewBalanceSeries(q *GetBalanceSeries) *BalanceSeries {
+	s := &BalanceSeries{
+		Interval: q.Interval,
+	}
+
+	for _, st := range seriesWindows(q.From, q.To, q.Interval) {
+		_, nst := periodWindow(st, q.Interval)
+		s.Points = append(s.Points, &BalancePoint{Time: st})
+		s.ends = append(s.ends, nst)
+	}
+
+	return s
+}
+
+// fill sets the balance of the intervals ending at or before t.
+func (s *BalanceSeries) fill(t time.Time) {
+	for s.filled < len(s.Points) && !t.Before(s.ends[s.filled]) {
+		s.Points[s.filled].Balance = s.balance
+		s.filled++
+	}
+}
+
+func (s *BalanceSeries) Evolve(event *rita.Event) error {
+	var (
+		delta decimal.Decimal
+		t     time.Time
+	)
+
+	switch e := event.Data.(type) {
+	case *FundsDeposited:
+		if isForeign(e.Currency) {
+			return nil
+		}
+		delta, t = e.Amount, e.Time
+	case *FundsWithdrawn:
+		if isForeign(e.Currency) {
+			return nil
+		}
+		delta, t = e.Amount.Neg(), e.Time
+	case *RoundUpWithdrawn:
+		delta, t = e.Amount.Neg(), e.Time
+	case *TransactionMerged:
+		if isForeign(e.Currency) {
+			return nil
+		}
+		delta, t = e.Amount, e.Time
+	case *InterestAccrued:
+		delta, t = e.Amount, e.Time
+	default:
+		return nil
+	}
+
+	s.fill(t)
+	s.balance = s.balance.Add(delta)
+
+	return nil
+}
+
+// Complete sets the balance of the remaining intervals, including those
+// with no activity. This must be called after all events are evolved.
+func (s *BalanceSeries) Complete() {
+	for s.filled < len(s.Points) {
+		s.Points[s.filled].Balance = s.balance
+		s.filled++
+	}
+}
+
+// GetBalanceAsOf is a query for the balance as of a point in time.
+type GetBalanceAsOf struct {
+	Time time.Time
+}
+
+func (q *GetBalanceAsOf) Validate() error {
+	if q.Time.IsZero() {
+		return ErrTimeRequired
+	}
+	return nil
+}
+
+// BalanceAsOf is the balance as of a point in time. Transactions which
+// occurred after the time are ignored. This is computed and not stored.
+type BalanceAsOf struct {
+	Time  time.Time
+	Funds CurrentFunds
+}
+
+func (b *BalanceAsOf) Evolve(event *rita.Event) error {
+	var t time.Time
+
+	switch e := event.Data.(type) {
+	case *FundsDeposited:
+		t = e.Time
+	case *FundsWithdrawn:
+		t = e.Time
+	case *RoundUpWithdrawn:
+		t = e.Time
+	case *TransactionMerged:
+		t = e.Time
+	case *InterestAccrued:
+		t = e.Time
+	default:
+		return nil
+	}
+
+	if t.After(b.Time) {
+		return nil
+	}
+	return b.Funds.Evolve(event)
+}
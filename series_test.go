@@ -0,0 +1,104 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+	"github.com/shopspring/decimal"
+)
+
+func TestBalanceSeries(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	day := func(n, hour int) time.Time {
+		return time.Date(2019, time.May, n, hour, 0, 0, 0, time.UTC)
+	}
+
+	events := []*rita.Event{
+		// Prior to the range.
+		{Data: &FundsDeposited{Amount: d("10"), Time: day(1, 9)}},
+		{Data: &FundsDeposited{Amount: d("5"), Time: day(6, 8)}},
+		{Data: &FundsWithdrawn{Amount: d("2.50"), Time: day(6, 17)}},
+		{Data: &BudgetRemoved{PolicyRemoveTime: day(7, 12)}},
+		// Midnight is the start of the next day.
+		{Data: &FundsWithdrawn{Amount: d("1"), Time: day(9, 0)}},
+		{Data: &RoundUpWithdrawn{Amount: d("0.50"), Time: day(9, 0)}},
+		{Data: &FundsDeposited{Amount: d("20"), Time: day(11, 23)}},
+		// After the range.
+		{Data: &FundsDeposited{Amount: d("100"), Time: day(13, 10)}},
+	}
+
+	q := &GetBalanceSeries{
+		From:     day(6, 12),
+		To:       day(12, 12),
+		Interval: Daily,
+	}
+	is.NoErr(q.Validate())
+
+	s := NewBalanceSeries(q)
+	for _, e := range events {
+		is.NoErr(s.Evolve(e))
+	}
+	s.Complete()
+
+	expected := []string{
+		"12.5", // 6th
+		"12.5", // 7th, no activity
+		"12.5", // 8th
+		"11",   // 9th
+		"11",   // 10th
+		"31",   // 11th
+		"31",   // 12th
+	}
+
+	is.Equal(len(s.Points), len(expected))
+	for i, p := range s.Points {
+		is.Equal(p.Time, day(6+i, 0))
+		is.True(p.Balance.Equal(d(expected[i])))
+	}
+
+	// No events at all.
+	s = NewBalanceSeries(q)
+	s.Complete()
+	is.Equal(len(s.Points), 7)
+	is.True(s.Points[6].Balance.Equal(decimal.Zero))
+
+	is.Err((&GetBalanceSeries{From: day(2, 0), To: day(1, 0), Interval: Daily}).Validate(), ErrInvalidRange)
+	is.Err((&GetBalanceSeries{From: day(1, 0), To: day(1, 0).AddDate(3, 0, 0), Interval: Daily}).Validate(), ErrTooManyPoints)
+	is.Err((&GetBalanceSeries{From: day(1, 0), To: day(2, 0)}).Validate(), ErrInvalidPeriod)
+}
+
+func TestBalanceAsOf(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	day := func(n, hour int) time.Time {
+		return time.Date(2019, time.May, n, hour, 0, 0, 0, time.UTC)
+	}
+
+	events := []*rita.Event{
+		{Data: &FundsDeposited{Amount: d("10"), Time: day(1, 9)}},
+		{Data: &FundsWithdrawn{Amount: d("2.50"), Time: day(3, 17)}},
+		{Data: &RoundUpWithdrawn{Amount: d("0.50"), Time: day(3, 17)}},
+		{Data: &TransactionMerged{Amount: d("4"), Time: day(5, 12)}},
+		{Data: &FundsDeposited{Amount: d("20"), Time: day(10, 8)}},
+	}
+
+	balance := func(t time.Time) decimal.Decimal {
+		b := &BalanceAsOf{Time: t}
+		for _, e := range events {
+			is.NoErr(b.Evolve(e))
+		}
+		return b.Funds.Amount
+	}
+
+	is.True(balance(day(1, 0)).Equal(decimal.Zero))
+	// Inclusive of the time.
+	is.True(balance(day(1, 9)).Equal(d("10")))
+	is.True(balance(day(3, 17)).Equal(d("7")))
+	is.True(balance(day(9, 0)).Equal(d("11")))
+	is.True(balance(day(20, 0)).Equal(d("31")))
+
+	is.Err((&GetBalanceAsOf{}).Validate(), ErrTimeRequired)
+}
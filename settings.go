@@ -0,0 +1,114 @@
+package kmm
+
+import (
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	_ rita.Evolver = &AccountSettings{}
+)
+
+// AccountSettings are the settings of an account. It is a projection of the
+// account events which is stored for cheap reads, but can always be rebuilt
+// from the events.
+type AccountSettings struct {
+	// Sequence is the last event sequence folded.
+	Sequence uint64
+
+	Owner            string
+	Note             string
+	RoundUpAccount   string
+	RoundUpIncrement decimal.Decimal
+	SpendReflection  bool
+	MaxDeposits      int
+	DepositPeriod    Period
+	AmountStep       decimal.Decimal
+	// ApprovalThreshold is the amount above which withdrawals must be
+	// approved.
+	ApprovalThreshold decimal.Decimal
+	MinimumBalance    decimal.Decimal
+	AllowanceAmount   decimal.Decimal
+	AllowancePeriod   Period
+	InterestRate      decimal.Decimal
+	InterestPeriod    Period
+	Archived          bool
+	Closed            bool
+	Frozen            bool
+	MergedInto        string
+
+	// Thresholds withdrawals alert at.
+	AlertLowBalance    decimal.Decimal
+	AlertBudgetPercent int
+	// UpdateTime is the time of the last change.
+	UpdateTime time.Time
+}
+
+// IsSettingsEvent returns true if the event changes the account settings.
+func IsSettingsEvent(event *rita.Event) bool {
+	switch event.Data.(type) {
+	case *AccountNoteSet, *RoundUpSet, *RoundUpRemoved, *SpendReflectionSet, *DepositLimitSet, *AmountStepSet, *ApprovalThresholdSet, *AlertThresholdSet, *MinimumBalanceSet, *MinimumBalanceRemoved, *AllowanceSet, *AllowanceRemoved, *InterestRateSet, *AccountOpened, *AccountClosed, *AccountFrozen, *AccountUnfrozen, *AccountArchived:
+		return true
+	}
+	return false
+}
+
+func (s *AccountSettings) Evolve(event *rita.Event) error {
+	if event.Sequence > s.Sequence {
+		s.Sequence = event.Sequence
+	}
+	if IsSettingsEvent(event) {
+		s.UpdateTime = event.Time
+	}
+
+	switch e := event.Data.(type) {
+	case *AccountNoteSet:
+		s.Note = e.Note
+	case *RoundUpSet:
+		s.RoundUpAccount = e.Account
+		s.RoundUpIncrement = e.Increment
+	case *RoundUpRemoved:
+		s.RoundUpAccount = ""
+		s.RoundUpIncrement = decimal.Zero
+	case *SpendReflectionSet:
+		s.SpendReflection = e.Enabled
+	case *DepositLimitSet:
+		s.MaxDeposits = e.MaxDeposits
+		s.DepositPeriod = e.Period
+	case *AmountStepSet:
+		s.AmountStep = e.Step
+	case *ApprovalThresholdSet:
+		s.ApprovalThreshold = e.Amount
+	case *AlertThresholdSet:
+		s.AlertLowBalance = e.LowBalance
+		s.AlertBudgetPercent = e.BudgetPercent
+	case *MinimumBalanceSet:
+		s.MinimumBalance = e.Amount
+	case *MinimumBalanceRemoved:
+		s.MinimumBalance = decimal.Zero
+	case *AllowanceSet:
+		s.AllowanceAmount = e.Amount
+		s.AllowancePeriod = e.Period
+	case *AllowanceRemoved:
+		s.AllowanceAmount = decimal.Zero
+		s.AllowancePeriod = ""
+	case *InterestRateSet:
+		s.InterestRate = e.Rate
+		s.InterestPeriod = e.Period
+	case *AccountOpened:
+		s.Owner = e.Owner
+	case *AccountClosed:
+		s.Closed = true
+	case *AccountFrozen:
+		s.Frozen = true
+	case *AccountUnfrozen:
+		s.Frozen = false
+	case *AccountArchived:
+		s.Archived = true
+		s.MergedInto = e.MergedInto
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+	"github.com/shopspring/decimal"
+)
+
+func TestAccountSettings(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	tm := time.Date(2019, time.September, 20, 14, 0, 0, 0, time.UTC)
+	half := decimal.RequireFromString("0.5")
+
+	events := []*rita.Event{
+		{Sequence: 1, Time: tm, Data: &FundsDeposited{Amount: half}},
+		{Sequence: 2, Time: tm.Add(time.Minute), Data: &AccountNoteSet{Note: "bike fund"}},
+		{Sequence: 3, Time: tm.Add(2 * time.Minute), Data: &RoundUpSet{Account: "savings", Increment: half}},
+		{Sequence: 4, Time: tm.Add(3 * time.Minute), Data: &SpendReflectionSet{Enabled: true}},
+		{Sequence: 5, Time: tm.Add(4 * time.Minute), Data: &DepositLimitSet{MaxDeposits: 2, Period: Weekly}},
+		{Sequence: 6, Time: tm.Add(5 * time.Minute), Data: &FundsWithdrawn{Amount: half}},
+	}
+
+	var s AccountSettings
+	for _, e := range events {
+		is.NoErr(s.Evolve(e))
+	}
+
+	is.Equal(s.Sequence, uint64(6))
+	is.Equal(s.Note, "bike fund")
+	is.Equal(s.RoundUpAccount, "savings")
+	is.True(s.RoundUpIncrement.Equal(half))
+	is.True(s.SpendReflection)
+	is.Equal(s.MaxDeposits, 2)
+	is.Equal(s.DepositPeriod, Weekly)
+	is.True(!s.Archived)
+	// Transactions do not change the settings.
+	is.Equal(s.UpdateTime, tm.Add(4*time.Minute))
+
+	is.NoErr(s.Evolve(&rita.Event{Sequence: 7, Data: &RoundUpRemoved{}}))
+	is.NoErr(s.Evolve(&rita.Event{Sequence: 8, Data: &AccountArchived{MergedInto: "wallet"}}))
+	is.Equal(s.RoundUpAccount, "")
+	is.True(s.Archived)
+	is.Equal(s.MergedInto, "wallet")
+
+	is.True(IsSettingsEvent(events[1]))
+	is.True(!IsSettingsEvent(events[0]))
+}
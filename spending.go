@@ -0,0 +1,102 @@
+package kmm
+
+import (
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	_ rita.Evolver = &CategorySpending{}
+)
+
+// Uncategorized is the category withdrawals without a category are reported
+// under.
+const Uncategorized = "uncategorized"
+
+// GetSpendingReport is a query for the spending by category within the
+// current period, e.g. this month.
+type GetSpendingReport struct {
+	Period Period
+}
+
+func (q *GetSpendingReport) Validate() error {
+	return q.Period.Validate()
+}
+
+type CategoryTotal struct {
+	Total decimal.Decimal
+	Count int
+}
+
+// CategorySpending is the total withdrawn and the number of withdrawals by
+// category within a period, in the default currency. Round-ups are not
+// spending and reversed withdrawals are subtracted. This is computed and not
+// stored.
+type CategorySpending struct {
+	Period              Period
+	PeriodStartTime     time.Time
+	NextPeriodStartTime time.Time
+	Categories          map[string]*CategoryTotal
+
+	// Category of each withdrawal in the period by event ID, so reversals
+	// can be subtracted.
+	withdrawals map[string]string
+}
+
+// NewCategorySpending returns the spending by category of the period of the
+// query containing time t.
+func NewCategorySpending(q *GetSpendingReport, t time.Time) *CategorySpending {
+	st, nst := periodWindow(t, q.Period)
+	return &CategorySpending{
+		Period:              q.Period,
+		PeriodStartTime:     st,
+		NextPeriodStartTime: nst,
+		Categories:          make(map[string]*CategoryTotal),
+		withdrawals:         make(map[string]string),
+	}
+}
+
+func (s *CategorySpending) Evolve(event *rita.Event) error {
+	switch e := event.Data.(type) {
+	case *FundsWithdrawn:
+		// Reversals of deposits are not spending.
+		if e.ReversalOf != "" || isForeign(e.Currency) || e.Time.Before(s.PeriodStartTime) || !e.Time.Before(s.NextPeriodStartTime) {
+			return nil
+		}
+
+		category := e.Category
+		if category == "" {
+			category = Uncategorized
+		}
+
+		t, ok := s.Categories[category]
+		if !ok {
+			t = &CategoryTotal{}
+			s.Categories[category] = t
+		}
+		t.Total = t.Total.Add(e.Amount)
+		t.Count++
+
+		if event.ID != "" {
+			s.withdrawals[event.ID] = category
+		}
+
+	case *FundsDeposited:
+		category, ok := s.withdrawals[e.ReversalOf]
+		if e.ReversalOf == "" || !ok {
+			return nil
+		}
+
+		t := s.Categories[category]
+		t.Total = t.Total.Sub(e.Amount)
+		t.Count--
+		if t.Count == 0 {
+			delete(s.Categories, category)
+		}
+		delete(s.withdrawals, e.ReversalOf)
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package kmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestCategorySpending(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	day := func(m time.Month, n int) time.Time {
+		return time.Date(2019, m, n, 12, 0, 0, 0, time.UTC)
+	}
+
+	is.Err((&GetSpendingReport{Period: "yearly"}).Validate(), ErrInvalidPeriod)
+
+	events := []*rita.Event{
+		// Prior to the period.
+		{ID: "1", Data: &FundsWithdrawn{Amount: d("9"), Category: "snacks", Time: day(time.April, 30)}},
+		{ID: "2", Data: &FundsDeposited{Amount: d("20"), Time: day(time.May, 1)}},
+		{ID: "3", Data: &FundsWithdrawn{Amount: d("2.50"), Category: "snacks", Time: day(time.May, 2)}},
+		{ID: "4", Data: &RoundUpWithdrawn{Amount: d("0.50"), Time: day(time.May, 2)}},
+		{ID: "5", Data: &FundsWithdrawn{Amount: d("1.50"), Category: "snacks", Time: day(time.May, 3)}},
+		{ID: "6", Data: &FundsWithdrawn{Amount: d("4"), Time: day(time.May, 4)}},
+		{ID: "7", Data: &FundsWithdrawn{Amount: d("6"), Category: "games", Time: day(time.May, 5)}},
+		// Reversed, so not counted.
+		{ID: "8", Data: &FundsDeposited{Amount: d("6"), ReversalOf: "7", Time: day(time.May, 6)}},
+		{ID: "9", Data: &FundsWithdrawn{Amount: d("20"), ReversalOf: "2", Time: day(time.May, 7)}},
+		// After the period.
+		{ID: "10", Data: &FundsWithdrawn{Amount: d("3"), Time: day(time.June, 1)}},
+	}
+
+	s := NewCategorySpending(&GetSpendingReport{Period: Monthly}, day(time.May, 15))
+	for _, e := range events {
+		is.NoErr(s.Evolve(e))
+	}
+
+	is.Equal(s.PeriodStartTime, time.Date(2019, time.May, 1, 0, 0, 0, 0, time.UTC))
+	is.Equal(len(s.Categories), 2)
+	is.True(s.Categories["snacks"].Total.Equal(d("4")))
+	is.Equal(s.Categories["snacks"].Count, 2)
+	is.True(s.Categories[Uncategorized].Total.Equal(d("4")))
+	is.Equal(s.Categories[Uncategorized].Count, 1)
+}
@@ -0,0 +1,68 @@
+package kmm
+
+import (
+	"github.com/bruth/kmm/money"
+	"github.com/bruth/rita"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	_ rita.Evolver = &TransactionStats{}
+)
+
+// TransactionStats are summary statistics over the transactions of an
+// account in the default currency. Amounts are absolute, so withdrawals are
+// positive. All values are zero if the account has no transactions.
+type TransactionStats struct {
+	Count               int
+	LargestDeposit      decimal.Decimal
+	LargestWithdrawal   decimal.Decimal
+	SmallestTransaction decimal.Decimal
+	// Total is the sum of all transaction amounts regardless of direction.
+	Total         decimal.Decimal
+	AverageAmount decimal.Decimal
+}
+
+func (s *TransactionStats) add(amount decimal.Decimal, deposit bool) {
+	if deposit {
+		if amount.GreaterThan(s.LargestDeposit) {
+			s.LargestDeposit = amount
+		}
+	} else {
+		if amount.GreaterThan(s.LargestWithdrawal) {
+			s.LargestWithdrawal = amount
+		}
+	}
+
+	if s.Count == 0 || amount.LessThan(s.SmallestTransaction) {
+		s.SmallestTransaction = amount
+	}
+
+	s.Count++
+	s.Total = s.Total.Add(amount)
+	s.AverageAmount = money.Round(s.Total.Div(decimal.NewFromInt(int64(s.Count))))
+}
+
+func (s *TransactionStats) Evolve(event *rita.Event) error {
+	switch e := event.Data.(type) {
+	case *FundsDeposited:
+		if !isForeign(e.Currency) {
+			s.add(e.Amount, true)
+		}
+	case *FundsWithdrawn:
+		if !isForeign(e.Currency) {
+			s.add(e.Amount, false)
+		}
+	case *RoundUpWithdrawn:
+		s.add(e.Amount, false)
+	case *TransactionMerged:
+		if !isForeign(e.Currency) {
+			s.add(e.Amount.Abs(), e.Amount.IsPositive())
+		}
+	case *InterestAccrued:
+		if e.Amount.IsPositive() {
+			s.add(e.Amount, true)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package kmm
+
+import (
+	"testing"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+	"github.com/shopspring/decimal"
+)
+
+func TestTransactionStats(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	var s TransactionStats
+	is.Equal(s.Count, 0)
+	is.True(s.LargestDeposit.Equal(decimal.Zero))
+	is.True(s.SmallestTransaction.Equal(decimal.Zero))
+	is.True(s.AverageAmount.Equal(decimal.Zero))
+
+	events := []*rita.Event{
+		{Data: &FundsDeposited{Amount: d("20")}},
+		{Data: &BudgetSet{MaxWithdrawAmount: d("10"), Period: Weekly}},
+		{Data: &FundsWithdrawn{Amount: d("4.50")}},
+		{Data: &RoundUpWithdrawn{Amount: d("0.50"), Account: "savings"}},
+		{Data: &FundsDeposited{Amount: d("5")}},
+		{Data: &TransactionMerged{Account: "piggy", Amount: d("-7")}},
+		{Data: &TransactionMerged{Account: "piggy", Amount: d("25")}},
+	}
+
+	for _, e := range events {
+		is.NoErr(s.Evolve(e))
+	}
+
+	is.Equal(s.Count, 6)
+	is.True(s.LargestDeposit.Equal(d("25")))
+	is.True(s.LargestWithdrawal.Equal(d("7")))
+	is.True(s.SmallestTransaction.Equal(d("0.50")))
+	is.True(s.Total.Equal(d("62")))
+	is.True(s.AverageAmount.Equal(d("10.33")))
+}
@@ -5,18 +5,106 @@ import "github.com/bruth/rita/types"
 var (
 	Types = map[string]*types.Type{
 		// Commands and events.
-		"deposit-funds":   {Init: func() any { return &DepositFunds{} }},
-		"funds-deposited": {Init: func() any { return &FundsDeposited{} }},
-		"withdraw-funds":  {Init: func() any { return &WithdrawFunds{} }},
-		"funds-withdrawn": {Init: func() any { return &FundsWithdrawn{} }},
-		"set-budget":      {Init: func() any { return &SetBudget{} }},
-		"budget-set":      {Init: func() any { return &BudgetSet{} }},
-		"remove-budget":   {Init: func() any { return &RemoveBudget{} }},
-		"budget-removed":  {Init: func() any { return &BudgetRemoved{} }},
+		"deposit-funds":           {Init: func() any { return &DepositFunds{} }},
+		"funds-deposited":         {Init: func() any { return &FundsDeposited{} }},
+		"withdraw-funds":          {Init: func() any { return &WithdrawFunds{} }},
+		"funds-withdrawn":         {Init: func() any { return &FundsWithdrawn{} }},
+		"set-budget":              {Init: func() any { return &SetBudget{} }},
+		"budget-set":              {Init: func() any { return &BudgetSet{} }},
+		"adjust-budget":           {Init: func() any { return &AdjustBudget{} }},
+		"budget-adjusted":         {Init: func() any { return &BudgetAdjusted{} }},
+		"roll-over-period":        {Init: func() any { return &RollOverPeriod{} }},
+		"period-rolled-over":      {Init: func() any { return &PeriodRolledOver{} }},
+		"remove-budget":           {Init: func() any { return &RemoveBudget{} }},
+		"budget-removed":          {Init: func() any { return &BudgetRemoved{} }},
+		"set-round-up":            {Init: func() any { return &SetRoundUp{} }},
+		"round-up-set":            {Init: func() any { return &RoundUpSet{} }},
+		"remove-round-up":         {Init: func() any { return &RemoveRoundUp{} }},
+		"round-up-removed":        {Init: func() any { return &RoundUpRemoved{} }},
+		"round-up-withdrawn":      {Init: func() any { return &RoundUpWithdrawn{} }},
+		"refund-round-up":         {Init: func() any { return &RefundRoundUp{} }},
+		"set-deposit-limit":       {Init: func() any { return &SetDepositLimit{} }},
+		"deposit-limit-set":       {Init: func() any { return &DepositLimitSet{} }},
+		"set-amount-step":         {Init: func() any { return &SetAmountStep{} }},
+		"amount-step-set":         {Init: func() any { return &AmountStepSet{} }},
+		"set-spend-reflection":    {Init: func() any { return &SetSpendReflection{} }},
+		"spend-reflection-set":    {Init: func() any { return &SpendReflectionSet{} }},
+		"spend-reflection":        {Init: func() any { return &SpendReflection{} }},
+		"open-account":            {Init: func() any { return &OpenAccount{} }},
+		"account-opened":          {Init: func() any { return &AccountOpened{} }},
+		"close-account":           {Init: func() any { return &CloseAccount{} }},
+		"account-closed":          {Init: func() any { return &AccountClosed{} }},
+		"freeze-account":          {Init: func() any { return &FreezeAccount{} }},
+		"account-frozen":          {Init: func() any { return &AccountFrozen{} }},
+		"unfreeze-account":        {Init: func() any { return &UnfreezeAccount{} }},
+		"account-unfrozen":        {Init: func() any { return &AccountUnfrozen{} }},
+		"archive-account":         {Init: func() any { return &ArchiveAccount{} }},
+		"account-archived":        {Init: func() any { return &AccountArchived{} }},
+		"transaction-merged":      {Init: func() any { return &TransactionMerged{} }},
+		"set-account-note":        {Init: func() any { return &SetAccountNote{} }},
+		"account-note-set":        {Init: func() any { return &AccountNoteSet{} }},
+		"add-family-member":       {Init: func() any { return &AddFamilyMember{} }},
+		"family-member-added":     {Init: func() any { return &FamilyMemberAdded{} }},
+		"remove-family-member":    {Init: func() any { return &RemoveFamilyMember{} }},
+		"family-member-removed":   {Init: func() any { return &FamilyMemberRemoved{} }},
+		"create-savings-goal":     {Init: func() any { return &CreateSavingsGoal{} }},
+		"savings-goal-created":    {Init: func() any { return &SavingsGoalCreated{} }},
+		"goal-reached":            {Init: func() any { return &GoalReached{} }},
+		"set-approval-threshold":  {Init: func() any { return &SetApprovalThreshold{} }},
+		"approval-threshold-set":  {Init: func() any { return &ApprovalThresholdSet{} }},
+		"set-alert-threshold":     {Init: func() any { return &SetAlertThreshold{} }},
+		"alert-threshold-set":     {Init: func() any { return &AlertThresholdSet{} }},
+		"request-withdrawal":      {Init: func() any { return &RequestWithdrawal{} }},
+		"withdrawal-requested":    {Init: func() any { return &WithdrawalRequested{} }},
+		"approve-withdrawal":      {Init: func() any { return &ApproveWithdrawal{} }},
+		"withdrawal-approved":     {Init: func() any { return &WithdrawalApproved{} }},
+		"deny-withdrawal":         {Init: func() any { return &DenyWithdrawal{} }},
+		"withdrawal-denied":       {Init: func() any { return &WithdrawalDenied{} }},
+		"set-allowance":           {Init: func() any { return &SetAllowance{} }},
+		"allowance-set":           {Init: func() any { return &AllowanceSet{} }},
+		"remove-allowance":        {Init: func() any { return &RemoveAllowance{} }},
+		"allowance-removed":       {Init: func() any { return &AllowanceRemoved{} }},
+		"deposit-allowance":       {Init: func() any { return &DepositAllowance{} }},
+		"set-interest-rate":       {Init: func() any { return &SetInterestRate{} }},
+		"interest-rate-set":       {Init: func() any { return &InterestRateSet{} }},
+		"accrue-interest":         {Init: func() any { return &AccrueInterest{} }},
+		"interest-accrued":        {Init: func() any { return &InterestAccrued{} }},
+		"reverse-transaction":     {Init: func() any { return &ReverseTransaction{} }},
+		"set-minimum-balance":     {Init: func() any { return &SetMinimumBalance{} }},
+		"minimum-balance-set":     {Init: func() any { return &MinimumBalanceSet{} }},
+		"remove-minimum-balance":  {Init: func() any { return &RemoveMinimumBalance{} }},
+		"minimum-balance-removed": {Init: func() any { return &MinimumBalanceRemoved{} }},
+		// Query parameters.
+		"project-interest":    {Init: func() any { return &ProjectInterest{} }},
+		"search-transactions": {Init: func() any { return &SearchTransactions{} }},
+		"get-balance-series":  {Init: func() any { return &GetBalanceSeries{} }},
+		"get-balance-as-of":   {Init: func() any { return &GetBalanceAsOf{} }},
+		"get-spending-report": {Init: func() any { return &GetSpendingReport{} }},
+		"get-net-flow":        {Init: func() any { return &GetNetFlow{} }},
 		// Aggregate state.
 		"account": {Init: func() any { return NewAccount() }},
+		"family":  {Init: func() any { return NewFamily(DefaultMaxFamilyMembers) }},
 		// Query results.
-		"current-funds": {Init: func() any { return &CurrentFunds{} }},
-		"budget-period": {Init: func() any { return &BudgetPeriod{} }},
+		"current-funds":       {Init: func() any { return &CurrentFunds{} }},
+		"budget-period":       {Init: func() any { return &BudgetPeriod{} }},
+		"category-periods":    {Init: func() any { return &CategoryPeriods{} }},
+		"budget-state":        {Init: func() any { return &BudgetState{} }},
+		"merge-plan":          {Init: func() any { return &MergePlan{} }},
+		"dry-run":             {Init: func() any { return &DryRun{} }},
+		"recent-descriptions": {Init: func() any { return &RecentDescriptions{} }},
+		"interest-projection": {Init: func() any { return &InterestProjection{} }},
+		"account-info":        {Init: func() any { return &AccountInfo{} }},
+		"carryover-report":    {Init: func() any { return &CarryoverReport{} }},
+		"transaction-search":  {Init: func() any { return &TransactionSearch{} }},
+		"balance-series":      {Init: func() any { return &BalanceSeries{} }},
+		"transaction-stats":   {Init: func() any { return &TransactionStats{} }},
+		"category-spending":   {Init: func() any { return &CategorySpending{} }},
+		"net-flow":            {Init: func() any { return &NetFlow{} }},
+		// Alerts.
+		"alert":                  {Init: func() any { return &Alert{} }},
+		"withdrawal-explanation": {Init: func() any { return &WithdrawalExplanation{} }},
+		"account-settings":       {Init: func() any { return &AccountSettings{} }},
+		"account-list":           {Init: func() any { return NewAccountList() }},
+		"savings-goal-progress":  {Init: func() any { return &SavingsGoalProgress{} }},
 	}
 )
@@ -0,0 +1,47 @@
+package kmm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bruth/rita/codec"
+	"github.com/bruth/rita/testutil"
+	"github.com/bruth/rita/types"
+)
+
+func TestTypes(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	for _, c := range []codec.Codec{codec.JSON, codec.MsgPack} {
+		r, err := types.NewRegistry(Types, types.Codec(c.Name()))
+		is.NoErr(err)
+
+		for name, typ := range Types {
+			t.Run(c.Name()+"/"+name, func(t *testing.T) {
+				v := typ.Init()
+				is.True(v != nil)
+				is.True(reflect.TypeOf(v).Kind() == reflect.Pointer)
+
+				n, err := r.Lookup(v)
+				is.NoErr(err)
+				is.Equal(n, name)
+
+				b, err := r.Marshal(v)
+				is.NoErr(err)
+
+				u, err := r.UnmarshalType(b, name)
+				is.NoErr(err)
+				is.True(reflect.TypeOf(u) == reflect.TypeOf(v))
+
+				b2, err := r.Marshal(u)
+				is.NoErr(err)
+
+				// The binary encoding of a zero decimal differs once decoded,
+				// so only the JSON encoding is compared.
+				if c == codec.JSON {
+					is.Equal(string(b2), string(b))
+				}
+			})
+		}
+	}
+}
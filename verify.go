@@ -0,0 +1,98 @@
+package kmm
+
+import (
+	"fmt"
+
+	"github.com/bruth/rita"
+)
+
+// Divergence is an inconsistency found while replaying the events of an
+// account.
+type Divergence struct {
+	// Sequence of the event after which the inconsistency was found.
+	Sequence uint64
+	Reason   string
+}
+
+// AccountVerification is the result of replaying the events of an account.
+type AccountVerification struct {
+	Account      string
+	Events       int
+	LastSequence uint64
+	Divergences  []*Divergence
+}
+
+func (v *AccountVerification) OK() bool {
+	return len(v.Divergences) == 0
+}
+
+// VerifyAccount replays the events of an account, folding both the aggregate
+// and the projections, and reports where they disagree with each other or
+// the aggregate violates an invariant enforced when the events were decided.
+func VerifyAccount(account string, events []*rita.Event) *AccountVerification {
+	v := &AccountVerification{
+		Account: account,
+	}
+
+	var (
+		a    = NewAccount()
+		f    CurrentFunds
+		info AccountInfo
+	)
+
+	diverge := func(seq uint64, format string, args ...any) {
+		v.Divergences = append(v.Divergences, &Divergence{
+			Sequence: seq,
+			Reason:   fmt.Sprintf(format, args...),
+		})
+	}
+
+	for _, e := range events {
+		v.Events++
+		v.LastSequence = e.Sequence
+
+		if err := a.Evolve(e); err != nil {
+			diverge(e.Sequence, "account: %s", err)
+		}
+		if err := f.Evolve(e); err != nil {
+			diverge(e.Sequence, "current funds: %s", err)
+		}
+		if err := info.Evolve(e); err != nil {
+			diverge(e.Sequence, "account info: %s", err)
+		}
+
+		if !f.Amount.Equal(a.CurrentFunds) {
+			diverge(e.Sequence, "current funds %s does not match account balance %s", f.Amount, a.CurrentFunds)
+		}
+		if !info.Balance.Equal(a.CurrentFunds) {
+			diverge(e.Sequence, "account info balance %s does not match account balance %s", info.Balance, a.CurrentFunds)
+		}
+		if a.CurrentFunds.IsNegative() {
+			diverge(e.Sequence, "balance %s is negative", a.CurrentFunds)
+		}
+
+		if _, ok := e.Data.(*FundsWithdrawn); ok && a.PolicyPeriod != "" {
+			if a.FundsWithdrawnInPeriod.GreaterThan(a.PeriodMaxWithdrawAmount) {
+				diverge(e.Sequence, "withdrawn %s exceeds max amount %s of the period", a.FundsWithdrawnInPeriod, a.PeriodMaxWithdrawAmount)
+			}
+		}
+	}
+
+	return v
+}
+
+// ReplayReport summarizes the verification of many accounts. Only the
+// accounts with divergences are retained.
+type ReplayReport struct {
+	Accounts int
+	Events   int
+	Failed   []*AccountVerification
+}
+
+func (r *ReplayReport) Add(v *AccountVerification) {
+	r.Accounts++
+	r.Events += v.Events
+	if !v.OK() {
+		r.Failed = append(r.Failed, v)
+	}
+}
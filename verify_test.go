@@ -0,0 +1,65 @@
+package kmm
+
+import (
+	"testing"
+
+	"github.com/bruth/rita"
+	"github.com/bruth/rita/testutil"
+)
+
+func TestReplayReport(t *testing.T) {
+	is := testutil.NewIs(t)
+
+	sequence := func(data ...any) []*rita.Event {
+		events := make([]*rita.Event, len(data))
+		for i, x := range data {
+			events[i] = &rita.Event{Sequence: uint64(i + 1), Data: x}
+		}
+		return events
+	}
+
+	accounts := map[string][]*rita.Event{
+		"alice": sequence(
+			&FundsDeposited{Amount: d("20")},
+			&BudgetSet{MaxWithdrawAmount: d("10"), Period: Weekly},
+			&FundsWithdrawn{Amount: d("6")},
+			&RoundUpWithdrawn{Amount: d("1"), Account: "savings"},
+		),
+		"bob": sequence(
+			&FundsDeposited{Amount: d("5")},
+			&FundsWithdrawn{Amount: d("3")},
+			// Appended without being decided.
+			&FundsWithdrawn{Amount: d("4")},
+			&FundsDeposited{Amount: d("10")},
+		),
+		"savings": sequence(
+			&FundsDeposited{Amount: d("1")},
+			&TransactionMerged{Account: "piggy", Amount: d("-0.50")},
+		),
+	}
+
+	var r ReplayReport
+	for _, name := range []string{"alice", "bob", "savings"} {
+		r.Add(VerifyAccount(name, accounts[name]))
+	}
+
+	is.Equal(r.Accounts, 3)
+	is.Equal(r.Events, 10)
+	is.Equal(len(r.Failed), 1)
+
+	v := r.Failed[0]
+	is.Equal(v.Account, "bob")
+	is.Equal(v.LastSequence, uint64(4))
+	is.Equal(len(v.Divergences), 1)
+	is.Equal(v.Divergences[0].Sequence, uint64(3))
+	is.Equal(v.Divergences[0].Reason, "balance -2 is negative")
+
+	// Over budget.
+	v = VerifyAccount("carol", sequence(
+		&FundsDeposited{Amount: d("20")},
+		&BudgetSet{MaxWithdrawAmount: d("5"), Period: Daily},
+		&FundsWithdrawn{Amount: d("6")},
+	))
+	is.True(!v.OK())
+	is.Equal(v.Divergences[0].Sequence, uint64(3))
+}